@@ -0,0 +1,536 @@
+// Package asahimap is the embeddable remapping engine behind the asahi-map
+// command. It grabs keyboards, applies a layout's Option key mappings and
+// sends the result to an Outputter.
+//
+//	layout, err := asahimap.LoadLayout("layouts/azerty-mac.yaml")
+//	...
+//	engine, err := asahimap.New(asahimap.Options{Layout: layout})
+//	...
+//	err = engine.Run(ctx)
+package asahimap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uplg/asahi-map/internal/handler"
+	"github.com/uplg/asahi-map/internal/keyboard"
+	"github.com/uplg/asahi-map/internal/mappings"
+)
+
+type (
+	// Layout is a set of Option key mappings, usually loaded from YAML.
+	Layout = mappings.Layout
+	// Outputter receives the remapped key events and text.
+	Outputter = keyboard.Outputter
+	// KeyEvent is a key press, release or repeat.
+	KeyEvent = keyboard.KeyEvent
+	// DeviceInfo describes a detected keyboard.
+	DeviceInfo = keyboard.DeviceInfo
+	// HandlerOptions tunes Option tap, auto-repeat and debugging behaviour.
+	HandlerOptions = handler.Options
+	// Stats holds output health counters.
+	Stats = handler.Stats
+	// TraceOutput is an Outputter that records calls instead of typing.
+	TraceOutput = keyboard.TraceOutput
+	// TraceEntry is one call recorded by TraceOutput.
+	TraceEntry = keyboard.TraceEntry
+)
+
+// OutputEnv selects the default output when Options.Outputter is nil. Set
+// it to "trace" to print JSON lines to stdout instead of using /dev/uinput.
+const OutputEnv = "ASAHI_MAP_OUTPUT"
+
+// Grab modes for Options.GrabMode.
+const (
+	// GrabExclusive grabs keyboards so only asahi-map sees their events.
+	GrabExclusive = "exclusive"
+	// GrabMonitor reads keyboards without grabbing them, for when grabbing
+	// is not possible. Apps get every original key press as well as the
+	// mapped output, so Option+e also arrives as Alt+e.
+	GrabMonitor = "monitor"
+)
+
+// OutputBackends lists how the default output can type text, for
+// Engine.SetOutputBackend: "hex" (Unicode hex entry, the default),
+// "clipboard", "keysym" and "ydotool".
+var OutputBackends = keyboard.TextBackends
+
+// LoadLayout reads and validates a layout file.
+func LoadLayout(path string) (*Layout, error) {
+	return mappings.LoadLayout(path)
+}
+
+// NewVirtualKeyboard creates the default uinput Outputter.
+func NewVirtualKeyboard(logger *slog.Logger) (Outputter, error) {
+	return keyboard.NewVirtualKeyboard(logger)
+}
+
+// NewTraceOutput creates an Outputter that records calls in memory and, when
+// w is not nil, writes each as a JSON line.
+func NewTraceOutput(w io.Writer) *TraceOutput {
+	return keyboard.NewTraceOutput(w)
+}
+
+// Replay reads events saved by a SIGUSR1 dump (JSON lines) and sends them to
+// events, for use as Options.Events. It does not close events.
+func Replay(ctx context.Context, r io.Reader, events chan<- *KeyEvent) (int, error) {
+	return handler.Replay(ctx, r, events)
+}
+
+// Options configures an Engine.
+type Options struct {
+	// Layout is the layout to apply. Required.
+	Layout *Layout
+
+	// Outputter receives remapped keys. When nil a uinput virtual keyboard
+	// is created, and recreated if it stops accepting events, unless
+	// OutputEnv asks for a trace.
+	Outputter Outputter
+
+	// UnicodeInput selects how the default virtual keyboard types Unicode
+	// characters: "auto" (or empty) detects the desktop, "gtk" or "kde".
+	UnicodeInput string
+
+	// UnicodeConfirm overrides the key that commits Unicode entry:
+	// "space", "enter" or "none". Empty keeps UnicodeInput's key.
+	UnicodeConfirm string
+
+	// IMEConfirm is the key committing Unicode entry while Fcitx 5 has an
+	// input method on, whose candidate window would take Space: "space",
+	// "enter" or "none". Empty turns detection off.
+	IMEConfirm string
+
+	// MaxEventsPerSec caps key presses per second on the default virtual
+	// keyboard, delaying the rest; 0 means unlimited.
+	MaxEventsPerSec int
+
+	// InjectHold keeps keys the default virtual keyboard taps down this
+	// long before releasing them, for apps that ignore instant taps.
+	InjectHold time.Duration
+
+	// OutputDevices are extra virtual keyboards the default output sends
+	// every event to as well, named "asahi-map-<name>", for consumers such
+	// as a virtual machine that grab a single device.
+	OutputDevices []string
+
+	// OutputBackend selects how the default output types text, one of
+	// OutputBackends; empty is "hex". An unavailable backend is ignored
+	// with a warning.
+	OutputBackend string
+
+	// Devices limits grabbing to these keyboards, by event path,
+	// /dev/input/by-id link or exact name. Empty grabs every detected
+	// keyboard.
+	Devices []string
+
+	// ForceKeyboards are devices treated as keyboards even when detection
+	// rejects them, by event path, /dev/input/by-id link or exact name.
+	ForceKeyboards []string
+
+	// Seat limits detection to keyboards on this logind seat. Empty or
+	// "auto" uses the current session's seat, see ResolveSeat; "any"
+	// disables the check.
+	Seat string
+
+	// GrabMode is GrabExclusive (or empty) or GrabMonitor.
+	GrabMode string
+
+	// DeviceEnabled reports whether a keyboard is grabbed when Run starts.
+	// Keyboards it rejects are still listed and can be enabled later.
+	DeviceEnabled func(name string) bool
+
+	// Events, when set, replaces the keyboards as the event source: no
+	// device is opened or grabbed and Run returns once it is closed.
+	Events <-chan *KeyEvent
+
+	// Handler tunes the event handler. Its NewOutput is filled in when
+	// Outputter is nil.
+	Handler HandlerOptions
+
+	Logger *slog.Logger
+}
+
+// Engine reads keyboards and remaps their events until Run returns.
+type Engine struct {
+	opts    Options
+	handler *handler.Handler
+	devices *keyboard.DeviceManager
+	events  chan *keyboard.KeyEvent
+	logger  *slog.Logger
+
+	mu      sync.Mutex
+	readers *deviceReaders
+
+	// backend is the text backend of the default output and newDefault
+	// creates that output; both are nil when Options.Outputter was set
+	backend    *atomic.Value
+	newDefault func() (keyboard.Outputter, error)
+}
+
+// New creates the output, finds keyboards and prepares the handler. Nothing
+// is grabbed until Run.
+func New(opts Options) (*Engine, error) {
+	if opts.Layout == nil {
+		return nil, errors.New("asahimap: no layout")
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	switch opts.GrabMode {
+	case "", GrabExclusive, GrabMonitor:
+	default:
+		return nil, fmt.Errorf("asahimap: unknown grab mode %q", opts.GrabMode)
+	}
+
+	// backend and newDefault are set when the Engine owns the output
+	var backend *atomic.Value
+	var newDefault func() (keyboard.Outputter, error)
+
+	output := opts.Outputter
+	if output == nil && os.Getenv(OutputEnv) == "trace" {
+		logger.Info("tracing output to stdout instead of uinput")
+		output = keyboard.NewTraceOutput(os.Stdout)
+	}
+	if output == nil {
+		entry, err := keyboard.UnicodeEntryFor(opts.UnicodeInput)
+		if err != nil {
+			return nil, err
+		}
+		entry, err = entry.WithConfirm(opts.UnicodeConfirm)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debug("unicode input method", "method", entry.Name)
+		imeActive, err := imeDetector(opts.IMEConfirm, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		backend = new(atomic.Value)
+		backend.Store(keyboard.BackendHex)
+		if opts.OutputBackend != "" {
+			if err := keyboard.CheckTextBackend(opts.OutputBackend); err != nil {
+				logger.Warn("ignoring output backend", "backend", opts.OutputBackend, "error", err)
+			} else {
+				backend.Store(opts.OutputBackend)
+			}
+		}
+		newOutput := func() (keyboard.Outputter, error) {
+			vkb, err := keyboard.NewMirroredVirtualKeyboard(opts.OutputDevices, logger)
+			if err != nil {
+				return nil, err
+			}
+			vkb.SetUnicodeEntry(entry)
+			// Checked by imeDetector, cannot fail here
+			_ = vkb.SetIMEConfirm(opts.IMEConfirm, imeActive)
+			vkb.SetRateLimit(opts.MaxEventsPerSec)
+			vkb.SetHoldDuration(opts.InjectHold)
+			out, err := keyboard.WithTextBackend(vkb, backend.Load().(string))
+			if err != nil {
+				vkb.Close()
+				return nil, err
+			}
+			return out, nil
+		}
+		output, err = newOutput()
+		if err != nil && backend.Load() != keyboard.BackendHex {
+			logger.Warn("output backend unavailable, using hex entry", "backend", backend.Load(), "error", err)
+			backend.Store(keyboard.BackendHex)
+			output, err = newOutput()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("creating virtual keyboard (is /dev/uinput writable?): %w", err)
+		}
+		if opts.Handler.NewOutput == nil {
+			opts.Handler.NewOutput = newOutput
+		}
+		newDefault = newOutput
+	}
+
+	if opts.GrabMode == GrabMonitor && opts.Events == nil {
+		logger.Warn("grab_mode is monitor: keyboards are not grabbed, so apps receive every original key as well as the mapped output (Option+e also arrives as Alt+e)")
+		output = keyboard.NewMonitorOutput(output)
+		if newOutput := opts.Handler.NewOutput; newOutput != nil {
+			opts.Handler.NewOutput = func() (keyboard.Outputter, error) {
+				out, err := newOutput()
+				if err != nil {
+					return nil, err
+				}
+				return keyboard.NewMonitorOutput(out), nil
+			}
+		}
+		if newOutput := newDefault; newOutput != nil {
+			newDefault = func() (keyboard.Outputter, error) {
+				out, err := newOutput()
+				if err != nil {
+					return nil, err
+				}
+				return keyboard.NewMonitorOutput(out), nil
+			}
+		}
+	}
+
+	devices := keyboard.NewDeviceManager(logger)
+	if opts.Events == nil {
+		devices.SetForcedKeyboards(opts.ForceKeyboards)
+		devices.SetSeat(ResolveSeat(opts.Seat))
+		keyboards, err := devices.FindKeyboards()
+		if err == nil && len(keyboards) == 0 {
+			err = errors.New("no keyboards found")
+		}
+		if err != nil {
+			devices.Close()
+			output.Close()
+			return nil, fmt.Errorf("finding keyboards: %w", err)
+		}
+	}
+
+	return &Engine{
+		opts:       opts,
+		handler:    handler.New(mappings.NewKeyLookup(opts.Layout), output, opts.Handler, logger),
+		devices:    devices,
+		events:     make(chan *keyboard.KeyEvent, 100),
+		logger:     logger,
+		backend:    backend,
+		newDefault: newDefault,
+	}, nil
+}
+
+// imeDetector checks Options.IMEConfirm and returns what reports an input
+// method on, nil when detection is off or the session bus is unreachable.
+func imeDetector(confirm string, logger *slog.Logger) (func() bool, error) {
+	if confirm == "" {
+		return nil, nil
+	}
+	if _, err := keyboard.UnicodeEntryGTK.WithConfirm(confirm); err != nil {
+		return nil, fmt.Errorf("ime confirm: %w", err)
+	}
+	ime, err := keyboard.NewFcitxIME()
+	if err != nil {
+		logger.Warn("input method detection unavailable", "error", err)
+		return nil, nil
+	}
+	return ime.Active, nil
+}
+
+// ResolveSeat turns an Options.Seat value into the seat to filter on. The
+// session's seat comes from XDG_SEAT, else from logind for XDG_SESSION_ID or
+// the user's display session, and is seat0 when none is known.
+func ResolveSeat(seat string) string {
+	if seat == "" || seat == "auto" {
+		return keyboard.CurrentSeat()
+	}
+	return seat
+}
+
+// Run grabs the enabled keyboards and processes their events until ctx is
+// done. On return every keyboard is released, held keys are lifted and the
+// output is closed; an Engine cannot be run twice.
+func (e *Engine) Run(ctx context.Context) error {
+	if e.opts.Events != nil {
+		err := e.handler.ProcessEvents(ctx, e.opts.Events)
+		if err := e.handler.CloseOutput(); err != nil {
+			e.logger.Error("failed to close output", "error", err)
+		}
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	readers := newDeviceReaders(ctx, e.events, e.devices.Remove, e.logger)
+	e.mu.Lock()
+	e.readers = readers
+	e.mu.Unlock()
+
+	started, failed := 0, 0
+	for _, info := range e.devices.List() {
+		if !e.wanted(info) {
+			e.logger.Info("keyboard disabled, not grabbing", "name", info.Name, "device", info.Ref())
+			continue
+		}
+		dev := e.devices.Device(info.Path)
+		if err := e.attach(dev); err != nil {
+			e.logger.Error("failed to grab keyboard", "name", info.Name, "error", err)
+			failed++
+			continue
+		}
+		e.initKeyState(dev)
+		readers.Start(dev)
+		started++
+	}
+	if started == 0 && failed > 0 && e.opts.GrabMode != GrabMonitor {
+		e.logger.Warn("no keyboard could be grabbed; grab_mode: monitor reads them without a grab, at the cost of apps also receiving the original keys")
+	}
+
+	err := e.handler.ProcessEvents(ctx, e.events)
+
+	e.mu.Lock()
+	e.readers = nil
+	e.mu.Unlock()
+
+	// Ungrab first so keys typed from now on reach apps directly, then stop
+	// readers before releasing held keys, so no late event can press them
+	// again
+	if err := e.devices.ReleaseAll(); err != nil {
+		e.logger.Error("failed to release keyboards", "error", err)
+	}
+	cancel()
+	if err := e.handler.CloseOutput(); err != nil {
+		e.logger.Error("failed to close output", "error", err)
+	}
+	e.devices.Close()
+
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// attach prepares dev for reading according to the grab mode.
+func (e *Engine) attach(dev *keyboard.Device) error {
+	if e.opts.GrabMode == GrabMonitor {
+		return e.devices.MonitorDevice(dev)
+	}
+	return e.devices.GrabDevice(dev)
+}
+
+func (e *Engine) wanted(info DeviceInfo) bool {
+	if len(e.opts.Devices) > 0 && !keyboard.MatchAny(e.opts.Devices, info) {
+		return false
+	}
+	return e.opts.DeviceEnabled == nil || e.opts.DeviceEnabled(info.Name)
+}
+
+// initKeyState picks up modifiers the user is holding as dev is grabbed.
+func (e *Engine) initKeyState(dev *keyboard.Device) {
+	if err := e.handler.InitKeyState(dev); err != nil {
+		e.logger.Warn("failed to read initial key state", "name", dev.Name(), "error", err)
+	}
+}
+
+// Enabled reports whether mappings are applied.
+func (e *Engine) Enabled() bool {
+	return e.handler.Enabled()
+}
+
+// SetEnabled turns mapping on or off; when off, keys pass through unchanged.
+func (e *Engine) SetEnabled(enabled bool) {
+	e.handler.SetEnabled(enabled)
+}
+
+// ResetState drops keys in progress and releases the keys the engine holds
+// on the output; keys the user holds stay down. Call it when keyboard focus
+// moves to another window, so a combo or Option held across the change does
+// not stay stuck in the new one.
+func (e *Engine) ResetState() {
+	e.handler.ResetState()
+}
+
+// SetAppUnicodeConfirm sets the key committing Unicode entry while an app
+// asking for its own has focus: "space", "enter" or "none", overriding the
+// layout's and UnicodeConfirm. Empty goes back to those. IMEConfirm still
+// wins while an input method is on.
+func (e *Engine) SetAppUnicodeConfirm(name string) {
+	e.handler.SetAppUnicodeConfirm(name)
+}
+
+// ConsumeLeftAlt reports whether Left Alt acts as Option.
+func (e *Engine) ConsumeLeftAlt() bool {
+	return e.handler.ConsumeLeftAlt()
+}
+
+// SetConsumeLeftAlt sets whether Left Alt acts as Option; when off it
+// reaches apps as a plain Alt and Option mappings do not apply.
+func (e *Engine) SetConsumeLeftAlt(consume bool) {
+	e.handler.SetConsumeLeftAlt(consume)
+}
+
+// SetLayout switches to another layout at runtime.
+func (e *Engine) SetLayout(layout *Layout) {
+	e.handler.SetLayout(mappings.NewKeyLookup(layout))
+}
+
+// OutputBackend returns how the default output types text, one of
+// OutputBackends, or "" when Options.Outputter was set.
+func (e *Engine) OutputBackend() string {
+	if e.backend == nil {
+		return ""
+	}
+	return e.backend.Load().(string)
+}
+
+// SetOutputBackend switches how the default output types text, replacing
+// the virtual keyboard without touching the grabbed keyboards. It fails when
+// the backend's tools are missing, leaving the output as it was.
+func (e *Engine) SetOutputBackend(name string) error {
+	if e.backend == nil {
+		return errors.New("output backends need the default output")
+	}
+	if err := keyboard.CheckTextBackend(name); err != nil {
+		return err
+	}
+
+	previous := e.backend.Swap(name)
+	output, err := e.newDefault()
+	if err != nil {
+		e.backend.Store(previous)
+		return fmt.Errorf("creating virtual keyboard: %w", err)
+	}
+	e.handler.SetOutputter(output)
+	e.logger.Info("output backend changed", "backend", name)
+	return nil
+}
+
+// Devices lists the detected keyboards and whether each is grabbed.
+func (e *Engine) Devices() []DeviceInfo {
+	return e.devices.List()
+}
+
+// SetDeviceEnabled grabs or releases a single keyboard while running.
+func (e *Engine) SetDeviceEnabled(path string, enabled bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.readers == nil {
+		return errors.New("engine is not running")
+	}
+	dev := e.devices.Device(path)
+	if dev == nil {
+		return fmt.Errorf("unknown device %s", path)
+	}
+
+	if enabled {
+		if err := e.attach(dev); err != nil {
+			return err
+		}
+		e.initKeyState(dev)
+		e.readers.Start(dev)
+		return nil
+	}
+	e.readers.Stop(dev)
+	return e.devices.ReleaseDevice(dev)
+}
+
+// Stats returns output health counters.
+func (e *Engine) Stats() Stats {
+	return e.handler.Stats()
+}
+
+// DumpRecent writes the recently seen key events as JSON lines and returns
+// how many were written.
+func (e *Engine) DumpRecent(w io.Writer) (int, error) {
+	return e.handler.DumpRecent(w)
+}
@@ -0,0 +1,62 @@
+package asahimap
+
+import (
+	"fmt"
+	"time"
+)
+
+// StallTimeout is how long a single event may take to handle before Health
+// reports the event loop as stuck, e.g. on a uinput write that never returns.
+const StallTimeout = 5 * time.Second
+
+// Health is a point-in-time check of a running Engine.
+type Health struct {
+	// Problems lists what is wrong; empty when healthy
+	Problems []string
+
+	// Grabbed is the number of keyboards being read
+	Grabbed int
+
+	// LastEvent is when the latest key event was handled, zero before the
+	// first. An idle keyboard is not a problem.
+	LastEvent time.Time
+}
+
+// Healthy reports whether no problem was found.
+func (h Health) Healthy() bool {
+	return len(h.Problems) == 0
+}
+
+// Health checks that the engine is running with at least one keyboard
+// grabbed, that the virtual keyboard accepts events and that the event loop
+// is not stuck on an event.
+func (e *Engine) Health() Health {
+	e.mu.Lock()
+	running := e.readers != nil
+	e.mu.Unlock()
+
+	stats := e.handler.Stats()
+	health := Health{LastEvent: stats.LastEvent}
+	if !running {
+		health.Problems = append(health.Problems, "engine is not running")
+	}
+
+	for _, dev := range e.devices.List() {
+		if dev.Active() {
+			health.Grabbed++
+		}
+	}
+	if health.Grabbed == 0 {
+		health.Problems = append(health.Problems, "no keyboard grabbed")
+	}
+
+	if stats.OutputFailing {
+		health.Problems = append(health.Problems, "virtual keyboard is failing")
+	}
+	if !stats.HandlingSince.IsZero() {
+		if busy := time.Since(stats.HandlingSince); busy > StallTimeout {
+			health.Problems = append(health.Problems, fmt.Sprintf("event loop stuck for %s", busy.Round(time.Second)))
+		}
+	}
+	return health
+}
@@ -0,0 +1,87 @@
+package asahimap
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/uplg/asahi-map/internal/keyboard"
+)
+
+// deviceReaders runs one ReadEvents goroutine per active keyboard so devices
+// can be started and stopped individually at runtime.
+type deviceReaders struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	events  chan<- *keyboard.KeyEvent
+	readers map[string]*reader
+	logger  *slog.Logger
+
+	// onDisconnect is called after a reader stops because its device went
+	// away
+	onDisconnect func(dev *keyboard.Device)
+}
+
+type reader struct {
+	cancel context.CancelFunc
+	done   chan struct{} // closed once ReadEvents has returned
+}
+
+func newDeviceReaders(ctx context.Context, events chan<- *keyboard.KeyEvent, onDisconnect func(*keyboard.Device), logger *slog.Logger) *deviceReaders {
+	return &deviceReaders{
+		ctx:          ctx,
+		events:       events,
+		readers:      make(map[string]*reader),
+		logger:       logger,
+		onDisconnect: onDisconnect,
+	}
+}
+
+// Start begins reading events from dev. It is a no-op if already running.
+func (r *deviceReaders) Start(dev *keyboard.Device) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, running := r.readers[dev.Path()]; running {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	rd := &reader{cancel: cancel, done: make(chan struct{})}
+	r.readers[dev.Path()] = rd
+
+	go func() {
+		err := keyboard.ReadEvents(ctx, dev, r.events)
+		close(rd.done)
+		disconnected := errors.Is(err, keyboard.ErrDisconnected)
+		switch {
+		case disconnected:
+			r.logger.Warn("keyboard disconnected", "name", dev.Name(), "device", dev.Path())
+		case err != nil && !errors.Is(err, context.Canceled):
+			r.logger.Error("error reading events", "device", dev.Name(), "error", err)
+		}
+		r.mu.Lock()
+		if r.readers[dev.Path()] == rd {
+			delete(r.readers, dev.Path())
+		}
+		r.mu.Unlock()
+		if disconnected && r.onDisconnect != nil {
+			r.onDisconnect(dev)
+		}
+	}()
+}
+
+// Stop stops reading events from dev and waits for the reader to return,
+// so the device is not closed under a later grab or reader.
+func (r *deviceReaders) Stop(dev *keyboard.Device) {
+	r.mu.Lock()
+	rd, running := r.readers[dev.Path()]
+	delete(r.readers, dev.Path())
+	r.mu.Unlock()
+
+	if running {
+		rd.cancel()
+		<-rd.done
+	}
+}
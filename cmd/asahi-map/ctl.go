@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/uplg/asahi-map/internal/control"
+	"github.com/uplg/asahi-map/internal/keyboard"
+)
+
+// runCtl implements the "ctl" subcommand, a client for the control socket.
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socketPath := fs.String("socket", control.DefaultSocketPath(), "Path to the control socket")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: asahi-map ctl [-socket path] <command> [args...]")
+		fmt.Fprintln(fs.Output(), "run \"asahi-map ctl help\" to list commands")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	out, err := control.Send(*socketPath, fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if out != "" {
+		fmt.Print(out)
+	}
+	return 0
+}
+
+// formatDevices renders a device list for status output.
+func formatDevices(devices []keyboard.DeviceInfo) string {
+	var b strings.Builder
+	for _, dev := range devices {
+		state := "not grabbed"
+		if dev.Grabbed {
+			state = "grabbed"
+		} else if dev.Monitored {
+			state = "monitored"
+		}
+		if dev.HasFn {
+			state += ", fn key"
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s", dev.Path, dev.Name, state)
+		if dev.ID != "" {
+			fmt.Fprintf(&b, "\t%s", dev.ID)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
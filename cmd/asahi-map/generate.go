@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/uplg/asahi-map/configs"
+	"github.com/uplg/asahi-map/internal/config"
+	"github.com/uplg/asahi-map/internal/mappings"
+	"github.com/uplg/asahi-map/internal/xkb"
+	"gopkg.in/yaml.v3"
+)
+
+// commonLayout supplies Mac Option characters for keys the XKB layout has
+// nothing on at the AltGr levels.
+const commonLayout = "layouts/qwerty-mac.yaml"
+
+// hexDigits are the characters typed during Ctrl+Shift+U entry.
+const hexDigits = "0123456789abcdef"
+
+// runGenerateLayout writes a starter layout built from an XKB layout, or
+// the configured one when spec is empty, to output or stdout.
+func runGenerateLayout(spec, output string, logger *slog.Logger) int {
+	if spec == "" {
+		spec = config.XKBLayout()
+	}
+	if spec == "" {
+		logger.Error("no XKB layout configured, pass one with -xkb-layout (e.g. fr or de(nodeadkeys))")
+		return 1
+	}
+
+	name, variant := xkb.ParseSpec(spec)
+	keys, err := xkb.Symbols(name, variant)
+	if err != nil {
+		logger.Error("failed to read XKB layout", "layout", spec, "error", err)
+		return 1
+	}
+
+	common, err := mappings.LoadLayoutFS(configs.Layouts, commonLayout)
+	if err != nil {
+		logger.Warn("common Option characters unavailable", "error", err)
+		common = &mappings.Layout{}
+	}
+
+	layout, skipped := generateLayout(spec, keys, common)
+	if skipped > 0 {
+		logger.Info("skipped dead keys on AltGr levels, add them as dead_keys by hand", "count", skipped)
+	}
+
+	data, err := yaml.Marshal(layout)
+	if err != nil {
+		logger.Error("failed to encode layout", "error", err)
+		return 1
+	}
+	data = append([]byte(fmt.Sprintf("# Generated by asahi-map -generate-layout from XKB layout %s.\n# AltGr characters are passthrough mappings; the rest are typed with\n# Unicode hex entry. Review, then save under layouts/ and select it.\n", spec)), data...)
+
+	if output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(output, data, 0644); err != nil {
+		logger.Error("failed to write layout", "path", output, "error", err)
+		return 1
+	}
+	logger.Info("wrote layout", "path", output, "alt", len(layout.Alt), "shiftAlt", len(layout.ShiftAlt))
+	return 0
+}
+
+// generateLayout maps the AltGr levels of keys to passthrough mappings,
+// level 3 for alt and level 4 for shift_alt, declaring the character each
+// one types. Keys without a usable AltGr character get common's character
+// for the key, typed with hex entry. Hex digit keys come from levels 1 and
+// 2. It returns the layout and how many dead keysyms were skipped.
+func generateLayout(spec string, keys map[string]xkb.Levels, common *mappings.Layout) (*mappings.Layout, int) {
+	layout := &mappings.Layout{
+		Version:     mappings.LayoutVersion,
+		Name:        "Generated " + spec,
+		Description: "Starter layout generated from XKB layout " + spec,
+		Alt:         make(map[string]mappings.Mapping),
+		ShiftAlt:    make(map[string]mappings.Mapping),
+		HexKeys:     make(map[string]string),
+	}
+
+	skipped := 0
+	for _, xkbName := range sortedXKBKeys(keys) {
+		key, ok := xkb.KeyNames[xkbName]
+		if !ok {
+			continue
+		}
+		levels := keys[xkbName]
+
+		for level, prefix := range []string{"", "shift+"} {
+			if r, ok := xkb.KeysymRune(levels[level]); ok && strings.ContainsRune(hexDigits, r) {
+				if _, taken := layout.HexKeys[string(r)]; !taken {
+					layout.HexKeys[string(r)] = prefix + key
+				}
+			}
+		}
+
+		sections := []struct {
+			m           map[string]mappings.Mapping
+			common      map[string]mappings.Mapping
+			passthrough func(*mappings.Mapping)
+		}{
+			{layout.Alt, common.Alt, func(m *mappings.Mapping) { m.Passthrough = key }},
+			{layout.ShiftAlt, common.ShiftAlt, func(m *mappings.Mapping) { m.PassthroughShift = key }},
+		}
+		for i, section := range sections {
+			sym := levels[2+i]
+			if xkb.IsDeadKeysym(sym) {
+				skipped++
+			}
+			if r, ok := xkb.KeysymRune(sym); ok && mappings.IsSafeRune(r) {
+				m := mappings.Mapping{Char: string(r)}
+				section.passthrough(&m)
+				section.m[key] = m
+				continue
+			}
+			if c := section.common[key]; c.Char != "" && !c.IsDeadKey {
+				section.m[key] = mappings.Mapping{Char: c.Char}
+			}
+		}
+	}
+	return layout, skipped
+}
+
+func sortedXKBKeys(keys map[string]xkb.Levels) []string {
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -3,19 +3,34 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/uplg/asahi-map/asahimap"
 	"github.com/uplg/asahi-map/internal/config"
-	"github.com/uplg/asahi-map/internal/handler"
+	"github.com/uplg/asahi-map/internal/control"
+	"github.com/uplg/asahi-map/internal/instance"
 	"github.com/uplg/asahi-map/internal/keyboard"
+	"github.com/uplg/asahi-map/internal/logfile"
 	"github.com/uplg/asahi-map/internal/mappings"
+	"github.com/uplg/asahi-map/internal/notify"
+	"github.com/uplg/asahi-map/internal/schedule"
 	"github.com/uplg/asahi-map/internal/tray"
+	"github.com/uplg/asahi-map/internal/usage"
+	"github.com/uplg/asahi-map/internal/window"
 )
 
 var (
@@ -25,18 +40,49 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			os.Exit(runCtl(os.Args[2:]))
+		case "install-service":
+			os.Exit(runInstallService(os.Args[2:]))
+		}
+	}
+
 	// Parse command line flags
 	configPath := flag.String("config", "", "Path to config file")
 	layoutName := flag.String("layout", "", "Layout name to use")
 	logLevel := flag.String("log-level", "", "Log level (debug, info, warn, error)")
+	logFile := flag.String("log-file", "", "Also write logs to this file")
+	logMaxSize := flag.Int("log-max-size", 10, "Size in MB at which -log-file is rotated (0 = never)")
+	logBackups := flag.Int("log-backups", 2, "Rotated -log-file backups to keep")
 	showVersion := flag.Bool("version", false, "Show version information")
 	noTray := flag.Bool("no-tray", false, "Run without system tray")
+	replace := flag.Bool("replace", false, "Stop an asahi-map that is already running and take its place")
+	listDevices := flag.Bool("list-devices", false, "List detected keyboards and exit")
+	validate := flag.Bool("validate", false, "Check the layout for errors and conflicts and exit")
+	showStats := flag.Bool("stats", false, "Print the most used mappings recorded with usage_stats and exit")
+	learn := flag.Bool("learn", false, "Record Option combos that have no mapping and print them on exit")
+	selfTest := flag.Bool("self-test", false, "Check that injected keys arrive intact and exit")
+	replayFile := flag.String("replay-file", "", "Feed events from a SIGUSR1 dump instead of keyboards, then exit")
+	dryRun := flag.Bool("dry-run", false, "With -replay-file, print the output instead of typing it")
+	generate := flag.Bool("generate-layout", false, "Print a starter layout built from the XKB layout and exit")
+	xkbLayout := flag.String("xkb-layout", "", "With -generate-layout, the XKB layout to read, e.g. fr or de(nodeadkeys) (default: the configured one)")
+	output := flag.String("output", "", "With -generate-layout, write the layout to this file instead of stdout")
+	migrateConfig := flag.Bool("migrate-config", false, "Save the config file in the current format and exit")
+	typeChar := flag.String("type-char", "", "Type this character into the focused app after a countdown and exit")
+	typeCodepoint := flag.String("type-codepoint", "", "Like -type-char, with the character as a hex codepoint such as 00e9")
+	printKeycodes := flag.Bool("print-keycodes", false, "Print the key names layouts can use with their key codes and exit")
 	flag.Parse()
 
 	if *showVersion {
 		fmt.Printf("asahi-map %s (%s) built %s\n", version, commit, buildDate)
 		os.Exit(0)
 	}
+	if *printKeycodes {
+		fmt.Print(formatKeycodes())
+		os.Exit(0)
+	}
 
 	// Setup logging
 	var level slog.Level
@@ -51,7 +97,17 @@ func main() {
 		level = slog.LevelInfo
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+	var logOutput io.Writer = os.Stderr
+	if *logFile != "" {
+		file, err := logfile.Open(*logFile, int64(*logMaxSize)<<20, *logBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "asahi-map: %v\n", err)
+			os.Exit(1)
+		}
+		logOutput = logfile.Tee(os.Stderr, file)
+	}
+
+	logger := slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{
 		Level: level,
 	}))
 	slog.SetDefault(logger)
@@ -62,12 +118,33 @@ func main() {
 		logger.Error("failed to load config", "error", err)
 		os.Exit(1)
 	}
+	if *migrateConfig {
+		os.Exit(runMigrateConfig(cfg, logger))
+	}
+	logConfigVersion(cfg, logger)
+
+	if *listDevices {
+		os.Exit(runListDevices(cfg, logger))
+	}
+	if *selfTest {
+		os.Exit(runSelfTest(logger))
+	}
+	if *generate {
+		os.Exit(runGenerateLayout(*xkbLayout, *output, logger))
+	}
 
 	// Override layout if specified on command line
 	if *layoutName != "" {
 		cfg.Layout = *layoutName
 	}
 
+	if *validate {
+		os.Exit(runValidate(cfg, logger))
+	}
+	if *showStats {
+		os.Exit(runStats(cfg, logger))
+	}
+
 	logger.Info("asahi-map starting",
 		"version", version,
 		"layout", cfg.Layout,
@@ -79,140 +156,830 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.FirstRun {
+		logger.Info("no config found, detected default layout", "layout", cfg.Layout, "source", cfg.LayoutSource)
+		if err := cfg.Save(); err != nil {
+			logger.Warn("failed to write initial config", "error", err)
+		}
+	}
+
 	// Load layout
-	layoutPath := cfg.LayoutPath(cfg.Layout)
-	logger.Debug("loading layout file", "path", layoutPath)
-	layout, err := mappings.LoadLayout(layoutPath)
+	layout, layoutPath, err := cfg.LoadLayout(cfg.Layout)
 	if err != nil {
 		logger.Error("failed to load layout", "layout", cfg.Layout, "path", layoutPath, "error", err)
 		os.Exit(1)
 	}
 	logger.Info("loaded layout", "name", layout.Name, "description", layout.Description, "path", layoutPath)
+	logLayoutUpgrade(layout, layoutPath, logger)
 
-	// Create key lookup
-	lookup := mappings.NewKeyLookup(layout)
-
-	// Create virtual keyboard
-	vkb, err := keyboard.NewVirtualKeyboard(logger)
-	if err != nil {
-		logger.Error("failed to create virtual keyboard", "error", err)
-		logger.Error("make sure you have write access to /dev/uinput")
+	if *typeChar != "" || *typeCodepoint != "" {
+		r, err := parseTypeChar(*typeChar, *typeCodepoint)
+		if err != nil {
+			logger.Error("nothing to type", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(runTypeChar(cfg, layout, r, logger))
+	}
+	if *replayFile != "" {
+		os.Exit(runReplay(cfg, layout, *replayFile, *dryRun, logger))
+	}
+	if *dryRun {
+		logger.Error("-dry-run requires -replay-file")
 		os.Exit(1)
 	}
-	defer vkb.Close()
 
-	// Find and grab keyboard devices
-	devManager := keyboard.NewDeviceManager(logger)
-	defer devManager.Close()
-
-	keyboards, err := devManager.FindKeyboards()
+	// Two instances would both grab the keyboards and type everything twice
+	lock, err := lockInstance(*replace, logger)
 	if err != nil {
-		logger.Error("failed to find keyboards", "error", err)
+		logger.Error("not starting", "error", err)
 		os.Exit(1)
 	}
+	defer lock.Release()
 
-	if len(keyboards) == 0 {
-		logger.Error("no keyboards found")
-		os.Exit(1)
+	// Count mapping use locally when usage_stats is on
+	var counter *usage.Counter
+	var onMapped func(combo string, chars int)
+	if cfg.UsageStats {
+		counter, err = usage.Load(filepath.Join(cfg.ConfigDir, usage.FileName), logger)
+		if err != nil {
+			logger.Warn("not counting mapping use", "error", err)
+		} else {
+			onMapped = counter.Record
+		}
 	}
 
-	// Grab the first keyboard (or all if needed)
-	for _, kb := range keyboards {
-		if err := devManager.GrabDevice(kb); err != nil {
-			logger.Error("failed to grab keyboard", "name", kb.Name(), "error", err)
-			continue
+	// Record unmapped Option combos in learning mode, on top of any feedback
+	onUnmapped := unmappedFeedback(cfg.FeedbackOnUnmapped, logger)
+	var learned *usage.Counter
+	if cfg.Learn || *learn {
+		learned, err = usage.Load(filepath.Join(cfg.ConfigDir, usage.LearnFileName), logger)
+		if err != nil {
+			logger.Warn("not recording unmapped combos", "error", err)
+		} else {
+			feedback := onUnmapped
+			onUnmapped = func(combo string) {
+				learned.Record(combo, 0)
+				if feedback != nil {
+					feedback(combo)
+				}
+			}
+			logger.Info("learning mode on, recording unmapped option combos", "path", filepath.Join(cfg.ConfigDir, usage.LearnFileName))
 		}
 	}
 
-	// Create event channel
-	events := make(chan *keyboard.KeyEvent, 100)
+	waitForStartup(cfg, logger)
+	if cfg.SelfTest {
+		startupSelfTest(logger)
+	}
+
+	momentary, err := cfg.MomentaryLayouts()
+	if err != nil {
+		logger.Warn("ignoring momentary layouts", "error", err)
+	}
+
+	// Tray is created later; the handler may toggle itself before that
+	var trayRef atomic.Pointer[tray.Tray]
 
-	// Create context for cancellation
+	engine, err := asahimap.New(asahimap.Options{
+		Layout:          layout,
+		ForceKeyboards:  cfg.ForceKeyboards,
+		Devices:         cfg.Devices(),
+		Seat:            cfg.Seat,
+		GrabMode:        cfg.GrabMode,
+		UnicodeInput:    cfg.UnicodeInput,
+		UnicodeConfirm:  cfg.UnicodeConfirm,
+		IMEConfirm:      cfg.IMEConfirm,
+		MaxEventsPerSec: cfg.MaxEventsPerSec,
+		InjectHold:      time.Duration(cfg.InjectHoldMs) * time.Millisecond,
+		OutputDevices:   cfg.OutputDevices,
+		OutputBackend:   cfg.OutputBackend,
+		DeviceEnabled:   cfg.DeviceEnabled,
+		Handler: asahimap.HandlerOptions{
+			TapAction:           cfg.Option.TapAction,
+			TapTimeout:          time.Duration(cfg.Option.TapTimeoutMs) * time.Millisecond,
+			OptionActivation:    cfg.Option.Activation,
+			ForwardLeftAlt:      !cfg.Option.ConsumeLeftAlt,
+			EscapeModifier:      cfg.Option.EscapeModifier,
+			UnmappedKeys:        cfg.Option.UnmappedKeys,
+			ExcludeNumberRow:    cfg.Option.ExcludeNumberRow,
+			SuppressModifiers:   cfg.SuppressWhenModifiers,
+			OutputNormalization: cfg.OutputNormalization,
+			HexEntryKeys:        cfg.HexEntryKeys,
+			MomentaryLayouts:    momentary,
+			Remap:               cfg.Remap,
+			OnToggle: func(enabled bool) {
+				if t := trayRef.Load(); t != nil {
+					t.SetEnabled(enabled)
+				}
+			},
+			OnUnmapped:     onUnmapped,
+			OnMapped:       onMapped,
+			ToggleHotkey:   cfg.ToggleHotkey,
+			RecentEvents:   cfg.RecentEvents,
+			RepeatInterval: time.Duration(cfg.RepeatIntervalMs) * time.Millisecond,
+		},
+		Logger: logger,
+	})
+	if err != nil {
+		logger.Error("failed to start", "error", err)
+		os.Exit(1)
+	}
+	if !cfg.Enabled {
+		engine.SetEnabled(false)
+	}
+
+	// Run the engine in background until shutdown cancels it
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	engineDone := make(chan struct{})
+	go func() {
+		defer close(engineDone)
+		if err := engine.Run(ctx); err != nil {
+			logger.Error("error processing events", "error", err)
+		}
+	}()
 
-	// Start reading events from keyboards
-	for _, kb := range keyboards {
-		go func(dev *keyboard.Device) {
-			if err := keyboard.ReadEvents(ctx, dev, events); err != nil {
-				logger.Error("error reading events", "device", dev.Name(), "error", err)
+	if counter != nil {
+		go counter.Run(ctx)
+	}
+	if learned != nil {
+		go learned.Run(ctx)
+	}
+
+	// Turn mapping off while a disable_when or app rule asks for it, and
+	// back on once none does unless it was already off. ruleHeld is set
+	// while the rules keep mapping off
+	var (
+		holdMu   sync.Mutex
+		holders  = make(map[string]bool)
+		ruleHeld atomic.Bool
+	)
+	setEnabled := func(enabled bool) {
+		engine.SetEnabled(enabled)
+		if t := trayRef.Load(); t != nil {
+			t.SetEnabled(enabled)
+		}
+	}
+	hold := func(holder string, off bool) {
+		holdMu.Lock()
+		defer holdMu.Unlock()
+		if off {
+			if len(holders) == 0 && engine.Enabled() {
+				ruleHeld.Store(true)
+				setEnabled(false)
 			}
-		}(kb)
+			holders[holder] = true
+			return
+		}
+		delete(holders, holder)
+		if len(holders) == 0 && ruleHeld.Swap(false) {
+			setEnabled(true)
+		}
+	}
+	scheduler, err := schedule.New(cfg.DisableWhen, func(rule string) {
+		hold("disable_when", rule != "")
+	}, logger)
+	if err != nil {
+		logger.Warn("ignoring disable_when rules", "error", err)
+	} else {
+		go scheduler.Run(ctx)
 	}
 
-	// Create handler
-	h := handler.New(lookup, vkb, logger)
+	// Follow the focused app: keys in progress are dropped whenever focus
+	// moves, so none stays stuck in the new window, and the app_rules of
+	// the app apply
+	var rules *window.Rules
+	if len(cfg.AppRules) > 0 {
+		if rules, err = window.NewRules(cfg.AppRules); err != nil {
+			logger.Warn("ignoring app_rules", "error", err)
+		}
+	}
+	var appDisabled bool
+	watcher := window.NewWatcher(func(app string) {
+		engine.ResetState()
+		if rules == nil {
+			return
+		}
+		rule := rules.Match(app)
+		disable := rule != nil && rule.Disable
+		if disable != appDisabled {
+			if disable {
+				logger.Info("app rule matched, disabling mapping", "app", app, "rule", rule.Name)
+			} else {
+				logger.Info("app rule ended, restoring mapping", "app", app)
+			}
+			appDisabled = disable
+		}
+		hold("app_rules", disable)
 
-	// Start event processing in background
+		confirm := ""
+		if rule != nil {
+			confirm = rule.UnicodeConfirm
+		}
+		engine.SetAppUnicodeConfirm(confirm)
+	}, logger)
 	go func() {
-		if err := h.ProcessEvents(ctx, events); err != nil {
-			logger.Error("error processing events", "error", err)
+		err := watcher.Run(ctx)
+		switch {
+		case err == nil:
+		case rules != nil:
+			logger.Warn("ignoring app_rules", "error", err)
+		default:
+			logger.Info("not following window focus", "error", err)
 		}
 	}()
 
+	// The control socket, tray, signals and shutdown all read and save cfg
+	// from their own goroutines
+	var cfgMu sync.Mutex
+
+	// cfg holds the settings in use and cfgFile the config changes are
+	// saved to: cfg itself until load-config switches to another file, whose
+	// settings that are not applied at runtime must not end up in cfg
+	cfgFile := cfg
+
+	// switchLayout loads and applies a layout by name, saves the choice and
+	// returns the layout's validation warnings, which are also logged and
+	// sent as a notification so a broken layout does not go unnoticed
+	switchLayout := func(name string) ([]string, error) {
+		cfgMu.Lock()
+		defer cfgMu.Unlock()
+		newLayout, layoutPath, err := cfgFile.LoadLayout(name)
+		if err != nil {
+			return nil, err
+		}
+		logLayoutUpgrade(newLayout, layoutPath, logger)
+		cfg.Layout = name
+		cfgFile.Layout = name
+		if err := cfgFile.Save(); err != nil {
+			logger.Warn("failed to save config", "error", err)
+		}
+		engine.SetLayout(newLayout)
+
+		warnings := layoutWarnings(newLayout)
+		if len(warnings) > 0 {
+			for _, w := range warnings {
+				logger.Warn("layout issue", "layout", name, "issue", w)
+			}
+			go func() {
+				summary := fmt.Sprintf("Layout %s has %d issue(s)", name, len(warnings))
+				if err := notify.Send("layout-issues", summary, strings.Join(warnings, "\n")); err != nil {
+					logger.Debug("failed to send notification", "error", err)
+				}
+			}()
+		}
+		return warnings, nil
+	}
+
+	// setConsumeLeftAlt switches Left Alt between Option and a plain Alt
+	// and saves the choice
+	setConsumeLeftAlt := func(consume bool) {
+		cfgMu.Lock()
+		defer cfgMu.Unlock()
+		engine.SetConsumeLeftAlt(consume)
+		cfg.Option.ConsumeLeftAlt = consume
+		cfgFile.Option.ConsumeLeftAlt = consume
+		if err := cfgFile.Save(); err != nil {
+			logger.Warn("failed to save config", "error", err)
+		}
+	}
+
+	// Start control socket
+	ctlServer := control.NewServer(control.DefaultSocketPath(), logger)
+	ctlServer.Handle("status", func(args []string) (string, error) {
+		cfgMu.Lock()
+		layoutName := cfg.Layout
+		cfgMu.Unlock()
+		if len(args) > 0 {
+			if args[0] != "--json" {
+				return "", fmt.Errorf("usage: status [--json]")
+			}
+			return formatStatusJSON(engine, layoutName, counter)
+		}
+		stats := engine.Stats()
+		return fmt.Sprintf("enabled: %t\nlayout: %s\noutput errors: %d\noutput recreations: %d\n%s",
+			engine.Enabled(), layoutName, stats.OutputErrors, stats.OutputRecreations, formatDevices(engine.Devices())), nil
+	})
+	ctlServer.Handle("health", func(args []string) (string, error) {
+		health := engine.Health()
+		if !health.Healthy() {
+			return "", fmt.Errorf("unhealthy: %s", strings.Join(health.Problems, "; "))
+		}
+		last := "never"
+		if !health.LastEvent.IsZero() {
+			last = time.Since(health.LastEvent).Round(time.Second).String() + " ago"
+		}
+		return fmt.Sprintf("healthy\nkeyboards grabbed: %d\nlast event: %s\n", health.Grabbed, last), nil
+	})
+	ctlServer.Handle("consume-alt", func(args []string) (string, error) {
+		if len(args) > 0 {
+			switch args[0] {
+			case "on":
+				setConsumeLeftAlt(true)
+			case "off":
+				setConsumeLeftAlt(false)
+			default:
+				return "", fmt.Errorf("usage: consume-alt [on|off]")
+			}
+			if t := trayRef.Load(); t != nil {
+				t.SetConsumeLeftAlt(engine.ConsumeLeftAlt())
+			}
+		}
+		state := "off (left alt is a plain alt)"
+		if engine.ConsumeLeftAlt() {
+			state = "on (left alt is option)"
+		}
+		return "consume-alt: " + state + "\n", nil
+	})
+	ctlServer.Handle("output-backend", func(args []string) (string, error) {
+		if len(args) > 0 {
+			if err := engine.SetOutputBackend(args[0]); err != nil {
+				return "", err
+			}
+		}
+		current := engine.OutputBackend()
+		if current == "" {
+			current = "none (custom output)"
+		}
+		return fmt.Sprintf("output-backend: %s\nbackends: %s\n", current, strings.Join(asahimap.OutputBackends, ", ")), nil
+	})
+	ctlServer.Handle("layout", func(args []string) (string, error) {
+		cfgMu.Lock()
+		current := cfg.Layout
+		names, err := cfgFile.AvailableLayouts()
+		cfgMu.Unlock()
+		if len(args) == 0 {
+			return current + "\n", nil
+		}
+		if err != nil {
+			logger.Warn("some layouts could not be listed", "error", err)
+		}
+		if args[0] == "list" && !slices.Contains(names, "list") {
+			var b strings.Builder
+			for _, name := range names {
+				marker := " "
+				if name == current {
+					marker = "*"
+				}
+				fmt.Fprintf(&b, "%s %s\n", marker, name)
+			}
+			return b.String(), nil
+		}
+
+		name, err := config.MatchLayout(names, args[0])
+		if err != nil {
+			return "", err
+		}
+		warnings, err := switchLayout(name)
+		if err != nil {
+			return "", err
+		}
+		if t := trayRef.Load(); t != nil {
+			t.SetLayout(name)
+			t.SetLayoutIssues(warnings)
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "layout: %s\n", name)
+		for _, w := range warnings {
+			fmt.Fprintf(&b, "%s\n", w)
+		}
+		return b.String(), nil
+	})
+	ctlServer.Handle("load-config", func(args []string) (string, error) {
+		if len(args) == 0 {
+			return "", fmt.Errorf("usage: load-config <path>")
+		}
+		// config.Load falls back to the default locations, so a mistyped
+		// path must fail here rather than load something else
+		path := strings.Join(args, " ")
+		if _, err := os.Stat(path); err != nil {
+			return "", err
+		}
+		fresh, err := config.Load(path)
+		if err != nil {
+			return "", err
+		}
+		newLayout, layoutPath, err := fresh.LoadLayout(fresh.Layout)
+		if err != nil {
+			return "", fmt.Errorf("layout %s (%s): %w", fresh.Layout, layoutPath, err)
+		}
+		logConfigVersion(fresh, logger)
+		logLayoutUpgrade(newLayout, layoutPath, logger)
+
+		// Everything loaded; only now touch the running state. Only the
+		// settings applied here are copied to cfg; fresh is not shared, so
+		// it is read below instead
+		cfgMu.Lock()
+		cfgFile = fresh
+		cfg.Layout = fresh.Layout
+		cfg.Enabled = fresh.Enabled
+		cfg.Option.ConsumeLeftAlt = fresh.Option.ConsumeLeftAlt
+		engine.SetLayout(newLayout)
+		engine.SetConsumeLeftAlt(fresh.Option.ConsumeLeftAlt)
+		ruleHeld.Store(false)
+		setEnabled(fresh.Enabled)
+		cfgMu.Unlock()
+		warnings := layoutWarnings(newLayout)
+		if t := trayRef.Load(); t != nil {
+			t.SetLayout(fresh.Layout)
+			t.SetLayoutIssues(warnings)
+			t.SetConsumeLeftAlt(fresh.Option.ConsumeLeftAlt)
+		}
+		logger.Info("loaded config", "path", path, "layout", fresh.Layout, "layoutPath", layoutPath)
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "config: %s\nlayout: %s\nenabled: %t\n", path, fresh.Layout, fresh.Enabled)
+		for _, w := range warnings {
+			fmt.Fprintf(&b, "%s\n", w)
+		}
+		return b.String(), nil
+	})
+	if err := ctlServer.Start(); err != nil {
+		logger.Warn("control socket unavailable", "error", err)
+	}
+	defer ctlServer.Close()
+
 	// Get available layouts for tray menu
+	cfgMu.Lock()
+	currentLayout := cfg.Layout
 	availableLayouts, err := cfg.AvailableLayouts()
+	cfgMu.Unlock()
 	if err != nil {
-		logger.Error("failed to list layouts", "error", err)
-		os.Exit(1)
+		logger.Warn("some layouts could not be listed", "error", err)
 	}
-	if len(availableLayouts) == 0 {
-		logger.Error("no layouts found", "layoutDir", filepath.Join(cfg.ConfigDir, "layouts"))
-		os.Exit(1)
+	if i, found := slices.BinarySearch(availableLayouts, currentLayout); !found {
+		availableLayouts = slices.Insert(availableLayouts, i, currentLayout)
 	}
 
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	if *noTray {
+	// Dump recent key events on SIGUSR1 for bug reports
+	dumpChan := make(chan os.Signal, 1)
+	signal.Notify(dumpChan, syscall.SIGUSR1)
+	go func() {
+		for range dumpChan {
+			dumpRecentEvents(engine, logger)
+		}
+	}()
+
+	// Reload the active layout from disk on SIGHUP, after editing it
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			cfgMu.Lock()
+			reloadLayout(cfg, *configPath, engine, logger)
+			cfgMu.Unlock()
+		}
+	}()
+
+	// Every exit path (signal, tray quit) goes through shutdown
+	var shutdownOnce sync.Once
+	shutdown := func() {
+		shutdownOnce.Do(func() {
+			logger.Info("shutting down...")
+
+			cfgMu.Lock()
+			cfg.Enabled = engine.Enabled() || ruleHeld.Load()
+			cfgFile.Enabled = cfg.Enabled
+			if err := cfgFile.Save(); err != nil {
+				logger.Error("failed to save config", "error", err)
+			}
+			cfgMu.Unlock()
+
+			cancel()
+			<-engineDone
+
+			if counter != nil {
+				if err := counter.Flush(); err != nil {
+					logger.Error("failed to save usage counts", "error", err)
+				}
+			}
+			if learned != nil {
+				if err := learned.Flush(); err != nil {
+					logger.Error("failed to save unmapped combos", "error", err)
+				}
+				printLearned(learned)
+			}
+			if err := lock.Release(); err != nil {
+				logger.Warn("failed to remove lock file", "error", err)
+			}
+		})
+	}
+
+	cfgMu.Lock()
+	trayHidden, toggleHotkey := cfg.Tray.Hidden, cfg.ToggleHotkey
+	cfgMu.Unlock()
+	if *noTray || trayHidden {
 		// Run without tray, wait for signal
 		logger.Info("running without system tray, press Ctrl+C to quit")
+		if trayHidden && toggleHotkey == "" {
+			logger.Warn("tray is hidden and no toggle_hotkey is set, mapping cannot be toggled")
+		}
 		<-sigChan
-		logger.Info("shutting down...")
+		shutdown()
 	} else {
-		// Create and run system tray
+		// Create and run system tray. The engine may still be grabbing, so
+		// device state comes from the config
+		var trayDevices []tray.Device
+		cfgMu.Lock()
+		for _, dev := range engine.Devices() {
+			trayDevices = append(trayDevices, tray.Device{Path: dev.Path, Name: dev.Name, Enabled: cfg.DeviceEnabled(dev.Name)})
+		}
+		cfgMu.Unlock()
+
 		trayCfg := tray.Config{
-			CurrentLayout:    cfg.Layout,
+			CurrentLayout:    currentLayout,
 			AvailableLayouts: availableLayouts,
-			Enabled:          true,
-			OnLayoutChange: func(layoutName string) {
-				newLayout, err := mappings.LoadLayout(cfg.LayoutPath(layoutName))
+			Devices:          trayDevices,
+			Enabled:          engine.Enabled(),
+			ConsumeLeftAlt:   engine.ConsumeLeftAlt(),
+			LayoutIssues:     layoutWarnings(layout),
+			OnLayoutChange: func(layoutName string) []string {
+				warnings, err := switchLayout(layoutName)
 				if err != nil {
 					logger.Error("failed to load layout", "layout", layoutName, "error", err)
-					return
 				}
-				cfg.Layout = layoutName
-				cfg.Save()
-				h.SetLayout(mappings.NewKeyLookup(newLayout))
+				return warnings
 			},
 			OnToggle: func(enabled bool) {
-				h.SetEnabled(enabled)
+				engine.SetEnabled(enabled)
 			},
-			OnQuit: func() {
-				logger.Info("shutting down...")
-				cancel()
-				os.Exit(0)
+			OnConsumeAltToggle: setConsumeLeftAlt,
+			OnDeviceToggle: func(path string, enabled bool) error {
+				cfgMu.Lock()
+				defer cfgMu.Unlock()
+				return setDeviceEnabled(cfg, cfgFile, engine, path, enabled)
 			},
+			OnQuit: shutdown,
 			Logger: logger,
 		}
 
 		trayIcon := tray.New(trayCfg)
+		trayRef.Store(trayIcon)
 
 		// Handle signals in a goroutine
+		signalled := make(chan struct{})
 		go func() {
 			<-sigChan
-			logger.Info("shutting down...")
+			shutdown()
 			trayIcon.Quit()
+			close(signalled)
 		}()
 
-		// Run systray (blocks)
-		trayIcon.Run()
+		// Run systray (blocks). Without a tray host keep mapping headless
+		// until a signal
+		if err := trayIcon.Run(); err != nil {
+			trayRef.Store(nil)
+			logger.Warn("system tray unavailable, running without it, press Ctrl+C to quit", "error", err)
+			<-signalled
+		}
 	}
 
 	logger.Info("asahi-map stopped")
 }
 
+// unmappedFeedback returns the handler callback for feedback_on_unmapped,
+// or nil when only the debug log is wanted.
+func unmappedFeedback(mode string, logger *slog.Logger) func(combo string) {
+	switch mode {
+	case "", "none":
+		return nil
+	case "log":
+		return func(combo string) {
+			logger.Info("no mapping for option combo", "combo", combo)
+		}
+	case "notify":
+		return func(combo string) {
+			// notify-send is slow; never hold up event handling
+			go func() {
+				if err := notify.Send("unmapped", "No mapping for "+combo, ""); err != nil {
+					logger.Debug("failed to send notification", "error", err)
+				}
+			}()
+		}
+	}
+	logger.Warn("unknown feedback_on_unmapped, ignoring", "value", mode)
+	return nil
+}
+
+// dumpRecentEvents writes the handler's recent events to a timestamped file
+// in the temp directory.
+func dumpRecentEvents(engine *asahimap.Engine, logger *slog.Logger) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("asahi-map-events-%s.jsonl", time.Now().Format("20060102-150405")))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		logger.Error("failed to create event dump", "error", err)
+		return
+	}
+	defer f.Close()
+
+	n, err := engine.DumpRecent(f)
+	if err != nil {
+		logger.Error("failed to write event dump", "path", path, "error", err)
+		return
+	}
+	logger.Info("dumped recent events", "path", path, "count", n)
+}
+
+// reloadLayout re-reads the config file and the active layout and applies
+// it. Enabled state and grabbed keyboards are untouched, and the running
+// layout is kept if either file fails to load.
+func reloadLayout(cfg *config.Config, configPath string, engine *asahimap.Engine, logger *slog.Logger) {
+	fresh, err := config.Load(configPath)
+	if err != nil {
+		logger.Error("reload failed, keeping current layout", "error", err)
+		return
+	}
+	layout, layoutPath, err := fresh.LoadLayout(cfg.Layout)
+	if err != nil {
+		logger.Error("reload failed, keeping current layout", "layout", cfg.Layout, "path", layoutPath, "error", err)
+		return
+	}
+	engine.SetLayout(layout)
+	logger.Info("reloaded layout", "name", layout.Name, "path", layoutPath)
+	logLayoutUpgrade(layout, layoutPath, logger)
+}
+
+// lockInstance takes the single-instance lock. With replace, an instance
+// already running is stopped first.
+func lockInstance(replace bool, logger *slog.Logger) (*instance.Lock, error) {
+	path := instance.DefaultPath()
+	if replace {
+		return instance.Replace(path, 5*time.Second)
+	}
+	lock, stalePID, err := instance.Acquire(path)
+	var running *instance.RunningError
+	if errors.As(err, &running) {
+		return nil, fmt.Errorf("%w: quit it first, or start with -replace to take over", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stalePID != 0 {
+		logger.Info("taking over the lock of an instance that is gone", "pid", stalePID, "path", path)
+	}
+	return lock, nil
+}
+
+// logConfigVersion notes a config file written in another format than
+// this asahi-map's.
+func logConfigVersion(cfg *config.Config, logger *slog.Logger) {
+	switch {
+	case cfg.Path == "":
+	case cfg.FileVersion > config.ConfigVersion:
+		logger.Warn("config was written by a newer asahi-map, settings this one does not know are ignored",
+			"path", cfg.Path, "version", cfg.FileVersion, "supported", config.ConfigVersion)
+	case cfg.FileVersion < config.ConfigVersion:
+		logger.Info("upgraded config from an older format in memory, -migrate-config saves it",
+			"path", cfg.Path, "from", cfg.FileVersion, "to", config.ConfigVersion)
+	}
+}
+
+// logLayoutUpgrade notes a layout read in an older format. Newer ones are
+// reported by validation.
+func logLayoutUpgrade(layout *mappings.Layout, source string, logger *slog.Logger) {
+	if from, ok := layout.Upgraded(); ok {
+		logger.Info("upgraded layout from an older format in memory", "path", source, "from", from, "to", mappings.LayoutVersion)
+	}
+}
+
+// runMigrateConfig saves an older config file in the current format,
+// keeping the original next to it as a .bak file.
+func runMigrateConfig(cfg *config.Config, logger *slog.Logger) int {
+	if cfg.Path == "" {
+		logger.Error("no config file found to migrate")
+		return 1
+	}
+	if cfg.FileVersion >= config.ConfigVersion {
+		fmt.Printf("%s: already version %d\n", cfg.Path, cfg.FileVersion)
+		return 0
+	}
+
+	original, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		logger.Error("failed to read config", "path", cfg.Path, "error", err)
+		return 1
+	}
+	backup := cfg.Path + ".bak"
+	if err := os.WriteFile(backup, original, 0644); err != nil {
+		logger.Error("failed to back up config", "path", backup, "error", err)
+		return 1
+	}
+	if err := cfg.SaveTo(cfg.Path); err != nil {
+		logger.Error("failed to save config", "path", cfg.Path, "error", err)
+		return 1
+	}
+	fmt.Printf("%s: upgraded from version %d to %d, original kept as %s\n", cfg.Path, cfg.FileVersion, config.ConfigVersion, backup)
+	return 0
+}
+
+// setDeviceEnabled grabs or releases a single keyboard at runtime, records
+// the choice in the settings in use, cfg, and saves it to cfgFile.
+func setDeviceEnabled(cfg, cfgFile *config.Config, engine *asahimap.Engine, path string, enabled bool) error {
+	if err := engine.SetDeviceEnabled(path, enabled); err != nil {
+		return err
+	}
+
+	for _, dev := range engine.Devices() {
+		if dev.Path == path {
+			cfg.SetDeviceEnabled(dev.Name, enabled)
+			cfgFile.SetDeviceEnabled(dev.Name, enabled)
+		}
+	}
+	if err := cfgFile.Save(); err != nil {
+		slog.Error("failed to save config", "error", err)
+	}
+	return nil
+}
+
+// layoutWarnings returns the warnings Validate reports for a loaded layout;
+// errors would have stopped it from loading.
+func layoutWarnings(layout *mappings.Layout) []string {
+	var warnings []string
+	for _, issue := range layout.Validate() {
+		if issue.Severity == mappings.SeverityWarning {
+			warnings = append(warnings, issue.String())
+		}
+	}
+	return warnings
+}
+
+// runValidate prints every issue in the active layout, warnings included,
+// and fails when any is an error.
+func runValidate(cfg *config.Config, logger *slog.Logger) int {
+	layout, issues, source, err := cfg.ValidateLayout(cfg.Layout)
+	if err != nil {
+		logger.Error("failed to read layout", "layout", cfg.Layout, "path", source, "error", err)
+		return 1
+	}
+	mode := mappings.LayoutFull
+	if layout.Sparse() {
+		mode = mappings.LayoutSparse
+	}
+
+	failed := 0
+	for _, issue := range issues {
+		fmt.Println(issue)
+		if issue.Severity == mappings.SeverityError {
+			failed++
+		}
+	}
+	warnings := len(issues) - failed
+	if len(cfg.HexEntryKeys) > 0 {
+		if _, err := mappings.ParseHexEntryKeys(cfg.HexEntryKeys); err != nil {
+			fmt.Printf("error: hex_entry_keys in config.yaml: %v\n", err)
+			failed++
+		}
+	}
+	if _, err := cfg.MomentaryLayouts(); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Printf("error: momentary_layout in config.yaml: %s\n", line)
+			failed++
+		}
+	}
+	fmt.Printf("%s: %s layout, %d errors, %d warnings\n", source, mode, failed, warnings)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// formatKeycodes lists every key name layouts understand, by key code.
+func formatKeycodes() string {
+	codes := make([]mappings.KeyCode, 0, len(mappings.KeyCodeToName))
+	for code := range mappings.KeyCodeToName {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CODE\tNAME")
+	for _, code := range codes {
+		fmt.Fprintf(w, "%d\t%s\n", code, mappings.KeyCodeToName[code])
+	}
+	w.Flush()
+	return b.String()
+}
+
+// runListDevices prints the keyboards asahi-map would grab, without grabbing them.
+func runListDevices(cfg *config.Config, logger *slog.Logger) int {
+	devManager := keyboard.NewDeviceManager(logger)
+	devManager.SetForcedKeyboards(cfg.ForceKeyboards)
+	devManager.SetSeat(asahimap.ResolveSeat(cfg.Seat))
+	defer devManager.Close()
+
+	if _, err := devManager.FindKeyboards(); err != nil {
+		logger.Error("failed to find keyboards", "error", err)
+		return 1
+	}
+	fmt.Print(formatDevices(devManager.List()))
+	return 0
+}
+
 // ensureConfigDir creates the config directory and copies default layouts if needed.
 func ensureConfigDir(cfg *config.Config) error {
 	layoutDir := filepath.Join(cfg.ConfigDir, "layouts")
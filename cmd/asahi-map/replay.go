@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/uplg/asahi-map/asahimap"
+	"github.com/uplg/asahi-map/internal/config"
+)
+
+// runReplay feeds a recorded event file through the handler without opening
+// any keyboard. With dryRun the output is printed instead of typed.
+func runReplay(cfg *config.Config, layout *asahimap.Layout, path string, dryRun bool, logger *slog.Logger) int {
+	f, err := os.Open(path)
+	if err != nil {
+		logger.Error("failed to open replay file", "error", err)
+		return 1
+	}
+	defer f.Close()
+
+	var output asahimap.Outputter
+	if dryRun {
+		output = asahimap.NewTraceOutput(os.Stdout)
+	}
+
+	momentary, err := cfg.MomentaryLayouts()
+	if err != nil {
+		logger.Warn("ignoring momentary layouts", "error", err)
+	}
+
+	events := make(chan *asahimap.KeyEvent)
+	engine, err := asahimap.New(asahimap.Options{
+		Layout:          layout,
+		Outputter:       output,
+		UnicodeInput:    cfg.UnicodeInput,
+		UnicodeConfirm:  cfg.UnicodeConfirm,
+		IMEConfirm:      cfg.IMEConfirm,
+		MaxEventsPerSec: cfg.MaxEventsPerSec,
+		InjectHold:      time.Duration(cfg.InjectHoldMs) * time.Millisecond,
+		OutputDevices:   cfg.OutputDevices,
+		OutputBackend:   cfg.OutputBackend,
+		Events:          events,
+		// Remap is left out: dumps record events after it was applied
+		Handler: asahimap.HandlerOptions{
+			TapAction:           cfg.Option.TapAction,
+			TapTimeout:          time.Duration(cfg.Option.TapTimeoutMs) * time.Millisecond,
+			OptionActivation:    cfg.Option.Activation,
+			ForwardLeftAlt:      !cfg.Option.ConsumeLeftAlt,
+			EscapeModifier:      cfg.Option.EscapeModifier,
+			UnmappedKeys:        cfg.Option.UnmappedKeys,
+			ExcludeNumberRow:    cfg.Option.ExcludeNumberRow,
+			SuppressModifiers:   cfg.SuppressWhenModifiers,
+			OutputNormalization: cfg.OutputNormalization,
+			HexEntryKeys:        cfg.HexEntryKeys,
+			MomentaryLayouts:    momentary,
+			RepeatInterval:      time.Duration(cfg.RepeatIntervalMs) * time.Millisecond,
+			ToggleHotkey:        cfg.ToggleHotkey,
+		},
+		Logger: logger,
+	})
+	if err != nil {
+		logger.Error("failed to start", "error", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	replayErr := make(chan error, 1)
+	go func() {
+		defer close(events)
+		n, err := asahimap.Replay(ctx, f, events)
+		logger.Info("replayed events", "path", path, "count", n)
+		replayErr <- err
+	}()
+
+	if err := engine.Run(ctx); err != nil {
+		logger.Error("error processing events", "error", err)
+		return 1
+	}
+	if err := <-replayErr; err != nil {
+		logger.Error("failed to read replay file", "error", err)
+		return 1
+	}
+	return 0
+}
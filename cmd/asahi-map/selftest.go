@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/uplg/asahi-map/internal/keyboard"
+)
+
+// runSelfTest implements -self-test: it checks that injected key events
+// arrive intact and prints the result.
+func runSelfTest(logger *slog.Logger) int {
+	result, err := keyboard.SelfTest(logger)
+	if err != nil {
+		fmt.Println("self-test could not run:", err)
+		fmt.Println("check that /dev/uinput and /dev/input/event* are accessible (see Setup permissions)")
+		return 1
+	}
+	fmt.Println("self-test", result)
+	if !result.Passed() {
+		return 1
+	}
+	return 0
+}
+
+// startupSelfTest runs the self-test when self_test is set, logging the
+// outcome; a failure does not stop startup.
+func startupSelfTest(logger *slog.Logger) {
+	result, err := keyboard.SelfTest(logger)
+	switch {
+	case err != nil:
+		logger.Warn("output self-test could not run", "error", err)
+	case !result.Passed():
+		logger.Warn("output self-test failed, injected keys may be lost", "mismatch", result.Mismatch())
+	default:
+		logger.Info("output self-test passed", "events", len(result.Sent), "duration", result.Duration)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const serviceName = "asahi-map.service"
+
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=Asahi-Map Option Key Mapper
+{{- if .System}}
+After=systemd-udevd.service
+{{- else}}
+After=graphical-session.target
+PartOf=graphical-session.target
+{{- end}}
+
+[Service]
+Type=simple
+ExecStart={{.ExecStart}}
+ExecReload=/bin/kill -HUP $MAINPID
+{{- range .Environment}}
+Environment={{.}}
+{{- end}}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+{{- if .System}}
+WantedBy=multi-user.target
+{{- else}}
+WantedBy=graphical-session.target
+{{- end}}
+`))
+
+// serviceEnv lists environment variables copied into the unit when set.
+var serviceEnv = []string{"ASAHI_MAP_SOCKET", "XDG_CURRENT_DESKTOP"}
+
+// runInstallService implements the "install-service" subcommand, which
+// writes a systemd unit starting this executable with the given flags.
+func runInstallService(args []string) int {
+	fs := flag.NewFlagSet("install-service", flag.ExitOnError)
+	system := fs.Bool("system", false, "Install a system unit in /etc/systemd/system instead of a user unit")
+	printOnly := fs.Bool("print", false, "Print the unit instead of writing it")
+	withTray := fs.Bool("tray", false, "Run with the tray icon (user units only)")
+	configPath := fs.String("config", "", "Config file passed to asahi-map")
+	layoutName := fs.String("layout", "", "Layout passed to asahi-map")
+	logLevel := fs.String("log-level", "", "Log level passed to asahi-map")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: asahi-map install-service [-system] [-print] [-tray] [-config path] [-layout name] [-log-level level]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *system && *withTray {
+		fmt.Fprintln(os.Stderr, "error: -tray needs a desktop session and cannot be used with -system")
+		return 2
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: locating executable:", err)
+		return 1
+	}
+
+	cmd := []string{exe}
+	if !*withTray {
+		cmd = append(cmd, "-no-tray")
+	}
+	if *configPath != "" {
+		abs, err := filepath.Abs(*configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		cmd = append(cmd, "-config", abs)
+	}
+	if *layoutName != "" {
+		cmd = append(cmd, "-layout", *layoutName)
+	}
+	if *logLevel != "" {
+		cmd = append(cmd, "-log-level", *logLevel)
+	}
+
+	var env []string
+	for _, name := range serviceEnv {
+		if value := os.Getenv(name); value != "" {
+			env = append(env, quoteUnitArg(name+"="+value))
+		}
+	}
+
+	quoted := make([]string, len(cmd))
+	for i, arg := range cmd {
+		quoted[i] = quoteUnitArg(arg)
+	}
+
+	var unit strings.Builder
+	err = unitTemplate.Execute(&unit, struct {
+		System      bool
+		ExecStart   string
+		Environment []string
+	}{*system, strings.Join(quoted, " "), env})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: rendering unit:", err)
+		return 1
+	}
+
+	if *printOnly {
+		fmt.Print(unit.String())
+		return 0
+	}
+
+	dir, err := serviceDir(*system)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error: creating unit directory:", err)
+		return 1
+	}
+	path := filepath.Join(dir, serviceName)
+	if err := os.WriteFile(path, []byte(unit.String()), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "error: writing unit:", err)
+		return 1
+	}
+
+	fmt.Println("wrote", path)
+	if *system {
+		fmt.Println("enable it with:")
+		fmt.Println("  sudo systemctl daemon-reload")
+		fmt.Println("  sudo systemctl enable --now", serviceName)
+	} else {
+		fmt.Println("enable it with:")
+		fmt.Println("  systemctl --user daemon-reload")
+		fmt.Println("  systemctl --user enable --now", serviceName)
+	}
+	return 0
+}
+
+// serviceDir returns where the unit is installed.
+func serviceDir(system bool) (string, error) {
+	if system {
+		return "/etc/systemd/system", nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("finding user config directory: %w", err)
+	}
+	return filepath.Join(configDir, "systemd", "user"), nil
+}
+
+// quoteUnitArg quotes s for a unit file command line when it contains
+// characters systemd would split or expand.
+func quoteUnitArg(s string) string {
+	if !strings.ContainsAny(s, " \t\"'\\$%") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uplg/asahi-map/internal/config"
+)
+
+// sessionWaitTimeout bounds wait_for_session, so a headless machine or an
+// unusual session still gets its keyboards remapped.
+const sessionWaitTimeout = time.Minute
+
+// sessionPollInterval is how often wait_for_session checks for the session.
+const sessionPollInterval = 500 * time.Millisecond
+
+// waitForStartup applies startup_delay_ms and wait_for_session before any
+// keyboard is opened, so the display manager has released them.
+func waitForStartup(cfg *config.Config, logger *slog.Logger) {
+	if cfg.StartupDelayMs > 0 {
+		delay := time.Duration(cfg.StartupDelayMs) * time.Millisecond
+		logger.Info("waiting before grabbing keyboards", "delay", delay)
+		time.Sleep(delay)
+	}
+
+	if !cfg.WaitForSession {
+		return
+	}
+	deadline := time.Now().Add(sessionWaitTimeout)
+	logged := false
+	for {
+		display, ok := graphicalSession()
+		if ok {
+			if logged {
+				logger.Info("graphical session found", "display", display)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			logger.Warn("no graphical session found, starting anyway", "waited", sessionWaitTimeout)
+			return
+		}
+		if !logged {
+			logger.Info("waiting for a graphical session", "timeout", sessionWaitTimeout)
+			logged = true
+		}
+		time.Sleep(sessionPollInterval)
+	}
+}
+
+// graphicalSession reports whether a Wayland or X11 display socket exists,
+// returning its name. WAYLAND_DISPLAY and DISPLAY are checked first; when
+// neither is set, as for services started before the session exported
+// them, any Wayland socket in XDG_RUNTIME_DIR or X11 socket counts.
+func graphicalSession() (string, bool) {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+
+	if name := os.Getenv("WAYLAND_DISPLAY"); name != "" {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(runtimeDir, name)
+		}
+		if _, err := os.Stat(path); err == nil {
+			return name, true
+		}
+	}
+	if display := os.Getenv("DISPLAY"); display != "" {
+		// ":0" or ":0.0" is served by /tmp/.X11-unix/X0; remote displays
+		// such as "host:10" have no local socket but exist by definition
+		host, num, _ := strings.Cut(display, ":")
+		num, _, _ = strings.Cut(num, ".")
+		if host != "" && host != "unix" {
+			return display, true
+		}
+		if _, err := os.Stat(fmt.Sprintf("/tmp/.X11-unix/X%s", num)); err == nil {
+			return display, true
+		}
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" || os.Getenv("DISPLAY") != "" {
+		return "", false
+	}
+
+	if runtimeDir != "" {
+		if sockets, _ := filepath.Glob(filepath.Join(runtimeDir, "wayland-[0-9]*")); len(sockets) > 0 {
+			return filepath.Base(sockets[0]), true
+		}
+	}
+	if sockets, _ := filepath.Glob("/tmp/.X11-unix/X*"); len(sockets) > 0 {
+		return ":" + strings.TrimPrefix(filepath.Base(sockets[0]), "X"), true
+	}
+	return "", false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/uplg/asahi-map/internal/config"
+	"github.com/uplg/asahi-map/internal/mappings"
+	"github.com/uplg/asahi-map/internal/usage"
+)
+
+// statsTop is how many mappings -stats lists.
+const statsTop = 20
+
+// runStats prints the most used mappings recorded with usage_stats.
+func runStats(cfg *config.Config, logger *slog.Logger) int {
+	path := filepath.Join(cfg.ConfigDir, usage.FileName)
+	counter, err := usage.Load(path, logger)
+	if err != nil {
+		logger.Error("failed to load usage counts", "error", err)
+		return 1
+	}
+
+	top := counter.Top(statsTop)
+	if len(top) == 0 {
+		fmt.Println("no mapping use recorded yet")
+		if !cfg.UsageStats {
+			fmt.Println("set usage_stats: true in config.yaml to start counting")
+		}
+		return 0
+	}
+
+	// Labels come from the current layout, when it still loads
+	layout, _, err := cfg.LoadLayout(cfg.Layout)
+	if err != nil {
+		logger.Debug("not showing mapping labels", "error", err)
+	}
+
+	fmt.Printf("characters typed: %d\n\n", counter.Chars())
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMBO\tUSES\tLABEL")
+	for _, entry := range top {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", entry.Combo, entry.Count, comboLabel(layout, entry.Combo))
+	}
+	w.Flush()
+	return 0
+}
+
+// comboLabel returns the label of the mapping a combo such as "shift+alt+e"
+// runs in layout, or "" when it has none.
+func comboLabel(layout *mappings.Layout, combo string) string {
+	if layout == nil {
+		return ""
+	}
+	if rest, ok := strings.CutPrefix(combo, "fn+"); ok {
+		key := strings.TrimPrefix(strings.TrimPrefix(rest, "shift+"), "alt+")
+		return layout.FnAlt[key].Label
+	}
+	if key, ok := strings.CutPrefix(combo, "shift+alt+"); ok {
+		return layout.ShiftAlt[key].Label
+	}
+	if key, ok := strings.CutPrefix(combo, "alt+"); ok {
+		return layout.Alt[key].Label
+	}
+	return ""
+}
+
+// printLearned prints the unmapped Option combos recorded in learning mode,
+// most tried first, as candidates for the layout.
+func printLearned(learned *usage.Counter) {
+	top := learned.Top(statsTop)
+	if len(top) == 0 {
+		fmt.Println("learning mode: no unmapped option combos recorded")
+		return
+	}
+
+	fmt.Println("learning mode: option combos without a mapping")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMBO\tTRIES")
+	for _, entry := range top {
+		fmt.Fprintf(w, "%s\t%d\n", entry.Combo, entry.Count)
+	}
+	w.Flush()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/uplg/asahi-map/asahimap"
+	"github.com/uplg/asahi-map/internal/usage"
+)
+
+// statusSchema versions the "ctl status --json" output. Fields may be added
+// without a bump; it changes when one is removed or changes meaning.
+const statusSchema = 1
+
+// statusReport is the "ctl status --json" output, for status bar modules.
+type statusReport struct {
+	Schema         int                   `json:"schema"`
+	Version        string                `json:"version"`
+	Enabled        bool                  `json:"enabled"`
+	Layout         string                `json:"layout"`
+	ConsumeLeftAlt bool                  `json:"consume_left_alt"`
+	Devices        []asahimap.DeviceInfo `json:"devices"`
+	Stats          asahimap.Stats        `json:"stats"`
+
+	// Usage is null unless usage_stats is on
+	Usage *usageReport `json:"usage"`
+}
+
+// usageReport holds the usage_stats counts, most used mappings first.
+type usageReport struct {
+	Chars uint64       `json:"chars"`
+	Top   []usageEntry `json:"top"`
+}
+
+type usageEntry struct {
+	Combo string `json:"combo"`
+	Count uint64 `json:"count"`
+}
+
+// formatStatusJSON renders the engine state as a statusReport; counter is
+// nil when usage_stats is off.
+func formatStatusJSON(engine *asahimap.Engine, layout string, counter *usage.Counter) (string, error) {
+	report := statusReport{
+		Schema:         statusSchema,
+		Version:        version,
+		Enabled:        engine.Enabled(),
+		Layout:         layout,
+		ConsumeLeftAlt: engine.ConsumeLeftAlt(),
+		Devices:        engine.Devices(),
+		Stats:          engine.Stats(),
+	}
+	if report.Devices == nil {
+		report.Devices = []asahimap.DeviceInfo{}
+	}
+	if counter != nil {
+		report.Usage = &usageReport{Chars: counter.Chars(), Top: []usageEntry{}}
+		for _, entry := range counter.Top(statsTop) {
+			report.Usage.Top = append(report.Usage.Top, usageEntry{Combo: entry.Combo, Count: entry.Count})
+		}
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return "", fmt.Errorf("encoding status: %w", err)
+	}
+	return string(data) + "\n", nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/uplg/asahi-map/internal/config"
+	"github.com/uplg/asahi-map/internal/handler"
+	"github.com/uplg/asahi-map/internal/keyboard"
+	"github.com/uplg/asahi-map/internal/mappings"
+)
+
+// typeCountdown leaves time to focus the app under test, and for the
+// desktop to pick up the new virtual keyboard.
+const typeCountdown = 3 * time.Second
+
+// parseTypeChar returns the character given to -type-char or, as hex such
+// as "00e9" or "U+00E9", to -type-codepoint.
+func parseTypeChar(char, codepoint string) (rune, error) {
+	switch {
+	case char != "" && codepoint != "":
+		return 0, fmt.Errorf("use either -type-char or -type-codepoint")
+	case char != "":
+		r, size := utf8.DecodeRuneInString(char)
+		if r == utf8.RuneError || size != len(char) {
+			return 0, fmt.Errorf("-type-char takes a single character, got %q", char)
+		}
+		return r, nil
+	}
+	hex := strings.TrimPrefix(strings.ToUpper(codepoint), "U+")
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || !utf8.ValidRune(rune(n)) {
+		return 0, fmt.Errorf("invalid codepoint %q", codepoint)
+	}
+	return rune(n), nil
+}
+
+// runTypeChar types r once into the focused app through the configured
+// Unicode entry and output backend, as a mapping would, without grabbing
+// any keyboard.
+func runTypeChar(cfg *config.Config, layout *mappings.Layout, r rune, logger *slog.Logger) int {
+	if !mappings.IsSafeRune(r) {
+		logger.Error("refusing to type a control or format character", "codepoint", fmt.Sprintf("U+%04X", r))
+		return 1
+	}
+	entry, err := keyboard.UnicodeEntryFor(cfg.UnicodeInput)
+	if err == nil {
+		entry, err = entry.WithConfirm(cfg.UnicodeConfirm)
+	}
+	if err != nil {
+		logger.Error("invalid unicode entry settings", "error", err)
+		return 1
+	}
+
+	vkb, err := keyboard.NewVirtualKeyboard(logger)
+	if err != nil {
+		logger.Error("failed to create virtual keyboard (is /dev/uinput writable?)", "error", err)
+		return 1
+	}
+	vkb.SetUnicodeEntry(entry)
+	if cfg.IMEConfirm != "" {
+		if ime, err := keyboard.NewFcitxIME(); err != nil {
+			logger.Warn("input method detection unavailable", "error", err)
+		} else if err := vkb.SetIMEConfirm(cfg.IMEConfirm, ime.Active); err != nil {
+			vkb.Close()
+			logger.Error("invalid ime confirm key", "error", err)
+			return 1
+		}
+	}
+	vkb.SetRateLimit(cfg.MaxEventsPerSec)
+	vkb.SetHoldDuration(time.Duration(cfg.InjectHoldMs) * time.Millisecond)
+
+	backend := cfg.OutputBackend
+	if backend == "" {
+		backend = keyboard.BackendHex
+	}
+	if err := keyboard.CheckTextBackend(backend); err != nil {
+		logger.Warn("ignoring output backend", "backend", backend, "error", err)
+		backend = keyboard.BackendHex
+	}
+	var out keyboard.Outputter = vkb
+	if out, err = keyboard.WithTextBackend(vkb, backend); err != nil {
+		logger.Warn("output backend unavailable, using hex entry", "backend", backend, "error", err)
+		out, backend = vkb, keyboard.BackendHex
+	}
+	defer out.Close()
+
+	// The layout's hex digit keys, as the handler sets them at startup
+	handler.ConfigureOutput(out, mappings.NewKeyLookup(layout), cfg.HexEntryKeys, logger)
+
+	fmt.Printf("typing %q (U+%04X) with %s entry through the %s backend, focus the app to test\n", r, r, entry.Name, backend)
+	for left := typeCountdown; left > 0; left -= time.Second {
+		fmt.Printf("%d...\n", left/time.Second)
+		time.Sleep(time.Second)
+	}
+	if err := out.TypeUnicode(r); err != nil {
+		logger.Error("failed to type character", "error", err)
+		return 1
+	}
+	fmt.Println("typed")
+	return 0
+}
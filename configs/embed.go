@@ -0,0 +1,15 @@
+// Package configs embeds the default layouts and data shipped with asahi-map.
+package configs
+
+import "embed"
+
+// Layouts holds the built-in layout files under "layouts/".
+//
+//go:embed layouts/*.yaml
+var Layouts embed.FS
+
+// Emoji holds the built-in emoji shortcodes, a YAML map of shortcode to
+// emoji.
+//
+//go:embed emoji.yaml
+var Emoji []byte
@@ -7,11 +7,10 @@ toolchain go1.24.11
 require (
 	fyne.io/systray v1.12.0
 	github.com/bendahl/uinput v1.7.0
+	github.com/godbus/dbus/v5 v5.2.2
 	github.com/holoplot/go-evdev v0.0.0-20250804134636-ab1d56a1fe83
+	golang.org/x/text v0.33.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	github.com/godbus/dbus/v5 v5.2.2 // indirect
-	golang.org/x/sys v0.40.0 // indirect
-)
+require golang.org/x/sys v0.40.0 // indirect
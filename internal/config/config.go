@@ -2,32 +2,266 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/uplg/asahi-map/configs"
+	"github.com/uplg/asahi-map/internal/mappings"
+	"github.com/uplg/asahi-map/internal/schedule"
+	"github.com/uplg/asahi-map/internal/window"
 )
 
+// embeddedPrefix marks layout sources that come from the built-in set.
+const embeddedPrefix = "embedded:"
+
 // ConfigData contains user-configurable settings from YAML.
 type ConfigData struct {
-	Layout         string `yaml:"layout"`
-	LogLevel       string `yaml:"log_level"`
+	// Version is the file format, ConfigVersion for current files; older
+	// ones are upgraded when loaded
+	Version int `yaml:"version"`
+
+	Layout   string `yaml:"layout"`
+	LogLevel string `yaml:"log_level"`
+
+	// KeyboardDevice limits grabbing to one keyboard, by event path,
+	// /dev/input/by-id link (stable across reboots) or exact name; "auto"
+	// grabs every detected keyboard.
 	KeyboardDevice string `yaml:"keyboard_device"`
+
+	// Enabled is the mapping state restored at startup.
+	Enabled bool `yaml:"enabled"`
+
+	// ForceKeyboards lists device paths or names always treated as
+	// keyboards, for devices the capability check rejects.
+	ForceKeyboards []string `yaml:"force_keyboards,omitempty"`
+
+	// Seat limits grabbing to keyboards on one logind seat: "auto" uses the
+	// session's seat, "any" grabs keyboards on every seat.
+	Seat string `yaml:"seat"`
+
+	// GrabMode is "exclusive" to grab keyboards or "monitor" to read them
+	// without a grab when grabbing fails, letting original keys through.
+	GrabMode string `yaml:"grab_mode"`
+
+	// StartupDelayMs waits this long before looking for keyboards, for
+	// display managers that still hold them when the session starts.
+	StartupDelayMs int `yaml:"startup_delay_ms"`
+
+	// WaitForSession delays grabbing until a Wayland or X11 display is up,
+	// for at most a minute.
+	WaitForSession bool `yaml:"wait_for_session"`
+
+	// SelfTest checks at startup that injected key events arrive intact,
+	// logging the result, as -self-test does.
+	SelfTest bool `yaml:"self_test"`
+
+	// DisabledDevices lists keyboard names that should not be grabbed.
+	DisabledDevices []string `yaml:"disabled_devices,omitempty"`
+
+	// Remap rewrites physical keys by name for every event, e.g.
+	// capslock: leftctrl, independently of the layout.
+	Remap map[string]string `yaml:"remap,omitempty"`
+
+	Option OptionConfig `yaml:"option"`
+
+	Tray TrayConfig `yaml:"tray"`
+
+	// SuppressWhenModifiers lists modifiers (ctrl, meta, altgr) that turn
+	// the Option layer off while held, leaving their shortcuts alone.
+	SuppressWhenModifiers []string `yaml:"suppress_when_modifiers,omitempty"`
+
+	// ToggleHotkey is a chord such as "ctrl+alt+m" that turns mapping on
+	// and off from the keyboard; empty disables it.
+	ToggleHotkey string `yaml:"toggle_hotkey,omitempty"`
+
+	// UnicodeInput selects how characters are typed as hex: "auto" detects
+	// the desktop from XDG_CURRENT_DESKTOP, "gtk" or "kde" force one.
+	UnicodeInput string `yaml:"unicode_input"`
+
+	// UnicodeConfirm is the key committing hex entry: "space", "enter" or
+	// "none"; empty uses the one unicode_input implies.
+	UnicodeConfirm string `yaml:"unicode_confirm,omitempty"`
+
+	// IMEConfirm is the confirm key used instead while Fcitx 5 has an input
+	// method on, such as "enter" for CJK input; empty disables detection.
+	IMEConfirm string `yaml:"ime_confirm,omitempty"`
+
+	// OutputNormalization puts all typed text in Unicode form "nfc" or
+	// "nfd"; empty or "none" leaves it as the layout spells it.
+	OutputNormalization string `yaml:"output_normalization,omitempty"`
+
+	// HexEntryKeys sets the chord typing each hex digit during Unicode
+	// entry for all layouts, overriding their hex_keys; all of 0-f must be
+	// listed.
+	HexEntryKeys map[string]string `yaml:"hex_entry_keys,omitempty"`
+
+	// RepeatIntervalMs throttles how often a held Option combo repeats its
+	// output; 0 follows the keyboard repeat rate.
+	RepeatIntervalMs int `yaml:"repeat_interval_ms"`
+
+	// MaxEventsPerSec caps how many key presses per second are injected,
+	// delaying the rest, to contain a runaway mapping; 0 removes the cap.
+	MaxEventsPerSec int `yaml:"max_events_per_sec"`
+
+	// InjectHoldMs keeps injected key taps down this many milliseconds,
+	// for games and apps that ignore instant synthetic taps; 0 is instant.
+	InjectHoldMs int `yaml:"inject_hold_ms,omitempty"`
+
+	// OutputDevices are extra virtual keyboards that receive a copy of all
+	// output, for a VM or other consumer that grabs a single device.
+	OutputDevices []string `yaml:"output_devices,omitempty"`
+
+	// OutputBackend selects how characters are typed at startup: hex (the
+	// default), clipboard, keysym, ydotool or xtest
+	OutputBackend string `yaml:"output_backend,omitempty"`
+
+	// FeedbackOnUnmapped signals Option combos that have no mapping:
+	// "none" (debug log only), "log" or "notify" (desktop notification).
+	FeedbackOnUnmapped string `yaml:"feedback_on_unmapped"`
+
+	// RecentEvents is how many key events to keep in memory for SIGUSR1
+	// debug dumps; 0 disables the buffer.
+	RecentEvents int `yaml:"recent_events"`
+
+	// UsageStats counts which Option mappings are used in a local file in
+	// the config directory, shown by -stats. Off by default.
+	UsageStats bool `yaml:"usage_stats"`
+
+	// Learn records Option combos that have no mapping, with how often
+	// they were tried, in a local file in the config directory. Off by
+	// default; -learn turns it on for one run.
+	Learn bool `yaml:"learn"`
+
+	// DisableWhen lists rules that turn mapping off while they match.
+	DisableWhen []schedule.Rule `yaml:"disable_when,omitempty"`
+
+	// AppRules hold settings for the apps matching them, applied while
+	// one has focus.
+	AppRules []window.Rule `yaml:"app_rules,omitempty"`
+
+	// MomentaryLayout applies another layout while Option and a key are
+	// held; one entry or a list of them.
+	MomentaryLayout MomentaryLayouts `yaml:"momentary_layout,omitempty"`
+}
+
+// OptionConfig controls the behavior of the Option (Left Alt) key itself.
+type OptionConfig struct {
+	// TapAction runs when Option is tapped without using it in a combo:
+	// "none", "toggle" (enable/disable mapping), "alt" (send a bare Alt tap)
+	// or any key name from the layout key table.
+	TapAction string `yaml:"tap_action"`
+
+	// TapTimeoutMs is the longest press, in milliseconds, counted as a tap,
+	// and the longest gap between the two taps of a double tap.
+	TapTimeoutMs int `yaml:"tap_timeout_ms"`
+
+	// Activation selects when the Option layer applies: "hold" (while Left
+	// Alt is held), "double-tap" (held after a quick tap) or
+	// "double-tap-latch" (toggled by a double tap).
+	Activation string `yaml:"activation"`
+
+	// ConsumeLeftAlt makes Left Alt act as Option. When false it reaches
+	// apps as a plain Alt and mappings are off; the tray and
+	// "ctl consume-alt" change it at runtime.
+	ConsumeLeftAlt bool `yaml:"consume_left_alt"`
+
+	// EscapeModifier is "ctrl", "meta" or "altgr": holding it with Option
+	// sends the plain Alt+key instead of the mapping. "none" disables it.
+	EscapeModifier string `yaml:"escape_modifier"`
+
+	// UnmappedKeys sets, per key name, what Option plus a key without a
+	// mapping sends: "alt" (Alt+key) or "bare" (the key alone, the default)
+	UnmappedKeys map[string]string `yaml:"unmapped_keys,omitempty"`
+
+	// ExcludeNumberRow sends Option+1 to Option+0 as Alt+digit whatever
+	// the layout maps there, for app shortcuts
+	ExcludeNumberRow bool `yaml:"exclude_number_row,omitempty"`
+}
+
+// TrayConfig controls the system tray icon.
+type TrayConfig struct {
+	// Hidden runs without the icon, as with -no-tray; use toggle_hotkey to
+	// turn mapping on and off instead.
+	Hidden bool `yaml:"hidden"`
+}
+
+// MomentaryLayout is a layout applied while Option+Key is held.
+type MomentaryLayout struct {
+	Key    string `yaml:"key"`
+	Layout string `yaml:"layout"`
+}
+
+// MomentaryLayouts reads a single MomentaryLayout as well as a list.
+type MomentaryLayouts []MomentaryLayout
+
+func (m *MomentaryLayouts) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		var one MomentaryLayout
+		if err := node.Decode(&one); err != nil {
+			return err
+		}
+		*m = MomentaryLayouts{one}
+		return nil
+	}
+	var list []MomentaryLayout
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*m = list
+	return nil
 }
 
 // Config wraps ConfigData with runtime metadata.
 type Config struct {
 	ConfigData
 	ConfigDir string
+
+	// FirstRun is set when no config file was found; the layout was then
+	// detected from the system and should be saved.
+	FirstRun bool
+
+	// LayoutSource records what the first-run layout was detected from.
+	LayoutSource string
+
+	// Path is the config file that was loaded, which Save writes back;
+	// empty on first run
+	Path string
+
+	// FileVersion is the Version the loaded file was written in, before
+	// any upgrade
+	FileVersion int
 }
 
 func DefaultConfig() *Config {
 	return &Config{
 		ConfigData: ConfigData{
-			Layout:         "azerty-mac",
-			LogLevel:       "info",
-			KeyboardDevice: "auto",
+			Version:            ConfigVersion,
+			Layout:             fallbackLayout,
+			LogLevel:           "info",
+			KeyboardDevice:     "auto",
+			Seat:               "auto",
+			GrabMode:           "exclusive",
+			Enabled:            true,
+			UnicodeInput:       "auto",
+			FeedbackOnUnmapped: "none",
+			RecentEvents:       256,
+			MaxEventsPerSec:    1000,
+			Option: OptionConfig{
+				TapAction:      "none",
+				TapTimeoutMs:   200,
+				Activation:     "hold",
+				ConsumeLeftAlt: true,
+				EscapeModifier: "none",
+				UnmappedKeys:   map[string]string{"tab": "alt"},
+			},
 		},
 	}
 }
@@ -63,9 +297,13 @@ func Load(configPath string) (*Config, error) {
 	var loadedPath string
 	for _, path := range searchPaths {
 		if data, err := os.ReadFile(path); err == nil {
+			// Files without a version field predate it
+			cfg.Version = 0
 			if err := yaml.Unmarshal(data, &cfg.ConfigData); err != nil {
 				return nil, fmt.Errorf("parsing config %s: %w", path, err)
 			}
+			cfg.FileVersion = cfg.Version
+			migrate(&cfg.ConfigData)
 			loadedPath = path
 			break
 		}
@@ -73,13 +311,20 @@ func Load(configPath string) (*Config, error) {
 
 	// Set config directory based on loaded file or default
 	if loadedPath != "" {
+		cfg.Path = loadedPath
 		cfg.ConfigDir = filepath.Dir(loadedPath)
 	} else {
-		// Fallback: use executable directory
-		if exe, err := os.Executable(); err == nil {
-			cfg.ConfigDir = filepath.Join(filepath.Dir(exe), "configs")
+		// First run: pick a layout matching the system and default to the
+		// user config directory so it can be saved there
+		cfg.FirstRun = true
+		cfg.Layout, cfg.LayoutSource = DetectLayout()
+
+		if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+			cfg.ConfigDir = filepath.Join("/home", sudoUser, ".config", "asahi-map")
 		} else if home, err := os.UserHomeDir(); err == nil {
 			cfg.ConfigDir = filepath.Join(home, ".config", "asahi-map")
+		} else if exe, err := os.Executable(); err == nil {
+			cfg.ConfigDir = filepath.Join(filepath.Dir(exe), "configs")
 		} else {
 			cfg.ConfigDir = "/etc/asahi-map"
 		}
@@ -88,32 +333,236 @@ func Load(configPath string) (*Config, error) {
 	return cfg, nil
 }
 
+// LayoutDirs returns the directories searched for layout files, highest
+// priority first: user config, loaded config directory, portable and system.
+// The embedded layouts act as a final fallback and are not listed here.
+func (c *Config) LayoutDirs() []string {
+	var candidates []string
+
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		candidates = append(candidates, filepath.Join("/home", sudoUser, ".config", "asahi-map", "layouts"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".config", "asahi-map", "layouts"))
+	}
+	if c.ConfigDir != "" {
+		candidates = append(candidates, filepath.Join(c.ConfigDir, "layouts"))
+	}
+	if exe, err := os.Executable(); err == nil {
+		candidates = append(candidates, filepath.Join(filepath.Dir(exe), "configs", "layouts"))
+	}
+	candidates = append(candidates, "/etc/asahi-map/layouts")
+
+	seen := make(map[string]bool, len(candidates))
+	dirs := make([]string, 0, len(candidates))
+	for _, dir := range candidates {
+		dir = filepath.Clean(dir)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// LayoutPath returns the first existing file for layoutName across LayoutDirs.
+// If no directory has it, the path in ConfigDir is returned so callers can
+// report where the layout was expected.
 func (c *Config) LayoutPath(layoutName string) string {
+	for _, dir := range c.LayoutDirs() {
+		path := filepath.Join(dir, layoutName+".yaml")
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
 	return filepath.Join(c.ConfigDir, "layouts", layoutName+".yaml")
 }
 
-func (c *Config) AvailableLayouts() ([]string, error) {
-	layoutDir := filepath.Join(c.ConfigDir, "layouts")
-	entries, err := os.ReadDir(layoutDir)
+// LoadLayout loads layoutName from the first layout directory containing it,
+// falling back to the embedded layouts. It also returns the source the layout
+// was read from.
+func (c *Config) LoadLayout(layoutName string) (*mappings.Layout, string, error) {
+	fsys, name, source, err := c.findLayout(layoutName)
 	if err != nil {
-		return nil, fmt.Errorf("reading layouts directory: %w", err)
+		return nil, source, err
+	}
+	layout, err := mappings.LoadLayoutFS(fsys, name)
+	return layout, source, err
+}
+
+// ValidateLayout finds layoutName like LoadLayout and returns the layout
+// unvalidated with every issue Validate reports, warnings included, along
+// with the source it read.
+func (c *Config) ValidateLayout(layoutName string) (*mappings.Layout, []mappings.Issue, string, error) {
+	fsys, name, source, err := c.findLayout(layoutName)
+	if err != nil {
+		return nil, nil, source, err
+	}
+	layout, err := mappings.ReadLayoutFS(fsys, name)
+	if err != nil {
+		return nil, nil, source, err
+	}
+	return layout, layout.Validate(), source, nil
+}
+
+// findLayout locates layoutName on disk or in the embedded set, returning
+// the file system and file name to read it from and a source for messages.
+func (c *Config) findLayout(layoutName string) (fs.FS, string, string, error) {
+	path := c.LayoutPath(layoutName)
+	if _, err := os.Stat(path); err == nil {
+		return os.DirFS(filepath.Dir(path)), filepath.Base(path), path, nil
+	}
+
+	name := "layouts/" + layoutName + ".yaml"
+	if _, err := fs.Stat(configs.Layouts, name); err == nil {
+		return configs.Layouts, name, embeddedPrefix + name, nil
+	}
+
+	return nil, "", path, fmt.Errorf("layout %q not found in %v or embedded layouts", layoutName, c.LayoutDirs())
+}
+
+// MatchLayout returns the layout in names that query refers to: an exact
+// name first, else the only name starting with query, else the only name
+// containing it. Ambiguous queries list the candidates in the error.
+func MatchLayout(names []string, query string) (string, error) {
+	if slices.Contains(names, query) {
+		return query, nil
+	}
+
+	for _, match := range []func(name string) bool{
+		func(name string) bool { return strings.HasPrefix(name, query) },
+		func(name string) bool { return strings.Contains(name, query) },
+	} {
+		var candidates []string
+		for _, name := range names {
+			if match(name) {
+				candidates = append(candidates, name)
+			}
+		}
+		switch len(candidates) {
+		case 0:
+			continue
+		case 1:
+			return candidates[0], nil
+		default:
+			return "", fmt.Errorf("%q matches several layouts: %s", query, strings.Join(candidates, ", "))
+		}
 	}
+	return "", fmt.Errorf("no layout matches %q", query)
+}
 
+// AvailableLayouts lists layout names across all layout directories and the
+// embedded set, sorted. Names are de-duplicated; earlier directories shadow
+// later ones.
+// A directory that cannot be read is reported in the error, but the layouts
+// found elsewhere are still returned.
+func (c *Config) AvailableLayouts() ([]string, error) {
+	seen := make(map[string]bool)
 	var layouts []string
-	for _, entry := range entries {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".yaml" {
+	var errs []error
+
+	add := func(entries []fs.DirEntry) {
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+				continue
+			}
 			name := entry.Name()
-			layouts = append(layouts, name[:len(name)-5])
+			name = name[:len(name)-5]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			layouts = append(layouts, name)
+		}
+	}
+
+	for _, dir := range c.LayoutDirs() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			// Directories that do not exist yet (fresh install) just
+			// contribute nothing
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+				continue
+			}
+			errs = append(errs, fmt.Errorf("reading layouts directory: %w", err))
+			continue
 		}
+		add(entries)
+	}
+
+	entries, err := fs.ReadDir(configs.Layouts, "layouts")
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading embedded layouts: %w", err))
 	}
+	add(entries)
 
-	return layouts, nil
+	// Sorted as a whole so menus do not depend on which directory a
+	// layout came from
+	slices.Sort(layouts)
+	return layouts, errors.Join(errs...)
 }
 
+// MomentaryLayouts loads the momentary_layout layouts by trigger key. Entries
+// that fail to load are left out and reported in the error.
+func (c *Config) MomentaryLayouts() (map[string]*mappings.Layout, error) {
+	if len(c.MomentaryLayout) == 0 {
+		return nil, nil
+	}
+	layouts := make(map[string]*mappings.Layout, len(c.MomentaryLayout))
+	var errs []error
+	for _, m := range c.MomentaryLayout {
+		if _, ok := mappings.NameToKeyCode[m.Key]; !ok {
+			errs = append(errs, fmt.Errorf("momentary layout %s: unknown key %q", m.Layout, m.Key))
+			continue
+		}
+		if _, dup := layouts[m.Key]; dup {
+			errs = append(errs, fmt.Errorf("momentary layout %s: key %s is already used", m.Layout, m.Key))
+			continue
+		}
+		layout, source, err := c.LoadLayout(m.Layout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("momentary layout %s (%s): %w", m.Layout, source, err))
+			continue
+		}
+		layouts[m.Key] = layout
+	}
+	return layouts, errors.Join(errs...)
+}
+
+// Devices returns the keyboards to grab from keyboard_device, nil for all.
+func (c *Config) Devices() []string {
+	if c.KeyboardDevice == "" || c.KeyboardDevice == "auto" {
+		return nil
+	}
+	return []string{c.KeyboardDevice}
+}
+
+// DeviceEnabled reports whether the keyboard with the given name should be grabbed.
+func (c *Config) DeviceEnabled(name string) bool {
+	return !slices.Contains(c.DisabledDevices, name)
+}
+
+// SetDeviceEnabled records whether the keyboard with the given name should be grabbed.
+func (c *Config) SetDeviceEnabled(name string, enabled bool) {
+	c.DisabledDevices = slices.DeleteFunc(c.DisabledDevices, func(n string) bool { return n == name })
+	if !enabled {
+		c.DisabledDevices = append(c.DisabledDevices, name)
+	}
+}
+
+// Save writes the config back to Path, or on first run to config.yaml in
+// ConfigDir.
 func (c *Config) Save() error {
-	configPath := filepath.Join(c.ConfigDir, "config.yaml")
+	if c.Path != "" {
+		return c.SaveTo(c.Path)
+	}
+	return c.SaveTo(filepath.Join(c.ConfigDir, "config.yaml"))
+}
 
-	if err := os.MkdirAll(c.ConfigDir, 0755); err != nil {
+// SaveTo writes the config to configPath, creating its directory.
+func (c *Config) SaveTo(configPath string) error {
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
 		return fmt.Errorf("creating config directory: %w", err)
 	}
 
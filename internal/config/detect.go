@@ -0,0 +1,123 @@
+package config
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fallbackLayout is used when neither the XKB layout nor the locale is known.
+const fallbackLayout = "qwerty-mac"
+
+// xkbLayouts maps XKB layout codes to built-in layouts.
+var xkbLayouts = map[string]string{
+	"fr": "azerty-mac",
+	"be": "azerty-mac",
+	"us": "qwerty-mac",
+}
+
+// localeLayouts maps locales to built-in layouts. Full language_TERRITORY
+// entries are tried before the bare language.
+var localeLayouts = map[string]string{
+	"fr_FR": "azerty-mac",
+	"fr_BE": "azerty-mac",
+	"fr_LU": "azerty-mac",
+	"fr_MC": "azerty-mac",
+	"fr_CA": "qwerty-mac",
+	"fr":    "azerty-mac",
+	"en":    "qwerty-mac",
+}
+
+// DetectLayout picks a default layout for first run. The configured XKB
+// layout describes the physical keyboard best, so it is checked first, then
+// LC_ALL / LC_CTYPE / LANG. It returns the layout and what it was based on.
+func DetectLayout() (layout, source string) {
+	if xkb := detectXKBLayout(); xkb != "" {
+		if layout, ok := xkbLayouts[xkb]; ok {
+			return layout, "xkb:" + xkb
+		}
+	}
+
+	for _, env := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		locale := os.Getenv(env)
+		if locale == "" || locale == "C" || locale == "POSIX" {
+			continue
+		}
+		// Strip encoding and modifier: fr_FR.UTF-8@euro -> fr_FR
+		locale, _, _ = strings.Cut(locale, ".")
+		locale, _, _ = strings.Cut(locale, "@")
+
+		if layout, ok := localeLayouts[locale]; ok {
+			return layout, env + ":" + locale
+		}
+		lang, _, _ := strings.Cut(locale, "_")
+		if layout, ok := localeLayouts[lang]; ok {
+			return layout, env + ":" + locale
+		}
+		break
+	}
+
+	return fallbackLayout, "default"
+}
+
+// XKBLayout returns the first configured XKB layout code, e.g. "fr", or ""
+// when none is found.
+func XKBLayout() string {
+	return detectXKBLayout()
+}
+
+// detectXKBLayout returns the first configured XKB layout code, looking at
+// the environment, KDE's kxkbrc and the files written by localectl and
+// Debian's keyboard-configuration.
+func detectXKBLayout() string {
+	if layout := os.Getenv("XKB_DEFAULT_LAYOUT"); layout != "" {
+		return firstLayout(layout)
+	}
+
+	var kxkbrc []string
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		kxkbrc = append(kxkbrc, filepath.Join("/home", sudoUser, ".config", "kxkbrc"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		kxkbrc = append(kxkbrc, filepath.Join(home, ".config", "kxkbrc"))
+	}
+	for _, path := range kxkbrc {
+		if layout := scanSetting(path, "LayoutList="); layout != "" {
+			return firstLayout(layout)
+		}
+	}
+
+	if layout := scanSetting("/etc/X11/xorg.conf.d/00-keyboard.conf", `Option "XkbLayout"`); layout != "" {
+		return firstLayout(layout)
+	}
+	if layout := scanSetting("/etc/default/keyboard", "XKBLAYOUT="); layout != "" {
+		return firstLayout(layout)
+	}
+	return ""
+}
+
+// scanSetting returns the value after prefix on the first matching line of
+// path, without surrounding quotes or spaces.
+func scanSetting(path, prefix string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if value, ok := strings.CutPrefix(line, prefix); ok {
+			return strings.Trim(strings.TrimSpace(value), `"'`)
+		}
+	}
+	return ""
+}
+
+// firstLayout returns the first entry of a comma-separated XKB layout list.
+func firstLayout(list string) string {
+	first, _, _ := strings.Cut(list, ",")
+	return strings.ToLower(strings.TrimSpace(first))
+}
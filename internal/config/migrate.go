@@ -0,0 +1,25 @@
+package config
+
+// ConfigVersion is the config file format this asahi-map reads and writes.
+// Files without a version field are version 0, from before it was added.
+const ConfigVersion = 1
+
+// configMigrations upgrade config data one version at a time: entry i
+// turns version i into version i+1. Append one whenever a setting changes
+// meaning or default, so older files keep behaving as they did.
+var configMigrations = []func(*ConfigData){
+	// 0 to 1 only added the version field
+	func(*ConfigData) {},
+}
+
+// migrate upgrades data from an older file to ConfigVersion in memory.
+// Newer versions are left as they are; their unknown settings are ignored.
+func migrate(data *ConfigData) {
+	if data.Version < 0 || data.Version >= ConfigVersion {
+		return
+	}
+	for v := data.Version; v < ConfigVersion; v++ {
+		configMigrations[v](data)
+	}
+	data.Version = ConfigVersion
+}
@@ -0,0 +1,202 @@
+// Package control exposes a local Unix socket for querying and driving a
+// running asahi-map instance.
+//
+// The protocol is line based: the client sends a single line containing the
+// command and its space-separated arguments. The server answers with "ok" or
+// "error: <message>" on the first line, followed by the command output, then
+// closes the connection.
+package control
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandFunc runs a control command and returns its textual output.
+type CommandFunc func(args []string) (string, error)
+
+// Server accepts control connections on a Unix socket.
+type Server struct {
+	mu       sync.RWMutex
+	path     string
+	listener net.Listener
+	commands map[string]CommandFunc
+	logger   *slog.Logger
+}
+
+// DefaultSocketPath returns the control socket location: $ASAHI_MAP_SOCKET if
+// set, otherwise asahi-map.sock in $XDG_RUNTIME_DIR, falling back to /tmp.
+func DefaultSocketPath() string {
+	if path := os.Getenv("ASAHI_MAP_SOCKET"); path != "" {
+		return path
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "asahi-map.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("asahi-map-%d.sock", os.Getuid()))
+}
+
+// NewServer creates a server for the socket at path. It answers "help" with
+// the registered command names; call Start to listen.
+func NewServer(path string, logger *slog.Logger) *Server {
+	s := &Server{
+		path:     path,
+		commands: make(map[string]CommandFunc),
+		logger:   logger,
+	}
+	s.Handle("help", func(args []string) (string, error) {
+		return strings.Join(s.commandNames(), "\n"), nil
+	})
+	return s
+}
+
+// Handle registers a command. Registering an existing name replaces it.
+func (s *Server) Handle(name string, fn CommandFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands[name] = fn
+}
+
+// Start listens on the socket and serves connections in the background.
+// A stale socket left by a crashed instance is removed; a live one is an error.
+func (s *Server) Start() error {
+	if _, err := os.Stat(s.path); err == nil {
+		if conn, err := net.DialTimeout("unix", s.path, time.Second); err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s is in use by another instance", s.path)
+		}
+		if err := os.Remove(s.path); err != nil {
+			return fmt.Errorf("removing stale control socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("listening on control socket: %w", err)
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("setting control socket permissions: %w", err)
+	}
+
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	s.logger.Info("control socket listening", "path", s.path)
+	go s.acceptLoop(listener)
+	return nil
+}
+
+// Close stops accepting connections and removes the socket file.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	listener := s.listener
+	s.listener = nil
+	s.mu.Unlock()
+
+	if listener == nil {
+		return nil
+	}
+	return listener.Close()
+}
+
+func (s *Server) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("control socket accept failed", "error", err)
+			}
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		s.logger.Debug("control read failed", "error", err)
+		return
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fmt.Fprintln(conn, "error: empty command")
+		return
+	}
+
+	s.mu.RLock()
+	fn, ok := s.commands[fields[0]]
+	s.mu.RUnlock()
+	if !ok {
+		fmt.Fprintf(conn, "error: unknown command %q (try \"help\")\n", fields[0])
+		return
+	}
+
+	s.logger.Debug("control command", "command", fields[0], "args", fields[1:])
+	out, err := fn(fields[1:])
+	if err != nil {
+		fmt.Fprintf(conn, "error: %v\n", err)
+		return
+	}
+
+	fmt.Fprintln(conn, "ok")
+	if out != "" {
+		fmt.Fprintln(conn, strings.TrimRight(out, "\n"))
+	}
+}
+
+func (s *Server) commandNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Send runs a command against the instance listening on path and returns
+// its output. Server-side failures are returned as errors.
+func Send(path string, args []string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, 2*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("connecting to asahi-map (is it running?): %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, strings.Join(args, " ")); err != nil {
+		return "", fmt.Errorf("sending command: %w", err)
+	}
+
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("reading response: %w", err)
+	}
+
+	status, body, _ := strings.Cut(string(data), "\n")
+	if msg, isErr := strings.CutPrefix(status, "error: "); isErr {
+		return "", errors.New(msg)
+	}
+	if status != "ok" {
+		return "", fmt.Errorf("malformed response %q", status)
+	}
+	return body, nil
+}
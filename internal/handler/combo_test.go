@@ -0,0 +1,124 @@
+package handler
+
+import "testing"
+
+func TestShiftAddedWhileOptionHeld(t *testing.T) {
+	h, out := newTestHandler(t, testLayout, Options{})
+
+	send(t, h, down("leftalt"), down("e"), up("e"))
+	expectOps(t, out, "unicode €")
+
+	send(t, h, down("leftshift"))
+	expectOps(t, out, "press leftshift")
+	send(t, h, down("e"), repeat("e"), repeat("e"), up("e"))
+	expectOps(t, out, "unicode É", "unicode É", "unicode É")
+}
+
+func TestShiftChangedDuringRepeat(t *testing.T) {
+	h, out := newTestHandler(t, testLayout, Options{})
+
+	send(t, h, down("leftalt"), down("e"), repeat("e"))
+	expectOps(t, out, "unicode €", "unicode €")
+
+	send(t, h, down("leftshift"))
+	expectOps(t, out, "press leftshift")
+	send(t, h, repeat("e"), repeat("e"))
+	expectOps(t, out, "unicode É", "unicode É")
+
+	send(t, h, up("leftshift"))
+	expectOps(t, out, "release leftshift")
+	send(t, h, repeat("e"), up("e"))
+	expectOps(t, out, "unicode €")
+}
+
+const directKeyLayout = `name: direct keys
+alt:
+  5: {passthrough: "5", char: "{"}
+  e: {char: "{"}
+  a: {char: "æ"}
+shift_alt:
+  5: {passthrough: "5", char: "["}
+  b: {char: "["}
+  c: {char: "{"}
+`
+
+func TestDirectKeyOutput(t *testing.T) {
+	h, out := newTestHandler(t, directKeyLayout, Options{})
+
+	// A character an AltGr passthrough types is typed with that keystroke,
+	// others with Unicode entry
+	send(t, h, down("leftalt"))
+	send(t, h, tap("5", "e", "a")...)
+	expectOps(t, out, "ralt 5", "ralt 5", "unicode æ")
+
+	// With Shift held, only keystrokes that need Shift are reused
+	send(t, h, down("leftshift"))
+	expectOps(t, out, "press leftshift")
+	send(t, h, tap("b", "c")...)
+	expectOps(t, out, "shift_ralt 5 shift", "unicode {")
+}
+
+func TestOptionHeldAcrossMappings(t *testing.T) {
+	h, out := newTestHandler(t, `name: symbols
+alt:
+  e: {char: "é"}
+  a: {char: "à"}
+  u: {char: "ü"}
+`, Options{})
+
+	// Option stays held for all three and never reaches apps
+	send(t, h, down("leftalt"))
+	send(t, h, tap("e", "a", "u")...)
+	send(t, h, up("leftalt"))
+	expectOps(t, out, "unicode é", "unicode à", "unicode ü")
+}
+
+func TestSuppressModifiers(t *testing.T) {
+	h, out := newTestHandler(t, testLayout, Options{SuppressModifiers: []string{"ctrl", "meta"}})
+
+	// Option+Ctrl+e reaches apps as Ctrl+e
+	send(t, h, down("leftalt"), down("leftctrl"))
+	send(t, h, tap("e")...)
+	send(t, h, up("leftctrl"))
+	expectOps(t, out, "press leftctrl", "press e", "release e", "release leftctrl")
+
+	// Mapping resumes once Ctrl is released
+	send(t, h, tap("e")...)
+	expectOps(t, out, "unicode €")
+
+	send(t, h, down("rightctrl"))
+	send(t, h, tap("a")...)
+	send(t, h, up("rightctrl"), down("leftmeta"))
+	send(t, h, tap("5")...)
+	send(t, h, up("leftmeta"), up("leftalt"))
+	expectOps(t, out, "press rightctrl", "press a", "release a", "release rightctrl",
+		"press leftmeta", "press 5", "release 5", "release leftmeta")
+}
+
+func TestSuppressModifiersUnset(t *testing.T) {
+	h, out := newTestHandler(t, testLayout, Options{})
+
+	// Without the setting Option+Ctrl+e is still mapped
+	send(t, h, down("leftalt"), down("leftctrl"))
+	send(t, h, tap("e")...)
+	expectOps(t, out, "press leftctrl", "unicode €")
+}
+
+func TestCapsLockShiftsLetters(t *testing.T) {
+	h, out := newTestHandler(t, testLayout, Options{})
+
+	send(t, h, tap("capslock")...)
+	expectOps(t, out, "press capslock", "release capslock")
+
+	// Letters take their Shift+Option mapping, others are unchanged
+	send(t, h, down("leftalt"))
+	send(t, h, tap("a", "e", "5")...)
+	send(t, h, up("leftalt"))
+	expectOps(t, out, "unicode Æ", "unicode É", "ralt 5")
+
+	send(t, h, tap("capslock")...)
+	out.Reset()
+	send(t, h, down("leftalt"))
+	send(t, h, tap("a")...)
+	expectOps(t, out, "unicode æ")
+}
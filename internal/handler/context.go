@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/uplg/asahi-map/internal/mappings"
+)
+
+// wordRune stands in for the character a plain key typed; it depends on the
+// system keymap, which the handler does not know, and only has to be neither
+// whitespace nor opening punctuation.
+const wordRune = 'a'
+
+// printableKeys are the named keys that type a character, besides the
+// single-character letter and digit names.
+var printableKeys = map[string]bool{
+	"grave": true, "minus": true, "equal": true, "leftbrace": true,
+	"rightbrace": true, "semicolon": true, "apostrophe": true,
+	"backslash": true, "comma": true, "dot": true, "slash": true,
+	"102nd": true,
+}
+
+// cursorKeys move the cursor somewhere the handler cannot see, or delete
+// the text before it.
+var cursorKeys = map[string]bool{
+	"up": true, "down": true, "left": true, "right": true,
+	"home": true, "end": true, "pageup": true, "pagedown": true,
+	"backspace": true, "delete": true,
+}
+
+// noteKey updates lastTyped for a key press passed to apps as is.
+func (h *Handler) noteKey(keyName string) {
+	// Shortcuts type nothing
+	if h.keyState.CtrlPressed() || h.keyState.MetaPressed() {
+		return
+	}
+	switch {
+	case keyName == "space":
+		h.lastTyped = ' '
+	case keyName == "enter":
+		h.lastTyped = '\n'
+	case keyName == "tab":
+		h.lastTyped = '\t'
+	case cursorKeys[keyName]:
+		h.lastTyped = 0
+	case len(keyName) == 1 || printableKeys[keyName]:
+		h.lastTyped = wordRune
+	}
+}
+
+// noteTyped records the last character of text typed by a mapping.
+func (h *Handler) noteTyped(text string) {
+	if r, size := utf8.DecodeLastRuneInString(text); size > 0 {
+		h.lastTyped = r
+	}
+}
+
+// notePassthrough updates lastTyped for an AltGr passthrough, which types
+// the char it declares or, without one, a character only the keymap knows.
+func (h *Handler) notePassthrough(m *mappings.Mapping) {
+	if text := m.GetOutputString(); text != "" {
+		h.noteTyped(text)
+		return
+	}
+	h.lastTyped = wordRune
+}
+
+// contextOutput picks the text of m's context pair for where the cursor is.
+func (h *Handler) contextOutput(m *mappings.Mapping) string {
+	return m.ContextOutput(opensContext(h.lastTyped))
+}
+
+// opensContext reports whether a context pair typed after prev takes its
+// opening form: at the start, after whitespace or after opening punctuation
+// such as "(" or another opening quote.
+func opensContext(prev rune) bool {
+	return prev == 0 || unicode.IsSpace(prev) || unicode.In(prev, unicode.Ps, unicode.Pi)
+}
@@ -0,0 +1,36 @@
+package handler
+
+import "testing"
+
+const quoteLayout = `name: quotes
+alt:
+  apostrophe: {context_pair: ["“", "”"]}
+`
+
+func TestContextPair(t *testing.T) {
+	h, out := newTestHandler(t, quoteLayout, Options{})
+	quote := func() {
+		t.Helper()
+		send(t, h, down("leftalt"), down("apostrophe"), up("apostrophe"), up("leftalt"))
+	}
+
+	quote()
+	expectOps(t, out, "unicode “")
+	send(t, h, tap("w")...)
+	quote()
+	expectOps(t, out, "press w", "release w", "unicode ”")
+	send(t, h, tap("space")...)
+	quote()
+	expectOps(t, out, "press space", "release space", "unicode “")
+}
+
+func TestContextResetByEditingKeys(t *testing.T) {
+	h, out := newTestHandler(t, quoteLayout, Options{})
+
+	// After each of these, what is before the cursor is unknown
+	for _, key := range []string{"backspace", "delete", "home", "end", "pageup", "pagedown", "left"} {
+		send(t, h, tap("w", key)...)
+		send(t, h, down("leftalt"), down("apostrophe"), up("apostrophe"), up("leftalt"))
+		expectOps(t, out, "press w", "release w", "press "+key, "release "+key, "unicode “")
+	}
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/uplg/asahi-map/configs"
+)
+
+const deadKeyLayout = `name: dead keys
+alt:
+  e: {dead_key: true, dead_key_id: acute}
+dead_keys:
+  acute:
+    base: "´"
+    combinations: {e: "é", a: "á"}
+`
+
+func TestDeadKeyDoublePress(t *testing.T) {
+	h, out := newTestHandler(t, deadKeyLayout, Options{})
+
+	send(t, h, down("leftalt"))
+	send(t, h, tap("e", "e")...)
+	send(t, h, up("leftalt"))
+	expectOps(t, out, "unicode ´")
+	if h.lookup.HasActiveDeadKey() {
+		t.Error("dead key still active after its second press")
+	}
+	send(t, h, tap("a")...)
+	expectOps(t, out, "press a", "release a")
+}
+
+func TestGraveDeadKey(t *testing.T) {
+	data, err := fs.ReadFile(configs.Layouts, "layouts/qwerty-mac.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, out := newTestHandler(t, string(data), Options{})
+
+	// Option+` then a types à, and the a itself is not forwarded
+	send(t, h, down("leftalt"), down("grave"), up("grave"), up("leftalt"))
+	expectOps(t, out)
+	send(t, h, tap("a")...)
+	expectOps(t, out, "string à")
+
+	send(t, h, down("leftalt"), down("grave"), up("grave"), up("leftalt"))
+	send(t, h, tap("e")...)
+	expectOps(t, out, "string è")
+
+	// Space types the bare backtick
+	send(t, h, down("leftalt"), down("grave"), up("grave"), up("leftalt"))
+	send(t, h, tap("space")...)
+	expectOps(t, out, "string `")
+}
+
+func TestDeadKeyThenDigitOrPunctuation(t *testing.T) {
+	h, out := newTestHandler(t, deadKeyLayout, Options{})
+
+	for _, key := range []string{"1", "comma", "slash"} {
+		send(t, h, down("leftalt"), down("e"), up("e"), up("leftalt"))
+		send(t, h, tap(key)...)
+		expectOps(t, out, "string ´", "press "+key, "release "+key)
+		if h.lookup.HasActiveDeadKey() {
+			t.Errorf("dead key still active after %s", key)
+		}
+	}
+}
+
+func TestDeadKeyCancelledByEscBackspaceAndKeypad(t *testing.T) {
+	h, out := newTestHandler(t, deadKeyLayout, Options{})
+
+	for _, key := range []string{"esc", "backspace", "delete", "home", "kp1", "kpenter"} {
+		send(t, h, down("leftalt"), down("e"), up("e"), up("leftalt"))
+		send(t, h, tap(key)...)
+		expectOps(t, out, "press "+key, "release "+key)
+		if h.lookup.HasActiveDeadKey() {
+			t.Errorf("dead key still active after %s", key)
+		}
+	}
+}
+
+func TestDeadKeyCapsLock(t *testing.T) {
+	h, out := newTestHandler(t, deadKeyLayout, Options{})
+
+	send(t, h, tap("capslock")...)
+	out.Reset()
+	send(t, h, down("leftalt"), down("e"), up("e"), up("leftalt"))
+	send(t, h, tap("a")...)
+	expectOps(t, out, "string Á")
+}
@@ -3,68 +3,762 @@ package handler
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/uplg/asahi-map/internal/keyboard"
 	"github.com/uplg/asahi-map/internal/mappings"
+	"golang.org/x/text/unicode/norm"
 )
 
+// maxOutputFailures is the number of consecutive failed events after which
+// the virtual keyboard is considered broken and recreated.
+const maxOutputFailures = 5
+
 // Handler processes keyboard events and applies mappings.
 type Handler struct {
 	mu       sync.RWMutex
 	lookup   *mappings.KeyLookup
-	vkb      *keyboard.VirtualKeyboard
+	vkb      keyboard.Outputter
 	keyState *keyboard.KeyState
 	enabled  bool
+	opts     Options
 	logger   *slog.Logger
 
-	// Track keys we've intercepted to properly handle release
-	interceptedKeys map[uint16]bool
+	// consumeLeftAlt is set while Left Alt acts as Option instead of
+	// reaching apps; leftAltForwarded is set while a forwarded Left Alt is
+	// down, so its release is forwarded even if consuming resumed
+	consumeLeftAlt   bool
+	leftAltForwarded bool
+
+	// down holds the keys physically held, as the keyboard sends them
+	down map[uint16]bool
+
+	// Track keys we've intercepted to properly handle release and repeat.
+	// The value is the mapping to re-run on auto-repeat, nil if none.
+	interceptedKeys map[uint16]*mappings.Mapping
+	lastRepeatAt    time.Time
+
+	// Option tap detection: when Left Alt went down and whether it was
+	// used in a combo before being released.
+	optionDownAt time.Time
+	optionUsed   bool
+
+	// Double-tap activation: when the last plain Option tap ended, whether
+	// the current press was forwarded as a real Alt, and the layer state
+	lastOptionTapAt time.Time
+	optionForwarded bool
+	optionArmed     bool
+	optionLatched   bool
+
+	// toggleHotkey is the parsed ToggleHotkey, nil when unset; hotkeyHeld
+	// is set while its key is down so the release is swallowed too
+	toggleHotkey *mappings.Chord
+	hotkeyHeld   bool
+
+	// escapeCodes are the keys of EscapeModifier, nil when unset
+	escapeCodes []uint16
+
+	// suppressCodes are the keys of SuppressModifiers
+	suppressCodes []uint16
+
+	// remap holds Options.Remap as key codes
+	remap map[uint16]uint16
+
+	// normalize applies OutputNormalization, nil when text is typed as is
+	normalize func(string) string
+
+	// hexOverride holds HexEntryKeys for the output, nil when unset
+	hexOverride map[rune]keyboard.KeyChord
+
+	// appConfirm is the focused app's Unicode confirm key, "" for the
+	// layout's
+	appConfirm string
+
+	// momentary holds MomentaryLayouts by trigger key; held lists the
+	// layers whose key is down, latest last
+	momentary map[uint16]*momentaryLayer
+	held      []*momentaryLayer
+
+	// lastTyped is the last character sent to apps as far as the handler
+	// can tell, 0 at the start or after the cursor moved; context pairs
+	// look at it
+	lastTyped rune
+
+	// altUnmapped holds the UnmappedKeys sent as Alt+key; altSent is set
+	// while a real Alt is held for them, until Option is released
+	altUnmapped map[uint16]bool
+	altSent     bool
+
+	// numberRow holds the digit keys while ExcludeNumberRow is set
+	numberRow map[uint16]bool
+
+	// outputMu serializes event handling against output recreation
+	outputMu  sync.Mutex
+	pending   *pendingNext
+	shortcode *pendingShortcode
+	// shortcodeTyped is the shortcode mapping whose emoji was typed before
+	// its closing combo; the next key press, if that combo, only closes it
+	shortcodeTyped *mappings.Mapping
+	outputFailures int
+	stats          handlerStats
+
+	// recent holds the last events for DumpRecent; nil when disabled
+	recent *eventRing
+}
+
+// Stats holds handler counters for status reporting.
+type Stats struct {
+	OutputErrors      uint64 `json:"output_errors"`
+	OutputRecreations uint64 `json:"output_recreations"`
+
+	// OutputFailing is set while the latest events failed to reach the
+	// virtual keyboard
+	OutputFailing bool `json:"output_failing"`
+
+	// LastEvent is when the latest event was handled, zero before the first
+	LastEvent time.Time `json:"last_event"`
+
+	// HandlingSince is when the event being handled arrived, zero when the
+	// loop is idle; an old value means the loop is stuck
+	HandlingSince time.Time `json:"handling_since"`
+}
+
+type handlerStats struct {
+	outputErrors      atomic.Uint64
+	outputRecreations atomic.Uint64
+	outputFailing     atomic.Bool
+
+	// Wall clock times in Unix nanoseconds, 0 when unset
+	lastEvent     atomic.Int64
+	handlingSince atomic.Int64
+}
+
+// Option layer activation modes.
+const (
+	// ActivationHold applies the Option layer while Left Alt is held.
+	ActivationHold = "hold"
+	// ActivationDoubleTap applies it while Left Alt is held after a quick
+	// tap; a single press acts as a normal Alt.
+	ActivationDoubleTap = "double-tap"
+	// ActivationDoubleTapLatch turns it on and off with a double tap.
+	ActivationDoubleTapLatch = "double-tap-latch"
+)
+
+// namedModifiers maps the modifier names of EscapeModifier and
+// SuppressModifiers to the keys that count as held.
+var namedModifiers = map[string][]uint16{
+	"":      nil,
+	"none":  nil,
+	"ctrl":  {keyboard.KEY_LEFTCTRL, keyboard.KEY_RIGHTCTRL},
+	"meta":  {keyboard.KEY_LEFTMETA, keyboard.KEY_RIGHTMETA},
+	"altgr": {keyboard.KEY_RIGHTALT},
+}
+
+// normalizations are the OutputNormalization forms.
+var normalizations = map[string]func(string) string{
+	"":     nil,
+	"none": nil,
+	"nfc":  norm.NFC.String,
+	"nfd":  norm.NFD.String,
 }
 
-func New(lookup *mappings.KeyLookup, vkb *keyboard.VirtualKeyboard, logger *slog.Logger) *Handler {
+// Options configures optional handler behavior.
+type Options struct {
+	// TapAction runs when Left Alt is tapped on its own: "none", "toggle",
+	// "alt" or a key name to tap.
+	TapAction string
+
+	// TapTimeout is the longest Left Alt press still treated as a tap, and
+	// the longest gap between the two taps of a double tap.
+	TapTimeout time.Duration
+
+	// OptionActivation is one of the Activation modes; empty means hold.
+	OptionActivation string
+
+	// ForwardLeftAlt starts the handler with Left Alt sent to apps as a
+	// plain Alt and the Option layer off; see SetConsumeLeftAlt.
+	ForwardLeftAlt bool
+
+	// EscapeModifier is a modifier ("ctrl", "meta" or "altgr") that, held
+	// with Option, skips mapping and sends the plain Alt+key to the app.
+	// Empty or "none" disables it.
+	EscapeModifier string
+
+	// Remap rewrites physical keys by name before anything else, e.g.
+	// "capslock": "leftctrl", so the rest of the handler and apps only see
+	// the target key. It only applies while mapping is enabled.
+	Remap map[string]string
+
+	// SuppressModifiers lists modifiers ("ctrl", "meta" or "altgr") that
+	// turn the Option layer off while held, so Option+Ctrl+key reaches
+	// apps as Ctrl+key instead of being mapped.
+	SuppressModifiers []string
+
+	// UnmappedKeys sets, by key name, what an Option combo without a
+	// mapping sends: "alt" for the Alt+key shortcut (Alt+Tab switches
+	// windows) or "bare" for the key alone. Unlisted keys are sent bare.
+	UnmappedKeys map[string]string
+
+	// ExcludeNumberRow takes the digit keys out of the Option layer:
+	// Option+1 to Option+0 reach apps as Alt+digit, mapped or not, while
+	// the other keys are mapped as usual.
+	ExcludeNumberRow bool
+
+	// OutputNormalization puts all typed text in Unicode normalization form
+	// "nfc" (precomposed é) or "nfd" (e followed by a combining accent),
+	// for apps or fonts that only render one of them. Empty or "none"
+	// types text as the layout spells it.
+	OutputNormalization string
+
+	// HexEntryKeys sets the chord typing each hex digit during Unicode
+	// entry for every layout, replacing their hex_keys and the AZERTY
+	// defaults. It must list all of 0-9 and a-f; an incomplete or invalid
+	// table is ignored with a warning.
+	HexEntryKeys map[string]string
+
+	// MomentaryLayouts maps a key name to a layout applied while
+	// Option+key is held, in place of the current layout, until the key
+	// is released. The key itself types nothing. Several can be held at
+	// once; the one pressed last applies.
+	MomentaryLayouts map[string]*mappings.Layout
+
+	// OnUnmapped is called with a combo such as "shift+alt+x" when an
+	// Option combo has no mapping. The key is still forwarded.
+	OnUnmapped func(combo string)
+
+	// OnMapped is called with the combo and the number of characters it
+	// typed each time an Option mapping runs, not counting auto-repeat.
+	OnMapped func(combo string, chars int)
+
+	// ToggleHotkey is a chord such as "ctrl+alt+m" that turns mapping on
+	// and off wherever it is pressed. The chord's key never reaches apps.
+	ToggleHotkey string
+
+	// OnToggle is called when the handler changes its own enabled state,
+	// so UI surfaces can follow.
+	OnToggle func(enabled bool)
+
+	// NewOutput creates a replacement virtual keyboard when the current one
+	// stops accepting events. Recreation is disabled when nil.
+	NewOutput func() (keyboard.Outputter, error)
+
+	// RecentEvents is how many raw events to keep for DumpRecent; 0 disables.
+	RecentEvents int
+
+	// RepeatInterval is the minimum time between re-runs of a held mapping
+	// on auto-repeat; 0 follows the kernel repeat rate.
+	RepeatInterval time.Duration
+}
+
+func New(lookup *mappings.KeyLookup, vkb keyboard.Outputter, opts Options, logger *slog.Logger) *Handler {
+	switch opts.OptionActivation {
+	case "", ActivationHold, ActivationDoubleTap, ActivationDoubleTapLatch:
+	default:
+		logger.Warn("unknown option activation, using hold", "activation", opts.OptionActivation)
+		opts.OptionActivation = ActivationHold
+	}
+	var hotkey *mappings.Chord
+	if opts.ToggleHotkey != "" {
+		chord, err := mappings.ParseChord(opts.ToggleHotkey)
+		if err != nil {
+			logger.Warn("ignoring toggle hotkey", "error", err)
+		} else {
+			hotkey = &chord
+		}
+	}
+	escapeCodes, ok := namedModifiers[opts.EscapeModifier]
+	if !ok {
+		logger.Warn("unknown escape modifier, ignoring", "modifier", opts.EscapeModifier)
+	}
+	var suppressCodes []uint16
+	for _, name := range opts.SuppressModifiers {
+		codes, ok := namedModifiers[name]
+		if !ok {
+			logger.Warn("unknown suppressing modifier, ignoring", "modifier", name)
+		}
+		suppressCodes = append(suppressCodes, codes...)
+	}
+	normalize, ok := normalizations[opts.OutputNormalization]
+	if !ok {
+		logger.Warn("unknown output normalization, ignoring", "normalization", opts.OutputNormalization)
+	}
+	hexOverride := parseHexOverride(opts.HexEntryKeys, logger)
+	altUnmapped := parseUnmappedKeys(opts.UnmappedKeys, logger)
+	var numberRow map[uint16]bool
+	if opts.ExcludeNumberRow {
+		numberRow = make(map[uint16]bool)
+		for _, name := range "1234567890" {
+			code := uint16(mappings.NameToKeyCode[string(name)])
+			numberRow[code] = true
+			altUnmapped[code] = true
+		}
+	}
+	setEntryKeys(vkb, lookup, hexOverride, "")
 	return &Handler{
+		hexOverride:     hexOverride,
 		lookup:          lookup,
+		momentary:       parseMomentary(opts.MomentaryLayouts, logger),
+		remap:           parseRemap(opts.Remap, logger),
+		altUnmapped:     altUnmapped,
+		numberRow:       numberRow,
+		toggleHotkey:    hotkey,
+		escapeCodes:     escapeCodes,
+		suppressCodes:   suppressCodes,
+		normalize:       normalize,
 		vkb:             vkb,
 		keyState:        &keyboard.KeyState{},
 		enabled:         true,
+		consumeLeftAlt:  !opts.ForwardLeftAlt,
+		opts:            opts,
 		logger:          logger,
-		interceptedKeys: make(map[uint16]bool),
+		interceptedKeys: make(map[uint16]*mappings.Mapping),
+		down:            make(map[uint16]bool),
+		recent:          newEventRing(opts.RecentEvents),
 	}
 }
 
 func (h *Handler) SetEnabled(enabled bool) {
+	h.outputMu.Lock()
+	defer h.outputMu.Unlock()
+	h.setEnabled(enabled)
+}
+
+// setEnabled is SetEnabled with outputMu held. Keys the handler holds down
+// are released, so none stays down in apps under the other mode.
+func (h *Handler) setEnabled(enabled bool) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
 	h.enabled = enabled
+	h.mu.Unlock()
+	h.resetState()
 	h.logger.Info("handler state changed", "enabled", enabled)
 }
 
+// ResetState drops the transient state of keys in progress: intercepted
+// keys, dead keys, a pending next table or shortcode, and the keys the
+// handler holds down on the output, which are released. Keys the user
+// holds, such as the Ctrl of a shortcut, stay down. Call it when apps may
+// have lost track of held keys, e.g. when focus moves to another window
+// while Option is down.
+func (h *Handler) ResetState() {
+	h.outputMu.Lock()
+	defer h.outputMu.Unlock()
+	h.resetState()
+}
+
+// resetState is ResetState with outputMu held.
+func (h *Handler) resetState() {
+	h.cancelNext()
+	h.shortcode = nil
+	h.shortcodeTyped = nil
+	h.lastTyped = 0
+
+	h.mu.Lock()
+	lookup := h.lookup
+	clear(h.interceptedKeys)
+	h.mu.Unlock()
+	lookup.ClearDeadKey()
+	for _, layer := range h.held {
+		layer.lookup.ClearDeadKey()
+	}
+
+	// Release the keys held on the output that the user does not hold under
+	// the same code: the Alt sent for unmapped keys (Option is the physical
+	// Left Alt) and remapped or translated keys, whose release may come
+	// back under another code after a switch
+	if h.altSent {
+		if err := h.releaseSentAlt(); err != nil {
+			h.logger.Debug("releasing held alt failed", "error", err)
+		}
+	}
+	for _, code := range h.vkb.HeldKeys() {
+		if h.down[uint16(code)] {
+			continue
+		}
+		if err := h.vkb.ForwardEvent(uint16(code), 0); err != nil {
+			h.logger.Debug("releasing held key failed", "code", code, "error", err)
+		}
+	}
+	h.logger.Debug("transient state reset")
+}
+
+// Enabled reports whether mapping is currently active.
+func (h *Handler) Enabled() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.enabled
+}
+
+// SetConsumeLeftAlt sets whether Left Alt is consumed as Option. When it
+// is not, Left Alt reaches apps as a plain Alt, so Alt+Tab and menu
+// accelerators work, and Option mappings do not apply.
+func (h *Handler) SetConsumeLeftAlt(consume bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.consumeLeftAlt = consume
+	h.logger.Info("left alt consumption changed", "consume", consume)
+}
+
+// ConsumeLeftAlt reports whether Left Alt is consumed as Option.
+func (h *Handler) ConsumeLeftAlt() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.consumeLeftAlt
+}
+
 func (h *Handler) SetLayout(lookup *mappings.KeyLookup) {
+	h.outputMu.Lock()
+	defer h.outputMu.Unlock()
+	setEntryKeys(h.vkb, lookup, h.hexOverride, h.appConfirm)
+
+	h.shortcode = nil
+	h.shortcodeTyped = nil
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.lookup = lookup
 	h.logger.Info("layout changed")
 }
 
+// ProcessEvents handles events until ctx is done or events is closed.
 func (h *Handler) ProcessEvents(ctx context.Context, events <-chan *keyboard.KeyEvent) error {
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case ev := <-events:
-			if err := h.handleEvent(ev); err != nil {
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			h.stats.handlingSince.Store(time.Now().UnixNano())
+			h.outputMu.Lock()
+			err := h.handleEvent(ev)
+			h.outputMu.Unlock()
+			h.stats.handlingSince.Store(0)
+			h.stats.lastEvent.Store(time.Now().UnixNano())
+			h.stats.outputFailing.Store(err != nil)
+			if err != nil {
 				h.logger.Error("error handling event", "error", err)
+				h.recordOutputFailure()
+			} else {
+				h.outputFailures = 0
 			}
 		}
 	}
 }
 
+// recordOutputFailure trips after maxOutputFailures consecutive errors and
+// recreates the virtual keyboard, e.g. after suspend/resume broke uinput.
+func (h *Handler) recordOutputFailure() {
+	h.stats.outputErrors.Add(1)
+	h.outputFailures++
+	if h.outputFailures < maxOutputFailures {
+		return
+	}
+	h.outputFailures = 0
+
+	h.logger.Warn("virtual keyboard keeps failing, recreating it", "failures", maxOutputFailures)
+	if err := h.RecreateOutput(); err != nil {
+		h.logger.Error("failed to recreate virtual keyboard", "error", err)
+	}
+}
+
+// RecreateOutput releases held keys, closes the virtual keyboard and
+// replaces it with a fresh one from Options.NewOutput.
+func (h *Handler) RecreateOutput() error {
+	if h.opts.NewOutput == nil {
+		return fmt.Errorf("output recreation not configured")
+	}
+
+	h.outputMu.Lock()
+	defer h.outputMu.Unlock()
+
+	if err := h.vkb.ReleaseAll(); err != nil {
+		h.logger.Debug("releasing keys on old virtual keyboard failed", "error", err)
+	}
+	h.vkb.Close()
+
+	vkb, err := h.opts.NewOutput()
+	if err != nil {
+		return err
+	}
+	h.useOutput(vkb)
+
+	h.stats.outputRecreations.Add(1)
+	h.logger.Info("virtual keyboard recreated", "recreations", h.stats.outputRecreations.Load())
+	return nil
+}
+
+// SetOutputter replaces the output, e.g. to switch how text is typed at
+// runtime. Keys the old output holds are released and it is closed.
+func (h *Handler) SetOutputter(out keyboard.Outputter) {
+	h.outputMu.Lock()
+	defer h.outputMu.Unlock()
+
+	if err := h.vkb.ReleaseAll(); err != nil {
+		h.logger.Debug("releasing keys on old output failed", "error", err)
+	}
+	if err := h.vkb.Close(); err != nil {
+		h.logger.Debug("closing old output failed", "error", err)
+	}
+	h.useOutput(out)
+}
+
+// useOutput makes out the output. Keys intercepted on the old one are
+// forgotten, as their releases cannot be matched any more. Call it with
+// outputMu held.
+func (h *Handler) useOutput(out keyboard.Outputter) {
+	h.vkb = out
+
+	h.mu.Lock()
+	setEntryKeys(out, h.lookup, h.hexOverride, h.appConfirm)
+	clear(h.interceptedKeys)
+	h.mu.Unlock()
+}
+
+// ConfigureOutput sets the keys out uses for Unicode entry as a Handler
+// does on its own output: the layout's hex digit chords, or hexEntryKeys
+// (Options.HexEntryKeys) when set, and its confirm key. It is for typing
+// through an output without a Handler.
+func ConfigureOutput(out keyboard.Outputter, lookup *mappings.KeyLookup, hexEntryKeys map[string]string, logger *slog.Logger) {
+	setEntryKeys(out, lookup, parseHexOverride(hexEntryKeys, logger), "")
+}
+
+// SetAppUnicodeConfirm sets the key committing Unicode entry in the focused
+// app by name, overriding the layout's; "" goes back to the layout's.
+func (h *Handler) SetAppUnicodeConfirm(name string) {
+	h.outputMu.Lock()
+	defer h.outputMu.Unlock()
+	h.appConfirm = name
+
+	h.mu.RLock()
+	lookup := h.lookup
+	h.mu.RUnlock()
+	setEntryKeys(h.vkb, lookup, h.hexOverride, name)
+}
+
+// setEntryKeys sets the Unicode entry keys of out for lookup. appConfirm,
+// the focused app's confirm key, wins over the layout's.
+func setEntryKeys(out keyboard.Outputter, lookup *mappings.KeyLookup, hexOverride map[rune]keyboard.KeyChord, appConfirm string) {
+	out.SetHexKeys(hexKeysFor(lookup, hexOverride))
+	confirm := lookup.UnicodeConfirm()
+	if appConfirm != "" {
+		confirm = appConfirm
+	}
+	out.SetUnicodeConfirm(confirm)
+}
+
+// parseHexOverride converts HexEntryKeys for the output, nil when unset or
+// invalid.
+func parseHexOverride(keys map[string]string, logger *slog.Logger) map[rune]keyboard.KeyChord {
+	if len(keys) == 0 {
+		return nil
+	}
+	chords, err := mappings.ParseHexEntryKeys(keys)
+	if err != nil {
+		logger.Warn("ignoring hex entry keys", "error", err)
+		return nil
+	}
+	return outputChords(chords)
+}
+
+// hexKeysFor returns the hex digit chords for the output: override when
+// set, else the layout's.
+func hexKeysFor(lookup *mappings.KeyLookup, override map[rune]keyboard.KeyChord) map[rune]keyboard.KeyChord {
+	if override != nil {
+		return override
+	}
+	return outputChords(lookup.HexKeys())
+}
+
+// outputChords converts hex digit chords for the output.
+func outputChords(chords map[rune]mappings.Chord) map[rune]keyboard.KeyChord {
+	if chords == nil {
+		return nil
+	}
+	keys := make(map[rune]keyboard.KeyChord, len(chords))
+	for digit, chord := range chords {
+		mods := make([]int, len(chord.Modifiers))
+		for i, mod := range chord.Modifiers {
+			mods[i] = int(mod)
+		}
+		keys[digit] = keyboard.KeyChord{Modifiers: mods, Key: int(chord.Key)}
+	}
+	return keys
+}
+
+// InitKeyState seeds the modifier state from keys already held on dev. Call
+// it after grabbing dev, before its events are read.
+func (h *Handler) InitKeyState(dev *keyboard.Device) error {
+	h.outputMu.Lock()
+	defer h.outputMu.Unlock()
+	return h.keyState.InitFromDevice(dev, h.translateKey)
+}
+
+// translateKey maps a physical key code to the code handleEvent sees after
+// Remap and the layout's modifier roles; ok is false for a displaced
+// modifier, which has no role.
+func (h *Handler) translateKey(code uint16) (uint16, bool) {
+	if to, ok := h.remap[code]; ok {
+		code = to
+	}
+	h.mu.RLock()
+	lookup := h.lookup
+	h.mu.RUnlock()
+	logical, displaced := lookup.TranslateModifier(mappings.KeyCode(code))
+	return uint16(logical), !displaced
+}
+
+// parseUnmappedKeys returns the key codes set to "alt" in UnmappedKeys.
+func parseUnmappedKeys(keys map[string]string, logger *slog.Logger) map[uint16]bool {
+	alt := make(map[uint16]bool)
+	for name, action := range keys {
+		code, ok := mappings.NameToKeyCode[name]
+		if !ok {
+			logger.Warn("ignoring unmapped key setting with unknown key name", "key", name)
+			continue
+		}
+		switch action {
+		case "alt":
+			alt[uint16(code)] = true
+		case "bare":
+		default:
+			logger.Warn("unknown unmapped key action, sending the key bare", "key", name, "action", action)
+		}
+	}
+	return alt
+}
+
+// parseRemap converts Remap key names to codes, skipping unknown names.
+func parseRemap(remap map[string]string, logger *slog.Logger) map[uint16]uint16 {
+	if len(remap) == 0 {
+		return nil
+	}
+	codes := make(map[uint16]uint16, len(remap))
+	for from, to := range remap {
+		fromCode, okFrom := mappings.NameToKeyCode[from]
+		toCode, okTo := mappings.NameToKeyCode[to]
+		if !okFrom || !okTo {
+			logger.Warn("ignoring remap with unknown key name", "from", from, "to", to)
+			continue
+		}
+		codes[uint16(fromCode)] = uint16(toCode)
+	}
+	return codes
+}
+
+// CloseOutput releases held keys and closes the current virtual keyboard.
+func (h *Handler) CloseOutput() error {
+	h.outputMu.Lock()
+	defer h.outputMu.Unlock()
+
+	h.cancelNext()
+
+	h.vkb.ReleaseAll()
+	return h.vkb.Close()
+}
+
+// Stats returns a snapshot of the handler counters.
+func (h *Handler) Stats() Stats {
+	return Stats{
+		OutputErrors:      h.stats.outputErrors.Load(),
+		OutputRecreations: h.stats.outputRecreations.Load(),
+		OutputFailing:     h.stats.outputFailing.Load(),
+		LastEvent:         unixTime(h.stats.lastEvent.Load()),
+		HandlingSince:     unixTime(h.stats.handlingSince.Load()),
+	}
+}
+
+// handleDisabled forwards ev exactly as the keyboard sent it, before Remap
+// and the layout's modifier roles, while mapping is off. Modifier state and
+// the toggle hotkey still follow the translated key, so the hotkey can turn
+// mapping back on and the state is right once it is.
+func (h *Handler) handleDisabled(ev *keyboard.KeyEvent) error {
+	code, ok := h.translateKey(ev.Code)
+	if !ok {
+		h.recordEvent(ev)
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	}
+	translated := *ev
+	translated.Code = code
+	h.keyState.UpdateFromEvent(&translated)
+	h.recordEvent(ev)
+
+	if h.toggleHotkey != nil && h.handleToggleHotkey(&translated) {
+		return nil
+	}
+	// A momentary layer ends with its key, even if mapping was turned off
+	// meanwhile
+	if translated.IsRelease() && h.releaseLayer(code) {
+		return nil
+	}
+	return h.vkb.ForwardEvent(ev.Code, ev.Value)
+}
+
+// unixTime converts Unix nanoseconds to a time, 0 to the zero time.
+func unixTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
 func (h *Handler) handleEvent(ev *keyboard.KeyEvent) error {
+	h.mu.RLock()
+	enabled := h.enabled
+	consumeAlt := h.consumeLeftAlt
+	lookup := h.lookup
+	h.mu.RUnlock()
+
+	if ev.IsRelease() {
+		delete(h.down, ev.Code)
+	} else {
+		h.down[ev.Code] = true
+	}
+
+	if !enabled {
+		return h.handleDisabled(ev)
+	}
+
+	// Recorded as the keyboard sent it, so a replay goes through remap
+	// and translation once
+	raw := ev
+
+	if to, ok := h.remap[ev.Code]; ok {
+		remapped := *ev
+		remapped.Code = to
+		ev = &remapped
+	}
+
+	// Apply the layout's modifier role assignments before any modifier
+	// logic, so everything below sees logical Option/Shift/Meta keys
+	logical, displaced := lookup.TranslateModifier(mappings.KeyCode(ev.Code))
+	if displaced {
+		h.recordEvent(raw)
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	}
+	if uint16(logical) != ev.Code {
+		translated := *ev
+		translated.Code = uint16(logical)
+		ev = &translated
+	}
+
+	// Modifier roles stay those of the base layout, so presses and
+	// releases pair up across a momentary layer
+	lookup = h.activeLookup(lookup)
+
 	h.keyState.UpdateFromEvent(ev)
+	h.recordEvent(raw)
 
-	keyName, hasName := mappings.KeyCodeToName[mappings.KeyCode(ev.Code)]
+	keyName, hasName := mappings.KeyName(mappings.KeyCode(ev.Code))
 	if !hasName {
 		keyName = "unknown"
 	}
@@ -76,30 +770,52 @@ func (h *Handler) handleEvent(ev *keyboard.KeyEvent) error {
 		"shift", h.keyState.ShiftPressed(),
 	)
 
-	// IMPORTANT: Don't forward Left Alt at all - we consume it entirely
-	// This prevents KDE/GTK/Qt from showing menus when Alt is pressed
-	// Users can still use Right Alt for system shortcuts
+	// Any other key pressed while Option is held makes it a hold, not a tap
+	if ev.IsPress() && ev.Code != keyboard.KEY_LEFTALT && h.keyState.LeftAltPressed() {
+		h.optionUsed = true
+	}
+
+	// Left Alt sent to apps as is, or the release of one that was
+	if ev.Code == keyboard.KEY_LEFTALT && (!consumeAlt || h.leftAltForwarded) {
+		h.leftAltForwarded = !ev.IsRelease()
+		if ev.IsRelease() {
+			h.optionArmed = false
+		}
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	}
+
 	if ev.Code == keyboard.KEY_LEFTALT {
+		if ev.IsRelease() && h.altSent {
+			if err := h.releaseSentAlt(); err != nil {
+				return err
+			}
+		}
+		switch h.opts.OptionActivation {
+		case ActivationDoubleTap, ActivationDoubleTapLatch:
+			return h.trackDoubleTap(ev)
+		}
+		// IMPORTANT: Don't forward Left Alt at all - we consume it entirely
+		// This prevents KDE/GTK/Qt from showing menus when Alt is pressed
+		// Users can still use Right Alt for system shortcuts
 		h.logger.Debug("consuming left alt (not forwarding)")
-		return nil
+		return h.trackOptionTap(ev)
 	}
 
 	if keyboard.IsModifier(ev.Code) {
 		return h.vkb.ForwardEvent(ev.Code, ev.Value)
 	}
 
-	h.mu.RLock()
-	enabled := h.enabled
-	lookup := h.lookup
-	h.mu.RUnlock()
+	if h.toggleHotkey != nil && h.handleToggleHotkey(ev) {
+		return nil
+	}
 
-	if !enabled {
-		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	if ev.IsRelease() && h.releaseLayer(ev.Code) {
+		return nil
 	}
 
 	if ev.IsRelease() {
 		h.mu.Lock()
-		wasIntercepted := h.interceptedKeys[ev.Code]
+		_, wasIntercepted := h.interceptedKeys[ev.Code]
 		delete(h.interceptedKeys, ev.Code)
 		h.mu.Unlock()
 
@@ -109,39 +825,245 @@ func (h *Handler) handleEvent(ev *keyboard.KeyEvent) error {
 		return h.vkb.ForwardEvent(ev.Code, ev.Value)
 	}
 
+	if ev.IsRepeat() {
+		h.mu.Lock()
+		mapping, intercepted := h.interceptedKeys[ev.Code]
+		h.mu.Unlock()
+		if intercepted {
+			// Shift pressed or released while the key is held switches
+			// the repeats to the other variant, as it does for plain keys
+			if mapping != nil && mapping.Repeats() && consumeAlt && h.optionLayerActive() {
+				if current, _ := h.lookupCombo(ev.Code, keyName, lookup); current != nil && current != mapping {
+					h.logger.Debug("modifiers changed while held, repeating other mapping", "key", keyName, "mapping", current)
+					mapping = current
+					h.mu.Lock()
+					h.interceptedKeys[ev.Code] = mapping
+					h.mu.Unlock()
+				}
+			}
+			return h.repeatMapping(ev, mapping, lookup)
+		}
+	}
+
 	if !ev.IsPress() {
 		return h.vkb.ForwardEvent(ev.Code, ev.Value)
 	}
 
-	if !h.keyState.LeftAltPressed() {
+	closing := h.shortcodeTyped
+	h.shortcodeTyped = nil
+
+	// A mapping waiting on its follow-up key is settled by this press
+	if h.pending != nil {
+		if consumed, err := h.resolveNext(ev); consumed || err != nil {
+			return err
+		}
+	}
+
+	// Keys typed after a shortcode mapping spell the shortcode
+	if h.shortcode != nil && (!consumeAlt || !h.optionLayerActive()) {
+		if consumed, err := h.resolveShortcode(ev, keyName); consumed || err != nil {
+			return err
+		}
+	}
+
+	if !consumeAlt || !h.optionLayerActive() {
 		if lookup.HasActiveDeadKey() {
 			return h.handleDeadKeyCombo(ev, lookup)
 		}
 		h.logger.Debug("forwarding non-alt key press", "code", ev.Code, "key", keyName, "shift", h.keyState.ShiftPressed())
+		h.noteKey(keyName)
 		return h.vkb.ForwardEvent(ev.Code, ev.Value)
 	}
 
-	keyName, ok := mappings.KeyCodeToName[mappings.KeyCode(ev.Code)]
+	if held := h.heldEscapeKeys(); len(held) > 0 {
+		return h.forwardAltChord(ev, held)
+	}
+
+	if h.suppressed() {
+		h.logger.Debug("suppressing modifier held, forwarding key", "code", ev.Code)
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	}
+
+	keyName, ok := mappings.KeyName(mappings.KeyCode(ev.Code))
 	if !ok {
 		return h.vkb.ForwardEvent(ev.Code, ev.Value)
 	}
 
-	var mapping *mappings.Mapping
-	if h.keyState.ShiftPressed() {
-		mapping = lookup.LookupShiftAlt(keyName)
-	} else {
-		mapping = lookup.LookupAlt(keyName)
+	if layer, ok := h.momentary[ev.Code]; ok {
+		return h.holdLayer(layer)
+	}
+
+	mapping, combo := h.lookupCombo(ev.Code, keyName, lookup)
+	if h.numberRow[ev.Code] {
+		mapping = nil
+	}
+
+	// Any other Option combo ends shortcode entry
+	if h.shortcode != nil && (mapping == nil || !mapping.Shortcode) {
+		if err := h.abandonShortcode(); err != nil {
+			return err
+		}
+	}
+
+	if mapping == nil && h.altUnmapped[ev.Code] {
+		return h.forwardWithAlt(ev)
+	}
+
+	// A real Alt held for an earlier Alt+key would turn anything else into
+	// shortcuts
+	if h.altSent {
+		if err := h.releaseSentAlt(); err != nil {
+			return err
+		}
 	}
 
 	if mapping == nil {
+		h.logger.Debug("unmapped option combo", "combo", combo)
+		if h.opts.OnUnmapped != nil {
+			h.opts.OnUnmapped(combo)
+		}
+		h.noteKey(keyName)
 		return h.vkb.ForwardEvent(ev.Code, ev.Value)
 	}
 
-	h.mu.Lock()
-	h.interceptedKeys[ev.Code] = true
-	h.mu.Unlock()
+	h.logger.Debug("option combo mapped", "combo", combo, "mapping", mapping)
+
+	if mapping.Shortcode {
+		h.intercept(ev.Code)
+		if mapping == closing {
+			h.logger.Debug("closing combo of a typed shortcode", "combo", combo)
+			return nil
+		}
+		if h.opts.OnMapped != nil {
+			h.opts.OnMapped(combo, 0)
+		}
+		return h.runShortcode(mapping, lookup)
+	}
+
+	// With a next table the output waits for the following key press
+	if len(mapping.Next) > 0 {
+		h.mu.Lock()
+		h.interceptedKeys[ev.Code] = nil
+		h.mu.Unlock()
+		if h.opts.OnMapped != nil {
+			h.opts.OnMapped(combo, typedChars(mapping))
+		}
+		h.startNext(mapping, ev, lookup)
+		return nil
+	}
 
-	return h.executeMapping(mapping, ev.Code, lookup)
+	// With also_forward the original key is sent too, so its release must
+	// reach the app as well and the key is not marked intercepted
+	if !mapping.AlsoForward {
+		h.mu.Lock()
+		h.interceptedKeys[ev.Code] = mapping
+		h.mu.Unlock()
+	}
+
+	if err := h.executeMapping(mapping, ev.Code, lookup); err != nil {
+		return err
+	}
+	if h.opts.OnMapped != nil {
+		h.opts.OnMapped(combo, typedChars(mapping))
+	}
+
+	if mapping.AlsoForward {
+		h.logger.Debug("also forwarding original key", "code", ev.Code, "key", keyName)
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	}
+	return nil
+}
+
+// lookupCombo returns the mapping for Option+code, named keyName, with the
+// modifiers held now, nil when there is none, and the combo name, e.g.
+// "shift+alt+e". Caps Lock counts as Shift for letters the layout maps
+// with Shift.
+func (h *Handler) lookupCombo(code uint16, keyName string, lookup *mappings.KeyLookup) (*mappings.Mapping, string) {
+	shift := h.keyState.ShiftPressed()
+	if !shift && h.capsShifted(keyName) && lookup.LookupShiftAltCode(mappings.KeyCode(code)) != nil {
+		shift = true
+	}
+	var mapping *mappings.Mapping
+	if shift {
+		mapping = lookup.LookupShiftAltCode(mappings.KeyCode(code))
+	} else {
+		mapping = lookup.LookupAltCode(mappings.KeyCode(code))
+	}
+
+	// The Fn layer wins while Fn is held, for the keys it maps
+	fn := false
+	if h.keyState.FnPressed() {
+		if fnMapping := lookup.LookupFnAltCode(mappings.KeyCode(code)); fnMapping != nil {
+			mapping = fnMapping
+			fn = true
+		}
+	}
+	return mapping, comboName(code, keyName, shift, fn)
+}
+
+// comboNames caches the combo names of keys below 256 by modifier set,
+// indexed by comboIndex, so handling a key builds no string
+var comboNames [4][256]string
+
+func init() {
+	for code, name := range mappings.KeyCodeToName {
+		if int(code) >= len(comboNames[0]) {
+			continue
+		}
+		for _, shift := range []bool{false, true} {
+			for _, fn := range []bool{false, true} {
+				comboNames[comboIndex(shift, fn)][code] = buildComboName(name, shift, fn)
+			}
+		}
+	}
+}
+
+func comboIndex(shift, fn bool) int {
+	i := 0
+	if shift {
+		i |= 1
+	}
+	if fn {
+		i |= 2
+	}
+	return i
+}
+
+// comboName returns the combo name of keyName, cached when code has one.
+func comboName(code uint16, keyName string, shift, fn bool) string {
+	if int(code) < len(comboNames[0]) {
+		if name := comboNames[comboIndex(shift, fn)][code]; name != "" {
+			return name
+		}
+	}
+	return buildComboName(keyName, shift, fn)
+}
+
+func buildComboName(keyName string, shift, fn bool) string {
+	combo := "alt+" + keyName
+	if shift {
+		combo = "shift+" + combo
+	}
+	if fn {
+		combo = "fn+" + combo
+	}
+	return combo
+}
+
+// typedChars estimates how many characters a mapping types: its text, or
+// the one character of an AltGr passthrough or sequence that does not
+// declare it.
+func typedChars(m *mappings.Mapping) int {
+	if len(m.ContextPair) == 2 {
+		return utf8.RuneCountInString(m.ContextPair[0])
+	}
+	if n := utf8.RuneCountInString(m.GetOutputString()); n > 0 || m.IsDeadKey {
+		return n
+	}
+	if m.Passthrough != "" || m.PassthroughShift != "" || len(m.Sequence) > 0 {
+		return 1
+	}
+	return 0
 }
 
 func (h *Handler) executeMapping(m *mappings.Mapping, keyCode uint16, lookup *mappings.KeyLookup) error {
@@ -149,11 +1071,12 @@ func (h *Handler) executeMapping(m *mappings.Mapping, keyCode uint16, lookup *ma
 	if m.Passthrough != "" {
 		passthroughCode, ok := mappings.NameToKeyCode[m.Passthrough]
 		if !ok {
-			h.logger.Warn("unknown passthrough key", "key", m.Passthrough)
+			h.logger.Warn("unknown passthrough key", "key", m.Passthrough, "mapping", m)
 			return nil
 		}
 		shiftPressed := h.keyState.ShiftPressed()
 		h.logger.Debug("passthrough", "from", keyCode, "to", m.Passthrough, "toCode", passthroughCode, "shift", shiftPressed)
+		h.notePassthrough(m)
 		if shiftPressed {
 			// Pass true to indicate Shift was already held by user - don't release it
 			return h.vkb.PassthroughWithShiftRAlt(int(passthroughCode), true)
@@ -166,49 +1089,533 @@ func (h *Handler) executeMapping(m *mappings.Mapping, keyCode uint16, lookup *ma
 	if m.PassthroughShift != "" {
 		passthroughCode, ok := mappings.NameToKeyCode[m.PassthroughShift]
 		if !ok {
-			h.logger.Warn("unknown passthrough_shift key", "key", m.PassthroughShift)
+			h.logger.Warn("unknown passthrough_shift key", "key", m.PassthroughShift, "mapping", m)
 			return nil
 		}
 		shiftPressed := h.keyState.ShiftPressed()
 		h.logger.Debug("passthrough_shift", "from", keyCode, "to", m.PassthroughShift, "toCode", passthroughCode, "userShift", shiftPressed)
+		h.notePassthrough(m)
 		// Always send with Shift, pass shiftPressed to indicate if user was already holding it
 		return h.vkb.PassthroughWithShiftRAlt(int(passthroughCode), shiftPressed)
 	}
 
+	// Handle keystroke sequences the system layout composes, such as an
+	// AltGr dead key then a letter
+	if steps := m.SequenceSteps(); len(steps) > 0 {
+		h.logger.Debug("passthrough sequence", "from", keyCode, "sequence", m.Sequence)
+		h.notePassthrough(m)
+		return h.playChords(steps)
+	}
+
+	// Handle key chord sequences (e.g. ctrl+shift+4)
+	if chords := m.Chords(); len(chords) > 0 {
+		return h.playChords(chords)
+	}
+
 	// Handle dead key
 	if m.IsDeadKey {
+		// The same dead key again, e.g. Option+E twice, types the accent
+		// alone instead of starting over
+		if text, repeated := lookup.RepeatDeadKey(m.DeadKeyID); repeated {
+			h.logger.Debug("dead key pressed twice", "id", m.DeadKeyID, "text", text)
+			return h.typeWithMethod(m.Method, text, lookup)
+		}
 		lookup.SetDeadKey(m.DeadKeyID)
+		if dk := lookup.ActiveDeadKey(); dk != nil {
+			h.logger.Debug("dead key active", "id", m.DeadKeyID, "deadKey", dk)
+		}
 		// Also output the base accent character
-		if r, ok := m.GetOutput(); ok {
-			return h.vkb.TypeUnicode(r)
+		return h.typeWithMethod(m.Method, m.GetOutputString(), lookup)
+	}
+
+	// Handle context pairs, e.g. “ after a space and ” after a word
+	if len(m.ContextPair) == 2 {
+		return h.typeWithMethod(m.Method, h.contextOutput(m), lookup)
+	}
+
+	// Handle auto-paired output, e.g. "()" then Left to land inside the pair
+	if m.CursorBack > 0 {
+		return h.typeThenMoveBack(m, lookup)
+	}
+
+	// Handle Unicode character
+	return h.typeWithMethod(m.Method, m.GetOutputString(), lookup)
+}
+
+// typeText types every rune of text, so combining marks after a base letter
+// are not dropped. Unsafe or empty text types nothing.
+func (h *Handler) typeText(text string, lookup *mappings.KeyLookup) error {
+	if text == "" || !h.safeToType(text, lookup) {
+		return nil
+	}
+	text = h.normalized(text)
+	for _, r := range text {
+		if err := h.typeRune(r, lookup); err != nil {
+			return err
 		}
+	}
+	h.noteTyped(text)
+	return nil
+}
+
+// typeWithMethod types text with a mapping's output method; an empty method
+// is typeText's default.
+func (h *Handler) typeWithMethod(method, text string, lookup *mappings.KeyLookup) error {
+	if method == "" {
+		return h.typeText(text, lookup)
+	}
+	if text == "" || !h.safeToType(text, lookup) {
 		return nil
 	}
+	text = h.normalized(text)
 
-	// Handle Unicode character
-	if r, ok := m.GetOutput(); ok {
-		h.logger.Debug("typing unicode", "char", string(r), "codepoint", r)
-		return h.vkb.TypeUnicode(r)
+	if method == mappings.MethodClipboard {
+		h.noteTyped(text)
+		return h.paste(text)
 	}
 
+	h.logger.Debug("typing with method", "text", text, "method", method)
+	switch method {
+	case mappings.MethodPassthrough:
+		return h.typeText(text, lookup)
+	}
+	for _, r := range text {
+		var err error
+		if method == mappings.MethodKeysym {
+			err = h.vkb.TypeKeysym(r)
+		} else {
+			err = h.vkb.TypeUnicode(r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	h.noteTyped(text)
 	return nil
 }
 
+// paste types text through the clipboard. The clipboard tool runs without
+// outputMu, which handleEvent holds, so a slow tool does not block output
+// recreation or a layout switch; events still wait for it.
+func (h *Handler) paste(text string) error {
+	out := h.vkb
+	h.outputMu.Unlock()
+	err := out.CopyText(text)
+	h.outputMu.Lock()
+	if err != nil {
+		return err
+	}
+	return h.vkb.PasteClipboard()
+}
+
+// normalized returns text in the OutputNormalization form.
+func (h *Handler) normalized(text string) string {
+	if h.normalize == nil {
+		return text
+	}
+	return h.normalize(text)
+}
+
+// typeRune types r with the AltGr keystroke the layout says produces it,
+// falling back to Unicode hex entry, which some apps do not support.
+func (h *Handler) typeRune(r rune, lookup *mappings.KeyLookup) error {
+	shiftPressed := h.keyState.ShiftPressed()
+	if key, ok := lookup.DirectKey(r); ok && (key.Shift || !shiftPressed) {
+		code := int(mappings.NameToKeyCode[key.Key])
+		h.logger.Debug("typing via direct key", "char", string(r), "key", key.Key, "shift", key.Shift)
+		if key.Shift {
+			return h.vkb.PassthroughWithShiftRAlt(code, shiftPressed)
+		}
+		return h.vkb.PassthroughWithRAlt(code)
+	}
+	h.logger.Debug("typing unicode", "char", string(r), "codepoint", r)
+	return h.vkb.TypeUnicode(r)
+}
+
+// repeatMapping re-runs a held key's mapping on auto-repeat, so holding
+// Option+5 repeats "{" instead of leaking bare "5" repeats. Mappings that
+// don't repeat (see Mapping.Repeats) swallow the repeats.
+func (h *Handler) repeatMapping(ev *keyboard.KeyEvent, m *mappings.Mapping, lookup *mappings.KeyLookup) error {
+	if m == nil || !m.Repeats() {
+		return nil
+	}
+
+	if h.opts.RepeatInterval > 0 {
+		now := ev.Time()
+		if now.Sub(h.lastRepeatAt) < h.opts.RepeatInterval {
+			return nil
+		}
+		h.lastRepeatAt = now
+	}
+
+	return h.executeMapping(m, ev.Code, lookup)
+}
+
+// playChords plays key chords in order. Shift physically held by the user is
+// lifted around chords that don't ask for it, so Shift+Option combos can
+// emit unshifted shortcuts.
+func (h *Handler) playChords(chords []mappings.Chord) error {
+	for _, chord := range chords {
+		h.logger.Debug("playing chord", "modifiers", chord.Modifiers, "key", chord.Key)
+
+		var lifted []uint16
+		if !chord.HasModifier(mappings.KEY_LEFTSHIFT) {
+			if h.keyState.LeftShift {
+				lifted = append(lifted, keyboard.KEY_LEFTSHIFT)
+			}
+			if h.keyState.RightShift {
+				lifted = append(lifted, keyboard.KEY_RIGHTSHIFT)
+			}
+		}
+		for _, code := range lifted {
+			if err := h.vkb.ForwardEvent(code, 0); err != nil {
+				return err
+			}
+		}
+
+		mods := make([]int, len(chord.Modifiers))
+		for i, mod := range chord.Modifiers {
+			mods[i] = int(mod)
+		}
+		err := h.vkb.TapChord(mods, int(chord.Key))
+
+		for _, code := range lifted {
+			if restoreErr := h.vkb.ForwardEvent(code, 1); restoreErr != nil && err == nil {
+				err = restoreErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typeThenMoveBack types the mapping's full output and taps Left CursorBack times.
+func (h *Handler) typeThenMoveBack(m *mappings.Mapping, lookup *mappings.KeyLookup) error {
+	text := m.GetOutputString()
+	if text == "" || !h.safeToType(text, lookup) {
+		return nil
+	}
+
+	h.logger.Debug("typing with cursor back", "text", text, "back", m.CursorBack)
+	typeOutput := func(text string) error { return h.vkb.TypeString(h.normalized(text)) }
+	if m.Method != "" {
+		typeOutput = func(text string) error { return h.typeWithMethod(m.Method, text, lookup) }
+	}
+	if err := typeOutput(text); err != nil {
+		return err
+	}
+	for i := 0; i < m.CursorBack; i++ {
+		if err := h.vkb.TapKey(int(mappings.KEY_LEFT)); err != nil {
+			return err
+		}
+	}
+
+	// The cursor now follows the character before the ones skipped back
+	runes := []rune(h.normalized(text))
+	h.lastTyped = 0
+	if i := len(runes) - m.CursorBack - 1; i >= 0 {
+		h.lastTyped = runes[i]
+	}
+	return nil
+}
+
+// trackOptionTap measures Left Alt presses and runs the tap action when the
+// key is released quickly without having been used in a combo.
+func (h *Handler) trackOptionTap(ev *keyboard.KeyEvent) error {
+	if h.opts.TapAction == "" || h.opts.TapAction == "none" {
+		return nil
+	}
+
+	if ev.IsPress() {
+		h.optionDownAt = ev.Time()
+		h.optionUsed = false
+		return nil
+	}
+	if !ev.IsRelease() || h.optionDownAt.IsZero() {
+		return nil
+	}
+
+	held := ev.Time().Sub(h.optionDownAt)
+	h.optionDownAt = time.Time{}
+	if h.optionUsed || held > h.opts.TapTimeout {
+		return nil
+	}
+
+	h.logger.Debug("option tapped", "action", h.opts.TapAction, "held", held)
+	return h.runTapAction(h.opts.TapAction)
+}
+
+// trackDoubleTap implements the double-tap activation modes. A lone Option
+// press is forwarded as a normal Alt; a press that quickly follows a plain
+// tap is consumed and engages (or, latching, toggles) the Option layer.
+func (h *Handler) trackDoubleTap(ev *keyboard.KeyEvent) error {
+	switch {
+	case ev.IsPress():
+		second := !h.lastOptionTapAt.IsZero() && ev.Time().Sub(h.lastOptionTapAt) <= h.opts.TapTimeout
+		h.lastOptionTapAt = time.Time{}
+		h.optionDownAt = ev.Time()
+		h.optionUsed = false
+
+		if second {
+			h.optionForwarded = false
+			if h.opts.OptionActivation == ActivationDoubleTapLatch {
+				h.optionLatched = !h.optionLatched
+				h.logger.Debug("option layer latch toggled", "latched", h.optionLatched)
+			} else {
+				h.optionArmed = true
+				h.logger.Debug("option layer engaged by double tap")
+			}
+			return nil
+		}
+		h.optionForwarded = true
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+
+	case ev.IsRelease():
+		h.optionArmed = false
+		if !h.optionForwarded {
+			return nil
+		}
+		h.optionForwarded = false
+		if !h.optionUsed && ev.Time().Sub(h.optionDownAt) <= h.opts.TapTimeout {
+			h.lastOptionTapAt = ev.Time()
+		}
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	}
+
+	// Repeats follow whatever the press did
+	if h.optionForwarded {
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	}
+	return nil
+}
+
+// optionLayerActive reports whether Option mappings apply to the next key.
+func (h *Handler) optionLayerActive() bool {
+	switch h.opts.OptionActivation {
+	case ActivationDoubleTap:
+		return h.optionArmed
+	case ActivationDoubleTapLatch:
+		// A forwarded Alt held during the latch is meant for app shortcuts
+		return h.optionLatched && !h.optionForwarded
+	}
+	return h.keyState.LeftAltPressed()
+}
+
+// heldEscapeKeys returns the escape modifier keys currently held.
+func (h *Handler) heldEscapeKeys() []uint16 {
+	var held []uint16
+	for _, code := range h.escapeCodes {
+		if h.keyState.Pressed(code) {
+			held = append(held, code)
+		}
+	}
+	return held
+}
+
+// suppressed reports whether one of the SuppressModifiers keys is held.
+func (h *Handler) suppressed() bool {
+	for _, code := range h.suppressCodes {
+		if h.keyState.Pressed(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardAltChord bypasses mapping and taps the key with Left Alt, lifting
+// the held escape keys around it so the app sees exactly Alt+key (plus
+// Shift if held). The key's release is swallowed since it was tapped here.
+func (h *Handler) forwardAltChord(ev *keyboard.KeyEvent, escape []uint16) error {
+	h.logger.Debug("escape modifier held, forwarding alt chord", "code", ev.Code)
+	h.mu.Lock()
+	h.interceptedKeys[ev.Code] = nil
+	h.mu.Unlock()
+
+	for _, code := range escape {
+		if err := h.vkb.ForwardEvent(code, 0); err != nil {
+			return err
+		}
+	}
+	err := h.vkb.TapChord([]int{int(keyboard.KEY_LEFTALT)}, int(ev.Code))
+	for _, code := range escape {
+		if downErr := h.vkb.ForwardEvent(code, 1); downErr != nil && err == nil {
+			err = downErr
+		}
+	}
+	return err
+}
+
+// forwardWithAlt sends an unmapped Option combo as Alt+key. While Option is
+// physically held a real Alt is pressed once and kept down until Option is
+// released, so Alt+Tab can cycle through windows; otherwise the chord is
+// tapped.
+func (h *Handler) forwardWithAlt(ev *keyboard.KeyEvent) error {
+	if !h.keyState.LeftAltPressed() {
+		h.mu.Lock()
+		h.interceptedKeys[ev.Code] = nil
+		h.mu.Unlock()
+		return h.vkb.TapChord([]int{int(keyboard.KEY_LEFTALT)}, int(ev.Code))
+	}
+	if !h.altSent {
+		h.logger.Debug("holding alt for unmapped key", "code", ev.Code)
+		if err := h.vkb.ForwardEvent(keyboard.KEY_LEFTALT, 1); err != nil {
+			return err
+		}
+		h.altSent = true
+	}
+	return h.vkb.ForwardEvent(ev.Code, ev.Value)
+}
+
+// releaseSentAlt releases the Alt pressed by forwardWithAlt.
+func (h *Handler) releaseSentAlt() error {
+	h.altSent = false
+	return h.vkb.ForwardEvent(keyboard.KEY_LEFTALT, 0)
+}
+
+// toggle flips mapping on or off and tells OnToggle.
+func (h *Handler) toggle() {
+	h.mu.RLock()
+	enabled := !h.enabled
+	h.mu.RUnlock()
+	h.setEnabled(enabled)
+	if h.opts.OnToggle != nil {
+		h.opts.OnToggle(enabled)
+	}
+}
+
+// handleToggleHotkey toggles mapping when ev presses the toggle hotkey with
+// exactly its modifiers held, and reports whether ev belongs to the hotkey
+// and must not be forwarded: the press, its repeats and its release.
+func (h *Handler) handleToggleHotkey(ev *keyboard.KeyEvent) bool {
+	hotkey := h.toggleHotkey
+	if ev.Code != uint16(hotkey.Key) {
+		return false
+	}
+	if !ev.IsPress() {
+		if !h.hotkeyHeld {
+			return false
+		}
+		if ev.IsRelease() {
+			h.hotkeyHeld = false
+		}
+		return true
+	}
+
+	ks := h.keyState
+	if ks.CtrlPressed() != hotkey.HasModifier(mappings.KEY_LEFTCTRL) ||
+		ks.ShiftPressed() != hotkey.HasModifier(mappings.KEY_LEFTSHIFT) ||
+		ks.LeftAltPressed() != hotkey.HasModifier(mappings.KEY_LEFTALT) ||
+		ks.RightAlt != hotkey.HasModifier(mappings.KEY_RIGHTALT) ||
+		ks.MetaPressed() != hotkey.HasModifier(mappings.KEY_LEFTMETA) {
+		return false
+	}
+
+	h.hotkeyHeld = true
+	h.logger.Debug("toggle hotkey pressed", "hotkey", h.opts.ToggleHotkey)
+	h.toggle()
+	return true
+}
+
+// runTapAction executes a configured Option tap action.
+func (h *Handler) runTapAction(action string) error {
+	switch action {
+	case "toggle":
+		h.toggle()
+		return nil
+	case "alt":
+		return h.vkb.TapKey(int(keyboard.KEY_LEFTALT))
+	}
+
+	code, ok := mappings.NameToKeyCode[action]
+	if !ok {
+		h.logger.Warn("unknown option tap action", "action", action)
+		return nil
+	}
+	return h.vkb.TapKey(int(code))
+}
+
+// capsShifted reports whether Caps Lock shifts keyName, a letter, as on
+// macOS: Option+letter takes its Shift+Option mapping and a dead key
+// composes the capital.
+func (h *Handler) capsShifted(keyName string) bool {
+	return h.keyState.CapsLockOn() && len(keyName) == 1 && keyName[0] >= 'a' && keyName[0] <= 'z'
+}
+
 // handleDeadKeyCombo processes a key after a dead key.
 func (h *Handler) handleDeadKeyCombo(ev *keyboard.KeyEvent, lookup *mappings.KeyLookup) error {
 	keyName, ok := mappings.KeyCodeToName[mappings.KeyCode(ev.Code)]
 	if !ok {
+		h.logger.Debug("dead key cleared by unnamed key", "id", lookup.ActiveDeadKeyID(), "code", ev.Code)
+		lookup.ClearDeadKey()
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	}
+	if cancelsDeadKey(keyName) {
+		h.logger.Debug("dead key cancelled", "id", lookup.ActiveDeadKeyID(), "key", keyName)
+		lookup.ClearDeadKey()
+		h.noteKey(keyName)
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	}
+
+	if dk := lookup.ActiveDeadKey(); dk.ShiftCancels && h.keyState.ShiftPressed() {
+		h.logger.Debug("shift cancels dead key", "id", lookup.ActiveDeadKeyID(), "key", keyName)
 		lookup.ClearDeadKey()
 		return h.vkb.ForwardEvent(ev.Code, ev.Value)
 	}
 
-	result, applied := lookup.ApplyDeadKey(keyName)
-	if applied {
+	shift := h.keyState.ShiftPressed() || h.capsShifted(keyName)
+	result := lookup.ApplyDeadKey(keyName, shift)
+	text, forward := result.Text, result.Forward
+	h.logger.Debug("dead key composed",
+		"id", result.ID,
+		"key", keyName,
+		"shift", shift,
+		"outcome", result.Outcome,
+		"text", text,
+		"forward", forward,
+	)
+	if !forward {
 		h.mu.Lock()
-		h.interceptedKeys[ev.Code] = true
+		h.interceptedKeys[ev.Code] = nil
 		h.mu.Unlock()
-		return h.vkb.TypeString(result)
 	}
+	if text != "" && h.safeToType(text, lookup) {
+		if err := h.vkb.TypeString(h.normalized(text)); err != nil {
+			return err
+		}
+		h.noteTyped(text)
+	}
+	if forward {
+		h.noteKey(keyName)
+		return h.vkb.ForwardEvent(ev.Code, ev.Value)
+	}
+	return nil
+}
 
-	return h.vkb.ForwardEvent(ev.Code, ev.Value)
+// cancelsDeadKey reports whether keyName drops a pending dead key without
+// typing the accent, as on macOS: Esc, Backspace and Delete, Home, End,
+// PageUp and PageDown, and the keypad keys, which had no name before they
+// could be mapped and never composed.
+func cancelsDeadKey(keyName string) bool {
+	switch keyName {
+	case "esc", "backspace", "delete", "home", "end", "pageup", "pagedown":
+		return true
+	}
+	return strings.HasPrefix(keyName, "kp")
+}
+
+// safeToType guards against typing control or bidi format characters that
+// slipped past layout validation, unless the layout explicitly allows them.
+func (h *Handler) safeToType(s string, lookup *mappings.KeyLookup) bool {
+	if lookup.AllowControlChars() {
+		return true
+	}
+	for _, r := range s {
+		if !mappings.IsSafeRune(r) {
+			h.logger.Warn("refusing to type unsafe character", "codepoint", fmt.Sprintf("U+%04X", r))
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/uplg/asahi-map/internal/keyboard"
+	"github.com/uplg/asahi-map/internal/mappings"
+)
+
+// testLayout is the layout tests get unless they bring their own.
+const testLayout = `name: test
+alt:
+  e: {char: "€"}
+  a: {char: "æ"}
+  5: {passthrough: "5"}
+shift_alt:
+  e: {char: "É"}
+  a: {char: "Æ"}
+`
+
+// newTestHandler returns a handler for the layout YAML, recording its output.
+func newTestHandler(tb testing.TB, layout string, opts Options) (*Handler, *keyboard.TraceOutput) {
+	tb.Helper()
+	l, err := mappings.LoadLayoutFS(fstest.MapFS{"test.yaml": {Data: []byte(layout)}}, "test.yaml")
+	if err != nil {
+		tb.Fatalf("loading layout: %v", err)
+	}
+	out := keyboard.NewTraceOutput(nil)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(mappings.NewKeyLookup(l), out, opts, logger), out
+}
+
+// key returns the code of a key name.
+func key(tb testing.TB, name string) uint16 {
+	tb.Helper()
+	code, ok := mappings.NameToKeyCode[name]
+	if !ok {
+		tb.Fatalf("unknown key name %q", name)
+	}
+	return uint16(code)
+}
+
+// Key events for send, by key name.
+func down(name string) keyboard.KeyEvent {
+	return keyboard.KeyEvent{Code: uint16(mappings.NameToKeyCode[name]), Value: 1}
+}
+
+func up(name string) keyboard.KeyEvent {
+	return keyboard.KeyEvent{Code: uint16(mappings.NameToKeyCode[name]), Value: 0}
+}
+
+func repeat(name string) keyboard.KeyEvent {
+	return keyboard.KeyEvent{Code: uint16(mappings.NameToKeyCode[name]), Value: 2}
+}
+
+// tap returns a press and release of each key in turn.
+func tap(names ...string) []keyboard.KeyEvent {
+	var events []keyboard.KeyEvent
+	for _, name := range names {
+		events = append(events, down(name), up(name))
+	}
+	return events
+}
+
+// send handles events as ProcessEvents would.
+func send(tb testing.TB, h *Handler, events ...keyboard.KeyEvent) {
+	tb.Helper()
+	for _, ev := range events {
+		h.outputMu.Lock()
+		err := h.handleEvent(&ev)
+		h.outputMu.Unlock()
+		if err != nil {
+			tb.Fatalf("handling %+v: %v", ev, err)
+		}
+	}
+}
+
+// ops returns the recorded output as "op arg" strings, keys by name, e.g.
+// "unicode é", "press leftalt" or "chord leftctrl+v".
+func ops(out *keyboard.TraceOutput) []string {
+	var got []string
+	for _, e := range out.Entries() {
+		op := e.Op
+		switch {
+		case e.Text != "":
+			op += " " + e.Text
+		case e.Code != 0:
+			var keys []string
+			for _, mod := range e.Modifiers {
+				keys = append(keys, mappings.KeyCodeToName[mappings.KeyCode(mod)])
+			}
+			keys = append(keys, mappings.KeyCodeToName[mappings.KeyCode(e.Code)])
+			op += " " + strings.Join(keys, "+")
+		}
+		if e.Shift {
+			op += " shift"
+		}
+		got = append(got, op)
+	}
+	return got
+}
+
+// expectOps fails unless the handler sent exactly want, then clears the
+// record.
+func expectOps(tb testing.TB, out *keyboard.TraceOutput, want ...string) {
+	tb.Helper()
+	if got := ops(out); !slices.Equal(got, want) {
+		tb.Errorf("output:\n got %q\nwant %q", got, want)
+	}
+	out.Reset()
+}
+
+// lookupComboByName is lookupCombo as it was before the code-indexed
+// tables, for BenchmarkLookupCombo.
+func (h *Handler) lookupComboByName(keyName string, lookup *mappings.KeyLookup) (*mappings.Mapping, string) {
+	shift := h.keyState.ShiftPressed()
+	var mapping *mappings.Mapping
+	if shift {
+		mapping = lookup.LookupShiftAlt(keyName)
+	} else {
+		mapping = lookup.LookupAlt(keyName)
+	}
+	fn := false
+	if h.keyState.FnPressed() {
+		if fnMapping := lookup.LookupFnAlt(keyName); fnMapping != nil {
+			mapping = fnMapping
+			fn = true
+		}
+	}
+	return mapping, buildComboName(keyName, shift, fn)
+}
+
+func BenchmarkLookupCombo(b *testing.B) {
+	h, _ := newTestHandler(b, testLayout, Options{})
+	code := key(b, "e")
+
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			keyName := mappings.KeyCodeToName[mappings.KeyCode(code)]
+			if m, _ := h.lookupComboByName(keyName, h.lookup); m == nil {
+				b.Fatal("no mapping")
+			}
+		}
+	})
+	b.Run("array", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			keyName, _ := mappings.KeyName(mappings.KeyCode(code))
+			if m, _ := h.lookupCombo(code, keyName, h.lookup); m == nil {
+				b.Fatal("no mapping")
+			}
+		}
+	})
+}
+
+// BenchmarkHandleEvent measures an Option+e press and release, which
+// looks the combo up through the code-indexed tables.
+func BenchmarkHandleEvent(b *testing.B) {
+	h, out := newTestHandler(b, testLayout, Options{})
+	send(b, h, down("leftalt"))
+	events := tap("e")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		send(b, h, events...)
+		out.Reset()
+	}
+}
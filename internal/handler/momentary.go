@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"log/slog"
+
+	"github.com/uplg/asahi-map/internal/mappings"
+)
+
+// momentaryLayer is a layout applied while its trigger key is held.
+type momentaryLayer struct {
+	code   uint16
+	name   string
+	lookup *mappings.KeyLookup
+}
+
+// parseMomentary turns Options.MomentaryLayouts into layers by key code,
+// warning about unknown keys.
+func parseMomentary(layouts map[string]*mappings.Layout, logger *slog.Logger) map[uint16]*momentaryLayer {
+	if len(layouts) == 0 {
+		return nil
+	}
+	layers := make(map[uint16]*momentaryLayer, len(layouts))
+	for key, layout := range layouts {
+		code, ok := mappings.NameToKeyCode[key]
+		if !ok || layout == nil {
+			logger.Warn("ignoring momentary layout", "key", key)
+			continue
+		}
+		layers[uint16(code)] = &momentaryLayer{code: uint16(code), name: layout.Name, lookup: mappings.NewKeyLookup(layout)}
+	}
+	return layers
+}
+
+// activeLookup returns the lookup of the latest momentary layer held, or
+// base when none is.
+func (h *Handler) activeLookup(base *mappings.KeyLookup) *mappings.KeyLookup {
+	if n := len(h.held); n > 0 {
+		return h.held[n-1].lookup
+	}
+	return base
+}
+
+// holdLayer applies the momentary layer of code until its key is released.
+// Layers held together stack, the latest on top.
+func (h *Handler) holdLayer(layer *momentaryLayer) error {
+	if err := h.abandonShortcode(); err != nil {
+		return err
+	}
+	h.intercept(layer.code)
+	h.held = append(h.held, layer)
+	h.logger.Debug("momentary layout on", "layout", layer.name, "depth", len(h.held))
+	return nil
+}
+
+// releaseLayer removes the momentary layer of code, wherever it is in the
+// stack, so releasing keys in any order leaves the others applied. It
+// reports whether code held a layer.
+func (h *Handler) releaseLayer(code uint16) bool {
+	for i, layer := range h.held {
+		if layer.code != code {
+			continue
+		}
+		h.held = append(h.held[:i], h.held[i+1:]...)
+		// A dead key started in the layer would otherwise wait for its
+		// next use
+		layer.lookup.ClearDeadKey()
+		h.mu.Lock()
+		delete(h.interceptedKeys, code)
+		h.mu.Unlock()
+		h.logger.Debug("momentary layout off", "layout", layer.name, "depth", len(h.held))
+		return true
+	}
+	return false
+}
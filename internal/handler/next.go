@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/uplg/asahi-map/internal/keyboard"
+	"github.com/uplg/asahi-map/internal/mappings"
+)
+
+// nextTimeout is how long a mapping with a next table waits for its
+// follow-up key before typing its own output.
+const nextTimeout = time.Second
+
+// pendingNext is an Option combo whose output waits on the next key, e.g.
+// Option+f waiting for "i" to type the ﬁ ligature.
+type pendingNext struct {
+	mapping *mappings.Mapping
+	lookup  *mappings.KeyLookup
+	at      time.Time
+	timer   *time.Timer
+}
+
+// startNext holds back m's output until the next key press or nextTimeout.
+func (h *Handler) startNext(m *mappings.Mapping, ev *keyboard.KeyEvent, lookup *mappings.KeyLookup) {
+	h.cancelNext()
+
+	p := &pendingNext{mapping: m, lookup: lookup, at: ev.Time()}
+	p.timer = time.AfterFunc(nextTimeout, func() {
+		h.outputMu.Lock()
+		defer h.outputMu.Unlock()
+		if h.pending != p {
+			return
+		}
+		h.pending = nil
+		h.logger.Debug("no follow-up key, typing mapping output")
+		if err := h.executeMapping(p.mapping, ev.Code, p.lookup); err != nil {
+			h.logger.Error("error typing pending mapping", "error", err)
+		}
+	})
+	h.pending = p
+}
+
+// cancelNext drops the pending mapping without typing it.
+func (h *Handler) cancelNext() {
+	if h.pending != nil {
+		h.pending.timer.Stop()
+		h.pending = nil
+	}
+}
+
+// resolveNext settles the pending mapping with the key press ev. A listed
+// follow-up key within nextTimeout types its output and is consumed;
+// otherwise the mapping's own output is typed and ev is left for normal
+// handling. It reports whether ev was consumed.
+func (h *Handler) resolveNext(ev *keyboard.KeyEvent) (bool, error) {
+	p := h.pending
+	h.cancelNext()
+
+	keyName := mappings.KeyCodeToName[mappings.KeyCode(ev.Code)]
+	if text, ok := p.mapping.Next[keyName]; ok && ev.Time().Sub(p.at) <= nextTimeout {
+		h.logger.Debug("follow-up key matched", "key", keyName, "text", text)
+		h.mu.Lock()
+		h.interceptedKeys[ev.Code] = nil
+		h.mu.Unlock()
+		return true, h.typeText(text, p.lookup)
+	}
+
+	return false, h.executeMapping(p.mapping, ev.Code, p.lookup)
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"syscall"
+	"testing"
+)
+
+const nextLayout = `name: ligatures
+alt:
+  f:
+    char: "ƒ"
+    next: {i: "ﬁ", l: "ﬂ"}
+`
+
+func TestNextLigature(t *testing.T) {
+	h, out := newTestHandler(t, nextLayout, Options{})
+
+	send(t, h, down("leftalt"), down("f"), up("f"), up("leftalt"))
+	expectOps(t, out)
+	send(t, h, tap("i")...)
+	expectOps(t, out, "unicode ﬁ")
+
+	// The follow-up key may come with Option still held
+	send(t, h, down("leftalt"), down("f"), up("f"), down("l"), up("l"), up("leftalt"))
+	expectOps(t, out, "unicode ﬂ")
+}
+
+func TestNextMismatch(t *testing.T) {
+	h, out := newTestHandler(t, nextLayout, Options{})
+
+	// Any other key types the mapping's own output, then itself
+	send(t, h, down("leftalt"), down("f"), up("f"), up("leftalt"))
+	send(t, h, tap("x")...)
+	expectOps(t, out, "unicode ƒ", "press x", "release x")
+	if h.pending != nil {
+		t.Error("mapping still pending after a mismatched key")
+	}
+
+	// So does the follow-up key once nextTimeout has passed
+	send(t, h, down("leftalt"), down("f"), up("f"), up("leftalt"))
+	late := tap("i")
+	for i := range late {
+		late[i].Timestamp = syscall.Timeval{Sec: int64(nextTimeout.Seconds()) + 1}
+	}
+	send(t, h, late...)
+	expectOps(t, out, "unicode ƒ", "press i", "release i")
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/uplg/asahi-map/internal/keyboard"
+	"github.com/uplg/asahi-map/internal/mappings"
+)
+
+// RecordedEvent is a key event captured for debugging, with the modifier
+// state after the event was applied. Code is the physical key, before Remap
+// and the layout's modifier roles, so replaying it gives the same result.
+type RecordedEvent struct {
+	Time  time.Time `json:"time"`
+	Code  uint16    `json:"code"`
+	Value int32     `json:"value"`
+	Key   string    `json:"key,omitempty"`
+	Alt   bool      `json:"alt"`
+	Shift bool      `json:"shift"`
+	Ctrl  bool      `json:"ctrl"`
+	Meta  bool      `json:"meta"`
+}
+
+// eventRing keeps the last N events in a fixed-size buffer.
+type eventRing struct {
+	mu     sync.Mutex
+	events []RecordedEvent
+	next   int
+	full   bool
+}
+
+func newEventRing(size int) *eventRing {
+	if size <= 0 {
+		return nil
+	}
+	return &eventRing{events: make([]RecordedEvent, size)}
+}
+
+func (r *eventRing) add(ev RecordedEvent) {
+	r.mu.Lock()
+	r.events[r.next] = ev
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// snapshot returns the buffered events, oldest first.
+func (r *eventRing) snapshot() []RecordedEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]RecordedEvent(nil), r.events[:r.next]...)
+	}
+	out := make([]RecordedEvent, 0, len(r.events))
+	out = append(out, r.events[r.next:]...)
+	return append(out, r.events[:r.next]...)
+}
+
+// recordEvent stores ev in the recent-events buffer, if enabled.
+func (h *Handler) recordEvent(ev *keyboard.KeyEvent) {
+	if h.recent == nil {
+		return
+	}
+	h.recent.add(RecordedEvent{
+		Time:  ev.Time(),
+		Code:  ev.Code,
+		Value: ev.Value,
+		Key:   mappings.KeyCodeToName[mappings.KeyCode(ev.Code)],
+		Alt:   h.keyState.LeftAltPressed(),
+		Shift: h.keyState.ShiftPressed(),
+		Ctrl:  h.keyState.CtrlPressed(),
+		Meta:  h.keyState.MetaPressed(),
+	})
+}
+
+// DumpRecent writes the buffered events to w as JSON lines, oldest first,
+// and returns how many were written.
+func (h *Handler) DumpRecent(w io.Writer) (int, error) {
+	if h.recent == nil {
+		return 0, nil
+	}
+
+	events := h.recent.snapshot()
+	enc := json.NewEncoder(w)
+	for i := range events {
+		if err := enc.Encode(&events[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(events), nil
+}
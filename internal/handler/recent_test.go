@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/uplg/asahi-map/internal/keyboard"
+	"github.com/uplg/asahi-map/internal/mappings"
+)
+
+func TestRecordedEventsReplay(t *testing.T) {
+	layout := `name: roles
+modifiers:
+  option: [leftmeta]
+alt:
+  e: {char: "€"}
+`
+	opts := Options{Remap: map[string]string{"capslock": "leftctrl"}, RecentEvents: 16}
+	h, out := newTestHandler(t, layout, opts)
+
+	send(t, h, down("capslock"), up("capslock"), down("leftmeta"))
+	send(t, h, tap("e")...)
+	send(t, h, up("leftmeta"))
+	want := ops(out)
+
+	var dump bytes.Buffer
+	if _, err := h.DumpRecent(&dump); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan *keyboard.KeyEvent, 16)
+	n, err := Replay(context.Background(), &dump, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+	if n != 6 {
+		t.Fatalf("replayed %d events, want 6", n)
+	}
+
+	// Physical keys are recorded, so the replay is remapped and
+	// translated once, like the original
+	replayed, replayOut := newTestHandler(t, layout, opts)
+	var codes []string
+	for ev := range events {
+		codes = append(codes, mappings.KeyCodeToName[mappings.KeyCode(ev.Code)])
+		send(t, replayed, *ev)
+	}
+	if wantCodes := []string{"capslock", "capslock", "leftmeta", "e", "e", "leftmeta"}; !slices.Equal(codes, wantCodes) {
+		t.Errorf("recorded keys %q, want %q", codes, wantCodes)
+	}
+	expectOps(t, replayOut, want...)
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/uplg/asahi-map/internal/keyboard"
+)
+
+// Replay reads events written by DumpRecent and sends them to events in
+// order, keeping their original timestamps so tap timing is reproduced.
+// It returns after the last event or when ctx is done; events is not closed.
+func Replay(ctx context.Context, r io.Reader, events chan<- *keyboard.KeyEvent) (int, error) {
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		ev := &keyboard.KeyEvent{
+			Code:      rec.Code,
+			Value:     rec.Value,
+			Timestamp: syscall.NsecToTimeval(rec.Time.UnixNano()),
+		}
+		select {
+		case events <- ev:
+			n++
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+	}
+	return n, scanner.Err()
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"github.com/uplg/asahi-map/internal/keyboard"
+	"github.com/uplg/asahi-map/internal/mappings"
+)
+
+// pendingShortcode is an emoji shortcode being typed after a shortcode
+// mapping, e.g. "smi" on the way to "smile". Its keys are held back until
+// it resolves.
+type pendingShortcode struct {
+	mapping *mappings.Mapping
+	lookup  *mappings.KeyLookup
+	code    []rune
+	keys    []keyboard.KeyChord
+}
+
+// runShortcode handles a shortcode mapping: the first press starts entry,
+// the next one closes it like the colon in ":smile:".
+func (h *Handler) runShortcode(m *mappings.Mapping, lookup *mappings.KeyLookup) error {
+	p := h.shortcode
+	if p == nil {
+		h.logger.Debug("shortcode entry started")
+		h.shortcode = &pendingShortcode{mapping: m, lookup: lookup}
+		return nil
+	}
+
+	h.shortcode = nil
+	if emoji, _ := p.lookup.MatchShortcode(string(p.code)); emoji != "" {
+		return h.typeShortcode(p, emoji)
+	}
+	return h.replayShortcode(p)
+}
+
+// resolveShortcode adds the key press ev to the pending shortcode. Keys that
+// cannot continue any shortcode end entry: the keys held back so far are
+// replayed and ev is left for normal handling. Escape cancels entry and
+// Backspace takes back the last key. It reports whether ev was consumed.
+func (h *Handler) resolveShortcode(ev *keyboard.KeyEvent, keyName string) (bool, error) {
+	p := h.shortcode
+	switch keyName {
+	case "esc":
+		h.logger.Debug("shortcode entry cancelled")
+		h.shortcode = nil
+		h.intercept(ev.Code)
+		return true, nil
+	case "backspace":
+		if len(p.code) == 0 {
+			h.shortcode = nil
+		} else {
+			p.code = p.code[:len(p.code)-1]
+			p.keys = p.keys[:len(p.keys)-1]
+		}
+		h.intercept(ev.Code)
+		return true, nil
+	}
+
+	r, ok := mappings.ShortcodeRune(keyName, h.keyState.ShiftPressed())
+	if h.keyState.CtrlPressed() || h.keyState.MetaPressed() {
+		ok = false
+	}
+	var emoji string
+	var longer bool
+	if ok {
+		emoji, longer = p.lookup.MatchShortcode(string(append(p.code, r)))
+	}
+	if emoji == "" && !longer {
+		h.shortcode = nil
+		return false, h.replayShortcode(p)
+	}
+
+	h.intercept(ev.Code)
+	p.code = append(p.code, r)
+	chord := keyboard.KeyChord{Key: int(ev.Code)}
+	if h.keyState.ShiftPressed() {
+		chord.Modifiers = []int{int(keyboard.KEY_LEFTSHIFT)}
+	}
+	p.keys = append(p.keys, chord)
+
+	// Nothing longer can follow, so there is no need to wait for the colon;
+	// if it comes next anyway, it only closes this shortcode
+	if !longer {
+		h.shortcode = nil
+		h.shortcodeTyped = p.mapping
+		return true, h.typeShortcode(p, emoji)
+	}
+	return true, nil
+}
+
+// typeShortcode types the emoji p resolved to.
+func (h *Handler) typeShortcode(p *pendingShortcode, emoji string) error {
+	h.logger.Debug("shortcode matched", "shortcode", string(p.code), "text", emoji)
+	return h.typeWithMethod(p.mapping.Method, emoji, p.lookup)
+}
+
+// abandonShortcode ends shortcode entry, replaying the keys held back.
+func (h *Handler) abandonShortcode() error {
+	p := h.shortcode
+	if p == nil {
+		return nil
+	}
+	h.shortcode = nil
+	return h.replayShortcode(p)
+}
+
+// replayShortcode types the keys of a shortcode that matched nothing, as
+// they would have been typed without shortcode entry.
+func (h *Handler) replayShortcode(p *pendingShortcode) error {
+	if len(p.keys) == 0 {
+		return nil
+	}
+	h.logger.Debug("no shortcode matched, replaying keys", "shortcode", string(p.code))
+	shiftHeld := h.keyState.ShiftPressed()
+	for _, chord := range p.keys {
+		// Shift the user holds now already applies
+		modifiers := chord.Modifiers
+		if shiftHeld {
+			modifiers = nil
+		}
+		if err := h.vkb.TapChord(modifiers, chord.Key); err != nil {
+			return err
+		}
+	}
+	h.lastTyped = wordRune
+	return nil
+}
+
+// intercept keeps the release of a consumed key press from reaching apps.
+func (h *Handler) intercept(code uint16) {
+	h.mu.Lock()
+	h.interceptedKeys[code] = nil
+	h.mu.Unlock()
+}
@@ -0,0 +1,46 @@
+package handler
+
+import "testing"
+
+const shortcodeLayout = `name: shortcodes
+alt:
+  semicolon: {shortcode: true}
+`
+
+// typeShortcodeCombo presses the shortcode combo, Option+;.
+func typeShortcodeCombo(t *testing.T, h *Handler) {
+	t.Helper()
+	send(t, h, down("leftalt"), down("semicolon"), up("semicolon"), up("leftalt"))
+}
+
+func TestShortcodeClosed(t *testing.T) {
+	h, out := newTestHandler(t, shortcodeLayout, Options{})
+
+	typeShortcodeCombo(t, h)
+	send(t, h, tap("s", "m", "i", "l", "e")...)
+	expectOps(t, out)
+	typeShortcodeCombo(t, h)
+	expectOps(t, out, "unicode 😄")
+}
+
+func TestShortcodeTypedBeforeClosingCombo(t *testing.T) {
+	h, out := newTestHandler(t, shortcodeLayout, Options{})
+
+	// Nothing continues "tada", so it is typed before the closing combo,
+	// which then only closes it
+	typeShortcodeCombo(t, h)
+	send(t, h, tap("t", "a", "d", "a")...)
+	expectOps(t, out, "unicode 🎉")
+	typeShortcodeCombo(t, h)
+	send(t, h, tap("f", "i", "r", "e")...)
+	expectOps(t, out, "press f", "release f", "press i", "release i",
+		"press r", "release r", "press e", "release e")
+
+	// Without the closing combo, the next combo starts a new shortcode
+	typeShortcodeCombo(t, h)
+	send(t, h, tap("t", "a", "d", "a", "space")...)
+	expectOps(t, out, "unicode 🎉", "press space", "release space")
+	typeShortcodeCombo(t, h)
+	send(t, h, tap("f", "i", "r", "e")...)
+	expectOps(t, out, "unicode 🔥")
+}
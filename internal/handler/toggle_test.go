@@ -0,0 +1,64 @@
+package handler
+
+import "testing"
+
+func TestDisabledForwardsRawKeys(t *testing.T) {
+	h, out := newTestHandler(t, `name: roles
+modifiers:
+  option: [leftmeta]
+  meta: [leftalt]
+alt:
+  e: {char: "€"}
+`, Options{
+		Remap:        map[string]string{"capslock": "leftctrl"},
+		ToggleHotkey: "ctrl+shift+m",
+	})
+
+	send(t, h, down("leftctrl"), down("leftshift"))
+	send(t, h, tap("m")...)
+	send(t, h, up("leftshift"), up("leftctrl"))
+	out.Reset()
+	if h.Enabled() {
+		t.Fatal("toggle hotkey did not turn mapping off")
+	}
+
+	// Neither the remap nor the modifier roles apply
+	send(t, h, down("capslock"), up("capslock"))
+	expectOps(t, out, "press capslock", "release capslock")
+	send(t, h, down("leftmeta"))
+	send(t, h, tap("e")...)
+	send(t, h, up("leftmeta"))
+	expectOps(t, out, "press leftmeta", "press e", "release e", "release leftmeta")
+
+	// The hotkey still follows the remapped Ctrl
+	send(t, h, down("capslock"), down("leftshift"))
+	send(t, h, tap("m")...)
+	send(t, h, up("leftshift"), up("capslock"))
+	if !h.Enabled() {
+		t.Fatal("toggle hotkey did not turn mapping back on")
+	}
+	out.Reset()
+	send(t, h, down("leftmeta"))
+	send(t, h, tap("e")...)
+	send(t, h, up("leftmeta"))
+	expectOps(t, out, "unicode €")
+}
+
+func TestResetStateReleasesOnlySentKeys(t *testing.T) {
+	h, out := newTestHandler(t, "name: reset\n", Options{
+		Remap:        map[string]string{"capslock": "leftctrl"},
+		UnmappedKeys: map[string]string{"tab": "alt"},
+	})
+
+	// A Ctrl the user holds, a Caps Lock sent as Ctrl, and the Alt held
+	// for Option+Tab
+	send(t, h, down("rightctrl"), down("capslock"), down("leftalt"))
+	send(t, h, tap("tab")...)
+	out.Reset()
+
+	h.ResetState()
+	expectOps(t, out, "release leftalt", "release leftctrl")
+	if held := out.HeldKeys(); len(held) != 1 || held[0] != int(key(t, "rightctrl")) {
+		t.Errorf("held after reset: %v, want only rightctrl", held)
+	}
+}
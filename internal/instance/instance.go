@@ -0,0 +1,148 @@
+// Package instance keeps one asahi-map running per user. The running
+// instance holds an flock on a PID file, so a lock left by a crashed
+// instance is free again and only its file remains.
+package instance
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RunningError reports a lock held by another live instance.
+type RunningError struct {
+	PID  int
+	Path string
+}
+
+func (e *RunningError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("asahi-map is already running (lock %s)", e.Path)
+	}
+	return fmt.Sprintf("asahi-map is already running as pid %d (lock %s)", e.PID, e.Path)
+}
+
+// Lock is the lock of the running instance.
+type Lock struct {
+	f    *os.File
+	path string
+}
+
+// DefaultPath returns the lock file location: asahi-map.pid in
+// $XDG_RUNTIME_DIR, falling back to /tmp like the control socket.
+func DefaultPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "asahi-map.pid")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("asahi-map-%d.pid", os.Getuid()))
+}
+
+// Acquire takes the lock at path and writes this process's PID in it. When
+// another instance holds it the error is a *RunningError. stalePID is the
+// PID found in a file left behind by an instance that is gone, 0 if none.
+func Acquire(path string) (l *Lock, stalePID int, err error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, 0, fmt.Errorf("opening lock file: %w", err)
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			pid := readPID(f)
+			f.Close()
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, 0, &RunningError{PID: pid, Path: path}
+			}
+			return nil, 0, fmt.Errorf("locking %s: %w", path, err)
+		}
+
+		// The holder may have removed the file between our open and flock,
+		// leaving us a lock on a file nobody else will find
+		if !samePath(f, path) {
+			f.Close()
+			continue
+		}
+
+		stalePID = readPID(f)
+		if err := writePID(f); err != nil {
+			f.Close()
+			return nil, 0, fmt.Errorf("writing lock file: %w", err)
+		}
+		return &Lock{f: f, path: path}, stalePID, nil
+	}
+}
+
+// Replace stops the instance holding the lock at path with SIGTERM and takes
+// the lock once it has exited, waiting at most timeout.
+func Replace(path string, timeout time.Duration) (*Lock, error) {
+	l, _, err := Acquire(path)
+	var running *RunningError
+	if !errors.As(err, &running) {
+		return l, err
+	}
+	if running.PID == 0 {
+		return nil, err
+	}
+	if err := syscall.Kill(running.PID, syscall.SIGTERM); err != nil {
+		return nil, fmt.Errorf("stopping pid %d: %w", running.PID, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		l, _, err = Acquire(path)
+		if !errors.As(err, &running) {
+			return l, err
+		}
+	}
+	return nil, fmt.Errorf("pid %d did not exit within %s", running.PID, timeout)
+}
+
+// Release removes the lock file and unlocks it.
+func (l *Lock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	// Removed first, so the next instance cannot open the old file once
+	// it is unlocked
+	err := os.Remove(l.path)
+	l.f.Close()
+	l.f = nil
+	return err
+}
+
+// samePath reports whether the open file is still the one at path.
+func samePath(f *os.File, path string) bool {
+	opened, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(opened, current)
+}
+
+// readPID returns the PID in a lock file, 0 when there is none.
+func readPID(f *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
+
+func writePID(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return err
+}
@@ -0,0 +1,117 @@
+package keyboard
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/uplg/asahi-map/internal/xtest"
+)
+
+// Text backends for WithTextBackend, selecting how TypeUnicode and
+// TypeString type characters. Keys are sent by the wrapped output whatever
+// the backend.
+const (
+	// BackendHex types Unicode hex entry on the virtual keyboard, the default
+	BackendHex = "hex"
+	// BackendClipboard pastes text through the clipboard
+	BackendClipboard = "clipboard"
+	// BackendKeysym types keysyms with wtype or xdotool
+	BackendKeysym = "keysym"
+	// BackendYdotool types text with ydotool, through the ydotoold daemon
+	BackendYdotool = "ydotool"
+	// BackendXTest types text through the X11 XTEST extension
+	BackendXTest = "xtest"
+)
+
+// TextBackends lists the text backends, default first.
+var TextBackends = []string{BackendHex, BackendClipboard, BackendKeysym, BackendYdotool, BackendXTest}
+
+// CheckTextBackend reports why backend cannot type text in this session, or
+// nil when its tools are there.
+func CheckTextBackend(backend string) error {
+	switch backend {
+	case BackendHex:
+		return nil
+	case BackendClipboard:
+		if onWayland() {
+			return needTool("wl-copy")
+		}
+		return needTool("xclip")
+	case BackendKeysym:
+		if onWayland() {
+			return needTool("wtype")
+		}
+		return needTool("xdotool")
+	case BackendYdotool:
+		if err := needTool("ydotool"); err != nil {
+			return err
+		}
+		if _, err := os.Stat(ydotoolSocket()); err != nil {
+			return fmt.Errorf("ydotoold is not running: %w", err)
+		}
+		return nil
+	case BackendXTest:
+		return xtest.Available()
+	}
+	return fmt.Errorf("unknown output backend %q, want one of %s", backend, strings.Join(TextBackends, ", "))
+}
+
+// needTool checks that an external helper is installed.
+func needTool(name string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%s is not installed: %w", name, err)
+	}
+	return nil
+}
+
+// ydotoolSocket returns the socket ydotoold listens on.
+func ydotoolSocket() string {
+	if socket := os.Getenv("YDOTOOL_SOCKET"); socket != "" {
+		return socket
+	}
+	return "/tmp/.ydotool_socket"
+}
+
+// WithTextBackend returns out typing text with backend instead of hex
+// entry. BackendHex and "" return out unchanged.
+func WithTextBackend(out Outputter, backend string) (Outputter, error) {
+	switch backend {
+	case "", BackendHex:
+		return out, nil
+	case BackendXTest:
+		return NewXTestOutputter(out)
+	}
+	return &backendOutput{Outputter: out, backend: backend}, nil
+}
+
+// backendOutput replaces how an Outputter types text.
+type backendOutput struct {
+	Outputter
+	backend string
+}
+
+func (b *backendOutput) TypeUnicode(r rune) error {
+	return b.TypeString(string(r))
+}
+
+func (b *backendOutput) TypeString(s string) error {
+	switch b.backend {
+	case BackendClipboard:
+		if err := b.CopyText(s); err != nil {
+			return err
+		}
+		return b.PasteClipboard()
+	case BackendKeysym:
+		for _, r := range s {
+			if err := b.TypeKeysym(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	case BackendYdotool:
+		return runTool("", "ydotool", "type", "--", s)
+	}
+	return b.Outputter.TypeString(s)
+}
@@ -5,8 +5,9 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 
@@ -14,9 +15,84 @@ import (
 )
 
 type Device struct {
-	path   string
-	device *evdev.InputDevice
-	name   string
+	mu      sync.Mutex
+	path    string
+	id      string
+	device  *evdev.InputDevice
+	name    string
+	grabbed bool
+	// monitored is set while the device is read without a grab
+	monitored bool
+	closed    bool
+	// hasFn is set for keyboards that report an Fn key, like Apple's
+	hasFn bool
+}
+
+// DeviceInfo is a snapshot of a managed device for status reporting.
+type DeviceInfo struct {
+	Path string `json:"path"`
+	// ID is the stable /dev/input/by-id link, empty when udev made none
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name"`
+	Grabbed bool   `json:"grabbed"`
+	// Monitored is set while the device is read without a grab
+	Monitored bool `json:"monitored,omitempty"`
+	// HasFn is set for keyboards that report an Fn key, like Apple's
+	HasFn bool `json:"fn,omitempty"`
+}
+
+// Active reports whether asahi-map reads the device, grabbed or not.
+func (i DeviceInfo) Active() bool {
+	return i.Grabbed || i.Monitored
+}
+
+// Ref returns the by-id link when there is one, else the event path, for
+// logs and configs that should survive event renumbering.
+func (i DeviceInfo) Ref() string {
+	if i.ID != "" {
+		return i.ID
+	}
+	return i.Path
+}
+
+// byIDDir holds udev's stable per-device links, which survive reboots and
+// reconnects unlike event node numbers.
+const byIDDir = "/dev/input/by-id"
+
+// MatchDevice reports whether spec names the device: its event path, its
+// by-id link (or any symlink resolving to its node) or its exact name.
+func MatchDevice(spec string, info DeviceInfo) bool {
+	if spec == info.Path || spec == info.Name || (info.ID != "" && spec == info.ID) {
+		return true
+	}
+	if !strings.HasPrefix(spec, "/") {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(spec)
+	return err == nil && resolved == info.Path
+}
+
+// MatchAny reports whether any of specs names the device.
+func MatchAny(specs []string, info DeviceInfo) bool {
+	return slices.ContainsFunc(specs, func(spec string) bool { return MatchDevice(spec, info) })
+}
+
+// stableIDs maps event nodes to their by-id links. Keyboards get both an
+// "-event-kbd" link and, for extra interfaces, "-if01-event-kbd" ones; the
+// shortest link wins so the main interface keeps its plain name.
+func stableIDs() map[string]string {
+	links, _ := filepath.Glob(filepath.Join(byIDDir, "*"))
+	ids := make(map[string]string)
+	for _, link := range links {
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil || !strings.HasPrefix(filepath.Base(target), "event") {
+			continue
+		}
+		if existing, ok := ids[target]; !ok || len(link) < len(existing) || (len(link) == len(existing) && link < existing) {
+			ids[target] = link
+		}
+	}
+	return ids
 }
 
 // DeviceManager handles discovery and management of keyboard devices.
@@ -24,6 +100,13 @@ type DeviceManager struct {
 	mu      sync.RWMutex
 	devices map[string]*Device
 	logger  *slog.Logger
+
+	// forced lists device paths or names treated as keyboards regardless
+	// of their capabilities
+	forced []string
+
+	// seat limits discovery to devices on this seat; AnySeat or "" for all
+	seat string
 }
 
 func NewDeviceManager(logger *slog.Logger) *DeviceManager {
@@ -33,6 +116,23 @@ func NewDeviceManager(logger *slog.Logger) *DeviceManager {
 	}
 }
 
+// SetForcedKeyboards sets device paths or exact names that FindKeyboards
+// accepts even when the capability heuristic rejects them.
+func (dm *DeviceManager) SetForcedKeyboards(forced []string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.forced = forced
+}
+
+// SetSeat limits FindKeyboards to devices udev assigned to seat, so other
+// users' keyboards on a multi-seat machine are left alone. AnySeat or ""
+// considers every device. Forced keyboards are accepted on any seat.
+func (dm *DeviceManager) SetSeat(seat string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.seat = seat
+}
+
 // FindKeyboards discovers keyboard devices in /dev/input.
 func (dm *DeviceManager) FindKeyboards() ([]*Device, error) {
 	dm.mu.Lock()
@@ -45,6 +145,7 @@ func (dm *DeviceManager) FindKeyboards() ([]*Device, error) {
 	}
 
 	var keyboards []*Device
+	ids := stableIDs()
 
 	for _, path := range matches {
 		dev, err := evdev.Open(path)
@@ -59,16 +160,27 @@ func (dm *DeviceManager) FindKeyboards() ([]*Device, error) {
 			continue
 		}
 
+		dm.logCapabilities(path, name, dev)
+
 		// Check if device has key capabilities
-		if !dm.isKeyboard(dev) {
+		info := DeviceInfo{Path: path, ID: ids[path], Name: name}
+		if MatchAny(dm.forced, info) {
+			dm.logger.Info("treating device as keyboard (forced)", "name", name, "device", info.Ref())
+		} else if !dm.isKeyboard(path, name, dev) {
+			dev.Close()
+			continue
+		} else if seat := deviceSeat(path); dm.seat != "" && dm.seat != AnySeat && seat != dm.seat {
+			dm.logger.Info("skipping keyboard on another seat", "name", name, "device", info.Ref(), "seat", seat)
 			dev.Close()
 			continue
 		}
 
 		device := &Device{
 			path:   path,
+			id:     info.ID,
 			device: dev,
 			name:   name,
+			hasFn:  hasKey(dev, KEY_FN),
 		}
 
 		// Skip virtual devices we might have created
@@ -80,92 +192,327 @@ func (dm *DeviceManager) FindKeyboards() ([]*Device, error) {
 		dm.devices[path] = device
 		keyboards = append(keyboards, device)
 
-		dm.logger.Info("found keyboard", "name", name, "path", path)
+		dm.logger.Info("found keyboard", "name", name, "device", info.Ref(), "fn", device.hasFn)
 	}
 
 	return keyboards, nil
 }
 
-func (dm *DeviceManager) isKeyboard(dev *evdev.InputDevice) bool {
-	// Check for EV_KEY capability
-	capableTypes := dev.CapableTypes()
-	for _, t := range capableTypes {
-		if t == evdev.EV_KEY {
-			// Check if it has typical keyboard keys
-			keyCodes := dev.CapableEvents(evdev.EV_KEY)
-			for _, code := range keyCodes {
-				// Look for letter keys (KEY_A through KEY_Z)
-				if code >= 30 && code <= 52 {
-					return true
-				}
-			}
+// minLetterKeys is how many of the 26 letter keys a device must report to be
+// treated as a keyboard. Keyboards that split into several event nodes often
+// give their media or system node a few stray key codes; that node is left
+// alone so its events reach the system untouched.
+const minLetterKeys = 20
+
+func (dm *DeviceManager) isKeyboard(path, name string, dev *evdev.InputDevice) bool {
+	letters := countLetterKeys(dev)
+	if letters > 0 && letters < minLetterKeys {
+		dm.logger.Debug("not grabbing secondary input node", "path", path, "name", name, "letterKeys", letters)
+	}
+	return letters >= minLetterKeys
+}
+
+// isLetterKey reports whether code is one of KEY_A..KEY_Z.
+func isLetterKey(code evdev.EvCode) bool {
+	return (code >= 16 && code <= 25) || // Q..P
+		(code >= 30 && code <= 38) || // A..L
+		(code >= 44 && code <= 50) // Z..M
+}
+
+// countLetterKeys returns how many letter keys the device can send.
+func countLetterKeys(dev *evdev.InputDevice) int {
+	letters := 0
+	for _, code := range dev.CapableEvents(evdev.EV_KEY) {
+		if isLetterKey(code) {
+			letters++
+		}
+	}
+	return letters
+}
+
+// hasKey reports whether the device can send the key code.
+func hasKey(dev *evdev.InputDevice, code uint16) bool {
+	for _, c := range dev.CapableEvents(evdev.EV_KEY) {
+		if uint16(c) == code {
+			return true
 		}
 	}
 	return false
 }
 
-// GrabDevice takes exclusive control of a device.
+// logCapabilities logs a device's event types and key count at debug level,
+// to help users fill in force_keyboards.
+func (dm *DeviceManager) logCapabilities(path, name string, dev *evdev.InputDevice) {
+	if !dm.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	var types []string
+	for _, t := range dev.CapableTypes() {
+		types = append(types, evdev.TypeName(t))
+	}
+	dm.logger.Debug("device capabilities",
+		"path", path,
+		"name", name,
+		"types", strings.Join(types, ","),
+		"keys", len(dev.CapableEvents(evdev.EV_KEY)),
+		"letterKeys", countLetterKeys(dev),
+	)
+}
+
+// GrabDevice takes exclusive control of a device, reopening it first if a
+// stopped reader closed it. Grabbing a grabbed device is a no-op.
 func (dm *DeviceManager) GrabDevice(dev *Device) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if dev.grabbed {
+		return nil
+	}
+	if dev.closed {
+		reopened, err := evdev.Open(dev.path)
+		if err != nil {
+			return fmt.Errorf("reopening device %s: %w", dev.path, err)
+		}
+		dev.device = reopened
+		dev.closed = false
+	}
+
 	if err := dev.device.Grab(); err != nil {
 		return fmt.Errorf("grabbing device %s: %w", dev.path, err)
 	}
+	dev.grabbed = true
 	dm.logger.Info("grabbed device", "name", dev.name)
 	return nil
 }
 
-// ReleaseDevice releases exclusive control of a device.
+// MonitorDevice prepares a device to be read without taking exclusive
+// control, reopening it first if a stopped reader closed it. Its events
+// keep reaching apps. Monitoring a monitored device is a no-op.
+func (dm *DeviceManager) MonitorDevice(dev *Device) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if dev.monitored {
+		return nil
+	}
+	if dev.closed {
+		reopened, err := evdev.Open(dev.path)
+		if err != nil {
+			return fmt.Errorf("reopening device %s: %w", dev.path, err)
+		}
+		dev.device = reopened
+		dev.closed = false
+	}
+	dev.monitored = true
+	dm.logger.Info("monitoring device without grab", "name", dev.name)
+	return nil
+}
+
+// ReleaseDevice releases exclusive control of a device, or stops counting
+// a monitored one as read. Releasing a device that is neither is a no-op,
+// and a closed device has already lost its grab, so releasing it only
+// updates the state.
 func (dm *DeviceManager) ReleaseDevice(dev *Device) error {
-	if err := dev.device.Ungrab(); err != nil {
-		return fmt.Errorf("releasing device %s: %w", dev.path, err)
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if dev.monitored {
+		dev.monitored = false
+		dm.logger.Info("stopped monitoring device", "name", dev.name)
+		return nil
+	}
+	if !dev.grabbed {
+		return nil
+	}
+	if !dev.closed {
+		if err := dev.device.Ungrab(); err != nil {
+			return fmt.Errorf("releasing device %s: %w", dev.path, err)
+		}
 	}
+	dev.grabbed = false
 	dm.logger.Info("released device", "name", dev.name)
 	return nil
 }
 
+// ReleaseAll releases every grabbed device, returning the first error.
+func (dm *DeviceManager) ReleaseAll() error {
+	dm.mu.RLock()
+	devices := make([]*Device, 0, len(dm.devices))
+	for _, dev := range dm.devices {
+		devices = append(devices, dev)
+	}
+	dm.mu.RUnlock()
+
+	var firstErr error
+	for _, dev := range devices {
+		if err := dm.ReleaseDevice(dev); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Device returns the managed device at path, or nil.
+func (dm *DeviceManager) Device(path string) *Device {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.devices[path]
+}
+
+// List returns a snapshot of the managed devices, sorted by path.
+func (dm *DeviceManager) List() []DeviceInfo {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	infos := make([]DeviceInfo, 0, len(dm.devices))
+	for _, dev := range dm.devices {
+		dev.mu.Lock()
+		infos = append(infos, DeviceInfo{
+			Path:      dev.path,
+			ID:        dev.id,
+			Name:      dev.name,
+			Grabbed:   dev.grabbed,
+			Monitored: dev.monitored,
+			HasFn:     dev.hasFn,
+		})
+		dev.mu.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Path < infos[j].Path })
+	return infos
+}
+
+// Remove closes dev and stops managing it, for a keyboard that went away.
+func (dm *DeviceManager) Remove(dev *Device) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if dm.devices[dev.path] == dev {
+		delete(dm.devices, dev.path)
+	}
+	dev.close()
+	dm.logger.Info("removed device", "name", dev.name, "device", dev.path)
+}
+
 // Close closes all managed devices.
 func (dm *DeviceManager) Close() {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 
 	for _, dev := range dm.devices {
-		dev.device.Close()
+		dev.close()
 	}
 	dm.devices = make(map[string]*Device)
 }
 
 // ReadEvents reads events from a device and sends them to a channel.
+//
+// Reads block in the Go poller; cancelling ctx closes the device, which wakes
+// the pending read instead of spinning on a non-blocking select. Non-key
+// events (EV_SYN, EV_MSC, ...) are dropped without allocating.
 func ReadEvents(ctx context.Context, dev *Device, events chan<- *KeyEvent) error {
+	dev.mu.Lock()
+	input := dev.device
+	closed := dev.closed
+	dev.mu.Unlock()
+	if closed {
+		return fmt.Errorf("device closed: %s", dev.path)
+	}
+
+	// Grab and capability queries switch the fd back to blocking mode, in
+	// which closing it would not interrupt ReadOne
+	if err := input.NonBlock(); err != nil {
+		return fmt.Errorf("setting non-blocking mode on %s: %w", dev.path, err)
+	}
+	closeDone := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		dev.close()
+		close(closeDone)
+	})
+	// Return only once a close started by ctx is done, so it cannot hit a
+	// device reopened after this reader
+	defer func() {
+		if !stop() {
+			<-closeDone
+		}
+	}()
+
+	retries := 0
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			ev, err := dev.device.ReadOne()
-			if err != nil {
-				if os.IsNotExist(err) {
-					return fmt.Errorf("device disconnected: %s", dev.path)
+		ev, err := input.ReadOne()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			switch classifyReadError(err) {
+			case readRetry:
+				// Interrupted or short read: drop it and resync
+				if retries++; retries <= maxReadRetries {
+					continue
 				}
+				return fmt.Errorf("reading event: giving up after %d retries: %w", maxReadRetries, err)
+			case readDisconnected:
+				return fmt.Errorf("%w: %s", ErrDisconnected, dev.path)
+			default:
 				return fmt.Errorf("reading event: %w", err)
 			}
+		}
+		retries = 0
 
-			// Only process key events
-			if ev.Type == evdev.EV_KEY {
-				keyEvent := &KeyEvent{
-					Code:      uint16(ev.Code),
-					Value:     ev.Value,
-					Timestamp: ev.Time,
-					Device:    dev,
-				}
-				events <- keyEvent
-			}
+		// The reader may have been stopped while blocked in ReadOne
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Only process key events
+		if ev.Type != evdev.EV_KEY {
+			continue
 		}
+
+		keyEvent := &KeyEvent{
+			Code:      uint16(ev.Code),
+			Value:     ev.Value,
+			Timestamp: ev.Time,
+			Device:    dev,
+		}
+		select {
+		case events <- keyEvent:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// close closes the underlying device once. Closing drops any grab.
+func (d *Device) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
 	}
+	d.device.Close()
+	d.closed = true
+	d.grabbed = false
+	d.monitored = false
 }
 
 func (d *Device) Path() string {
 	return d.path
 }
 
+// ID returns the device's /dev/input/by-id link, or "" when it has none.
+func (d *Device) ID() string {
+	return d.id
+}
+
+// Grabbed reports whether asahi-map holds the device's exclusive grab.
+func (d *Device) Grabbed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.grabbed
+}
+
 func (d *Device) Name() string {
 	return d.name
 }
@@ -1,7 +1,11 @@
 package keyboard
 
 import (
+	"fmt"
 	"syscall"
+	"time"
+
+	"github.com/holoplot/go-evdev"
 )
 
 type KeyEvent struct {
@@ -23,6 +27,11 @@ func (e *KeyEvent) IsRepeat() bool {
 	return e.Value == 2
 }
 
+// Time returns the kernel timestamp of the event.
+func (e *KeyEvent) Time() time.Time {
+	return time.Unix(int64(e.Timestamp.Sec), int64(e.Timestamp.Usec)*int64(time.Microsecond))
+}
+
 type KeyState struct {
 	LeftAlt    bool
 	RightAlt   bool
@@ -32,6 +41,13 @@ type KeyState struct {
 	RightCtrl  bool
 	LeftMeta   bool
 	RightMeta  bool
+
+	// CapsLock follows the Caps Lock LED
+	CapsLock bool
+
+	// Fn is the Fn key of Apple keyboards, which the kernel reports as
+	// KEY_FN alongside the keys it changes
+	Fn bool
 }
 
 const (
@@ -43,8 +59,43 @@ const (
 	KEY_RIGHTALT   uint16 = 100
 	KEY_LEFTMETA   uint16 = 125
 	KEY_RIGHTMETA  uint16 = 126
+	KEY_CAPSLOCK   uint16 = 58
+	KEY_FN         uint16 = 464
 )
 
+// InitFromDevice marks the modifiers already held on dev as pressed and
+// reads its Caps Lock LED, so keys held while a keyboard is grabbed count
+// for the first chord. Modifiers held on other keyboards are kept. translate
+// maps each held key to the code events from it are handled as, ok false to
+// ignore it.
+func (ks *KeyState) InitFromDevice(dev *Device, translate func(code uint16) (uint16, bool)) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.closed {
+		return fmt.Errorf("device %s is closed", dev.path)
+	}
+
+	keys, err := dev.device.State(evdev.EV_KEY)
+	if err != nil {
+		return fmt.Errorf("reading key state of %s: %w", dev.path, err)
+	}
+	for physical, down := range keys {
+		if !down {
+			continue
+		}
+		if code, ok := translate(uint16(physical)); ok && IsModifier(code) {
+			ks.UpdateFromEvent(&KeyEvent{Code: code, Value: 1})
+		}
+	}
+
+	leds, err := dev.device.State(evdev.EV_LED)
+	if err != nil {
+		return fmt.Errorf("reading LED state of %s: %w", dev.path, err)
+	}
+	ks.CapsLock = leds[evdev.LED_CAPSL]
+	return nil
+}
+
 func (ks *KeyState) UpdateFromEvent(ev *KeyEvent) {
 	pressed := ev.IsPress()
 	released := ev.IsRelease()
@@ -98,7 +149,42 @@ func (ks *KeyState) UpdateFromEvent(ev *KeyEvent) {
 		} else if released {
 			ks.RightMeta = false
 		}
+	case KEY_CAPSLOCK:
+		if pressed {
+			ks.CapsLock = !ks.CapsLock
+		}
+	case KEY_FN:
+		if pressed {
+			ks.Fn = true
+		} else if released {
+			ks.Fn = false
+		}
+	}
+}
+
+// Pressed reports whether the modifier key code is held.
+func (ks *KeyState) Pressed(code uint16) bool {
+	switch code {
+	case KEY_LEFTALT:
+		return ks.LeftAlt
+	case KEY_RIGHTALT:
+		return ks.RightAlt
+	case KEY_LEFTSHIFT:
+		return ks.LeftShift
+	case KEY_RIGHTSHIFT:
+		return ks.RightShift
+	case KEY_LEFTCTRL:
+		return ks.LeftCtrl
+	case KEY_RIGHTCTRL:
+		return ks.RightCtrl
+	case KEY_LEFTMETA:
+		return ks.LeftMeta
+	case KEY_RIGHTMETA:
+		return ks.RightMeta
+	case KEY_FN:
+		return ks.Fn
 	}
+	return false
 }
 
 func (ks *KeyState) AltPressed() bool {
@@ -121,12 +207,22 @@ func (ks *KeyState) MetaPressed() bool {
 	return ks.LeftMeta || ks.RightMeta
 }
 
+// FnPressed reports whether the Fn key of an Apple keyboard is held.
+func (ks *KeyState) FnPressed() bool {
+	return ks.Fn
+}
+
+func (ks *KeyState) CapsLockOn() bool {
+	return ks.CapsLock
+}
+
 func IsModifier(code uint16) bool {
 	switch code {
 	case KEY_LEFTALT, KEY_RIGHTALT,
 		KEY_LEFTSHIFT, KEY_RIGHTSHIFT,
 		KEY_LEFTCTRL, KEY_RIGHTCTRL,
-		KEY_LEFTMETA, KEY_RIGHTMETA:
+		KEY_LEFTMETA, KEY_RIGHTMETA,
+		KEY_FN:
 		return true
 	}
 	return false
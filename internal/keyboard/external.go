@@ -0,0 +1,89 @@
+package keyboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/bendahl/uinput"
+)
+
+// externalTimeout bounds how long a clipboard or keysym tool may take.
+const externalTimeout = 2 * time.Second
+
+// externalWaitDelay bounds how long a tool's output is waited for once it
+// has exited or timed out, in case a child it left running holds stdin.
+const externalWaitDelay = 100 * time.Millisecond
+
+// runTool runs an external helper with externalTimeout, feeding it stdin
+// when not empty. Its output is discarded: wl-copy and xclip leave a child
+// running to serve the clipboard, and an output pipe that child inherits
+// would keep Wait blocked until another app takes the clipboard.
+func runTool(stdin string, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), externalTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	cmd.WaitDelay = externalWaitDelay
+	if err := cmd.Run(); err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// onWayland reports whether the session is Wayland rather than X11.
+func onWayland() bool {
+	return os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+// CopyText puts s on the clipboard with wl-copy (Wayland) or xclip (X11).
+func (vk *VirtualKeyboard) CopyText(s string) error {
+	vk.logger.Debug("copying text to clipboard", "length", len(s))
+	var err error
+	if onWayland() {
+		err = runTool(s, "wl-copy")
+	} else {
+		err = runTool(s, "xclip", "-selection", "clipboard")
+	}
+	if err != nil {
+		return fmt.Errorf("copying to clipboard: %w", err)
+	}
+	return nil
+}
+
+// PasteClipboard pastes with Ctrl+V, releasing held modifiers around it.
+// Terminals that paste with Ctrl+Shift+V receive a plain Ctrl+V.
+func (vk *VirtualKeyboard) PasteClipboard() error {
+	held := vk.heldModifiers()
+	for _, code := range held {
+		if err := vk.keyUp(code); err != nil {
+			return err
+		}
+	}
+	err := vk.TapChord([]int{uinput.KeyLeftctrl}, uinput.KeyV)
+	for _, code := range held {
+		if downErr := vk.keyDown(code); downErr != nil && err == nil {
+			err = downErr
+		}
+	}
+	return err
+}
+
+// TypeKeysym types r through its Unicode keysym with wtype (Wayland) or
+// xdotool (X11), which map the keysym to a spare keycode themselves, for
+// apps that ignore Ctrl+Shift+U entry.
+func (vk *VirtualKeyboard) TypeKeysym(r rune) error {
+	keysym := fmt.Sprintf("U%04X", r)
+	vk.logger.Debug("typing keysym", "char", string(r), "keysym", keysym)
+	if onWayland() {
+		return runTool("", "wtype", "-k", keysym)
+	}
+	return runTool("", "xdotool", "key", "--clearmodifiers", keysym)
+}
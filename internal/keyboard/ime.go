@@ -0,0 +1,66 @@
+package keyboard
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	fcitxName      = "org.fcitx.Fcitx5"
+	fcitxPath      = "/controller"
+	fcitxInterface = "org.fcitx.Fcitx.Controller1"
+
+	// fcitxActive is the State of an input method that is on, as
+	// fcitx5-remote prints it: 0 closed, 1 inactive, 2 active
+	fcitxActive = 2
+
+	// imeStateTTL is how long a state read is reused, so a burst of typed
+	// characters asks the bus once
+	imeStateTTL = 250 * time.Millisecond
+
+	// imeCallTimeout bounds a state read, a hung IME must not stall typing
+	imeCallTimeout = 100 * time.Millisecond
+)
+
+// FcitxIME reports whether Fcitx 5 has an input method switched on, which
+// would take the Space confirming Unicode entry for its candidate window.
+// IBus has no such query on the session bus and is not detected.
+type FcitxIME struct {
+	conn *dbus.Conn
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	active    bool
+}
+
+// NewFcitxIME connects to the session bus. Fcitx 5 itself may start later;
+// until it answers, Active reports false.
+func NewFcitxIME() (*FcitxIME, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the session bus: %w", err)
+	}
+	return &FcitxIME{conn: conn}, nil
+}
+
+// Active reports whether an input method is on.
+func (f *FcitxIME) Active() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checkedAt) < imeStateTTL {
+		return f.active
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), imeCallTimeout)
+	defer cancel()
+	var state int32
+	// Asking must not start Fcitx for a user who does not run it
+	err := f.conn.Object(fcitxName, fcitxPath).CallWithContext(ctx, fcitxInterface+".State", dbus.FlagNoAutoStart).Store(&state)
+	f.active = err == nil && state == fcitxActive
+	f.checkedAt = time.Now()
+	return f.active
+}
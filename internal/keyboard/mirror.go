@@ -0,0 +1,81 @@
+package keyboard
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bendahl/uinput"
+)
+
+// virtualName is the name of the main virtual keyboard. Device detection
+// skips every device whose name contains "asahi-map", so mirrors are named
+// after it too.
+const virtualName = "asahi-map-virtual"
+
+// mirrorKeyboard sends every event to several uinput keyboards, for setups
+// where one consumer, such as a virtual machine, grabs a single device.
+type mirrorKeyboard []uinput.Keyboard
+
+var _ uinput.Keyboard = mirrorKeyboard(nil)
+
+// newMirrorKeyboard creates the main virtual keyboard plus one named
+// "asahi-map-<name>" per mirror. Empty and repeated names are skipped.
+func newMirrorKeyboard(mirrors []string) (mirrorKeyboard, error) {
+	names := []string{virtualName}
+	seen := map[string]bool{virtualName: true}
+	for _, mirror := range mirrors {
+		name := "asahi-map-" + mirror
+		if mirror == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	var kbs mirrorKeyboard
+	for _, name := range names {
+		kb, err := uinput.CreateKeyboard("/dev/uinput", []byte(name))
+		if err != nil {
+			kbs.Close()
+			return nil, fmt.Errorf("creating virtual keyboard %s: %w", name, err)
+		}
+		kbs = append(kbs, kb)
+	}
+	return kbs, nil
+}
+
+// each calls fn on every keyboard, even after a failure, and returns the
+// first error.
+func (m mirrorKeyboard) each(fn func(uinput.Keyboard) error) error {
+	var firstErr error
+	for _, kb := range m {
+		if err := fn(kb); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m mirrorKeyboard) KeyPress(key int) error {
+	return m.each(func(kb uinput.Keyboard) error { return kb.KeyPress(key) })
+}
+
+func (m mirrorKeyboard) KeyDown(key int) error {
+	return m.each(func(kb uinput.Keyboard) error { return kb.KeyDown(key) })
+}
+
+func (m mirrorKeyboard) KeyUp(key int) error {
+	return m.each(func(kb uinput.Keyboard) error { return kb.KeyUp(key) })
+}
+
+// FetchSyspath returns the main keyboard's syspath.
+func (m mirrorKeyboard) FetchSyspath() (string, error) {
+	if len(m) == 0 {
+		return "", errors.New("no virtual keyboard")
+	}
+	return m[0].FetchSyspath()
+}
+
+func (m mirrorKeyboard) Close() error {
+	return m.each(uinput.Keyboard.Close)
+}
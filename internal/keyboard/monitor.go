@@ -0,0 +1,20 @@
+package keyboard
+
+// MonitorOutput wraps an Outputter for keyboards read without a grab. Their
+// events already reach apps, so forwarded events are dropped instead of
+// being typed a second time; mapped output is injected as usual.
+type MonitorOutput struct {
+	Outputter
+}
+
+var _ Outputter = (*MonitorOutput)(nil)
+
+// NewMonitorOutput wraps out for monitor mode.
+func NewMonitorOutput(out Outputter) *MonitorOutput {
+	return &MonitorOutput{Outputter: out}
+}
+
+// ForwardEvent does nothing: the original event was not intercepted.
+func (m *MonitorOutput) ForwardEvent(code uint16, value int32) error {
+	return nil
+}
@@ -3,26 +3,135 @@ package keyboard
 import (
 	"fmt"
 	"log/slog"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/bendahl/uinput"
 )
 
+// Outputter injects key events and text into the system. VirtualKeyboard is
+// the uinput implementation; alternative backends implement the same set.
+type Outputter interface {
+	// TypeUnicode types a single character.
+	TypeUnicode(r rune) error
+	// TypeString types every character of s.
+	TypeString(s string) error
+	// CopyText puts s on the clipboard. It sends no keys, so callers may
+	// run it without holding up other output.
+	CopyText(s string) error
+	// PasteClipboard pastes the clipboard with Ctrl+V.
+	PasteClipboard() error
+	// TypeKeysym types r as an X keysym through an external tool.
+	TypeKeysym(r rune) error
+	// PassthroughWithRAlt taps keyCode with Right Alt (AltGr) held.
+	PassthroughWithRAlt(keyCode int) error
+	// PassthroughWithShiftRAlt taps keyCode with Shift and Right Alt held.
+	PassthroughWithShiftRAlt(keyCode int, shiftAlreadyDown bool) error
+	// TapKey presses and releases a key.
+	TapKey(code int) error
+	// TapChord taps key while holding modifiers.
+	TapChord(modifiers []int, key int) error
+	// ForwardEvent replays a press (1), release (0) or repeat (2).
+	ForwardEvent(code uint16, value int32) error
+	// SetHexKeys sets the chords typing hex digits during Unicode entry;
+	// nil restores the AZERTY defaults.
+	SetHexKeys(keys map[rune]KeyChord)
+	// SetUnicodeConfirm sets the key committing Unicode entry by name, as
+	// UnicodeEntry.WithConfirm takes it; "" restores the entry's own key.
+	SetUnicodeConfirm(name string)
+	// HeldKeys returns the keys the output holds down, in no order.
+	HeldKeys() []int
+	// ReleaseAll releases every key the output still holds down.
+	ReleaseAll() error
+	// Close releases the output's resources.
+	Close() error
+}
+
+var _ Outputter = (*VirtualKeyboard)(nil)
+
+// KeyChord is a key tapped while holding modifiers.
+type KeyChord struct {
+	Modifiers []int
+	Key       int
+}
+
+// defaultHexKeys types hex digits on a French AZERTY layout: digits need
+// Shift and "a" sits on the Q key.
+var defaultHexKeys = map[rune]KeyChord{
+	'0': {[]int{uinput.KeyLeftshift}, uinput.Key0},
+	'1': {[]int{uinput.KeyLeftshift}, uinput.Key1},
+	'2': {[]int{uinput.KeyLeftshift}, uinput.Key2},
+	'3': {[]int{uinput.KeyLeftshift}, uinput.Key3},
+	'4': {[]int{uinput.KeyLeftshift}, uinput.Key4},
+	'5': {[]int{uinput.KeyLeftshift}, uinput.Key5},
+	'6': {[]int{uinput.KeyLeftshift}, uinput.Key6},
+	'7': {[]int{uinput.KeyLeftshift}, uinput.Key7},
+	'8': {[]int{uinput.KeyLeftshift}, uinput.Key8},
+	'9': {[]int{uinput.KeyLeftshift}, uinput.Key9},
+	'a': {nil, uinput.KeyQ},
+	'b': {nil, uinput.KeyB},
+	'c': {nil, uinput.KeyC},
+	'd': {nil, uinput.KeyD},
+	'e': {nil, uinput.KeyE},
+	'f': {nil, uinput.KeyF},
+}
+
 // VirtualKeyboard provides methods to inject key events and Unicode characters.
 type VirtualKeyboard struct {
 	keyboard uinput.Keyboard
 	logger   *slog.Logger
+
+	// Keys currently held down on the virtual device, for ReleaseAll
+	mu      sync.Mutex
+	pressed map[int]bool
+
+	// hexKeys overrides defaultHexKeys per digit
+	hexKeys      map[rune]KeyChord
+	unicodeEntry UnicodeEntry
+
+	// confirm is the SetUnicodeConfirm key name, "" for the entry's own
+	confirm string
+
+	// imeConfirm replaces the confirm key while imeActive reports an
+	// input method is on, "" when SetIMEConfirm was not called
+	imeConfirm string
+	imeActive  func() bool
+
+	// limiter caps key presses per second, nil when unlimited
+	limiter *rateLimiter
+
+	// hold is how long tapped keys stay down, 0 for an instant tap
+	hold time.Duration
 }
 
 func NewVirtualKeyboard(logger *slog.Logger) (*VirtualKeyboard, error) {
-	kb, err := uinput.CreateKeyboard("/dev/uinput", []byte("asahi-map-virtual"))
+	kb, err := uinput.CreateKeyboard("/dev/uinput", []byte(virtualName))
 	if err != nil {
 		return nil, fmt.Errorf("creating virtual keyboard: %w", err)
 	}
+	return newVirtualKeyboard(kb, logger), nil
+}
 
+// NewMirroredVirtualKeyboard is like NewVirtualKeyboard but also sends
+// every event to one more virtual keyboard per name in mirrors, named
+// "asahi-map-<name>", so a consumer that grabs one of them still gets a
+// copy. ReleaseAll and Close act on all of them.
+func NewMirroredVirtualKeyboard(mirrors []string, logger *slog.Logger) (*VirtualKeyboard, error) {
+	kb, err := newMirrorKeyboard(mirrors)
+	if err != nil {
+		return nil, err
+	}
+	return newVirtualKeyboard(kb, logger), nil
+}
+
+func newVirtualKeyboard(kb uinput.Keyboard, logger *slog.Logger) *VirtualKeyboard {
 	return &VirtualKeyboard{
-		keyboard: kb,
-		logger:   logger,
-	}, nil
+		keyboard:     kb,
+		logger:       logger,
+		pressed:      make(map[int]bool),
+		unicodeEntry: UnicodeEntryGTK,
+	}
 }
 
 // Close releases the virtual keyboard.
@@ -30,121 +139,266 @@ func (vk *VirtualKeyboard) Close() error {
 	return vk.keyboard.Close()
 }
 
+// HeldKeys returns the keys held down on the virtual device.
+func (vk *VirtualKeyboard) HeldKeys() []int {
+	vk.mu.Lock()
+	defer vk.mu.Unlock()
+	codes := make([]int, 0, len(vk.pressed))
+	for code := range vk.pressed {
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// ReleaseAll sends a key up for every key still held on the virtual device.
+// It keeps going on errors and returns the first one.
+func (vk *VirtualKeyboard) ReleaseAll() error {
+	codes := vk.HeldKeys()
+	var firstErr error
+	for _, code := range codes {
+		if err := vk.keyUp(code); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(codes) > 0 {
+		vk.logger.Debug("released held keys", "count", len(codes))
+	}
+	return firstErr
+}
+
+// SetRateLimit caps how many key presses per second are injected; presses
+// beyond it are delayed, releases never are. 0 removes the cap.
+func (vk *VirtualKeyboard) SetRateLimit(perSecond int) {
+	vk.mu.Lock()
+	defer vk.mu.Unlock()
+	if perSecond <= 0 {
+		vk.limiter = nil
+		return
+	}
+	vk.limiter = newRateLimiter(perSecond)
+}
+
+// SetHoldDuration keeps tapped keys down for d before releasing them, for
+// apps that ignore instantaneous synthetic taps. 0 taps instantly.
+func (vk *VirtualKeyboard) SetHoldDuration(d time.Duration) {
+	vk.mu.Lock()
+	defer vk.mu.Unlock()
+	vk.hold = d
+}
+
+// holdDuration returns how long tapped keys stay down.
+func (vk *VirtualKeyboard) holdDuration() time.Duration {
+	vk.mu.Lock()
+	defer vk.mu.Unlock()
+	return vk.hold
+}
+
+// throttle waits until the rate limit allows another key press.
+func (vk *VirtualKeyboard) throttle() {
+	vk.mu.Lock()
+	limiter := vk.limiter
+	vk.mu.Unlock()
+	if limiter == nil {
+		return
+	}
+
+	delay, engaged := limiter.reserve(time.Now())
+	if engaged {
+		vk.logger.Warn("output rate limit reached, throttling key presses", "events_per_sec", limiter.rate)
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// keyDown presses a key on the device and records it as held.
+func (vk *VirtualKeyboard) keyDown(code int) error {
+	vk.throttle()
+	if err := vk.keyboard.KeyDown(code); err != nil {
+		return err
+	}
+	vk.mu.Lock()
+	vk.pressed[code] = true
+	vk.mu.Unlock()
+	return nil
+}
+
+// keyUp releases a key on the device. The key is considered released even
+// on error so ReleaseAll does not retry it forever.
+func (vk *VirtualKeyboard) keyUp(code int) error {
+	vk.mu.Lock()
+	delete(vk.pressed, code)
+	vk.mu.Unlock()
+	return vk.keyboard.KeyUp(code)
+}
+
+// keyPress taps a key on the device, holding it down for the hold duration
+// when one is set.
+func (vk *VirtualKeyboard) keyPress(code int) error {
+	if vk.holdDuration() > 0 {
+		return vk.TapKey(code)
+	}
+	vk.throttle()
+	return vk.keyboard.KeyPress(code)
+}
+
 // PressKey simulates a key press.
 func (vk *VirtualKeyboard) PressKey(code int) error {
-	return vk.keyboard.KeyDown(code)
+	return vk.keyDown(code)
 }
 
 // ReleaseKey simulates a key release.
 func (vk *VirtualKeyboard) ReleaseKey(code int) error {
-	return vk.keyboard.KeyUp(code)
+	return vk.keyUp(code)
 }
 
 // TapKey simulates a key press and release.
 func (vk *VirtualKeyboard) TapKey(code int) error {
-	if err := vk.keyboard.KeyDown(code); err != nil {
+	if err := vk.keyDown(code); err != nil {
 		return err
 	}
-	return vk.keyboard.KeyUp(code)
+	if hold := vk.holdDuration(); hold > 0 {
+		time.Sleep(hold)
+	}
+	return vk.keyUp(code)
 }
 
-// TypeUnicode types a Unicode character using the Ctrl+Shift+U method.
+// TypeUnicode types a Unicode character as hex using the input method's
+// Unicode entry, Ctrl+Shift+U by default (see SetUnicodeEntry).
 // This works in GTK/Qt applications that support Unicode input.
-// On AZERTY macOS keyboards, digits require Shift to be pressed.
+// Hex digits are typed with the keys set by SetHexKeys.
 func (vk *VirtualKeyboard) TypeUnicode(r rune) error {
 	hex := fmt.Sprintf("%x", r) // lowercase hex
 
-	vk.logger.Debug("typing unicode via ctrl+shift+u", "char", string(r), "hex", hex)
+	vk.mu.Lock()
+	entry := vk.unicodeEntry
+	confirm, imeConfirm, imeActive := vk.confirm, vk.imeConfirm, vk.imeActive
+	vk.mu.Unlock()
 
-	// Press Ctrl+Shift+U
-	if err := vk.keyboard.KeyDown(uinput.KeyLeftctrl); err != nil {
-		return err
+	// An input method composing text would take Space for its candidate
+	// window, so its own confirm key wins over the layout's
+	if imeConfirm != "" && imeActive() {
+		confirm = imeConfirm
 	}
-	if err := vk.keyboard.KeyDown(uinput.KeyLeftshift); err != nil {
-		vk.keyboard.KeyUp(uinput.KeyLeftctrl)
-		return err
+	if confirmed, err := entry.WithConfirm(confirm); err != nil {
+		vk.logger.Debug("ignoring unicode confirm key", "error", err)
+	} else {
+		entry = confirmed
 	}
-	if err := vk.keyboard.KeyPress(uinput.KeyU); err != nil {
-		vk.keyboard.KeyUp(uinput.KeyLeftshift)
-		vk.keyboard.KeyUp(uinput.KeyLeftctrl)
-		return err
+
+	vk.logger.Debug("typing unicode", "char", string(r), "hex", hex, "method", entry.Name)
+
+	// Modifiers still down on the device, such as the user's Shift or an
+	// Alt sent for a shortcut, would turn the entry into other shortcuts:
+	// lift them for the sequence and restore them after
+	held := vk.heldModifiers()
+	for _, code := range held {
+		if err := vk.keyUp(code); err != nil {
+			return err
+		}
 	}
-	if err := vk.keyboard.KeyUp(uinput.KeyLeftshift); err != nil {
-		vk.keyboard.KeyUp(uinput.KeyLeftctrl)
-		return err
+	err := vk.typeUnicodeEntry(entry, hex)
+	for _, code := range held {
+		if downErr := vk.keyDown(code); downErr != nil && err == nil {
+			err = downErr
+		}
 	}
-	if err := vk.keyboard.KeyUp(uinput.KeyLeftctrl); err != nil {
+	return err
+}
+
+// typeUnicodeEntry types the trigger, the hex digits and the confirm key.
+func (vk *VirtualKeyboard) typeUnicodeEntry(entry UnicodeEntry, hex string) error {
+	if err := vk.TapChord(entry.Trigger.Modifiers, entry.Trigger.Key); err != nil {
 		return err
 	}
 
-	// Type hex digits - on AZERTY, digits need Shift
+	// Type hex digits with the layout's hex keys
 	for _, c := range hex {
 		if err := vk.typeHexChar(c); err != nil {
 			return err
 		}
 	}
 
-	// Press Space to confirm
-	if err := vk.keyboard.KeyPress(uinput.KeySpace); err != nil {
-		return err
+	// Confirm the entry
+	if entry.Confirm == 0 {
+		return nil
 	}
+	return vk.keyPress(entry.Confirm)
+}
 
-	return nil
+// modifierKeys are the keys heldModifiers looks for.
+var modifierKeys = []int{
+	uinput.KeyLeftctrl, uinput.KeyRightctrl,
+	uinput.KeyLeftshift, uinput.KeyRightshift,
+	uinput.KeyLeftalt, uinput.KeyRightalt,
+	uinput.KeyLeftmeta, uinput.KeyRightmeta,
 }
 
-// typeHexChar types a single hex character (0-9, a-f).
-// On AZERTY keyboards, digits require Shift to be pressed.
-// Letters a-f are typed using their AZERTY physical positions.
-func (vk *VirtualKeyboard) typeHexChar(c rune) error {
-	switch c {
-	// Digits 0-9: need Shift on AZERTY
-	case '0':
-		return vk.typeWithShift(uinput.Key0)
-	case '1':
-		return vk.typeWithShift(uinput.Key1)
-	case '2':
-		return vk.typeWithShift(uinput.Key2)
-	case '3':
-		return vk.typeWithShift(uinput.Key3)
-	case '4':
-		return vk.typeWithShift(uinput.Key4)
-	case '5':
-		return vk.typeWithShift(uinput.Key5)
-	case '6':
-		return vk.typeWithShift(uinput.Key6)
-	case '7':
-		return vk.typeWithShift(uinput.Key7)
-	case '8':
-		return vk.typeWithShift(uinput.Key8)
-	case '9':
-		return vk.typeWithShift(uinput.Key9)
-	// Letters a-f: use AZERTY positions (KeyQ = 'a', KeyB = 'b', etc.)
-	case 'a', 'A':
-		return vk.keyboard.KeyPress(uinput.KeyQ) // 'a' is on Q key position on AZERTY
-	case 'b', 'B':
-		return vk.keyboard.KeyPress(uinput.KeyB)
-	case 'c', 'C':
-		return vk.keyboard.KeyPress(uinput.KeyC)
-	case 'd', 'D':
-		return vk.keyboard.KeyPress(uinput.KeyD)
-	case 'e', 'E':
-		return vk.keyboard.KeyPress(uinput.KeyE)
-	case 'f', 'F':
-		return vk.keyboard.KeyPress(uinput.KeyF)
+// heldModifiers returns the modifier keys currently down on the device.
+func (vk *VirtualKeyboard) heldModifiers() []int {
+	vk.mu.Lock()
+	defer vk.mu.Unlock()
+	var held []int
+	for _, code := range modifierKeys {
+		if vk.pressed[code] {
+			held = append(held, code)
+		}
 	}
-	return nil
+	return held
 }
 
-// typeWithShift types a key with Shift held down.
-func (vk *VirtualKeyboard) typeWithShift(keyCode int) error {
-	if err := vk.keyboard.KeyDown(uinput.KeyLeftshift); err != nil {
+// SetUnicodeEntry sets how TypeUnicode starts and commits hex entry.
+func (vk *VirtualKeyboard) SetUnicodeEntry(entry UnicodeEntry) {
+	vk.mu.Lock()
+	defer vk.mu.Unlock()
+	vk.unicodeEntry = entry
+}
+
+// SetUnicodeConfirm overrides the entry's confirm key with the one called
+// name, such as a layout's unicode_confirm; "" restores it.
+func (vk *VirtualKeyboard) SetUnicodeConfirm(name string) {
+	vk.mu.Lock()
+	defer vk.mu.Unlock()
+	vk.confirm = name
+}
+
+// SetIMEConfirm makes TypeUnicode confirm with the key called name while
+// active reports that an input method is on, whatever SetUnicodeConfirm
+// set. An empty name turns it off.
+func (vk *VirtualKeyboard) SetIMEConfirm(name string, active func() bool) error {
+	if _, err := UnicodeEntryGTK.WithConfirm(name); err != nil {
 		return err
 	}
-	if err := vk.keyboard.KeyPress(keyCode); err != nil {
-		vk.keyboard.KeyUp(uinput.KeyLeftshift)
-		return err
+	vk.mu.Lock()
+	defer vk.mu.Unlock()
+	vk.imeConfirm, vk.imeActive = name, active
+	if active == nil {
+		vk.imeConfirm = ""
+	}
+	return nil
+}
+
+// SetHexKeys sets the chords used for hex digits; digits missing from keys
+// keep their AZERTY default.
+func (vk *VirtualKeyboard) SetHexKeys(keys map[rune]KeyChord) {
+	vk.mu.Lock()
+	defer vk.mu.Unlock()
+	vk.hexKeys = keys
+}
+
+// typeHexChar types a single hex character (0-9, a-f) using the layout's
+// hex keys, or the AZERTY positions by default.
+func (vk *VirtualKeyboard) typeHexChar(c rune) error {
+	c = unicode.ToLower(c)
+	vk.mu.Lock()
+	chord, ok := vk.hexKeys[c]
+	vk.mu.Unlock()
+	if !ok {
+		if chord, ok = defaultHexKeys[c]; !ok {
+			return nil
+		}
 	}
-	return vk.keyboard.KeyUp(uinput.KeyLeftshift)
+	return vk.TapChord(chord.Modifiers, chord.Key)
 }
 
 // TypeString types a string character by character.
@@ -159,63 +413,103 @@ func (vk *VirtualKeyboard) TypeString(s string) error {
 
 // PassthroughWithRAlt sends a key with Right Alt modifier.
 func (vk *VirtualKeyboard) PassthroughWithRAlt(keyCode int) error {
-	if err := vk.keyboard.KeyDown(uinput.KeyRightalt); err != nil {
+	if err := vk.keyDown(uinput.KeyRightalt); err != nil {
 		return err
 	}
-	if err := vk.keyboard.KeyPress(keyCode); err != nil {
-		vk.keyboard.KeyUp(uinput.KeyRightalt)
+	if err := vk.keyPress(keyCode); err != nil {
+		vk.keyUp(uinput.KeyRightalt)
 		return err
 	}
-	return vk.keyboard.KeyUp(uinput.KeyRightalt)
+	return vk.keyUp(uinput.KeyRightalt)
 }
 
 // PassthroughWithShiftRAlt sends a key with Shift+Right Alt modifiers.
 // shiftAlreadyDown indicates if Shift was already being held by the user.
-// If true, we don't release Shift at the end to maintain the user's Shift state.
+// Whichever Shift is actually down on the device (left or right) is reused
+// and left alone; otherwise a Left Shift is pressed and released around the
+// key, so a synthetic Shift is never left unpaired.
 func (vk *VirtualKeyboard) PassthroughWithShiftRAlt(keyCode int, shiftAlreadyDown bool) error {
-	// Only press Shift if it wasn't already down
-	if !shiftAlreadyDown {
-		if err := vk.keyboard.KeyDown(uinput.KeyLeftshift); err != nil {
+	ownShift := !vk.shiftHeld()
+	if shiftAlreadyDown && ownShift {
+		vk.logger.Debug("shift reported held but not down on device, pressing our own")
+	}
+
+	if ownShift {
+		if err := vk.keyDown(uinput.KeyLeftshift); err != nil {
 			return err
 		}
 	}
-	if err := vk.keyboard.KeyDown(uinput.KeyRightalt); err != nil {
-		if !shiftAlreadyDown {
-			vk.keyboard.KeyUp(uinput.KeyLeftshift)
+	releaseShift := func() error {
+		if ownShift {
+			return vk.keyUp(uinput.KeyLeftshift)
 		}
+		return nil
+	}
+
+	if err := vk.keyDown(uinput.KeyRightalt); err != nil {
+		releaseShift()
 		return err
 	}
-	if err := vk.keyboard.KeyPress(keyCode); err != nil {
-		vk.keyboard.KeyUp(uinput.KeyRightalt)
-		if !shiftAlreadyDown {
-			vk.keyboard.KeyUp(uinput.KeyLeftshift)
-		}
+	if err := vk.keyPress(keyCode); err != nil {
+		vk.keyUp(uinput.KeyRightalt)
+		releaseShift()
 		return err
 	}
-	if err := vk.keyboard.KeyUp(uinput.KeyRightalt); err != nil {
-		if !shiftAlreadyDown {
-			vk.keyboard.KeyUp(uinput.KeyLeftshift)
-		}
+	if err := vk.keyUp(uinput.KeyRightalt); err != nil {
+		releaseShift()
 		return err
 	}
-	// Only release Shift if we pressed it ourselves
-	if !shiftAlreadyDown {
-		return vk.keyboard.KeyUp(uinput.KeyLeftshift)
+	return releaseShift()
+}
+
+// shiftHeld reports whether either Shift is currently down on the device.
+func (vk *VirtualKeyboard) shiftHeld() bool {
+	vk.mu.Lock()
+	defer vk.mu.Unlock()
+	return vk.pressed[uinput.KeyLeftshift] || vk.pressed[uinput.KeyRightshift]
+}
+
+// TapChord holds the modifiers in order, taps key, then releases the
+// modifiers in reverse order.
+func (vk *VirtualKeyboard) TapChord(modifiers []int, key int) error {
+	for i, mod := range modifiers {
+		if err := vk.keyDown(mod); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				vk.keyUp(modifiers[j])
+			}
+			return err
+		}
 	}
-	return nil
+
+	err := vk.keyPress(key)
+
+	for i := len(modifiers) - 1; i >= 0; i-- {
+		if upErr := vk.keyUp(modifiers[i]); upErr != nil && err == nil {
+			err = upErr
+		}
+	}
+	return err
 }
 
-// ForwardEvent forwards an event unchanged.
+// maxForwardKey is the highest key code the uinput keyboard can emit.
+const maxForwardKey = 248
+
+// ForwardEvent forwards an event unchanged. Keys the virtual keyboard cannot
+// emit are dropped rather than counted as output failures.
 func (vk *VirtualKeyboard) ForwardEvent(code uint16, value int32) error {
+	if code > maxForwardKey {
+		vk.logger.Debug("dropping key outside the virtual keyboard range", "code", code)
+		return nil
+	}
 	switch value {
 	case 0: // Release
-		return vk.keyboard.KeyUp(int(code))
+		return vk.keyUp(int(code))
 	case 1: // Press
-		return vk.keyboard.KeyDown(int(code))
+		return vk.keyDown(int(code))
 	case 2: // Repeat - send another key down (the kernel handles auto-repeat)
 		// Note: We just send KeyDown again, not KeyPress (which would do Down+Up)
 		// The key is already down, so another KeyDown triggers repeat in the kernel
-		return vk.keyboard.KeyDown(int(code))
+		return vk.keyDown(int(code))
 	}
 	return nil
 }
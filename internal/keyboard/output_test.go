@@ -0,0 +1,128 @@
+package keyboard
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"github.com/bendahl/uinput"
+)
+
+// fakeKeyboard records what a VirtualKeyboard sends to uinput.
+type fakeKeyboard struct {
+	events []string
+}
+
+func (f *fakeKeyboard) KeyPress(key int) error {
+	f.events = append(f.events, tap(key))
+	return nil
+}
+
+func (f *fakeKeyboard) KeyDown(key int) error {
+	f.events = append(f.events, down(key))
+	return nil
+}
+
+func (f *fakeKeyboard) KeyUp(key int) error {
+	f.events = append(f.events, up(key))
+	return nil
+}
+
+func (f *fakeKeyboard) FetchSyspath() (string, error) { return "", nil }
+
+func (f *fakeKeyboard) Close() error { return nil }
+
+// newTestKeyboard returns a VirtualKeyboard sending to a fakeKeyboard.
+func newTestKeyboard() (*VirtualKeyboard, *fakeKeyboard) {
+	fake := &fakeKeyboard{}
+	return newVirtualKeyboard(fake, slog.New(slog.NewTextHandler(io.Discard, nil))), fake
+}
+
+// Recorded events, by key code.
+func down(code int) string { return fmt.Sprintf("down %d", code) }
+func up(code int) string   { return fmt.Sprintf("up %d", code) }
+func tap(code int) string  { return fmt.Sprintf("tap %d", code) }
+
+// expectEvents fails unless the keyboard sent exactly want, then clears
+// the record.
+func expectEvents(t *testing.T, fake *fakeKeyboard, want ...string) {
+	t.Helper()
+	if !slices.Equal(fake.events, want) {
+		t.Errorf("events:\n got %q\nwant %q", fake.events, want)
+	}
+	fake.events = nil
+}
+
+func TestPassthroughWithShiftRAlt(t *testing.T) {
+	var (
+		lshift = uinput.KeyLeftshift
+		rshift = uinput.KeyRightshift
+		ralt   = uinput.KeyRightalt
+		key    = uinput.Key5
+	)
+
+	t.Run("no shift held", func(t *testing.T) {
+		vk, fake := newTestKeyboard()
+		if err := vk.PassthroughWithShiftRAlt(key, false); err != nil {
+			t.Fatal(err)
+		}
+		expectEvents(t, fake, down(lshift), down(ralt), tap(key), up(ralt), up(lshift))
+	})
+
+	for name, held := range map[string]int{"left shift held": lshift, "right shift held": rshift} {
+		t.Run(name, func(t *testing.T) {
+			vk, fake := newTestKeyboard()
+			vk.ForwardEvent(uint16(held), 1)
+			fake.events = nil
+
+			// The user's Shift is reused and left down, no Left Shift is
+			// pressed or released behind it
+			if err := vk.PassthroughWithShiftRAlt(key, true); err != nil {
+				t.Fatal(err)
+			}
+			expectEvents(t, fake, down(ralt), tap(key), up(ralt))
+
+			vk.ForwardEvent(uint16(held), 0)
+			expectEvents(t, fake, up(held))
+			if err := vk.ReleaseAll(); err != nil {
+				t.Fatal(err)
+			}
+			expectEvents(t, fake)
+		})
+	}
+
+	t.Run("shift reported but not down", func(t *testing.T) {
+		vk, fake := newTestKeyboard()
+		if err := vk.PassthroughWithShiftRAlt(key, true); err != nil {
+			t.Fatal(err)
+		}
+		expectEvents(t, fake, down(lshift), down(ralt), tap(key), up(ralt), up(lshift))
+	})
+}
+
+func TestTypeUnicodeLiftsHeldAlt(t *testing.T) {
+	vk, fake := newTestKeyboard()
+	alt := uinput.KeyLeftalt
+	vk.ForwardEvent(uint16(alt), 1)
+	fake.events = nil
+
+	for _, r := range "éàü" {
+		if err := vk.TypeUnicode(r); err != nil {
+			t.Fatal(err)
+		}
+		// Alt is lifted for the whole entry sequence and restored after it
+		events := fake.events
+		if len(events) < 3 || events[0] != up(alt) || events[len(events)-1] != down(alt) {
+			t.Fatalf("typing %q: Alt not lifted around the entry: %q", r, events)
+		}
+		if slices.Contains(events[1:len(events)-1], down(alt)) {
+			t.Errorf("typing %q: Alt pressed during the entry: %q", r, events)
+		}
+		fake.events = nil
+	}
+
+	vk.ForwardEvent(uint16(alt), 0)
+	expectEvents(t, fake, up(alt))
+}
@@ -0,0 +1,47 @@
+package keyboard
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket holding up to one second of events. Callers
+// reserve a token per event and sleep for the returned delay when the bucket
+// has run dry.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	tokens    float64
+	last      time.Time
+	throttled bool
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(perSecond),
+		tokens: float64(perSecond),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token at now and returns how long to wait before sending.
+// engaged is true for the first delay after the bucket was last full, so
+// throttling is logged once per burst rather than per event.
+func (l *rateLimiter) reserve(now time.Time) (delay time.Duration, engaged bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= l.rate {
+		l.throttled = false
+	}
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0, false
+	}
+	engaged = !l.throttled
+	l.throttled = true
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), engaged
+}
@@ -0,0 +1,47 @@
+package keyboard
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"syscall"
+)
+
+// ErrDisconnected is returned by ReadEvents when the device went away, e.g.
+// a Bluetooth keyboard turned off or a USB one unplugged.
+var ErrDisconnected = errors.New("device disconnected")
+
+// maxReadRetries bounds consecutive transient read errors so a device stuck
+// returning them cannot spin a reader forever.
+const maxReadRetries = 100
+
+// readErrorKind is what ReadEvents does about a failed read.
+type readErrorKind int
+
+const (
+	// readFatal stops the reader and reports the error
+	readFatal readErrorKind = iota
+	// readRetry drops the read and tries again
+	readRetry
+	// readDisconnected stops the reader with ErrDisconnected
+	readDisconnected
+)
+
+// classifyReadError sorts a read error into transient ones (an interrupted
+// call, a drained non-blocking fd, a short read), the device going away
+// (ENODEV once the kernel removes it, ENOENT when the node is gone) and
+// everything else, which is fatal.
+func classifyReadError(err error) readErrorKind {
+	switch {
+	case errors.Is(err, syscall.EINTR),
+		errors.Is(err, syscall.EAGAIN),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return readRetry
+	case errors.Is(err, syscall.ENODEV),
+		errors.Is(err, syscall.ENXIO),
+		errors.Is(err, fs.ErrNotExist):
+		return readDisconnected
+	default:
+		return readFatal
+	}
+}
@@ -0,0 +1,41 @@
+package keyboard
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyReadError(t *testing.T) {
+	// readErr is an error as os.File.Read returns it for an event node
+	readErr := func(errno syscall.Errno) error {
+		return &fs.PathError{Op: "read", Path: "/dev/input/event3", Err: errno}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want readErrorKind
+	}{
+		{"EINTR", readErr(syscall.EINTR), readRetry},
+		{"EAGAIN", readErr(syscall.EAGAIN), readRetry},
+		{"wrapped EAGAIN", fmt.Errorf("reading event: %w", readErr(syscall.EAGAIN)), readRetry},
+		{"short read", io.ErrUnexpectedEOF, readRetry},
+		{"ENODEV", readErr(syscall.ENODEV), readDisconnected},
+		{"wrapped ENODEV", fmt.Errorf("reading event: %w", readErr(syscall.ENODEV)), readDisconnected},
+		{"ENXIO", readErr(syscall.ENXIO), readDisconnected},
+		{"ENOENT", readErr(syscall.ENOENT), readDisconnected},
+		{"EIO", readErr(syscall.EIO), readFatal},
+		{"EBADF", readErr(syscall.EBADF), readFatal},
+		{"closed file", fs.ErrClosed, readFatal},
+		{"other", errors.New("boom"), readFatal},
+	}
+	for _, tt := range tests {
+		if got := classifyReadError(tt.err); got != tt.want {
+			t.Errorf("%s: classifyReadError(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package keyboard
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// DefaultSeat is the seat of devices udev has not assigned to another one.
+const DefaultSeat = "seat0"
+
+// AnySeat disables seat filtering.
+const AnySeat = "any"
+
+// udevDataDir holds the udev database, one file per device named after its
+// type and device number, e.g. "c13:64".
+const udevDataDir = "/run/udev/data"
+
+const (
+	logindName = "org.freedesktop.login1"
+	logindPath = "/org/freedesktop/login1"
+
+	// seatCallTimeout bounds the logind lookup, so a hung bus does not
+	// hold up startup
+	seatCallTimeout = 2 * time.Second
+)
+
+// CurrentSeat returns the seat of the session asahi-map runs in: XDG_SEAT,
+// which logind sets for graphical sessions, else the seat logind reports
+// for XDG_SESSION_ID or, when that is unset too as under a systemd user
+// service, for the user's display session. It is seat0 when none is known.
+func CurrentSeat() string {
+	if seat := os.Getenv("XDG_SEAT"); seat != "" {
+		return seat
+	}
+	if seat, err := logindSeat(os.Getenv("XDG_SESSION_ID")); err == nil && seat != "" {
+		return seat
+	}
+	return DefaultSeat
+}
+
+// logindSeat asks logind for the seat of session id, or of the user's
+// display session when id is empty. A session without a seat, e.g. over
+// SSH, has the empty seat.
+func logindSeat(id string) (string, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return "", fmt.Errorf("connecting to the system bus: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), seatCallTimeout)
+	defer cancel()
+
+	var session dbus.ObjectPath
+	if id != "" {
+		err = conn.Object(logindName, logindPath).CallWithContext(ctx, logindName+".Manager.GetSession", 0, id).Store(&session)
+	} else {
+		var display struct {
+			ID   string
+			Path dbus.ObjectPath
+		}
+		err = logindProperty(ctx, conn, logindPath+"/user/self", "User", "Display", &display)
+		session = display.Path
+	}
+	if err != nil {
+		return "", err
+	}
+	if session == "" || session == "/" {
+		return "", nil
+	}
+
+	var seat struct {
+		ID   string
+		Path dbus.ObjectPath
+	}
+	if err := logindProperty(ctx, conn, session, "Session", "Seat", &seat); err != nil {
+		return "", err
+	}
+	return seat.ID, nil
+}
+
+// logindProperty stores the property prop of the logind object at path,
+// which has the interface org.freedesktop.login1.<iface>, in v.
+func logindProperty(ctx context.Context, conn *dbus.Conn, path dbus.ObjectPath, iface, prop string, v any) error {
+	var value dbus.Variant
+	err := conn.Object(logindName, path).CallWithContext(ctx, "org.freedesktop.DBus.Properties.Get", 0, logindName+"."+iface, prop).Store(&value)
+	if err != nil {
+		return fmt.Errorf("reading %s.%s of %s: %w", iface, prop, path, err)
+	}
+	return value.Store(v)
+}
+
+// deviceSeat returns the seat udev assigned the event node at path via the
+// ID_SEAT property, seat0 when it has none or the database is unavailable.
+func deviceSeat(path string) string {
+	devnum, err := os.ReadFile(filepath.Join("/sys/class/input", filepath.Base(path), "dev"))
+	if err != nil {
+		return DefaultSeat
+	}
+	f, err := os.Open(filepath.Join(udevDataDir, "c"+strings.TrimSpace(string(devnum))))
+	if err != nil {
+		return DefaultSeat
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if seat, ok := strings.CutPrefix(scanner.Text(), "E:ID_SEAT="); ok && seat != "" {
+			return seat
+		}
+	}
+	return DefaultSeat
+}
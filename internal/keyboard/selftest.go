@@ -0,0 +1,200 @@
+package keyboard
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bendahl/uinput"
+	evdev "github.com/holoplot/go-evdev"
+)
+
+// selfTestChar is the character SelfTest types through Unicode entry.
+const selfTestChar = 'é'
+
+// selfTestTimeout bounds how long SelfTest waits for the device node to
+// appear and for the injected events to come back.
+const selfTestTimeout = 2 * time.Second
+
+// SelfTestResult describes a SelfTest run.
+type SelfTestResult struct {
+	// Node is the event node of the test device, e.g. /dev/input/event21
+	Node string
+
+	// Sent and Received are the key events as "code:value", e.g. "29:1"
+	Sent     []string
+	Received []string
+
+	Duration time.Duration
+}
+
+// Passed reports whether every injected event came back in order.
+func (r *SelfTestResult) Passed() bool {
+	return slices.Equal(r.Sent, r.Received)
+}
+
+// Mismatch describes the first difference between Sent and Received, or ""
+// when the test passed.
+func (r *SelfTestResult) Mismatch() string {
+	for i, sent := range r.Sent {
+		if i >= len(r.Received) {
+			return fmt.Sprintf("event %d (%s) and %d more not received", i+1, sent, len(r.Sent)-i-1)
+		}
+		if r.Received[i] != sent {
+			return fmt.Sprintf("event %d: sent %s, received %s", i+1, sent, r.Received[i])
+		}
+	}
+	if len(r.Received) > len(r.Sent) {
+		return fmt.Sprintf("%d unexpected extra events", len(r.Received)-len(r.Sent))
+	}
+	return ""
+}
+
+// String summarizes the result for logs and the command line.
+func (r *SelfTestResult) String() string {
+	if r.Passed() {
+		return fmt.Sprintf("ok: %d key events read back from %s in %s", len(r.Sent), r.Node, r.Duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("failed: %s (sent %s; received %s)", r.Mismatch(), strings.Join(r.Sent, " "), strings.Join(r.Received, " "))
+}
+
+// SelfTest checks the uinput output end to end. It creates a separate
+// virtual keyboard, grabs its event node so nothing reaches apps, types a
+// character through Unicode entry and reads the key events back. An error
+// means the test could not run, e.g. /dev/uinput or the node is not
+// accessible; a result that did not pass means events were lost or changed.
+func SelfTest(logger *slog.Logger) (*SelfTestResult, error) {
+	start := time.Now()
+	kb, err := uinput.CreateKeyboard("/dev/uinput", []byte("asahi-map-selftest"))
+	if err != nil {
+		return nil, fmt.Errorf("creating test keyboard: %w", err)
+	}
+	defer kb.Close()
+
+	node, err := waitEventNode(kb)
+	if err != nil {
+		return nil, err
+	}
+	input, err := evdev.Open(node)
+	if err != nil {
+		return nil, fmt.Errorf("opening test keyboard %s: %w", node, err)
+	}
+	defer input.Close()
+	if err := input.Grab(); err != nil {
+		return nil, fmt.Errorf("grabbing test keyboard %s: %w", node, err)
+	}
+	if err := input.NonBlock(); err != nil {
+		return nil, fmt.Errorf("setting non-blocking mode on %s: %w", node, err)
+	}
+
+	rec := &recordingKeyboard{Keyboard: kb}
+	vk := &VirtualKeyboard{
+		keyboard:     rec,
+		logger:       logger,
+		pressed:      make(map[int]bool),
+		unicodeEntry: UnicodeEntryGTK,
+	}
+
+	received := make(chan string, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			ev, err := input.ReadOne()
+			if err != nil {
+				return
+			}
+			if ev.Type == evdev.EV_KEY {
+				received <- fmt.Sprintf("%d:%d", ev.Code, ev.Value)
+			}
+		}
+	}()
+
+	if err := vk.TypeUnicode(selfTestChar); err != nil {
+		return nil, fmt.Errorf("typing test character: %w", err)
+	}
+
+	result := &SelfTestResult{Node: node, Sent: rec.events()}
+	timeout := time.After(selfTestTimeout)
+collect:
+	for len(result.Received) < len(result.Sent) {
+		select {
+		case ev := <-received:
+			result.Received = append(result.Received, ev)
+		case <-timeout:
+			break collect
+		}
+	}
+	// Closing the node ends the reader
+	input.Close()
+	<-done
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// waitEventNode returns the /dev/input node of a new uinput device, waiting
+// for udev to create it.
+func waitEventNode(kb uinput.Keyboard) (string, error) {
+	syspath, err := kb.FetchSyspath()
+	if err != nil {
+		return "", fmt.Errorf("finding test keyboard: %w", err)
+	}
+	deadline := time.Now().Add(selfTestTimeout)
+	for {
+		err := errors.New("no event node")
+		if nodes, _ := filepath.Glob(filepath.Join(syspath, "event*")); len(nodes) > 0 {
+			node := filepath.Join("/dev/input", filepath.Base(nodes[0]))
+			var dev *evdev.InputDevice
+			if dev, err = evdev.Open(node); err == nil {
+				dev.Close()
+				return node, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("test keyboard not accessible: %w", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// recordingKeyboard passes calls to a uinput keyboard and records the key
+// events they produce, a tap being a press then a release.
+type recordingKeyboard struct {
+	uinput.Keyboard
+	mu   sync.Mutex
+	sent []string
+}
+
+func (r *recordingKeyboard) record(code int, values ...int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		r.sent = append(r.sent, fmt.Sprintf("%d:%d", code, v))
+	}
+}
+
+func (r *recordingKeyboard) KeyPress(key int) error {
+	r.record(key, 1, 0)
+	return r.Keyboard.KeyPress(key)
+}
+
+func (r *recordingKeyboard) KeyDown(key int) error {
+	r.record(key, 1)
+	return r.Keyboard.KeyDown(key)
+}
+
+func (r *recordingKeyboard) KeyUp(key int) error {
+	r.record(key, 0)
+	return r.Keyboard.KeyUp(key)
+}
+
+func (r *recordingKeyboard) events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.sent)
+}
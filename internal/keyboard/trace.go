@@ -0,0 +1,150 @@
+package keyboard
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// TraceEntry is one call recorded by TraceOutput. Op is "unicode", "string",
+// "copy", "paste", "keysym", "ralt", "shift_ralt", "tap", "chord", "press", "release", "repeat" or
+// "release_all".
+type TraceEntry struct {
+	Op        string `json:"op"`
+	Code      int    `json:"code,omitempty"`
+	Modifiers []int  `json:"modifiers,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Shift     bool   `json:"shift,omitempty"`
+}
+
+// TraceOutput is an Outputter that records what would have been sent instead
+// of touching /dev/uinput, for tests and machines without uinput access.
+type TraceOutput struct {
+	mu      sync.Mutex
+	entries []TraceEntry
+	w       io.Writer
+
+	// pressed holds the keys forwarded down and not yet released
+	pressed map[int]bool
+}
+
+// NewTraceOutput creates a TraceOutput. When w is not nil, every entry is
+// also written to it as a JSON line.
+func NewTraceOutput(w io.Writer) *TraceOutput {
+	return &TraceOutput{w: w, pressed: make(map[int]bool)}
+}
+
+var _ Outputter = (*TraceOutput)(nil)
+
+func (t *TraceOutput) record(e TraceEntry) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entries = append(t.entries, e)
+	if t.w == nil {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = t.w.Write(append(data, '\n'))
+	return err
+}
+
+// Entries returns a copy of everything recorded so far.
+func (t *TraceOutput) Entries() []TraceEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TraceEntry(nil), t.entries...)
+}
+
+// Reset discards the recorded entries.
+func (t *TraceOutput) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = nil
+}
+
+func (t *TraceOutput) TypeUnicode(r rune) error {
+	return t.record(TraceEntry{Op: "unicode", Text: string(r)})
+}
+
+func (t *TraceOutput) TypeString(s string) error {
+	return t.record(TraceEntry{Op: "string", Text: s})
+}
+
+func (t *TraceOutput) CopyText(s string) error {
+	return t.record(TraceEntry{Op: "copy", Text: s})
+}
+
+func (t *TraceOutput) PasteClipboard() error {
+	return t.record(TraceEntry{Op: "paste"})
+}
+
+func (t *TraceOutput) TypeKeysym(r rune) error {
+	return t.record(TraceEntry{Op: "keysym", Text: string(r)})
+}
+
+func (t *TraceOutput) PassthroughWithRAlt(keyCode int) error {
+	return t.record(TraceEntry{Op: "ralt", Code: keyCode})
+}
+
+func (t *TraceOutput) PassthroughWithShiftRAlt(keyCode int, shiftAlreadyDown bool) error {
+	return t.record(TraceEntry{Op: "shift_ralt", Code: keyCode, Shift: shiftAlreadyDown})
+}
+
+func (t *TraceOutput) TapKey(code int) error {
+	return t.record(TraceEntry{Op: "tap", Code: code})
+}
+
+func (t *TraceOutput) TapChord(modifiers []int, key int) error {
+	return t.record(TraceEntry{Op: "chord", Code: key, Modifiers: append([]int(nil), modifiers...)})
+}
+
+func (t *TraceOutput) ForwardEvent(code uint16, value int32) error {
+	op := "press"
+	switch value {
+	case 0:
+		op = "release"
+	case 2:
+		op = "repeat"
+	}
+	t.mu.Lock()
+	if value == 0 {
+		delete(t.pressed, int(code))
+	} else {
+		t.pressed[int(code)] = true
+	}
+	t.mu.Unlock()
+	return t.record(TraceEntry{Op: op, Code: int(code)})
+}
+
+// SetHexKeys is a no-op: traces record characters, not hex keystrokes.
+func (t *TraceOutput) SetHexKeys(keys map[rune]KeyChord) {}
+
+// SetUnicodeConfirm is a no-op: traces record characters, not the key
+// confirming their entry.
+func (t *TraceOutput) SetUnicodeConfirm(name string) {}
+
+// HeldKeys returns the keys forwarded down and not released since.
+func (t *TraceOutput) HeldKeys() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	codes := make([]int, 0, len(t.pressed))
+	for code := range t.pressed {
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func (t *TraceOutput) ReleaseAll() error {
+	t.mu.Lock()
+	clear(t.pressed)
+	t.mu.Unlock()
+	return t.record(TraceEntry{Op: "release_all"})
+}
+
+func (t *TraceOutput) Close() error {
+	return nil
+}
@@ -0,0 +1,83 @@
+package keyboard
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bendahl/uinput"
+)
+
+// UnicodeEntry describes how a desktop's input method accepts a character
+// typed as hex: Trigger starts entry, the digits follow, Confirm commits it.
+type UnicodeEntry struct {
+	Name    string
+	Trigger KeyChord
+	Confirm int
+}
+
+var (
+	// UnicodeEntryGTK is the IBus/GTK Ctrl+Shift+U entry confirmed with Space.
+	UnicodeEntryGTK = UnicodeEntry{
+		Name:    "gtk",
+		Trigger: KeyChord{Modifiers: []int{uinput.KeyLeftctrl, uinput.KeyLeftshift}, Key: uinput.KeyU},
+		Confirm: uinput.KeySpace,
+	}
+
+	// UnicodeEntryKDE is Ctrl+Shift+U as handled by the Qt input method
+	// frontends on Plasma, where Space may be inserted after the character;
+	// Enter commits without it.
+	UnicodeEntryKDE = UnicodeEntry{
+		Name:    "kde",
+		Trigger: KeyChord{Modifiers: []int{uinput.KeyLeftctrl, uinput.KeyLeftshift}, Key: uinput.KeyU},
+		Confirm: uinput.KeyEnter,
+	}
+)
+
+// UnicodeEntryFor returns the entry method called name. "auto" or "" picks
+// one from XDG_CURRENT_DESKTOP, falling back to GTK.
+func UnicodeEntryFor(name string) (UnicodeEntry, error) {
+	switch name {
+	case "", "auto":
+		return DetectUnicodeEntry(), nil
+	case "gtk":
+		return UnicodeEntryGTK, nil
+	case "kde":
+		return UnicodeEntryKDE, nil
+	}
+	return UnicodeEntry{}, fmt.Errorf("unknown unicode input method %q (want auto, gtk or kde)", name)
+}
+
+// unicodeConfirmKeys are the keys WithConfirm accepts; "none" leaves the
+// entry unconfirmed, for input methods that commit on their own.
+var unicodeConfirmKeys = map[string]int{
+	"space": uinput.KeySpace,
+	"enter": uinput.KeyEnter,
+	"none":  0,
+}
+
+// WithConfirm returns e confirmed with the key called name: "space",
+// "enter" or "none". An empty name keeps e's own key.
+func (e UnicodeEntry) WithConfirm(name string) (UnicodeEntry, error) {
+	if name == "" {
+		return e, nil
+	}
+	key, ok := unicodeConfirmKeys[name]
+	if !ok {
+		return e, fmt.Errorf("unknown unicode confirm key %q (want space, enter or none)", name)
+	}
+	e.Confirm = key
+	return e, nil
+}
+
+// DetectUnicodeEntry picks the entry method for the running desktop.
+func DetectUnicodeEntry() UnicodeEntry {
+	// XDG_CURRENT_DESKTOP is a colon-separated list such as "KDE" or
+	// "ubuntu:GNOME"
+	for _, desktop := range strings.Split(os.Getenv("XDG_CURRENT_DESKTOP"), ":") {
+		if strings.EqualFold(desktop, "KDE") {
+			return UnicodeEntryKDE
+		}
+	}
+	return UnicodeEntryGTK
+}
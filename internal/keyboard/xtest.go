@@ -0,0 +1,44 @@
+package keyboard
+
+import (
+	"github.com/uplg/asahi-map/internal/xtest"
+)
+
+// XTestOutputter types text on X11 through the XTEST extension, mapping
+// each character to a spare keycode, for apps that ignore Ctrl+Shift+U
+// entry. Keys and everything else go to the wrapped Outputter.
+type XTestOutputter struct {
+	Outputter
+	typer *xtest.Typer
+}
+
+var _ Outputter = (*XTestOutputter)(nil)
+
+// NewXTestOutputter connects to the X server in DISPLAY. It fails outside
+// X11 sessions.
+func NewXTestOutputter(out Outputter) (*XTestOutputter, error) {
+	typer, err := xtest.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &XTestOutputter{Outputter: out, typer: typer}, nil
+}
+
+func (x *XTestOutputter) TypeUnicode(r rune) error {
+	return x.typer.TypeRune(r)
+}
+
+func (x *XTestOutputter) TypeString(s string) error {
+	for _, r := range s {
+		if err := x.typer.TypeRune(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close disconnects from the X server and closes the wrapped Outputter.
+func (x *XTestOutputter) Close() error {
+	x.typer.Close()
+	return x.Outputter.Close()
+}
@@ -0,0 +1,146 @@
+// Package logfile writes logs to a file that is rotated by size, so a
+// session started from the tray, with no terminal, keeps its logs.
+package logfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Writer appends to a log file and rotates it once it would grow past
+// maxSize: path becomes path.1, path.1 becomes path.2 and so on, keeping
+// backups old files.
+type Writer struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// Open opens path for appending, creating it and its directory if needed.
+// maxSize <= 0 disables rotation; backups is how many rotated files are kept,
+// 0 truncating the log instead.
+func Open(path string, maxSize int64, backups int) (*Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("creating log directory: %w", err)
+	}
+	w := &Writer{path: path, maxSize: maxSize, backups: max(backups, 0)}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// Write appends p, rotating first when p would push the file past maxSize.
+// A single record larger than maxSize is still written whole. When rotation
+// fails p goes to the current file anyway and the rotation error is
+// returned; the next write tries again.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	var rotateErr error
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		rotateErr = w.rotate()
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate shifts the backups along, dropping the oldest, and starts a new
+// file at path. The current file stays open until the new one is, so a
+// failure leaves logging where it was.
+func (w *Writer) rotate() error {
+	if w.backups == 0 {
+		// Appends go to the new end of the truncated file
+		if err := w.file.Truncate(0); err != nil {
+			return fmt.Errorf("rotating log file: %w", err)
+		}
+		w.size = 0
+		return nil
+	}
+	for i := w.backups - 1; i >= 1; i-- {
+		err := os.Rename(w.backup(i), w.backup(i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("rotating log file: %w", err)
+		}
+	}
+	if err := os.Rename(w.path, w.backup(1)); err != nil {
+		return fmt.Errorf("rotating log file: %w", err)
+	}
+	old := w.file
+	if err := w.open(); err != nil {
+		// Put the file back so the next attempt finds it at path
+		if err := os.Rename(w.backup(1), w.path); err != nil {
+			return fmt.Errorf("rotating log file: %w", err)
+		}
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+func (w *Writer) backup(n int) string {
+	return fmt.Sprintf("%s.%d", w.path, n)
+}
+
+// Close closes the file. Later writes fail.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// Tee returns a writer that writes to every w. Unlike io.MultiWriter a
+// failing writer does not stop the others, so logs still reach the file when
+// stderr is closed; the first error is returned.
+func Tee(writers ...io.Writer) io.Writer {
+	return tee(writers)
+}
+
+type tee []io.Writer
+
+func (t tee) Write(p []byte) (int, error) {
+	var firstErr error
+	for _, w := range t {
+		if _, err := w.Write(p); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return len(p), firstErr
+}
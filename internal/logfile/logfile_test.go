@@ -0,0 +1,94 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asahi-map.log")
+	w, err := Open(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{path: "third\n", path + ".1": "second\n", path + ".2": "first\n"} {
+		if got := readFile(t, name); got != want {
+			t.Errorf("%s: %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+}
+
+func TestRotateFailureKeepsLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asahi-map.log")
+	w, err := Open(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// A directory where the backup goes makes the rename fail
+	if err := os.Mkdir(path+".1", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path+".1", "keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := w.Write([]byte("second\n")); err == nil || n != len("second\n") {
+		t.Fatalf("write during failed rotation: n %d, err %v", n, err)
+	}
+	if got := readFile(t, path); got != "first\nsecond\n" {
+		t.Fatalf("log %q, want both lines", got)
+	}
+
+	// The next write rotates once the backup can be written
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("third\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != "third\n" {
+		t.Errorf("log %q, want the third line", got)
+	}
+	if got := readFile(t, path+".1"); got != "first\nsecond\n" {
+		t.Errorf("backup %q, want the first two lines", got)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asahi-map.log")
+	w, err := Open(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readFile(t, path); got != "second\n" {
+		t.Errorf("log %q, want only the second line", got)
+	}
+}
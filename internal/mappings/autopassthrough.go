@@ -0,0 +1,64 @@
+package mappings
+
+// usIntlAltGr holds the characters of the US International (AltGr dead
+// keys) layout, us(altgr-intl), at the AltGr and Shift+AltGr levels of the
+// letter and digit keys. Keys whose level is a dead key, or the plain
+// letter again, are left out or empty.
+var usIntlAltGr = map[string][2]string{
+	"1": {"¹", "¡"},
+	"2": {"²", ""},
+	"3": {"³", ""},
+	"4": {"¤", "£"},
+	"5": {"€", ""},
+	"6": {"", "¼"},
+	"7": {"", "½"},
+	"8": {"", "¾"},
+	"9": {"‘", ""},
+	"0": {"’", ""},
+	"a": {"á", "Á"},
+	"c": {"©", "¢"},
+	"d": {"ð", "Ð"},
+	"e": {"é", "É"},
+	"i": {"í", "Í"},
+	"j": {"ï", "Ï"},
+	"k": {"œ", "Œ"},
+	"l": {"ø", "Ø"},
+	"m": {"µ", "µ"},
+	"n": {"ñ", "Ñ"},
+	"o": {"ó", "Ó"},
+	"p": {"ö", "Ö"},
+	"q": {"ä", "Ä"},
+	"r": {"ë", "Ë"},
+	"s": {"ß", "§"},
+	"t": {"þ", "Þ"},
+	"u": {"ú", "Ú"},
+	"v": {"®", "®"},
+	"w": {"å", "Å"},
+	"x": {"œ", "Œ"},
+	"y": {"ü", "Ü"},
+	"z": {"æ", "Æ"},
+}
+
+// expandAutoPassthrough adds a passthrough Mapping, declaring its
+// character, for every letter and digit key the US International layout
+// has a character on at the AltGr levels, unless the layout maps the key
+// itself. Explicit mappings and ranges always win.
+func (l *Layout) expandAutoPassthrough() {
+	if !l.AutoPassthrough {
+		return
+	}
+	if l.Alt == nil {
+		l.Alt = make(map[string]Mapping)
+	}
+	if l.ShiftAlt == nil {
+		l.ShiftAlt = make(map[string]Mapping)
+	}
+	for key, chars := range usIntlAltGr {
+		if _, mapped := l.Alt[key]; !mapped && chars[0] != "" {
+			l.Alt[key] = Mapping{Passthrough: key, Char: chars[0]}
+		}
+		if _, mapped := l.ShiftAlt[key]; !mapped && chars[1] != "" {
+			l.ShiftAlt[key] = Mapping{Passthrough: key, Char: chars[1]}
+		}
+	}
+}
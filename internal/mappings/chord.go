@@ -0,0 +1,70 @@
+package mappings
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Chord is a key pressed while holding zero or more modifiers,
+// written as "ctrl+shift+4" in layouts.
+type Chord struct {
+	Modifiers []KeyCode
+	Key       KeyCode
+}
+
+// modifierNames maps chord modifier names to the key that is held.
+var modifierNames = map[string]KeyCode{
+	"ctrl":  KEY_LEFTCTRL,
+	"shift": KEY_LEFTSHIFT,
+	"alt":   KEY_LEFTALT,
+	"altgr": KEY_RIGHTALT,
+	"ralt":  KEY_RIGHTALT,
+	"meta":  KEY_LEFTMETA,
+	"super": KEY_LEFTMETA,
+}
+
+// ParseChord parses "mod+mod+key". Modifiers are ctrl, shift, alt,
+// altgr/ralt and meta/super; the key must be a known key name.
+func ParseChord(s string) (Chord, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(s)), "+")
+
+	var chord Chord
+	for _, mod := range parts[:len(parts)-1] {
+		code, ok := modifierNames[strings.TrimSpace(mod)]
+		if !ok {
+			return Chord{}, fmt.Errorf("unknown modifier %q in %q", mod, s)
+		}
+		chord.Modifiers = append(chord.Modifiers, code)
+	}
+
+	key := strings.TrimSpace(parts[len(parts)-1])
+	code, ok := NameToKeyCode[key]
+	if !ok {
+		return Chord{}, fmt.Errorf("unknown key %q in %q", key, s)
+	}
+	chord.Key = code
+	return chord, nil
+}
+
+// ParseChords parses a list of chords, stopping at the first invalid one.
+func ParseChords(keys []string) ([]Chord, error) {
+	chords := make([]Chord, 0, len(keys))
+	for _, k := range keys {
+		chord, err := ParseChord(k)
+		if err != nil {
+			return nil, err
+		}
+		chords = append(chords, chord)
+	}
+	return chords, nil
+}
+
+// HasModifier reports whether the chord holds the given modifier key.
+func (c Chord) HasModifier(code KeyCode) bool {
+	for _, m := range c.Modifiers {
+		if m == code {
+			return true
+		}
+	}
+	return false
+}
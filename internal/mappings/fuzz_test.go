@@ -0,0 +1,73 @@
+package mappings
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"unicode/utf8"
+
+	"github.com/uplg/asahi-map/configs"
+)
+
+const fuzzDeadKeyLayout = `name: fuzz
+alt:
+  e: {dead_key: true, dead_key_id: acute}
+  u: {dead_key: true, dead_key_id: diaeresis}
+dead_keys:
+  acute:
+    base: "´"
+    combining: "́"
+    combinations: {e: "é", a: "á", E: "É"}
+  diaeresis:
+    base: "¨"
+    shift_cancels: true
+    combinations: {u: "ü", o: "ö"}
+`
+
+// FuzzLayout loads random layouts and types random keys through their dead
+// keys, which must never panic or produce invalid UTF-8.
+func FuzzLayout(f *testing.F) {
+	layouts, err := fs.Glob(configs.Layouts, "layouts/*.yaml")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range layouts {
+		data, err := fs.ReadFile(configs.Layouts, name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data, []byte{18, 18, 57, 30})
+	}
+	f.Add([]byte(fuzzDeadKeyLayout), []byte{18, 30, 22, 22, 24, 18, 2, 18, 57})
+
+	f.Fuzz(func(t *testing.T, data, keys []byte) {
+		layout, err := LoadLayoutFS(fstest.MapFS{"layout.yaml": {Data: data}}, "layout.yaml")
+		if err != nil {
+			return
+		}
+		lookup := NewKeyLookup(layout)
+		ids := sortedKeys(layout.DeadKeys)
+
+		for i, b := range keys {
+			name, ok := KeyName(KeyCode(b))
+			if !ok {
+				continue
+			}
+			// A dead key combo starts a dead key, any other key ends it
+			if m := lookup.LookupAlt(name); m != nil && m.IsDeadKey {
+				if text, repeated := lookup.RepeatDeadKey(m.DeadKeyID); repeated && !utf8.ValidString(text) {
+					t.Fatalf("repeating dead key %q typed invalid UTF-8 %q", m.DeadKeyID, text)
+				}
+				lookup.SetDeadKey(m.DeadKeyID)
+				continue
+			}
+			if !lookup.HasActiveDeadKey() && len(ids) > 0 {
+				lookup.SetDeadKey(ids[i%len(ids)])
+			}
+			result := lookup.ApplyDeadKey(name, i%3 == 0)
+			if !utf8.ValidString(result.Text) {
+				t.Fatalf("dead key %q with %q typed invalid UTF-8 %q", result.ID, name, result.Text)
+			}
+		}
+	})
+}
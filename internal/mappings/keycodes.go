@@ -60,13 +60,55 @@ const (
 	KEY_DOT        KeyCode = 52
 	KEY_SLASH      KeyCode = 53
 	KEY_RIGHTSHIFT KeyCode = 54
+	KEY_KPASTERISK KeyCode = 55
 	KEY_LEFTALT    KeyCode = 56
 	KEY_SPACE      KeyCode = 57
 	KEY_CAPSLOCK   KeyCode = 58
+	KEY_F1         KeyCode = 59
+	KEY_F2         KeyCode = 60
+	KEY_F3         KeyCode = 61
+	KEY_F4         KeyCode = 62
+	KEY_F5         KeyCode = 63
+	KEY_F6         KeyCode = 64
+	KEY_F7         KeyCode = 65
+	KEY_F8         KeyCode = 66
+	KEY_F9         KeyCode = 67
+	KEY_F10        KeyCode = 68
+	KEY_NUMLOCK    KeyCode = 69
+	KEY_KP7        KeyCode = 71
+	KEY_KP8        KeyCode = 72
+	KEY_KP9        KeyCode = 73
+	KEY_KPMINUS    KeyCode = 74
+	KEY_KP4        KeyCode = 75
+	KEY_KP5        KeyCode = 76
+	KEY_KP6        KeyCode = 77
+	KEY_KPPLUS     KeyCode = 78
+	KEY_KP1        KeyCode = 79
+	KEY_KP2        KeyCode = 80
+	KEY_KP3        KeyCode = 81
+	KEY_KP0        KeyCode = 82
+	KEY_KPDOT      KeyCode = 83
 	KEY_102ND      KeyCode = 86
+	KEY_F11        KeyCode = 87
+	KEY_F12        KeyCode = 88
+	KEY_KPENTER    KeyCode = 96
+	KEY_RIGHTCTRL  KeyCode = 97
+	KEY_KPSLASH    KeyCode = 98
 	KEY_RIGHTALT   KeyCode = 100
+	KEY_HOME       KeyCode = 102
+	KEY_UP         KeyCode = 103
+	KEY_PAGEUP     KeyCode = 104
+	KEY_LEFT       KeyCode = 105
+	KEY_RIGHT      KeyCode = 106
+	KEY_END        KeyCode = 107
+	KEY_DOWN       KeyCode = 108
+	KEY_PAGEDOWN   KeyCode = 109
+	KEY_DELETE     KeyCode = 111
+	KEY_KPEQUAL    KeyCode = 117
+	KEY_KPCOMMA    KeyCode = 121
 	KEY_LEFTMETA   KeyCode = 125
 	KEY_RIGHTMETA  KeyCode = 126
+	KEY_FN         KeyCode = 464
 )
 
 // KeyCodeToName maps key codes to their string names (lowercase).
@@ -119,15 +161,90 @@ var KeyCodeToName = map[KeyCode]string{
 	KEY_DOT:        "dot",
 	KEY_SLASH:      "slash",
 	KEY_SPACE:      "space",
+	KEY_TAB:        "tab",
+	KEY_ENTER:      "enter",
+	KEY_BACKSPACE:  "backspace",
+	KEY_ESC:        "esc",
 	KEY_102ND:      "102nd",
+	KEY_UP:         "up",
+	KEY_LEFT:       "left",
+	KEY_RIGHT:      "right",
+	KEY_DOWN:       "down",
+	KEY_HOME:       "home",
+	KEY_END:        "end",
+	KEY_PAGEUP:     "pageup",
+	KEY_PAGEDOWN:   "pagedown",
+	KEY_DELETE:     "delete",
+	KEY_LEFTCTRL:   "leftctrl",
+	KEY_RIGHTCTRL:  "rightctrl",
+	KEY_LEFTSHIFT:  "leftshift",
+	KEY_RIGHTSHIFT: "rightshift",
+	KEY_LEFTALT:    "leftalt",
+	KEY_RIGHTALT:   "rightalt",
+	KEY_LEFTMETA:   "leftmeta",
+	KEY_RIGHTMETA:  "rightmeta",
+	KEY_CAPSLOCK:   "capslock",
+	KEY_FN:         "fn",
+	KEY_F1:         "f1",
+	KEY_F2:         "f2",
+	KEY_F3:         "f3",
+	KEY_F4:         "f4",
+	KEY_F5:         "f5",
+	KEY_F6:         "f6",
+	KEY_F7:         "f7",
+	KEY_F8:         "f8",
+	KEY_F9:         "f9",
+	KEY_F10:        "f10",
+	KEY_F11:        "f11",
+	KEY_F12:        "f12",
+
+	// Keypad keys keep their codes whatever the NumLock state, so Option
+	// mappings on them do not depend on it
+	KEY_NUMLOCK:    "numlock",
+	KEY_KP0:        "kp0",
+	KEY_KP1:        "kp1",
+	KEY_KP2:        "kp2",
+	KEY_KP3:        "kp3",
+	KEY_KP4:        "kp4",
+	KEY_KP5:        "kp5",
+	KEY_KP6:        "kp6",
+	KEY_KP7:        "kp7",
+	KEY_KP8:        "kp8",
+	KEY_KP9:        "kp9",
+	KEY_KPDOT:      "kpdot",
+	KEY_KPCOMMA:    "kpcomma",
+	KEY_KPPLUS:     "kpplus",
+	KEY_KPMINUS:    "kpminus",
+	KEY_KPASTERISK: "kpasterisk",
+	KEY_KPSLASH:    "kpslash",
+	KEY_KPEQUAL:    "kpequal",
+	KEY_KPENTER:    "kpenter",
 }
 
 // NameToKeyCode is the reverse mapping.
 var NameToKeyCode map[string]KeyCode
 
+// keyNames holds KeyCodeToName for codes below 256, so the name of a typed
+// key is an array index rather than a map lookup
+var keyNames [256]string
+
 func init() {
 	NameToKeyCode = make(map[string]KeyCode, len(KeyCodeToName))
 	for code, name := range KeyCodeToName {
 		NameToKeyCode[name] = code
+		if int(code) < len(keyNames) {
+			keyNames[code] = name
+		}
+	}
+}
+
+// KeyName returns the name of code, as KeyCodeToName has it; ok is false
+// for keys without one.
+func KeyName(code KeyCode) (name string, ok bool) {
+	if int(code) < len(keyNames) {
+		name = keyNames[code]
+		return name, name != ""
 	}
+	name, ok = KeyCodeToName[code]
+	return name, ok
 }
@@ -3,26 +3,115 @@ package mappings
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Layout represents a keyboard layout with Option key mappings.
 type Layout struct {
+	// Version is the file format, LayoutVersion for current files; older
+	// ones are upgraded when read
+	Version int `yaml:"version,omitempty"`
+
 	Name        string `yaml:"name"`
 	Description string `yaml:"description"`
 
+	// Mode is LayoutFull (the default) for layouts meant to cover the whole
+	// Option layer, or LayoutSparse for ones that map only a few keys and
+	// leave the rest to the system keymap
+	Mode string `yaml:"mode,omitempty"`
+
 	// Alt key mappings: key -> unicode codepoint or string
 	Alt map[string]Mapping `yaml:"alt"`
 
+	// AltTable names a CSV or TSV file of key,output rows, relative to the
+	// layout file, merged into Alt when the layout is read; see readAltTable
+	AltTable string `yaml:"alt_table,omitempty"`
+
 	// Shift+Alt key mappings
 	ShiftAlt map[string]Mapping `yaml:"shift_alt"`
 
+	// FnAlt mappings apply to Option+key while the Fn key of an Apple
+	// keyboard is held, with or without Shift; keys it leaves out use Alt
+	// and ShiftAlt as usual
+	FnAlt map[string]Mapping `yaml:"fn_alt,omitempty"`
+
+	// Ranges map runs of digit or letter keys to consecutive codepoints;
+	// they are expanded into Alt and ShiftAlt when the layout is read
+	Ranges []Range `yaml:"ranges,omitempty"`
+
+	// AutoPassthrough fills letter and digit keys the layout leaves
+	// unmapped with passthrough mappings to the same key's AltGr level, as
+	// the US International layout has it; see expandAutoPassthrough
+	AutoPassthrough bool `yaml:"auto_passthrough,omitempty"`
+
 	// Dead keys for accented characters
 	DeadKeys map[string]DeadKey `yaml:"dead_keys"`
+
+	// Modifiers reassigns which physical keys act as Option, Shift and Meta
+	Modifiers ModifierRoles `yaml:"modifiers,omitempty"`
+
+	// HexKeys sets the chord typing each hex digit (0-9, a-f) during
+	// Ctrl+Shift+U Unicode entry, e.g. "1": "shift+1" on AZERTY. Digits not
+	// listed use the AZERTY defaults.
+	HexKeys map[string]string `yaml:"hex_keys,omitempty"`
+
+	// UnicodeConfirm is the key committing Unicode entry while the layout
+	// is active: "space", "enter" or "none". Empty keeps the global
+	// unicode_confirm.
+	UnicodeConfirm string `yaml:"unicode_confirm,omitempty"`
+
+	// Shortcodes adds emoji shortcodes, e.g. "smile": "😄", to the built-in
+	// ones typed after a shortcode mapping; an empty emoji removes a
+	// built-in one
+	Shortcodes map[string]string `yaml:"shortcodes,omitempty"`
+
+	// AllowControlChars permits control and bidi format characters in
+	// outputs. Off by default so shared layouts cannot type them.
+	AllowControlChars bool `yaml:"allow_control_chars,omitempty"`
+
+	// fileVersion is the Version the file was written in
+	fileVersion int
+
+	// tableHidden are AltTable keys that inline Alt mappings override
+	tableHidden []string
+}
+
+// Layout modes for Layout.Mode.
+const (
+	// LayoutFull layouts are checked for letter and digit keys without a
+	// mapping
+	LayoutFull = "full"
+	// LayoutSparse layouts only map some keys on purpose; the others reach
+	// apps unchanged and are not reported
+	LayoutSparse = "sparse"
+)
+
+// Sparse reports whether the layout maps only some keys on purpose.
+func (l *Layout) Sparse() bool {
+	return l.Mode == LayoutSparse
 }
 
+// Output methods for Mapping.Method.
+const (
+	// MethodHex types each character with Unicode hex entry (Ctrl+Shift+U)
+	MethodHex = "hex"
+	// MethodPassthrough types each character with the AltGr keystroke a
+	// passthrough mapping declares for it, falling back to hex entry
+	MethodPassthrough = "passthrough"
+	// MethodClipboard copies the text to the clipboard and pastes it
+	MethodClipboard = "clipboard"
+	// MethodKeysym types each character as an X keysym through wtype or
+	// xdotool
+	MethodKeysym = "keysym"
+)
+
 // Mapping represents a single key mapping.
 type Mapping struct {
 	// Output can be a single Unicode character or codepoint
@@ -39,6 +128,130 @@ type Mapping struct {
 	// For key pass-through with Shift (e.g., Alt-N -> Shift+RAlt-N for ~)
 	// Used when the XKB layout has the desired character at level 4 (Shift+AltGr)
 	PassthroughShift string `yaml:"passthrough_shift,omitempty"`
+
+	// Sequence types one character with several keystrokes that the
+	// system layout composes, each a chord as in Keys, e.g.
+	// ["altgr+apostrophe", "e"] for é through an AltGr dead acute
+	Sequence []string `yaml:"sequence,omitempty"`
+
+	// CursorBack moves the cursor left this many times after typing the
+	// full Char, e.g. char "()" with cursor_back 1 leaves it between the pair
+	CursorBack int `yaml:"cursor_back,omitempty"`
+
+	// Keys plays a sequence of key chords such as "ctrl+shift+4"
+	Keys []string `yaml:"keys,omitempty"`
+
+	// AlsoForward sends the original key after the mapped output
+	AlsoForward bool `yaml:"also_forward,omitempty"`
+
+	// Transform rewrites the char or codepoint output before it is typed:
+	// nfc, nfd, nfkc, nfkd, upper, lower or fold
+	Transform string `yaml:"transform,omitempty"`
+
+	// Method picks how the char or codepoint output is typed, one of the
+	// Method constants; empty uses a known AltGr keystroke, else hex entry
+	Method string `yaml:"method,omitempty"`
+
+	// NoRepeat types the output once per press, ignoring auto-repeat while
+	// the key is held. Keys chords and dead keys never repeat anyway.
+	NoRepeat bool `yaml:"no_repeat,omitempty"`
+
+	// Next maps follow-up key names to the text typed when that key comes
+	// next, e.g. "i": "ﬁ" on Option+f. Any other key types this mapping's
+	// own output first.
+	Next map[string]string `yaml:"next,omitempty"`
+
+	// ContextPair holds two texts: the first is typed at the start of the
+	// text, after whitespace or after opening punctuation, the second
+	// anywhere else, e.g. ["“", "”"] for smart quotes
+	ContextPair []string `yaml:"context_pair,omitempty"`
+
+	// Shortcode starts emoji shortcode entry: the keys typed next spell a
+	// shortcode such as "smile", and the mapping's combo again (the closing
+	// colon) or a complete unambiguous shortcode types its emoji
+	Shortcode bool `yaml:"shortcode,omitempty"`
+
+	// Label names the mapping for people, e.g. "em dash". It does not
+	// change the output; logs and -stats show it.
+	Label string `yaml:"label,omitempty"`
+
+	// chords holds Keys parsed when the lookup is built, steps Sequence
+	chords []Chord
+	steps  []Chord
+}
+
+// Repeats reports whether holding the key re-runs the mapping on
+// auto-repeat: character and passthrough outputs do unless NoRepeat is set,
+// dead keys and key chords never do.
+func (m *Mapping) Repeats() bool {
+	return !m.NoRepeat && !m.IsDeadKey && len(m.Keys) == 0
+}
+
+// Chords returns the parsed Keys sequence.
+func (m *Mapping) Chords() []Chord {
+	return m.chords
+}
+
+// SequenceSteps returns the parsed Sequence.
+func (m *Mapping) SequenceSteps() []Chord {
+	return m.steps
+}
+
+// String describes the mapping for logs, e.g. "char=é", "deadkey=acute"
+// or "passthrough=5+ralt", followed by any options it sets.
+func (m Mapping) String() string {
+	var parts []string
+	switch {
+	case m.IsDeadKey:
+		parts = append(parts, "deadkey="+m.DeadKeyID)
+	case m.Passthrough != "":
+		parts = append(parts, "passthrough="+m.Passthrough+"+ralt")
+	case m.PassthroughShift != "":
+		parts = append(parts, "passthrough="+m.PassthroughShift+"+shift+ralt")
+	case len(m.Sequence) > 0:
+		parts = append(parts, "sequence="+strings.Join(m.Sequence, ","))
+	case len(m.Keys) > 0:
+		parts = append(parts, "keys="+strings.Join(m.Keys, ","))
+	case len(m.ContextPair) > 0:
+		parts = append(parts, "context_pair="+strings.Join(m.ContextPair, "/"))
+	case m.Shortcode:
+		parts = append(parts, "shortcode")
+	}
+	if m.Codepoint != 0 {
+		parts = append(parts, fmt.Sprintf("codepoint=U+%04X", m.Codepoint))
+	} else if m.Char != "" {
+		parts = append(parts, "char="+m.Char)
+	}
+	if m.Transform != "" {
+		parts = append(parts, "transform="+m.Transform)
+	}
+	if m.Method != "" {
+		parts = append(parts, "method="+m.Method)
+	}
+	if m.CursorBack > 0 {
+		parts = append(parts, fmt.Sprintf("cursor_back=%d", m.CursorBack))
+	}
+	if len(m.Next) > 0 {
+		keys := make([]string, 0, len(m.Next))
+		for key := range m.Next {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		parts = append(parts, "next="+strings.Join(keys, ","))
+	}
+	if m.NoRepeat {
+		parts = append(parts, "no_repeat")
+	}
+	if m.AlsoForward {
+		parts = append(parts, "also_forward")
+	}
+	if m.Label != "" {
+		parts = append(parts, fmt.Sprintf("label=%q", m.Label))
+	}
+	if len(parts) == 0 {
+		return "empty"
+	}
+	return strings.Join(parts, " ")
 }
 
 // DeadKey represents a dead key accent that combines with the next character.
@@ -46,27 +259,96 @@ type DeadKey struct {
 	// Base accent character (shown when followed by space)
 	Base string `yaml:"base"`
 
+	// Combining is the mark placed after a letter that has no combination,
+	// e.g. U+0301 for an acute whose Base is the spacing "´". Without it
+	// the letter follows Base.
+	Combining string `yaml:"combining,omitempty"`
+
 	// Combinations: base letter -> accented letter
 	Combinations map[string]string `yaml:"combinations"`
+
+	// ShiftCancels clears the dead key when the next key is typed with
+	// Shift, forwarding the capital letter instead of composing
+	ShiftCancels bool `yaml:"shift_cancels,omitempty"`
 }
 
-// GetOutput returns the Unicode character or codepoint for this mapping.
-func (m *Mapping) GetOutput() (rune, bool) {
+// String describes the dead key for logs, e.g. "base=´ combinations=10".
+func (dk DeadKey) String() string {
+	s := fmt.Sprintf("base=%s combinations=%d", dk.Base, len(dk.Combinations))
+	if dk.ShiftCancels {
+		s += " shift_cancels"
+	}
+	if dk.Combining != "" {
+		s += fmt.Sprintf(" combining=U+%04X", []rune(dk.Combining)[0])
+	}
+	return s
+}
+
+// GetOutputString returns the full output of a char or codepoint mapping,
+// which may be several runes such as a letter followed by combining marks or
+// an emoji with a variation selector, after Transform. Handlers should type
+// all of it.
+func (m *Mapping) GetOutputString() string {
+	text := m.Char
 	if m.Codepoint != 0 {
-		return rune(m.Codepoint), true
+		text = string(rune(m.Codepoint))
 	}
-	if m.Char != "" {
-		runes := []rune(m.Char)
-		if len(runes) > 0 {
-			return runes[0], true
-		}
+	return applyTransform(m.Transform, text)
+}
+
+// ContextOutput returns the opening or closing text of the mapping's
+// context pair, after its transform; "" when it has no pair.
+func (m *Mapping) ContextOutput(opening bool) string {
+	if len(m.ContextPair) != 2 {
+		return ""
 	}
-	return 0, false
+	if opening {
+		return applyTransform(m.Transform, m.ContextPair[0])
+	}
+	return applyTransform(m.Transform, m.ContextPair[1])
+}
+
+// GetOutput returns the character this mapping outputs. ok is false when the
+// output is empty, invalid or more than one rune; use GetOutputString to get
+// the whole output.
+func (m *Mapping) GetOutput() (rune, bool) {
+	text := m.GetOutputString()
+	r, size := utf8.DecodeRuneInString(text)
+	if text == "" || size != len(text) || r == utf8.RuneError {
+		return 0, false
+	}
+	return r, true
 }
 
 // LoadLayout reads a layout file from disk.
 func LoadLayout(path string) (*Layout, error) {
-	data, err := os.ReadFile(path)
+	return LoadLayoutFS(os.DirFS(filepath.Dir(path)), filepath.Base(path))
+}
+
+// LoadLayoutFS reads a layout file from fsys (e.g. the embedded layout set).
+func LoadLayoutFS(fsys fs.FS, name string) (*Layout, error) {
+	layout, err := ReadLayoutFS(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, issue := range layout.Validate() {
+		if issue.Severity == SeverityError {
+			errs = append(errs, issue.String())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid layout: %s", strings.Join(errs, "; "))
+	}
+
+	return layout, nil
+}
+
+// ReadLayoutFS parses a layout file without validating it, for tools that
+// report every issue instead of stopping at the first error.
+func ReadLayoutFS(fsys fs.FS, name string) (*Layout, error) {
+	data, err := fs.ReadFile(fsys, name)
 	if err != nil {
 		return nil, fmt.Errorf("reading layout file: %w", err)
 	}
@@ -75,7 +357,14 @@ func LoadLayout(path string) (*Layout, error) {
 	if err := yaml.Unmarshal(data, &layout); err != nil {
 		return nil, fmt.Errorf("parsing layout file: %w", err)
 	}
-
+	if err := layout.expandRanges(); err != nil {
+		return nil, fmt.Errorf("parsing layout file: %w", err)
+	}
+	if err := layout.readAltTable(fsys, name); err != nil {
+		return nil, fmt.Errorf("parsing layout file: %w", err)
+	}
+	layout.expandAutoPassthrough()
+	layout.migrate()
 	return &layout, nil
 }
 
@@ -84,7 +373,25 @@ type KeyLookup struct {
 	layout        *Layout
 	altMap        map[string]*Mapping
 	shiftAltMap   map[string]*Mapping
+	fnAltMap      map[string]*Mapping
+	modifiers     *modifierMap
+	direct        map[rune]DirectKey
+	hexKeys       map[rune]Chord
+	shortcodes    map[string]string
 	activeDeadKey *DeadKey
+	activeDeadID  string
+
+	// The maps indexed by key code, for the lookups made on every event
+	altCodes      codeTable
+	shiftAltCodes codeTable
+	fnAltCodes    codeTable
+}
+
+// DirectKey is an AltGr keystroke known to produce a character, learned from
+// passthrough mappings that also declare their char.
+type DirectKey struct {
+	Key   string
+	Shift bool
 }
 
 func NewKeyLookup(layout *Layout) *KeyLookup {
@@ -92,17 +399,57 @@ func NewKeyLookup(layout *Layout) *KeyLookup {
 		layout:      layout,
 		altMap:      make(map[string]*Mapping),
 		shiftAltMap: make(map[string]*Mapping),
+		fnAltMap:    make(map[string]*Mapping),
+		direct:      make(map[rune]DirectKey),
+		shortcodes:  buildShortcodes(layout),
 	}
 
 	// Build lookup maps for O(1) access
 	for k, v := range layout.Alt {
 		mapping := v // Create copy to avoid pointer issues
+		// Chords were validated at load, parse errors cannot happen here
+		mapping.chords, _ = ParseChords(mapping.Keys)
+		mapping.steps, _ = ParseChords(mapping.Sequence)
 		kl.altMap[k] = &mapping
 	}
 	for k, v := range layout.ShiftAlt {
 		mapping := v
+		mapping.chords, _ = ParseChords(mapping.Keys)
+		mapping.steps, _ = ParseChords(mapping.Sequence)
 		kl.shiftAltMap[k] = &mapping
 	}
+	for k, v := range layout.FnAlt {
+		mapping := v
+		mapping.chords, _ = ParseChords(mapping.Keys)
+		mapping.steps, _ = ParseChords(mapping.Sequence)
+		kl.fnAltMap[k] = &mapping
+	}
+
+	kl.altCodes.fill(kl.altMap)
+	kl.shiftAltCodes.fill(kl.shiftAltMap)
+	kl.fnAltCodes.fill(kl.fnAltMap)
+
+	// Passthrough mappings that name their character tell us which AltGr
+	// keystroke produces it, which beats Unicode hex entry elsewhere
+	for _, m := range kl.altMap {
+		if r, ok := m.GetOutput(); ok && m.Passthrough != "" {
+			kl.addDirect(r, DirectKey{Key: m.Passthrough})
+		}
+	}
+	for _, m := range kl.shiftAltMap {
+		if r, ok := m.GetOutput(); ok && m.Passthrough != "" {
+			kl.addDirect(r, DirectKey{Key: m.Passthrough, Shift: true})
+		}
+	}
+	for _, m := range kl.altMap {
+		if r, ok := m.GetOutput(); ok && m.PassthroughShift != "" {
+			kl.addDirect(r, DirectKey{Key: m.PassthroughShift, Shift: true})
+		}
+	}
+
+	// Role assignments were validated at load
+	kl.modifiers, _ = buildModifierMap(layout.Modifiers)
+	kl.hexKeys, _ = parseHexKeys(layout.HexKeys)
 
 	return kl
 }
@@ -117,10 +464,134 @@ func (kl *KeyLookup) LookupShiftAlt(key string) *Mapping {
 	return kl.shiftAltMap[key]
 }
 
+// LookupFnAlt returns the mapping for Fn+Alt+key.
+func (kl *KeyLookup) LookupFnAlt(key string) *Mapping {
+	return kl.fnAltMap[key]
+}
+
+// LookupAltCode is LookupAlt by key code.
+func (kl *KeyLookup) LookupAltCode(code KeyCode) *Mapping {
+	return kl.altCodes.lookup(code, kl.altMap)
+}
+
+// LookupShiftAltCode is LookupShiftAlt by key code.
+func (kl *KeyLookup) LookupShiftAltCode(code KeyCode) *Mapping {
+	return kl.shiftAltCodes.lookup(code, kl.shiftAltMap)
+}
+
+// LookupFnAltCode is LookupFnAlt by key code.
+func (kl *KeyLookup) LookupFnAltCode(code KeyCode) *Mapping {
+	return kl.fnAltCodes.lookup(code, kl.fnAltMap)
+}
+
+// codeTable holds the mappings of a section by key code, for codes below
+// 256; the rare keys above are looked up by name.
+type codeTable [256]*Mapping
+
+// fill indexes the mappings of m whose key name has a code in the table.
+func (t *codeTable) fill(m map[string]*Mapping) {
+	for name, mapping := range m {
+		if code, ok := NameToKeyCode[name]; ok && int(code) < len(t) {
+			t[code] = mapping
+		}
+	}
+}
+
+// lookup returns the mapping for code, from m when code is beyond the table.
+func (t *codeTable) lookup(code KeyCode, m map[string]*Mapping) *Mapping {
+	if int(code) < len(t) {
+		return t[code]
+	}
+	name, ok := KeyCodeToName[code]
+	if !ok {
+		return nil
+	}
+	return m[name]
+}
+
+// addDirect records a keystroke for r. An unshifted keystroke wins over one
+// that needs Shift; ties go to the lowest key name so the choice does not
+// depend on map order.
+func (kl *KeyLookup) addDirect(r rune, key DirectKey) {
+	if existing, ok := kl.direct[r]; ok {
+		if existing.Shift != key.Shift {
+			if key.Shift {
+				return
+			}
+		} else if existing.Key <= key.Key {
+			return
+		}
+	}
+	kl.direct[r] = key
+}
+
+// DirectKey returns the AltGr keystroke that types r, if the layout has one.
+func (kl *KeyLookup) DirectKey(r rune) (DirectKey, bool) {
+	key, ok := kl.direct[r]
+	return key, ok
+}
+
+// HexKeys returns the layout's hex digit chords, nil when it sets none.
+func (kl *KeyLookup) HexKeys() map[rune]Chord {
+	return kl.hexKeys
+}
+
+// ParseHexEntryKeys parses a hex digit table that replaces every layout's,
+// such as the hex_entry_keys config setting. Unlike a layout's hex_keys it
+// must list all sixteen digits.
+func ParseHexEntryKeys(keys map[string]string) (map[rune]Chord, error) {
+	chords, err := parseHexKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, d := range "0123456789abcdef" {
+		if _, ok := chords[d]; !ok {
+			missing = append(missing, string(d))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing hex digits %s", strings.Join(missing, ", "))
+	}
+	return chords, nil
+}
+
+// parseHexKeys parses a hex_keys table keyed by single hex digits.
+func parseHexKeys(keys map[string]string) (map[rune]Chord, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	chords := make(map[rune]Chord, len(keys))
+	for _, digit := range sortedKeys(keys) {
+		d := strings.ToLower(digit)
+		if len(d) != 1 || !strings.Contains("0123456789abcdef", d) {
+			return nil, fmt.Errorf("%q is not a hex digit", digit)
+		}
+		chord, err := ParseChord(keys[digit])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", digit, err)
+		}
+		chords[rune(d[0])] = chord
+	}
+	return chords, nil
+}
+
+// UnicodeConfirm returns the layout's Unicode entry confirm key name, empty
+// when it keeps the global one.
+func (kl *KeyLookup) UnicodeConfirm() string {
+	return kl.layout.UnicodeConfirm
+}
+
+// AllowControlChars reports whether the layout opted in to typing unsafe characters.
+func (kl *KeyLookup) AllowControlChars() bool {
+	return kl.layout.AllowControlChars
+}
+
 // SetDeadKey activates a dead key for the next character.
 func (kl *KeyLookup) SetDeadKey(id string) {
 	if dk, ok := kl.layout.DeadKeys[id]; ok {
 		kl.activeDeadKey = &dk
+		kl.activeDeadID = id
 	}
 }
 
@@ -129,25 +600,109 @@ func (kl *KeyLookup) ClearDeadKey() {
 	kl.activeDeadKey = nil
 }
 
+// RepeatDeadKey handles a dead key's combo pressed while that same dead key
+// is active: it clears the dead key and returns its base, to be typed
+// alone. ok is false, and nothing changes, when id is not the active dead
+// key.
+func (kl *KeyLookup) RepeatDeadKey(id string) (text string, ok bool) {
+	dk := kl.activeDeadKey
+	if dk == nil || kl.activeDeadID != id {
+		return "", false
+	}
+	kl.activeDeadKey = nil
+	return dk.Base, true
+}
+
+// ActiveDeadKey returns the active dead key, or nil.
+func (kl *KeyLookup) ActiveDeadKey() *DeadKey {
+	return kl.activeDeadKey
+}
+
 // HasActiveDeadKey returns true if a dead key is active.
 func (kl *KeyLookup) HasActiveDeadKey() bool {
 	return kl.activeDeadKey != nil
 }
 
-// ApplyDeadKey attempts to combine the active dead key with a character.
-// Returns the combined character, or the base accent if no combination exists.
-func (kl *KeyLookup) ApplyDeadKey(char string) (string, bool) {
+// Dead key outcomes for DeadKeyResult.Outcome, naming the rule that
+// produced the text.
+const (
+	DeadKeyInactive    = "inactive"
+	DeadKeyBare        = "bare"
+	DeadKeyCombination = "combination"
+	DeadKeyCapitalized = "capitalized"
+	DeadKeyCombining   = "combining"
+	DeadKeyFallback    = "fallback"
+	DeadKeyForwarded   = "forwarded"
+)
+
+// DeadKeyResult is what ApplyDeadKey made of a dead key and the next key.
+type DeadKeyResult struct {
+	// ID is the dead key that was active, empty if none was
+	ID string
+
+	// Text is typed, then the key itself when Forward is set
+	Text    string
+	Forward bool
+
+	// Outcome is one of the DeadKey outcome constants
+	Outcome string
+}
+
+// ApplyDeadKey combines the active dead key with the next key, given by its
+// key name, and clears it. The result holds the text to type and whether
+// the key itself should then be forwarded. Space yields the bare accent. With shift,
+// an uppercase combination is used when listed, otherwise the lowercase one
+// is capitalised. A letter that does not combine is typed with the
+// combining mark after it, or after the bare accent without one; any other
+// key, such as a digit or punctuation, is forwarded after the
+// accent so the system layout types its own symbol.
+func (kl *KeyLookup) ApplyDeadKey(key string, shift bool) DeadKeyResult {
 	if kl.activeDeadKey == nil {
-		return char, false
+		return DeadKeyResult{Forward: true, Outcome: DeadKeyInactive}
 	}
 
 	dk := kl.activeDeadKey
 	kl.activeDeadKey = nil
+	result := func(text string, forward bool, outcome string) DeadKeyResult {
+		return DeadKeyResult{ID: kl.activeDeadID, Text: text, Forward: forward, Outcome: outcome}
+	}
+
+	if key == "space" {
+		return result(dk.Base, false, DeadKeyBare)
+	}
+
+	if shift {
+		if combined, ok := dk.Combinations[strings.ToUpper(key)]; ok {
+			return result(combined, false, DeadKeyCombination)
+		}
+		if combined, ok := dk.Combinations[key]; ok {
+			return result(strings.ToUpper(combined), false, DeadKeyCapitalized)
+		}
+	} else if combined, ok := dk.Combinations[key]; ok {
+		return result(combined, false, DeadKeyCombination)
+	}
+
+	if !isLetterName(key) {
+		return result(dk.Base, true, DeadKeyForwarded)
+	}
+	if shift {
+		key = strings.ToUpper(key)
+	}
+	if dk.Combining != "" {
+		return result(key+dk.Combining, false, DeadKeyCombining)
+	}
+	return result(dk.Base+key, false, DeadKeyFallback)
+}
 
-	if combined, ok := dk.Combinations[char]; ok {
-		return combined, true
+// ActiveDeadKeyID returns the id of the active dead key, empty if none.
+func (kl *KeyLookup) ActiveDeadKeyID() string {
+	if kl.activeDeadKey == nil {
+		return ""
 	}
+	return kl.activeDeadID
+}
 
-	// No combination found, return accent + original char
-	return dk.Base + char, true
+// isLetterName reports whether key names a letter key (a-z).
+func isLetterName(key string) bool {
+	return len(key) == 1 && key[0] >= 'a' && key[0] <= 'z'
 }
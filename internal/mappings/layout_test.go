@@ -0,0 +1,158 @@
+package mappings
+
+import (
+	"testing"
+
+	"github.com/uplg/asahi-map/configs"
+)
+
+// loadShipped loads a layout shipped in configs/layouts.
+func loadShipped(t *testing.T, name string) *Layout {
+	t.Helper()
+	layout, err := LoadLayoutFS(configs.Layouts, "layouts/"+name+".yaml")
+	if err != nil {
+		t.Fatalf("loading %s: %v", name, err)
+	}
+	return layout
+}
+
+func TestQwertyMacNumberRow(t *testing.T) {
+	lookup := NewKeyLookup(loadShipped(t, "qwerty-mac"))
+
+	tests := []struct {
+		key      string
+		alt      string
+		shiftAlt string
+	}{
+		{"1", "¡", "⁄"},
+		{"2", "™", "€"},
+		{"3", "£", "‹"},
+		{"4", "¢", "›"},
+		{"5", "∞", "ﬁ"},
+		{"6", "§", "ﬂ"},
+		{"7", "¶", "‡"},
+		{"8", "•", "°"},
+		{"9", "ª", "·"},
+		{"0", "º", "‚"},
+		{"minus", "–", "—"},
+		{"equal", "≠", "±"},
+	}
+	for _, tt := range tests {
+		for _, v := range []struct {
+			mapping *Mapping
+			want    string
+			shift   bool
+		}{
+			{lookup.LookupAlt(tt.key), tt.alt, false},
+			{lookup.LookupShiftAlt(tt.key), tt.shiftAlt, true},
+		} {
+			if v.mapping == nil {
+				t.Errorf("%s (shift %v): no mapping", tt.key, v.shift)
+				continue
+			}
+			if got := v.mapping.GetOutputString(); got != v.want {
+				t.Errorf("%s (shift %v): types %q, want %q", tt.key, v.shift, got, v.want)
+			}
+			if v.mapping.Passthrough != tt.key {
+				t.Errorf("%s (shift %v): passthrough %q, want %q", tt.key, v.shift, v.mapping.Passthrough, tt.key)
+			}
+
+			r := []rune(v.want)[0]
+			key, ok := lookup.DirectKey(r)
+			if want := (DirectKey{Key: tt.key, Shift: v.shift}); !ok || key != want {
+				t.Errorf("DirectKey(%q) = %+v, %v; want %+v", v.want, key, ok, want)
+			}
+		}
+	}
+}
+
+func TestDirectKeyPreference(t *testing.T) {
+	layout := &Layout{
+		Alt: map[string]Mapping{
+			"b": {Passthrough: "b", Char: "x"},
+			"a": {Passthrough: "a", Char: "x"},
+			"c": {Passthrough: "c", Char: "y"},
+			// Without a char the keystroke's output is unknown
+			"d": {Passthrough: "d"},
+		},
+		ShiftAlt: map[string]Mapping{
+			"a": {Passthrough: "a", Char: "y"},
+			"b": {Passthrough: "b", Char: "z"},
+		},
+	}
+	lookup := NewKeyLookup(layout)
+
+	tests := []struct {
+		char rune
+		want DirectKey
+		ok   bool
+	}{
+		// Ties go to the lowest key name
+		{'x', DirectKey{Key: "a"}, true},
+		// An unshifted keystroke beats a shifted one
+		{'y', DirectKey{Key: "c"}, true},
+		{'z', DirectKey{Key: "b", Shift: true}, true},
+		{'w', DirectKey{}, false},
+	}
+	for _, tt := range tests {
+		key, ok := lookup.DirectKey(tt.char)
+		if key != tt.want || ok != tt.ok {
+			t.Errorf("DirectKey(%q) = %+v, %v; want %+v, %v", tt.char, key, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestGraveDeadKey(t *testing.T) {
+	lookup := NewKeyLookup(loadShipped(t, "qwerty-mac"))
+	if m := lookup.LookupAlt("grave"); m == nil || !m.IsDeadKey || m.DeadKeyID != "grave" {
+		t.Fatalf("Option+` is %v, want the grave dead key", m)
+	}
+
+	tests := []struct {
+		key     string
+		shift   bool
+		text    string
+		outcome string
+	}{
+		{"a", false, "à", DeadKeyCombination},
+		{"e", false, "è", DeadKeyCombination},
+		{"space", false, "`", DeadKeyBare},
+		{"a", true, "À", DeadKeyCapitalized},
+		{"e", true, "È", DeadKeyCapitalized},
+	}
+	for _, tt := range tests {
+		lookup.SetDeadKey("grave")
+		got := lookup.ApplyDeadKey(tt.key, tt.shift)
+		if got.Text != tt.text || got.Forward || got.Outcome != tt.outcome || got.ID != "grave" {
+			t.Errorf("grave then %s (shift %v) = %+v, want %q %s", tt.key, tt.shift, got, tt.text, tt.outcome)
+		}
+		if lookup.HasActiveDeadKey() {
+			t.Errorf("grave then %s left the dead key active", tt.key)
+		}
+	}
+}
+
+func TestDeadKeyNonLetters(t *testing.T) {
+	lookup := NewKeyLookup(&Layout{DeadKeys: map[string]DeadKey{
+		"acute": {Base: "´", Combining: "́", Combinations: map[string]string{"e": "é"}},
+	}})
+
+	// Digits and punctuation type the accent, then reach apps themselves
+	for _, key := range []string{"1", "0", "comma", "dot", "semicolon", "slash", "minus"} {
+		for _, shift := range []bool{false, true} {
+			lookup.SetDeadKey("acute")
+			got := lookup.ApplyDeadKey(key, shift)
+			want := DeadKeyResult{ID: "acute", Text: "´", Forward: true, Outcome: DeadKeyForwarded}
+			if got != want {
+				t.Errorf("acute then %s (shift %v) = %+v, want %+v", key, shift, got, want)
+			}
+		}
+	}
+
+	// A letter without a combination takes the combining mark instead
+	lookup.SetDeadKey("acute")
+	want := DeadKeyResult{ID: "acute", Text: "x́", Outcome: DeadKeyCombining}
+	if got := lookup.ApplyDeadKey("x", false); got != want {
+		t.Errorf("acute then x = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,33 @@
+package mappings
+
+// LayoutVersion is the layout file format this asahi-map reads. Files
+// without a version field are version 0, from before it was added.
+const LayoutVersion = 1
+
+// layoutMigrations upgrade a layout one version at a time: entry i turns
+// version i into version i+1. Append one whenever a field changes meaning
+// or default, so older files keep behaving as they did.
+var layoutMigrations = []func(*Layout){
+	// 0 to 1 only added the version field
+	func(*Layout) {},
+}
+
+// migrate upgrades an older layout to LayoutVersion in memory, remembering
+// the version it was written in. Newer and invalid versions are left for
+// Validate to report.
+func (l *Layout) migrate() {
+	l.fileVersion = l.Version
+	if l.Version < 0 || l.Version >= LayoutVersion {
+		return
+	}
+	for v := l.Version; v < LayoutVersion; v++ {
+		layoutMigrations[v](l)
+	}
+	l.Version = LayoutVersion
+}
+
+// Upgraded returns the version an older layout file was written in, and
+// whether it was upgraded to LayoutVersion when read.
+func (l *Layout) Upgraded() (from int, ok bool) {
+	return l.fileVersion, l.fileVersion >= 0 && l.fileVersion < LayoutVersion
+}
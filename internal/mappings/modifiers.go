@@ -0,0 +1,96 @@
+package mappings
+
+import "fmt"
+
+// ModifierRoles assigns physical keys to modifier roles, for keyboards
+// where Option, Shift or Command are not on the usual keys. A role that is
+// set replaces its default keys entirely.
+type ModifierRoles struct {
+	Option []string `yaml:"option,omitempty"`
+	Shift  []string `yaml:"shift,omitempty"`
+	Meta   []string `yaml:"meta,omitempty"`
+}
+
+// modifierRole describes one role: its default physical keys and the
+// logical keys assigned keys act as (first key left, second right).
+type modifierRole struct {
+	name     string
+	defaults []KeyCode
+	logical  []KeyCode
+}
+
+var modifierRoleTable = []modifierRole{
+	{"option", []KeyCode{KEY_LEFTALT}, []KeyCode{KEY_LEFTALT}},
+	{"shift", []KeyCode{KEY_LEFTSHIFT, KEY_RIGHTSHIFT}, []KeyCode{KEY_LEFTSHIFT, KEY_RIGHTSHIFT}},
+	{"meta", []KeyCode{KEY_LEFTMETA, KEY_RIGHTMETA}, []KeyCode{KEY_LEFTMETA, KEY_RIGHTMETA}},
+}
+
+func (r *ModifierRoles) keys(role string) []string {
+	switch role {
+	case "option":
+		return r.Option
+	case "shift":
+		return r.Shift
+	case "meta":
+		return r.Meta
+	}
+	return nil
+}
+
+// modifierMap translates physical key codes into logical modifier codes.
+type modifierMap struct {
+	logical   map[KeyCode]KeyCode
+	displaced map[KeyCode]bool
+}
+
+// buildModifierMap resolves role assignments. It returns nil when no role
+// is overridden, so the common case costs nothing.
+func buildModifierMap(roles ModifierRoles) (*modifierMap, error) {
+	mm := &modifierMap{
+		logical:   make(map[KeyCode]KeyCode),
+		displaced: make(map[KeyCode]bool),
+	}
+
+	overridden := false
+	for _, role := range modifierRoleTable {
+		names := roles.keys(role.name)
+		if len(names) == 0 {
+			continue
+		}
+		overridden = true
+
+		for _, code := range role.defaults {
+			mm.displaced[code] = true
+		}
+		for i, name := range names {
+			code, ok := NameToKeyCode[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown key %q for modifier %s", name, role.name)
+			}
+			mm.logical[code] = role.logical[min(i, len(role.logical)-1)]
+		}
+	}
+
+	if !overridden {
+		return nil, nil
+	}
+
+	// A displaced key that got another role is not displaced
+	for code := range mm.logical {
+		delete(mm.displaced, code)
+	}
+	return mm, nil
+}
+
+// TranslateModifier maps a physical key code to the logical code the
+// handler should treat it as. displaced is true for default modifier keys
+// whose role was moved elsewhere; they should be forwarded as plain keys.
+func (kl *KeyLookup) TranslateModifier(code KeyCode) (logical KeyCode, displaced bool) {
+	if kl.modifiers == nil {
+		return code, false
+	}
+	if l, ok := kl.modifiers.logical[code]; ok {
+		return l, false
+	}
+	return code, kl.modifiers.displaced[code]
+}
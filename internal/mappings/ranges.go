@@ -0,0 +1,89 @@
+package mappings
+
+import "fmt"
+
+// Range maps a run of digit or letter keys to consecutive codepoints, e.g.
+// from "1" to "9" starting at U+2460 gives ① to ⑨.
+type Range struct {
+	// Section is the mapping table to fill: alt (default) or shift_alt
+	Section string `yaml:"section,omitempty"`
+
+	// From and To are the first and last keys, both digits or both letters.
+	// Digits run 0 to 9 and letters a to z.
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+
+	// Start is the codepoint typed by From; each following key types the
+	// next one
+	Start uint32 `yaml:"start"`
+}
+
+// expandRanges adds a codepoint Mapping for every key covered by the
+// layout's ranges. A key already mapped explicitly or by an earlier range in
+// the same section is an error rather than silently replaced.
+func (l *Layout) expandRanges() error {
+	for i, r := range l.Ranges {
+		keys, err := rangeKeys(r.From, r.To)
+		if err != nil {
+			return fmt.Errorf("ranges[%d]: %w", i, err)
+		}
+		if r.Start == 0 {
+			return fmt.Errorf("ranges[%d]: start codepoint is required", i)
+		}
+
+		var target *map[string]Mapping
+		switch r.Section {
+		case "", "alt":
+			target = &l.Alt
+		case "shift_alt":
+			target = &l.ShiftAlt
+		default:
+			return fmt.Errorf("ranges[%d]: unknown section %q, want alt or shift_alt", i, r.Section)
+		}
+		if *target == nil {
+			*target = make(map[string]Mapping)
+		}
+
+		for j, key := range keys {
+			if _, exists := (*target)[key]; exists {
+				return fmt.Errorf("ranges[%d]: key %q is already mapped in %s", i, key, sectionName(r.Section))
+			}
+			(*target)[key] = Mapping{Codepoint: r.Start + uint32(j)}
+		}
+	}
+	return nil
+}
+
+// rangeKeys returns the key names from from to to inclusive.
+func rangeKeys(from, to string) ([]string, error) {
+	if len(from) != 1 || len(to) != 1 || rangeClass(from[0]) == 0 || rangeClass(from[0]) != rangeClass(to[0]) {
+		return nil, fmt.Errorf("from %q and to %q must both be digits or both letters", from, to)
+	}
+	if from[0] > to[0] {
+		return nil, fmt.Errorf("from %q comes after to %q", from, to)
+	}
+
+	keys := make([]string, 0, to[0]-from[0]+1)
+	for c := from[0]; c <= to[0]; c++ {
+		keys = append(keys, string(c))
+	}
+	return keys, nil
+}
+
+// rangeClass returns '0' for digits, 'a' for letters and 0 otherwise.
+func rangeClass(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return '0'
+	case c >= 'a' && c <= 'z':
+		return 'a'
+	}
+	return 0
+}
+
+func sectionName(section string) string {
+	if section == "" {
+		return "alt"
+	}
+	return section
+}
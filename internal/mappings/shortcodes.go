@@ -0,0 +1,82 @@
+package mappings
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/uplg/asahi-map/configs"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultShortcodes parses the built-in emoji shortcodes once.
+var defaultShortcodes = sync.OnceValue(func() map[string]string {
+	var codes map[string]string
+	if err := yaml.Unmarshal(configs.Emoji, &codes); err != nil {
+		panic(fmt.Sprintf("built-in emoji shortcodes: %v", err))
+	}
+	return codes
+})
+
+// ShortcodeRune returns the character a key adds to a shortcode being
+// typed. Keys are read at their US QWERTY position, like dead key
+// combinations: letters and digits type themselves, minus types "-", or
+// "_" with Shift, and Shift+equal types "+".
+func ShortcodeRune(key string, shift bool) (rune, bool) {
+	if len(key) == 1 && (isLetterName(key) || key[0] >= '0' && key[0] <= '9') {
+		return rune(key[0]), true
+	}
+	switch {
+	case key == "minus" && shift:
+		return '_', true
+	case key == "minus":
+		return '-', true
+	case key == "equal" && shift:
+		return '+', true
+	}
+	return 0, false
+}
+
+// validShortcode reports whether every character of name can be typed
+// during shortcode entry.
+func validShortcode(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("_-+", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildShortcodes merges the layout's shortcodes over the built-in ones; an
+// empty emoji removes a built-in shortcode.
+func buildShortcodes(layout *Layout) map[string]string {
+	codes := make(map[string]string, len(defaultShortcodes())+len(layout.Shortcodes))
+	for name, emoji := range defaultShortcodes() {
+		codes[name] = emoji
+	}
+	for name, emoji := range layout.Shortcodes {
+		if emoji == "" {
+			delete(codes, name)
+			continue
+		}
+		codes[name] = emoji
+	}
+	return codes
+}
+
+// MatchShortcode looks up a shortcode being typed. It returns the emoji when
+// code is a complete shortcode, and reports whether a longer shortcode
+// starts with code.
+func (kl *KeyLookup) MatchShortcode(code string) (emoji string, longer bool) {
+	emoji = kl.shortcodes[code]
+	for name := range kl.shortcodes {
+		if len(name) > len(code) && strings.HasPrefix(name, code) {
+			return emoji, true
+		}
+	}
+	return emoji, false
+}
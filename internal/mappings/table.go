@@ -0,0 +1,94 @@
+package mappings
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// readAltTable merges the rows of AltTable into Alt. The table is a CSV
+// file, or TSV when named .tsv, of key,output rows next to the layout file
+// name in fsys; lines starting with # are comments and a first row of
+// "key,output" is a header. Outputs are text, or a codepoint written as
+// U+2200. Inline alt mappings win over the table; the keys they hide are
+// kept for Validate.
+func (l *Layout) readAltTable(fsys fs.FS, name string) error {
+	if l.AltTable == "" {
+		return nil
+	}
+	table := path.Join(path.Dir(name), l.AltTable)
+	if !fs.ValidPath(table) {
+		return fmt.Errorf("alt_table %q must be in the layout's directory or below it", l.AltTable)
+	}
+	data, err := fs.ReadFile(fsys, table)
+	if err != nil {
+		return fmt.Errorf("reading alt_table: %w", err)
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	if strings.EqualFold(path.Ext(table), ".tsv") {
+		r.Comma = '\t'
+		r.LazyQuotes = true
+	}
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+
+	if l.Alt == nil {
+		l.Alt = make(map[string]Mapping)
+	}
+	rows := make(map[string]int)
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("alt_table %s: %w", l.AltTable, err)
+		}
+		line, _ := r.FieldPos(0)
+		key := strings.ToLower(strings.TrimSpace(record[0]))
+		if len(rows) == 0 && key == "key" {
+			continue
+		}
+
+		if _, ok := NameToKeyCode[key]; !ok {
+			return fmt.Errorf("alt_table %s line %d: unknown key name %q", l.AltTable, line, record[0])
+		}
+		if first, dup := rows[key]; dup {
+			return fmt.Errorf("alt_table %s line %d: key %q is already on line %d", l.AltTable, line, key, first)
+		}
+		rows[key] = line
+		mapping, err := tableMapping(record[1])
+		if err != nil {
+			return fmt.Errorf("alt_table %s line %d: %w", l.AltTable, line, err)
+		}
+
+		if _, inline := l.Alt[key]; inline {
+			l.tableHidden = append(l.tableHidden, key)
+			continue
+		}
+		l.Alt[key] = mapping
+	}
+	return nil
+}
+
+// tableMapping returns the Mapping typing a table row's output.
+func tableMapping(output string) (Mapping, error) {
+	if output == "" {
+		return Mapping{}, errors.New("empty output")
+	}
+	if hex, ok := strings.CutPrefix(strings.ToUpper(output), "U+"); ok {
+		cp, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return Mapping{}, fmt.Errorf("invalid codepoint %q", output)
+		}
+		return Mapping{Codepoint: uint32(cp)}, nil
+	}
+	return Mapping{Char: output}, nil
+}
@@ -0,0 +1,40 @@
+package mappings
+
+import (
+	"sort"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// transforms are the text transforms a mapping can apply to its output
+// before it is typed. Casers keep state, so a new one is made per call.
+var transforms = map[string]func(string) string{
+	"nfc":   norm.NFC.String,
+	"nfd":   norm.NFD.String,
+	"nfkc":  norm.NFKC.String,
+	"nfkd":  norm.NFKD.String,
+	"upper": func(s string) string { return cases.Upper(language.Und).String(s) },
+	"lower": func(s string) string { return cases.Lower(language.Und).String(s) },
+	"fold":  func(s string) string { return cases.Fold().String(s) },
+}
+
+// TransformNames lists the supported transform values, sorted.
+func TransformNames() []string {
+	names := make([]string, 0, len(transforms))
+	for name := range transforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyTransform runs text through the named transform. An empty or unknown
+// name, which Validate reports, leaves text unchanged.
+func applyTransform(name, text string) string {
+	if fn, ok := transforms[name]; ok {
+		return fn(text)
+	}
+	return text
+}
@@ -0,0 +1,322 @@
+package mappings
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Severity classifies a layout validation issue.
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Issue describes a problem found while validating a layout.
+type Issue struct {
+	Severity Severity
+	Section  string // "alt", "shift_alt", "dead_keys"
+	Key      string
+	Message  string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s: %s[%s]: %s", i.Severity, i.Section, i.Key, i.Message)
+}
+
+// unsafeRanges are codepoints rejected as output unless a layout sets
+// allow_control_chars: C0/C1 controls and DEL, bidi embedding, override and
+// isolate controls, and line/paragraph separators.
+var unsafeRanges = []struct{ lo, hi rune }{
+	{0x0000, 0x001F},
+	{0x007F, 0x009F},
+	{0x061C, 0x061C},
+	{0x200E, 0x200F},
+	{0x2028, 0x202E},
+	{0x2066, 0x2069},
+}
+
+// IsSafeRune reports whether r may be typed without an explicit opt-in.
+// Invalid codepoints (surrogates, out of range) are never safe.
+func IsSafeRune(r rune) bool {
+	if !utf8.ValidRune(r) {
+		return false
+	}
+	for _, rg := range unsafeRanges {
+		if r >= rg.lo && r <= rg.hi {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the layout for problems. Unsafe output characters are
+// errors unless AllowControlChars is set, in which case they are warnings.
+func (l *Layout) Validate() []Issue {
+	var issues []Issue
+
+	unsafe := SeverityError
+	if l.AllowControlChars {
+		unsafe = SeverityWarning
+	}
+
+	checkString := func(section, key, s string) {
+		if !utf8.ValidString(s) {
+			issues = append(issues, Issue{SeverityError, section, key, "output is not valid UTF-8"})
+			return
+		}
+		if strings.ContainsRune(s, utf8.RuneError) {
+			issues = append(issues, Issue{SeverityWarning, section, key, "output contains U+FFFD, the file may not be saved as UTF-8"})
+		}
+		for _, r := range s {
+			if !IsSafeRune(r) {
+				issues = append(issues, Issue{unsafe, section, key, fmt.Sprintf("unsafe character U+%04X in output", r)})
+			}
+		}
+	}
+
+	// Characters a passthrough mapping declares with char, which
+	// method: passthrough can type
+	direct := make(map[rune]bool)
+	for _, m := range []map[string]Mapping{l.Alt, l.ShiftAlt, l.FnAlt} {
+		for _, mapping := range m {
+			if r, ok := mapping.GetOutput(); ok && (mapping.Passthrough != "" || mapping.PassthroughShift != "") {
+				direct[r] = true
+			}
+		}
+	}
+
+	referenced := make(map[string]bool)
+	checkMappings := func(section string, m map[string]Mapping) {
+		for _, key := range sortedKeys(m) {
+			mapping := m[key]
+			if _, ok := NameToKeyCode[key]; !ok {
+				issues = append(issues, Issue{SeverityWarning, section, key, "unknown key name, this mapping never applies"})
+			}
+			for _, target := range []string{mapping.Passthrough, mapping.PassthroughShift} {
+				if _, ok := NameToKeyCode[target]; target != "" && !ok {
+					issues = append(issues, Issue{SeverityWarning, section, key, fmt.Sprintf("unknown passthrough key %q", target)})
+				}
+			}
+			if msg := outputConflict(mapping); msg != "" {
+				issues = append(issues, Issue{SeverityWarning, section, key, msg})
+			}
+			for _, next := range sortedKeys(mapping.Next) {
+				if _, ok := NameToKeyCode[next]; !ok {
+					issues = append(issues, Issue{SeverityWarning, section, key, fmt.Sprintf("unknown key name %q in next", next)})
+				}
+				checkString(section, key+".next."+next, mapping.Next[next])
+			}
+			if mapping.Codepoint != 0 && !utf8.ValidRune(rune(mapping.Codepoint)) {
+				issues = append(issues, Issue{SeverityError, section, key, fmt.Sprintf("codepoint U+%04X is a surrogate or out of range", mapping.Codepoint)})
+			} else if mapping.Codepoint != 0 && !IsSafeRune(rune(mapping.Codepoint)) {
+				issues = append(issues, Issue{unsafe, section, key, fmt.Sprintf("unsafe codepoint U+%04X", mapping.Codepoint)})
+			}
+			checkString(section, key, mapping.Char)
+			if n := len(mapping.ContextPair); n > 0 && n != 2 {
+				issues = append(issues, Issue{SeverityError, section, key, fmt.Sprintf("context_pair needs 2 texts, opening and closing, got %d", n)})
+			}
+			for _, text := range mapping.ContextPair {
+				checkString(section, key+".context_pair", text)
+			}
+			if _, err := ParseChords(mapping.Keys); err != nil {
+				issues = append(issues, Issue{SeverityError, section, key, err.Error()})
+			}
+			if _, err := ParseChords(mapping.Sequence); err != nil {
+				issues = append(issues, Issue{SeverityError, section, key, "sequence: " + err.Error()})
+			}
+			if mapping.IsDeadKey {
+				referenced[mapping.DeadKeyID] = true
+				if _, ok := l.DeadKeys[mapping.DeadKeyID]; !ok {
+					issues = append(issues, Issue{SeverityError, section, key, fmt.Sprintf("dead_key_id %q is not defined in dead_keys", mapping.DeadKeyID)})
+				}
+			}
+			switch mapping.Method {
+			case "", MethodHex, MethodClipboard, MethodKeysym:
+			case MethodPassthrough:
+				for _, r := range mapping.GetOutputString() {
+					if !direct[r] {
+						issues = append(issues, Issue{SeverityWarning, section, key, fmt.Sprintf("method passthrough: no passthrough mapping declares %q, hex entry is used", r)})
+					}
+				}
+			default:
+				issues = append(issues, Issue{SeverityError, section, key, fmt.Sprintf("unknown method %q, want hex, passthrough, clipboard or keysym", mapping.Method)})
+			}
+			if _, ok := transforms[mapping.Transform]; mapping.Transform != "" && !ok {
+				issues = append(issues, Issue{SeverityError, section, key, fmt.Sprintf("unknown transform %q, want one of %s", mapping.Transform, strings.Join(TransformNames(), ", "))})
+			}
+			if mapping.NoRepeat && (mapping.IsDeadKey || len(mapping.Keys) > 0) {
+				issues = append(issues, Issue{SeverityWarning, section, key, "no_repeat has no effect, dead keys and keys chords never repeat"})
+			}
+			if mapping.CursorBack < 0 {
+				issues = append(issues, Issue{SeverityError, section, key, "cursor_back must not be negative"})
+			} else if n := utf8.RuneCountInString(mapping.Char); mapping.CursorBack > n && mapping.Codepoint == 0 {
+				issues = append(issues, Issue{SeverityWarning, section, key, fmt.Sprintf("cursor_back %d exceeds the %d typed characters", mapping.CursorBack, n)})
+			}
+		}
+	}
+
+	checkMappings("alt", l.Alt)
+	for _, key := range l.tableHidden {
+		issues = append(issues, Issue{SeverityWarning, "alt", key, fmt.Sprintf("also in alt_table %s, the alt mapping is used", l.AltTable)})
+	}
+	checkMappings("shift_alt", l.ShiftAlt)
+	checkMappings("fn_alt", l.FnAlt)
+
+	switch l.Mode {
+	case "", LayoutFull:
+		for _, section := range []struct {
+			name string
+			m    map[string]Mapping
+		}{{"alt", l.Alt}, {"shift_alt", l.ShiftAlt}} {
+			if missing := missingKeys(section.m); len(missing) > 0 {
+				issues = append(issues, Issue{SeverityWarning, section.name, "", fmt.Sprintf("no mapping for %s; set mode: sparse if only some keys are mapped on purpose", strings.Join(missing, ", "))})
+			}
+		}
+	case LayoutSparse:
+	default:
+		issues = append(issues, Issue{SeverityError, "mode", "", fmt.Sprintf("unknown mode %q, want full or sparse", l.Mode)})
+	}
+
+	switch {
+	case l.Version < 0:
+		issues = append(issues, Issue{SeverityError, "version", "", fmt.Sprintf("invalid version %d", l.Version)})
+	case l.Version > LayoutVersion:
+		issues = append(issues, Issue{SeverityWarning, "version", "", fmt.Sprintf("layout version %d is newer than this asahi-map reads (%d), settings it does not know are ignored", l.Version, LayoutVersion)})
+	}
+
+	if _, err := buildModifierMap(l.Modifiers); err != nil {
+		issues = append(issues, Issue{SeverityError, "modifiers", "", err.Error()})
+	}
+
+	if _, err := parseHexKeys(l.HexKeys); err != nil {
+		issues = append(issues, Issue{SeverityError, "hex_keys", "", err.Error()})
+	}
+
+	switch l.UnicodeConfirm {
+	case "", "space", "enter", "none":
+	default:
+		issues = append(issues, Issue{SeverityError, "unicode_confirm", "", fmt.Sprintf("unknown confirm key %q (want space, enter or none)", l.UnicodeConfirm)})
+	}
+
+	for _, name := range sortedKeys(l.Shortcodes) {
+		if !validShortcode(name) {
+			issues = append(issues, Issue{SeverityWarning, "shortcodes", name, "shortcodes can only use a-z, 0-9, _, - and +, this one can never be typed"})
+		}
+		checkString("shortcodes", name, l.Shortcodes[name])
+	}
+
+	for _, id := range sortedKeys(l.DeadKeys) {
+		dk := l.DeadKeys[id]
+		if !referenced[id] {
+			issues = append(issues, Issue{SeverityWarning, "dead_keys", id, "not used by any dead_key mapping"})
+		}
+		checkString("dead_keys", id, dk.Base)
+		if dk.Combining != "" {
+			checkString("dead_keys", id+".combining", dk.Combining)
+			if !combiningMarks(dk.Combining) {
+				issues = append(issues, Issue{SeverityWarning, "dead_keys", id, fmt.Sprintf("combining %q is not only combining marks, it will not attach to the letter before it", dk.Combining)})
+			}
+		}
+		for _, key := range sortedKeys(dk.Combinations) {
+			checkString("dead_keys", id+"."+key, dk.Combinations[key])
+		}
+	}
+
+	return issues
+}
+
+// combiningMarks reports whether s consists of combining marks only.
+func combiningMarks(s string) bool {
+	for _, r := range s {
+		if !unicode.In(r, unicode.Mn, unicode.Me) {
+			return false
+		}
+	}
+	return true
+}
+
+// completenessKeys are the keys a full layout is expected to map in both
+// the alt and shift_alt sections.
+var completenessKeys = []string{
+	"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m",
+	"n", "o", "p", "q", "r", "s", "t", "u", "v", "w", "x", "y", "z",
+	"0", "1", "2", "3", "4", "5", "6", "7", "8", "9",
+}
+
+// missingKeys returns the completenessKeys m has no mapping for.
+func missingKeys(m map[string]Mapping) []string {
+	var missing []string
+	for _, key := range completenessKeys {
+		if _, ok := m[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// outputConflict describes output settings in m that are ignored because
+// another one takes precedence, or "" when there is no conflict. A char next
+// to a passthrough or sequence names the character it types, and next to
+// dead_key it is the accent typed on press, so neither counts.
+func outputConflict(m Mapping) string {
+	if m.Char != "" && m.Codepoint != 0 {
+		return "sets both char and codepoint; codepoint is used"
+	}
+
+	// In the order the handler applies them
+	var kinds []string
+	if m.Shortcode {
+		kinds = append(kinds, "shortcode")
+	}
+	if m.Passthrough != "" {
+		kinds = append(kinds, "passthrough")
+	}
+	if m.PassthroughShift != "" {
+		kinds = append(kinds, "passthrough_shift")
+	}
+	if len(m.Sequence) > 0 {
+		kinds = append(kinds, "sequence")
+	}
+	if len(m.Keys) > 0 {
+		kinds = append(kinds, "keys")
+	}
+	if m.IsDeadKey {
+		kinds = append(kinds, "dead_key")
+	}
+	if len(m.ContextPair) > 0 {
+		kinds = append(kinds, "context_pair")
+	}
+	if len(kinds) == 1 && (kinds[0] == "keys" || kinds[0] == "context_pair" || kinds[0] == "shortcode") && m.GetOutputString() != "" {
+		kinds = append(kinds, "char")
+	}
+
+	switch {
+	case len(kinds) > 1:
+		return fmt.Sprintf("sets %s; only %s is used", strings.Join(kinds, " and "), kinds[0])
+	case len(kinds) == 0 && m.GetOutputString() == "" && len(m.Next) == 0:
+		return "has no output"
+	}
+	return ""
+}
+
+// sortedKeys returns map keys in sorted order for stable reporting.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
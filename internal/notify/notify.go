@@ -0,0 +1,34 @@
+// Package notify shows desktop notifications through notify-send.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// timeout bounds how long a notify-send call may take.
+const timeout = 5 * time.Second
+
+// Send shows a short notification. Notifications sent with the same tag
+// replace each other instead of stacking, where the server supports it.
+func Send(tag, summary, body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := []string{
+		"--app-name=asahi-map",
+		"--icon=input-keyboard",
+		"--expire-time=2000",
+		"--hint=string:x-canonical-private-synchronous:" + tag,
+		summary,
+	}
+	if body != "" {
+		args = append(args, body)
+	}
+	if out, err := exec.CommandContext(ctx, "notify-send", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("notify-send: %w: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Package schedule turns mapping off automatically while a rule matches,
+// such as during set hours or while a given program is running.
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Interval is how often rules are evaluated.
+const Interval = 15 * time.Second
+
+// Rule disables mapping while it matches. A rule with both Hours and Process
+// matches only when both do.
+type Rule struct {
+	Name string `yaml:"name"`
+
+	// Hours is a local time range like "22:00-07:00"; it may wrap midnight.
+	Hours string `yaml:"hours,omitempty"`
+
+	// Process is a program name (as in /proc/<pid>/comm) that must be running.
+	Process string `yaml:"process,omitempty"`
+}
+
+type rule struct {
+	Rule
+	from, to int // minutes since midnight, -1 when Hours is unset
+}
+
+// Scheduler evaluates rules periodically and reports when the set of
+// matching rules goes from empty to non-empty or back.
+type Scheduler struct {
+	rules    []rule
+	active   string
+	onChange func(rule string)
+	now      func() time.Time
+	procDir  string
+	logger   *slog.Logger
+}
+
+// New validates rules. onChange is called with the matching rule's name when
+// mapping should be disabled, and with "" once no rule matches any more.
+func New(rules []Rule, onChange func(rule string), logger *slog.Logger) (*Scheduler, error) {
+	s := &Scheduler{
+		onChange: onChange,
+		now:      time.Now,
+		procDir:  "/proc",
+		logger:   logger,
+	}
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if r.Hours == "" && r.Process == "" {
+			return nil, fmt.Errorf("%s: needs hours or process", r.Name)
+		}
+		parsed := rule{Rule: r, from: -1, to: -1}
+		if r.Hours != "" {
+			from, to, err := parseHours(r.Hours)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", r.Name, err)
+			}
+			parsed.from, parsed.to = from, to
+		}
+		s.rules = append(s.rules, parsed)
+	}
+	return s, nil
+}
+
+// parseHours parses "HH:MM-HH:MM" into minutes since midnight.
+func parseHours(s string) (from, to int, err error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid hours %q, want HH:MM-HH:MM", s)
+	}
+	if from, err = parseClock(strings.TrimSpace(start)); err != nil {
+		return 0, 0, err
+	}
+	if to, err = parseClock(strings.TrimSpace(end)); err != nil {
+		return 0, 0, err
+	}
+	return from, to, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Run evaluates the rules immediately and then every Interval until ctx is
+// done.
+func (s *Scheduler) Run(ctx context.Context) {
+	if len(s.rules) == 0 {
+		return
+	}
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for {
+		s.evaluate()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) evaluate() {
+	var running map[string]bool
+	match := ""
+	for _, r := range s.rules {
+		if r.from >= 0 && !inRange(s.now(), r.from, r.to) {
+			continue
+		}
+		if r.Process != "" {
+			if running == nil {
+				running = s.processes()
+			}
+			if !running[commName(r.Process)] {
+				continue
+			}
+		}
+		match = r.Name
+		break
+	}
+
+	if (match == "") == (s.active == "") {
+		s.active = match
+		return
+	}
+	if match != "" {
+		s.logger.Info("schedule rule matched, disabling mapping", "rule", match)
+	} else {
+		s.logger.Info("schedule rule ended, restoring mapping", "rule", s.active)
+	}
+	s.active = match
+	s.onChange(match)
+}
+
+// inRange reports whether t falls in [from, to), wrapping past midnight
+// when to is earlier than from.
+func inRange(t time.Time, from, to int) bool {
+	m := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return m >= from && m < to
+	}
+	return m >= from || m < to
+}
+
+// commName truncates a program name the way the kernel does for
+// /proc/<pid>/comm.
+func commName(name string) string {
+	const taskCommLen = 15
+	if len(name) > taskCommLen {
+		return name[:taskCommLen]
+	}
+	return name
+}
+
+// processes returns the command names of all running processes.
+func (s *Scheduler) processes() map[string]bool {
+	running := make(map[string]bool)
+	paths, err := filepath.Glob(filepath.Join(s.procDir, "[0-9]*", "comm"))
+	if err != nil {
+		return running
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue // process exited
+		}
+		running[strings.TrimSpace(string(data))] = true
+	}
+	return running
+}
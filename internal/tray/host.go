@@ -0,0 +1,49 @@
+package tray
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// watcherName is the bus name of the StatusNotifierItem host that shows tray
+// icons; GNOME only has one with the AppIndicator extension.
+const watcherName = "org.kde.StatusNotifierWatcher"
+
+// readyTimeout bounds how long Run waits for the session bus to answer.
+const readyTimeout = 5 * time.Second
+
+// checkHost reports why a tray icon cannot be shown, or nil when a host is
+// there to show it. systray itself only logs these failures and then waits
+// forever.
+func checkHost(timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- findHost()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("session bus did not answer within %s", timeout)
+	}
+}
+
+func findHost() error {
+	// The shared connection, which systray goes on to use
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return fmt.Errorf("connecting to the session bus: %w", err)
+	}
+
+	var owned bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, watcherName).Store(&owned); err != nil {
+		return fmt.Errorf("looking up %s: %w", watcherName, err)
+	}
+	if !owned {
+		return fmt.Errorf("no tray host (%s) on the session bus", watcherName)
+	}
+	return nil
+}
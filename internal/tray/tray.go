@@ -2,67 +2,143 @@
 package tray
 
 import (
+	"fmt"
 	"log/slog"
+	"strings"
+	"sync"
 
 	"fyne.io/systray"
 )
 
-// Tray represents the system tray icon and menu.
+// Tray represents the system tray icon and menu. Its state and menu are
+// only touched on the update goroutine: clicks and the exported setters
+// queue their work there, so callers on other goroutines never race.
 type Tray struct {
 	logger *slog.Logger
 
+	// Work for the update goroutine
+	queueMu sync.Mutex
+	queue   []func()
+	wake    chan struct{}
+
 	// Callbacks
-	onLayoutChange func(layout string)
-	onToggle       func(enabled bool)
-	onQuit         func()
+	onLayoutChange     func(layout string) []string
+	onToggle           func(enabled bool)
+	onConsumeAltToggle func(consume bool)
+	onDeviceToggle     func(path string, enabled bool) error
+	onQuit             func()
 
 	// State
 	enabled          bool
+	consumeLeftAlt   bool
 	currentLayout    string
 	availableLayouts []string
+	devices          []Device
+	layoutIssues     []string
 
 	// Menu items for updates
 	statusItem  *systray.MenuItem
+	altItem     *systray.MenuItem
 	layoutMenu  *systray.MenuItem
 	layoutItems []*systray.MenuItem
+	issuesItem  *systray.MenuItem
+	deviceItems []*systray.MenuItem
+}
+
+// Device is a keyboard shown in the tray's keyboard submenu.
+type Device struct {
+	Path    string
+	Name    string
+	Enabled bool
 }
 
 // Config holds tray configuration.
 type Config struct {
-	CurrentLayout    string
-	AvailableLayouts []string
-	Enabled          bool
-	OnLayoutChange   func(layout string)
-	OnToggle         func(enabled bool)
-	OnQuit           func()
-	Logger           *slog.Logger
+	CurrentLayout      string
+	AvailableLayouts   []string
+	Devices            []Device
+	Enabled            bool
+	ConsumeLeftAlt     bool
+	LayoutIssues       []string
+	OnLayoutChange     func(layout string) []string
+	OnToggle           func(enabled bool)
+	OnConsumeAltToggle func(consume bool)
+	OnDeviceToggle     func(path string, enabled bool) error
+	OnQuit             func()
+	Logger             *slog.Logger
 }
 
 func New(cfg Config) *Tray {
-	return &Tray{
-		enabled:          cfg.Enabled,
-		currentLayout:    cfg.CurrentLayout,
-		availableLayouts: cfg.AvailableLayouts,
-		onLayoutChange:   cfg.OnLayoutChange,
-		onToggle:         cfg.OnToggle,
-		onQuit:           cfg.OnQuit,
-		logger:           cfg.Logger,
+	t := &Tray{
+		wake:               make(chan struct{}, 1),
+		enabled:            cfg.Enabled,
+		consumeLeftAlt:     cfg.ConsumeLeftAlt,
+		currentLayout:      cfg.CurrentLayout,
+		availableLayouts:   cfg.AvailableLayouts,
+		devices:            cfg.Devices,
+		layoutIssues:       cfg.LayoutIssues,
+		onLayoutChange:     cfg.OnLayoutChange,
+		onToggle:           cfg.OnToggle,
+		onConsumeAltToggle: cfg.OnConsumeAltToggle,
+		onDeviceToggle:     cfg.OnDeviceToggle,
+		onQuit:             cfg.OnQuit,
+		logger:             cfg.Logger,
+	}
+	go t.runUpdates()
+	return t
+}
+
+// do runs f on the update goroutine. It never blocks, so it may be called
+// from callbacks that hold their own locks, including the tray's.
+func (t *Tray) do(f func()) {
+	t.queueMu.Lock()
+	t.queue = append(t.queue, f)
+	t.queueMu.Unlock()
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runUpdates is the update goroutine, running queued work in order.
+func (t *Tray) runUpdates() {
+	for range t.wake {
+		t.queueMu.Lock()
+		queue := t.queue
+		t.queue = nil
+		t.queueMu.Unlock()
+		for _, f := range queue {
+			f()
+		}
 	}
 }
 
-// Run starts the system tray. This blocks until Quit is called.
-func (t *Tray) Run() {
+// Run starts the system tray. This blocks until Quit is called. Without a
+// session bus or a tray host to show the icon it returns an error at once,
+// so the caller can carry on without a tray.
+func (t *Tray) Run() error {
+	if err := checkHost(readyTimeout); err != nil {
+		return err
+	}
 	systray.Run(t.onReady, t.onExit)
+	return nil
 }
 
 // onReady is called when systray is ready.
 func (t *Tray) onReady() {
-	systray.SetIcon(keyboardIcon)
+	t.do(t.buildMenu)
+}
+
+// buildMenu creates the menu from the current state.
+func (t *Tray) buildMenu() {
 	systray.SetTitle("Asahi-Map")
-	t.updateTooltip()
 
 	// Status toggle
 	t.statusItem = systray.AddMenuItem("✓ Enabled", "Toggle Option key mapping")
+	t.setEnabled(t.enabled)
+
+	// Left Alt as Option, or a plain Alt for app shortcuts
+	t.altItem = systray.AddMenuItemCheckbox("Left Alt as Option", "Uncheck to send Left Alt to apps as Alt", t.consumeLeftAlt)
 
 	systray.AddSeparator()
 
@@ -77,6 +153,20 @@ func (t *Tray) onReady() {
 		}
 	}
 
+	// Warnings for the current layout, hidden while there are none
+	t.issuesItem = systray.AddMenuItem("", "")
+	t.issuesItem.Disable()
+	t.showIssues()
+
+	// Keyboard submenu
+	if len(t.devices) > 0 {
+		keyboardsMenu := systray.AddMenuItem("Keyboards", "Choose which keyboards are mapped")
+		t.deviceItems = make([]*systray.MenuItem, len(t.devices))
+		for i, dev := range t.devices {
+			t.deviceItems[i] = keyboardsMenu.AddSubMenuItemCheckbox(dev.Name, dev.Path, dev.Enabled)
+		}
+	}
+
 	systray.AddSeparator()
 
 	// Quit
@@ -91,7 +181,13 @@ func (t *Tray) handleClicks(quitItem *systray.MenuItem) {
 	// Handle status toggle
 	go func() {
 		for range t.statusItem.ClickedCh {
-			t.toggleEnabled()
+			t.do(t.toggleEnabled)
+		}
+	}()
+
+	go func() {
+		for range t.altItem.ClickedCh {
+			t.do(t.toggleConsumeAlt)
 		}
 	}()
 
@@ -99,7 +195,16 @@ func (t *Tray) handleClicks(quitItem *systray.MenuItem) {
 	for i, item := range t.layoutItems {
 		go func(idx int, menuItem *systray.MenuItem) {
 			for range menuItem.ClickedCh {
-				t.selectLayout(t.availableLayouts[idx])
+				t.do(func() { t.selectLayout(t.availableLayouts[idx]) })
+			}
+		}(i, item)
+	}
+
+	// Handle device items
+	for i, item := range t.deviceItems {
+		go func(idx int, menuItem *systray.MenuItem) {
+			for range menuItem.ClickedCh {
+				t.do(func() { t.toggleDevice(idx) })
 			}
 		}(i, item)
 	}
@@ -135,6 +240,55 @@ func (t *Tray) toggleEnabled() {
 	}
 }
 
+// toggleConsumeAlt flips whether Left Alt acts as Option.
+func (t *Tray) toggleConsumeAlt() {
+	t.logger.Info("toggleConsumeAlt called", "current", t.consumeLeftAlt)
+	t.setConsumeLeftAlt(!t.consumeLeftAlt)
+
+	if t.onConsumeAltToggle != nil {
+		t.onConsumeAltToggle(t.consumeLeftAlt)
+	}
+}
+
+// SetConsumeLeftAlt shows whether Left Alt acts as Option without calling
+// OnConsumeAltToggle, for changes made outside the tray.
+func (t *Tray) SetConsumeLeftAlt(consume bool) {
+	t.do(func() { t.setConsumeLeftAlt(consume) })
+}
+
+func (t *Tray) setConsumeLeftAlt(consume bool) {
+	t.consumeLeftAlt = consume
+	if t.altItem == nil {
+		return
+	}
+	if consume {
+		t.altItem.Check()
+	} else {
+		t.altItem.Uncheck()
+	}
+}
+
+// toggleDevice flips whether a keyboard is grabbed and mapped.
+func (t *Tray) toggleDevice(idx int) {
+	dev := &t.devices[idx]
+	enabled := !dev.Enabled
+	t.logger.Info("toggleDevice called", "name", dev.Name, "path", dev.Path, "enabled", enabled)
+
+	if t.onDeviceToggle != nil {
+		if err := t.onDeviceToggle(dev.Path, enabled); err != nil {
+			t.logger.Error("failed to toggle keyboard", "name", dev.Name, "error", err)
+			return
+		}
+	}
+
+	dev.Enabled = enabled
+	if enabled {
+		t.deviceItems[idx].Check()
+	} else {
+		t.deviceItems[idx].Uncheck()
+	}
+}
+
 // selectLayout changes the current layout.
 func (t *Tray) selectLayout(layout string) {
 	t.logger.Info("selectLayout called", "requested", layout, "current", t.currentLayout)
@@ -144,24 +298,62 @@ func (t *Tray) selectLayout(layout string) {
 		return
 	}
 
+	t.setLayout(layout)
+	t.logger.Info("layout changed", "layout", layout)
+
+	if t.onLayoutChange != nil {
+		t.setLayoutIssues(t.onLayoutChange(layout))
+	}
+}
+
+// SetLayout shows layout as the current one without calling OnLayoutChange,
+// for switches made outside the tray.
+func (t *Tray) SetLayout(layout string) {
+	t.do(func() { t.setLayout(layout) })
+}
+
+func (t *Tray) setLayout(layout string) {
+	t.currentLayout = layout
+	if t.layoutMenu == nil {
+		return
+	}
+
 	// Update menu checkmarks
 	for i, l := range t.availableLayouts {
 		if l == layout {
-			t.logger.Debug("checking layout", "layout", l, "index", i)
 			t.layoutItems[i].Check()
 		} else {
 			t.layoutItems[i].Uncheck()
 		}
 	}
-
-	t.currentLayout = layout
 	t.layoutMenu.SetTitle(layout + "    ")
 	t.updateTooltip()
-	t.logger.Info("layout changed", "layout", layout)
+}
 
-	if t.onLayoutChange != nil {
-		t.onLayoutChange(layout)
+// SetLayoutIssues shows the validation warnings of the current layout as a
+// "⚠" menu item and in the tooltip, or clears them when issues is empty.
+// Layouts picked from the menu get the warnings OnLayoutChange returns.
+func (t *Tray) SetLayoutIssues(issues []string) {
+	t.do(func() { t.setLayoutIssues(issues) })
+}
+
+func (t *Tray) setLayoutIssues(issues []string) {
+	t.layoutIssues = issues
+	if t.issuesItem == nil {
+		return
 	}
+	t.showIssues()
+	t.updateTooltip()
+}
+
+func (t *Tray) showIssues() {
+	if len(t.layoutIssues) == 0 {
+		t.issuesItem.Hide()
+		return
+	}
+	t.issuesItem.SetTitle(fmt.Sprintf("⚠ Layout has %d issue(s)", len(t.layoutIssues)))
+	t.issuesItem.SetTooltip(strings.Join(t.layoutIssues, "\n"))
+	t.issuesItem.Show()
 }
 
 func (t *Tray) updateTooltip() {
@@ -169,7 +361,11 @@ func (t *Tray) updateTooltip() {
 	if !t.enabled {
 		status = "Disabled"
 	}
-	systray.SetTooltip("Asahi-Map: " + status + " (" + t.currentLayout + ")")
+	tooltip := "Asahi-Map: " + status + " (" + t.currentLayout + ")"
+	if len(t.layoutIssues) > 0 {
+		tooltip += fmt.Sprintf(" ⚠ %d layout issue(s)", len(t.layoutIssues))
+	}
+	systray.SetTooltip(tooltip)
 }
 
 func (t *Tray) onExit() {
@@ -181,12 +377,18 @@ func (t *Tray) Quit() {
 }
 
 func (t *Tray) SetEnabled(enabled bool) {
+	t.do(func() { t.setEnabled(enabled) })
+}
+
+func (t *Tray) setEnabled(enabled bool) {
 	t.enabled = enabled
 	if t.statusItem != nil {
 		if enabled {
 			t.statusItem.SetTitle("✓ Enabled")
+			systray.SetIcon(keyboardIcon)
 		} else {
 			t.statusItem.SetTitle("✗ Disabled")
+			systray.SetIcon(keyboardDisabledIcon)
 		}
 	}
 	t.updateTooltip()
@@ -0,0 +1,164 @@
+// Package usage keeps local counts of the Option mappings that are typed, so
+// unused ones can be pruned from a layout. Nothing leaves the machine: the
+// counts live in a JSON file next to the config.
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileName is the state file kept in the config directory.
+const FileName = "usage.json"
+
+// LearnFileName is where learning mode counts Option combos that have no
+// mapping, in the same format.
+const LearnFileName = "unmapped.json"
+
+// FlushInterval is how often Run writes pending counts.
+const FlushInterval = 5 * time.Minute
+
+// Data is the persisted state.
+type Data struct {
+	// Chars counts characters typed by mappings
+	Chars uint64 `json:"chars"`
+
+	// Mappings counts uses per combo, e.g. "shift+alt+e"
+	Mappings map[string]uint64 `json:"mappings"`
+}
+
+// Entry is one combo and how often it was used.
+type Entry struct {
+	Combo string
+	Count uint64
+}
+
+// Counter accumulates usage in memory and writes it to path.
+type Counter struct {
+	mu     sync.Mutex
+	path   string
+	data   Data
+	dirty  bool
+	logger *slog.Logger
+}
+
+// Load reads the counts at path. A missing file starts from zero.
+func Load(path string, logger *slog.Logger) (*Counter, error) {
+	c := &Counter{
+		path:   path,
+		data:   Data{Mappings: make(map[string]uint64)},
+		logger: logger,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading usage file: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.data); err != nil {
+		return nil, fmt.Errorf("parsing usage file %s: %w", path, err)
+	}
+	if c.data.Mappings == nil {
+		c.data.Mappings = make(map[string]uint64)
+	}
+	return c, nil
+}
+
+// Record counts one use of combo that typed chars characters.
+func (c *Counter) Record(combo string, chars int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data.Mappings[combo]++
+	c.data.Chars += uint64(chars)
+	c.dirty = true
+}
+
+// Chars returns the number of characters typed by mappings.
+func (c *Counter) Chars() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.data.Chars
+}
+
+// Top returns the n most used combos, most used first; n <= 0 returns all.
+func (c *Counter) Top(n int) []Entry {
+	c.mu.Lock()
+	entries := make([]Entry, 0, len(c.data.Mappings))
+	for combo, count := range c.data.Mappings {
+		entries = append(entries, Entry{Combo: combo, Count: count})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Combo < entries[j].Combo
+	})
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// Flush writes the counts if they changed since the last flush. The file is
+// replaced atomically so a crash cannot leave it half written.
+func (c *Counter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding usage: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".usage-*.json")
+	if err != nil {
+		return fmt.Errorf("writing usage file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing usage file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing usage file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("writing usage file: %w", err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// Run flushes every FlushInterval until ctx is done. Callers flush once more
+// on shutdown.
+func (c *Counter) Run(ctx context.Context) {
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Flush(); err != nil {
+				c.logger.Warn("failed to save usage counts", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package window
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Rule holds settings applied while a matching app has focus. App is a
+// regular expression matched against the app id or window class, e.g.
+// `^org\.gnome\.` for a family of apps. A rule without App is the default
+// rule, used when no other rule matches.
+type Rule struct {
+	Name string `yaml:"name,omitempty"`
+	App  string `yaml:"app,omitempty"`
+
+	// Disable turns mapping off while the app has focus
+	Disable bool `yaml:"disable,omitempty"`
+
+	// UnicodeConfirm is the key committing Unicode entry in the app:
+	// "space", "enter" or "none"; empty keeps the layout's or global one
+	UnicodeConfirm string `yaml:"unicode_confirm,omitempty"`
+}
+
+// Rules picks the rule of the focused app. Rules are tried in order and the
+// first match wins.
+type Rules struct {
+	rules []rule
+}
+
+type rule struct {
+	Rule
+	re *regexp.Regexp // nil for the default rule
+}
+
+// NewRules compiles the rules' expressions once. Only the last rule may be
+// the default one, since the rules after it could never match.
+func NewRules(rules []Rule) (*Rules, error) {
+	r := &Rules{}
+	for i, ru := range rules {
+		if ru.Name == "" {
+			ru.Name = fmt.Sprintf("rule %d", i+1)
+			if ru.App == "" {
+				ru.Name = "default"
+			}
+		}
+		switch ru.UnicodeConfirm {
+		case "", "space", "enter", "none":
+		default:
+			return nil, fmt.Errorf("%s: unknown unicode_confirm %q (want space, enter or none)", ru.Name, ru.UnicodeConfirm)
+		}
+		compiled := rule{Rule: ru}
+		if ru.App == "" {
+			if i != len(rules)-1 {
+				return nil, fmt.Errorf("%s: only the last rule may leave out app", ru.Name)
+			}
+		} else {
+			re, err := regexp.Compile(ru.App)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid app: %w", ru.Name, err)
+			}
+			compiled.re = re
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// Match returns the first rule matching app, the default rule if none
+// does, or nil without a default rule.
+func (r *Rules) Match(app string) *Rule {
+	for i := range r.rules {
+		if re := r.rules[i].re; re == nil || re.MatchString(app) {
+			return &r.rules[i].Rule
+		}
+	}
+	return nil
+}
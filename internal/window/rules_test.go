@@ -0,0 +1,50 @@
+package window
+
+import "testing"
+
+func TestRulesMatch(t *testing.T) {
+	rules, err := NewRules([]Rule{
+		{Name: "terminal", App: `^org\.gnome\.Terminal$`},
+		{Name: "gnome", App: `^org\.gnome\.`, Disable: true},
+		{Name: "fallback"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for app, want := range map[string]string{
+		"org.gnome.Terminal":  "terminal",
+		"org.gnome.Nautilus":  "gnome",
+		"org.gnome.Terminalx": "gnome",
+		"firefox":             "fallback",
+		"":                    "fallback",
+	} {
+		if got := rules.Match(app); got == nil || got.Name != want {
+			t.Errorf("%q: matched %v, want %s", app, got, want)
+		}
+	}
+}
+
+func TestRulesWithoutDefault(t *testing.T) {
+	rules, err := NewRules([]Rule{{App: "^code$", Disable: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.Match("firefox"); got != nil {
+		t.Errorf("matched %v without a default rule", got)
+	}
+	if got := rules.Match("code"); got == nil || got.Name != "rule 1" {
+		t.Errorf("code: matched %v, want rule 1", got)
+	}
+}
+
+func TestRulesInvalid(t *testing.T) {
+	for name, rules := range map[string][]Rule{
+		"bad expression":       {{App: "("}},
+		"default not the last": {{Name: "default"}, {App: "^code$"}},
+		"unknown confirm key":  {{App: "^code$", UnicodeConfirm: "tab"}},
+	} {
+		if _, err := NewRules(rules); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Package window follows which application has keyboard focus, so settings
+// can depend on the app being typed in.
+package window
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Watcher reports the application of the focused window: its app id on
+// Wayland compositors, its WM_CLASS class on X11.
+type Watcher struct {
+	onFocus func(app string)
+	app     string
+	started bool
+	logger  *slog.Logger
+}
+
+// NewWatcher returns a Watcher calling onFocus with the focused app once it
+// is known and whenever it changes; "" stands for no window.
+func NewWatcher(onFocus func(app string), logger *slog.Logger) *Watcher {
+	return &Watcher{onFocus: onFocus, logger: logger}
+}
+
+// ErrUnsupported is returned by Run when the session offers no way to
+// follow focus, as on GNOME and Plasma under Wayland.
+var ErrUnsupported = errors.New("no way to follow the focused window in this session (supported: Hyprland, sway, i3, X11)")
+
+// Run follows focus until ctx is done or the source fails. The source is
+// picked from the session: the Hyprland, sway or i3 IPC socket, or xprop
+// on X11.
+func (w *Watcher) Run(ctx context.Context) error {
+	var err error
+	switch {
+	case os.Getenv("HYPRLAND_INSTANCE_SIGNATURE") != "":
+		err = w.runHyprland(ctx, os.Getenv("HYPRLAND_INSTANCE_SIGNATURE"))
+	case os.Getenv("SWAYSOCK") != "":
+		err = w.runI3(ctx, os.Getenv("SWAYSOCK"))
+	case os.Getenv("I3SOCK") != "":
+		err = w.runI3(ctx, os.Getenv("I3SOCK"))
+	case os.Getenv("WAYLAND_DISPLAY") == "" && os.Getenv("DISPLAY") != "":
+		err = w.runX11(ctx)
+	default:
+		return ErrUnsupported
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// focus reports app if it differs from the last one.
+func (w *Watcher) focus(app string) {
+	if w.started && app == w.app {
+		return
+	}
+	w.started = true
+	w.app = app
+	w.logger.Debug("focused app changed", "app", app)
+	w.onFocus(app)
+}
+
+// closeOnDone closes c once ctx is done, to interrupt a blocked read.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func() bool) {
+	return context.AfterFunc(ctx, func() { c.Close() })
+}
+
+// runHyprland reads the active window from Hyprland's request socket, then
+// follows activewindow events on its event socket.
+func (w *Watcher) runHyprland(ctx context.Context, signature string) error {
+	dir := filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "hypr", signature)
+	if _, err := os.Stat(dir); err != nil {
+		dir = filepath.Join("/tmp/hypr", signature) // before Hyprland 0.40
+	}
+
+	var d net.Dialer
+	req, err := d.DialContext(ctx, "unix", filepath.Join(dir, ".socket.sock"))
+	if err != nil {
+		return fmt.Errorf("connecting to Hyprland: %w", err)
+	}
+	_, err = io.WriteString(req, "j/activewindow")
+	var active struct {
+		Class string `json:"class"`
+	}
+	if err == nil {
+		err = json.NewDecoder(req).Decode(&active)
+	}
+	req.Close()
+	if err != nil {
+		return fmt.Errorf("reading Hyprland's active window: %w", err)
+	}
+
+	events, err := d.DialContext(ctx, "unix", filepath.Join(dir, ".socket2.sock"))
+	if err != nil {
+		return fmt.Errorf("connecting to Hyprland events: %w", err)
+	}
+	defer events.Close()
+	defer closeOnDone(ctx, events)()
+
+	w.focus(active.Class)
+	scanner := bufio.NewScanner(events)
+	for scanner.Scan() {
+		if app, ok := parseHyprlandEvent(scanner.Text()); ok {
+			w.focus(app)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading Hyprland events: %w", err)
+	}
+	return errors.New("Hyprland closed the event socket")
+}
+
+// parseHyprlandEvent returns the window class of an "activewindow>>class,title"
+// event; ok is false for other events.
+func parseHyprlandEvent(line string) (app string, ok bool) {
+	event, data, _ := strings.Cut(line, ">>")
+	if event != "activewindow" {
+		return "", false
+	}
+	app, _, _ = strings.Cut(data, ",")
+	return app, true
+}
+
+// i3 IPC message and event types, shared by sway.
+const (
+	i3Subscribe   = 2
+	i3GetTree     = 4
+	i3WindowEvent = 0x80000003
+)
+
+// i3Magic starts every i3 IPC message.
+const i3Magic = "i3-ipc"
+
+// runI3 reads the focused window from the sway or i3 tree, then follows
+// window events.
+func (w *Watcher) runI3(ctx context.Context, socket string) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", socket, err)
+	}
+	defer c.Close()
+	defer closeOnDone(ctx, c)()
+	r := bufio.NewReader(c)
+
+	if err := writeI3(c, i3GetTree, ""); err != nil {
+		return err
+	}
+	_, tree, err := readI3(r)
+	if err != nil {
+		return fmt.Errorf("reading the window tree: %w", err)
+	}
+	var root i3Node
+	if err := json.Unmarshal(tree, &root); err != nil {
+		return fmt.Errorf("parsing the window tree: %w", err)
+	}
+	if err := writeI3(c, i3Subscribe, `["window"]`); err != nil {
+		return err
+	}
+	if _, _, err := readI3(r); err != nil {
+		return fmt.Errorf("subscribing to window events: %w", err)
+	}
+
+	w.focus(root.focusedApp())
+	for {
+		typ, payload, err := readI3(r)
+		if err != nil {
+			return fmt.Errorf("reading window events: %w", err)
+		}
+		if typ != i3WindowEvent {
+			continue
+		}
+		if app, ok := parseI3Event(payload); ok {
+			w.focus(app)
+		}
+	}
+}
+
+func writeI3(c net.Conn, typ uint32, payload string) error {
+	msg := []byte(i3Magic)
+	msg = binary.NativeEndian.AppendUint32(msg, uint32(len(payload)))
+	msg = binary.NativeEndian.AppendUint32(msg, typ)
+	if _, err := c.Write(append(msg, payload...)); err != nil {
+		return fmt.Errorf("sending i3 IPC message: %w", err)
+	}
+	return nil
+}
+
+func readI3(r io.Reader) (typ uint32, payload []byte, err error) {
+	head := make([]byte, len(i3Magic)+8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+	if string(head[:len(i3Magic)]) != i3Magic {
+		return 0, nil, fmt.Errorf("unexpected i3 IPC header %q", head)
+	}
+	payload = make([]byte, binary.NativeEndian.Uint32(head[len(i3Magic):]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return binary.NativeEndian.Uint32(head[len(i3Magic)+4:]), payload, nil
+}
+
+// i3Node is the part of a sway or i3 tree node used to find the focused
+// window.
+type i3Node struct {
+	Focused          bool   `json:"focused"`
+	AppID            string `json:"app_id"`
+	WindowProperties struct {
+		Class string `json:"class"`
+	} `json:"window_properties"`
+	Nodes         []i3Node `json:"nodes"`
+	FloatingNodes []i3Node `json:"floating_nodes"`
+}
+
+// app returns the node's app id, or its X11 class for Xwayland and i3
+// windows.
+func (n *i3Node) app() string {
+	if n.AppID != "" {
+		return n.AppID
+	}
+	return n.WindowProperties.Class
+}
+
+// focusedApp returns the app of the focused node under n, "" when the
+// focus is on an empty workspace.
+func (n *i3Node) focusedApp() string {
+	if n.Focused {
+		return n.app()
+	}
+	for _, children := range [][]i3Node{n.Nodes, n.FloatingNodes} {
+		for i := range children {
+			if app := children[i].focusedApp(); app != "" {
+				return app
+			}
+		}
+	}
+	return ""
+}
+
+// parseI3Event returns the app a window event moves focus to; ok is false
+// for events that leave focus where it is.
+func parseI3Event(payload []byte) (app string, ok bool) {
+	var event struct {
+		Change    string `json:"change"`
+		Container i3Node `json:"container"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return "", false
+	}
+	switch {
+	case event.Change == "focus":
+		return event.Container.app(), true
+	case event.Change == "close" && event.Container.Focused:
+		return "", true
+	}
+	return "", false
+}
+
+// runX11 follows _NET_ACTIVE_WINDOW with xprop -spy and reads the class of
+// each newly active window.
+func (w *Watcher) runX11(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "xprop", "-spy", "-root", "_NET_ACTIVE_WINDOW")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("xprop: %w", err)
+	}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		id, ok := parseActiveWindow(scanner.Text())
+		if !ok {
+			continue
+		}
+		app := ""
+		if id != "0x0" {
+			class, err := exec.CommandContext(ctx, "xprop", "-id", id, "WM_CLASS").Output()
+			if err != nil {
+				// The window may be gone already
+				w.logger.Debug("reading window class failed", "window", id, "error", err)
+			}
+			app = parseWMClass(string(class))
+		}
+		w.focus(app)
+	}
+	return fmt.Errorf("xprop stopped: %w", cmd.Wait())
+}
+
+var activeWindowRe = regexp.MustCompile(`# (0x[0-9a-fA-F]+)`)
+
+// parseActiveWindow returns the window id of an xprop _NET_ACTIVE_WINDOW
+// line, "0x0" when no window is active.
+func parseActiveWindow(line string) (id string, ok bool) {
+	m := activeWindowRe.FindStringSubmatch(line)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// parseWMClass returns the class, the second string, of xprop's WM_CLASS
+// output, e.g. "firefox" for `WM_CLASS(STRING) = "Navigator", "firefox"`.
+func parseWMClass(out string) string {
+	_, values, ok := strings.Cut(out, "=")
+	if !ok {
+		return ""
+	}
+	fields := strings.Split(values, ",")
+	return strings.Trim(strings.TrimSpace(fields[len(fields)-1]), `"`)
+}
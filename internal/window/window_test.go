@@ -0,0 +1,135 @@
+package window
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseHyprlandEvent(t *testing.T) {
+	tests := []struct {
+		line string
+		app  string
+		ok   bool
+	}{
+		{"activewindow>>kitty,~/src", "kitty", true},
+		{"activewindow>>firefox,Title, with commas", "firefox", true},
+		{"activewindow>>,", "", true},
+		{"activewindowv2>>5612a0f0", "", false},
+		{"workspace>>2", "", false},
+	}
+	for _, tt := range tests {
+		app, ok := parseHyprlandEvent(tt.line)
+		if app != tt.app || ok != tt.ok {
+			t.Errorf("%q: got %q %t, want %q %t", tt.line, app, ok, tt.app, tt.ok)
+		}
+	}
+}
+
+func TestI3FocusedApp(t *testing.T) {
+	tree := i3Node{Nodes: []i3Node{
+		{Nodes: []i3Node{{AppID: "foot"}}},
+		{FloatingNodes: []i3Node{{Focused: true}}},
+	}}
+	tree.Nodes[1].FloatingNodes[0].WindowProperties.Class = "Steam"
+	if got := tree.focusedApp(); got != "Steam" {
+		t.Errorf("focused app %q, want Steam", got)
+	}
+	tree.Nodes[1].FloatingNodes[0].Focused = false
+	if got := tree.focusedApp(); got != "" {
+		t.Errorf("focused app %q without focus, want none", got)
+	}
+}
+
+func TestParseI3Event(t *testing.T) {
+	tests := []struct {
+		payload string
+		app     string
+		ok      bool
+	}{
+		{`{"change":"focus","container":{"app_id":"foot"}}`, "foot", true},
+		{`{"change":"focus","container":{"app_id":null,"window_properties":{"class":"firefox"}}}`, "firefox", true},
+		{`{"change":"close","container":{"focused":true,"app_id":"foot"}}`, "", true},
+		{`{"change":"close","container":{"focused":false,"app_id":"foot"}}`, "", false},
+		{`{"change":"title","container":{"app_id":"foot"}}`, "", false},
+	}
+	for _, tt := range tests {
+		app, ok := parseI3Event([]byte(tt.payload))
+		if app != tt.app || ok != tt.ok {
+			t.Errorf("%s: got %q %t, want %q %t", tt.payload, app, ok, tt.app, tt.ok)
+		}
+	}
+}
+
+func TestParseXprop(t *testing.T) {
+	if id, ok := parseActiveWindow("_NET_ACTIVE_WINDOW(WINDOW): window id # 0x3a00007"); !ok || id != "0x3a00007" {
+		t.Errorf("active window %q %t", id, ok)
+	}
+	if _, ok := parseActiveWindow("_NET_ACTIVE_WINDOW:  not found."); ok {
+		t.Error("parsed a window id from a missing property")
+	}
+	for out, want := range map[string]string{
+		`WM_CLASS(STRING) = "Navigator", "firefox"` + "\n": "firefox",
+		`WM_CLASS(STRING) = "xterm"`:                       "xterm",
+		"WM_CLASS:  not found.\n":                          "",
+	} {
+		if got := parseWMClass(out); got != want {
+			t.Errorf("%q: class %q, want %q", out, got, want)
+		}
+	}
+}
+
+func TestWatcherReportsChanges(t *testing.T) {
+	var got []string
+	w := NewWatcher(func(app string) { got = append(got, app) }, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for _, app := range []string{"", "foot", "foot", "firefox", ""} {
+		w.focus(app)
+	}
+	if want := []string{"", "foot", "firefox", ""}; !slices.Equal(got, want) {
+		t.Errorf("reported %q, want %q", got, want)
+	}
+}
+
+func TestRunI3(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "sway.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A compositor answering the tree and subscribe requests, then sending
+	// one focus event and leaving
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for _, reply := range []string{
+			`{"nodes":[{"focused":true,"app_id":"foot"}]}`,
+			`{"success":true}`,
+		} {
+			if _, _, err := readI3(r); err != nil {
+				return
+			}
+			writeI3(c, 0, reply)
+		}
+		writeI3(c, i3WindowEvent, `{"change":"focus","container":{"app_id":"firefox"}}`)
+	}()
+
+	var got []string
+	w := NewWatcher(func(app string) { got = append(got, app) }, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := w.runI3(context.Background(), socket); err == nil {
+		t.Error("no error once the socket closed")
+	}
+	if want := []string{"foot", "firefox"}; !slices.Equal(got, want) {
+		t.Errorf("reported %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+package xkb
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// keysymRunes maps the keysym names used in xkeyboard-config symbol files
+// for printable characters to the character they type. Single-character
+// names such as "a" or "5" and Unicode keysyms (U20AC, 0x10020ac) are
+// handled by KeysymRune directly.
+var keysymRunes = map[string]rune{
+	// ASCII punctuation
+	"space": ' ', "exclam": '!', "quotedbl": '"', "numbersign": '#',
+	"dollar": '$', "percent": '%', "ampersand": '&', "apostrophe": '\'',
+	"parenleft": '(', "parenright": ')', "asterisk": '*', "plus": '+',
+	"comma": ',', "minus": '-', "period": '.', "slash": '/',
+	"colon": ':', "semicolon": ';', "less": '<', "equal": '=',
+	"greater": '>', "question": '?', "at": '@', "bracketleft": '[',
+	"backslash": '\\', "bracketright": ']', "asciicircum": '^',
+	"underscore": '_', "grave": '`', "braceleft": '{', "bar": '|',
+	"braceright": '}', "asciitilde": '~',
+
+	// Latin-1, where keysym values equal codepoints
+	"nobreakspace": 0xa0, "exclamdown": 0xa1, "cent": 0xa2, "sterling": 0xa3,
+	"currency": 0xa4, "yen": 0xa5, "brokenbar": 0xa6, "section": 0xa7,
+	"diaeresis": 0xa8, "copyright": 0xa9, "ordfeminine": 0xaa,
+	"guillemotleft": 0xab, "guillemetleft": 0xab, "notsign": 0xac,
+	"hyphen": 0xad, "registered": 0xae, "macron": 0xaf, "degree": 0xb0,
+	"plusminus": 0xb1, "twosuperior": 0xb2, "threesuperior": 0xb3,
+	"acute": 0xb4, "mu": 0xb5, "paragraph": 0xb6, "periodcentered": 0xb7,
+	"cedilla": 0xb8, "onesuperior": 0xb9, "masculine": 0xba,
+	"ordmasculine": 0xba, "guillemotright": 0xbb, "guillemetright": 0xbb,
+	"onequarter": 0xbc, "onehalf": 0xbd, "threequarters": 0xbe,
+	"questiondown": 0xbf,
+
+	"Agrave": 0xc0, "Aacute": 0xc1, "Acircumflex": 0xc2, "Atilde": 0xc3,
+	"Adiaeresis": 0xc4, "Aring": 0xc5, "AE": 0xc6, "Ccedilla": 0xc7,
+	"Egrave": 0xc8, "Eacute": 0xc9, "Ecircumflex": 0xca, "Ediaeresis": 0xcb,
+	"Igrave": 0xcc, "Iacute": 0xcd, "Icircumflex": 0xce, "Idiaeresis": 0xcf,
+	"ETH": 0xd0, "Eth": 0xd0, "Ntilde": 0xd1, "Ograve": 0xd2, "Oacute": 0xd3,
+	"Ocircumflex": 0xd4, "Otilde": 0xd5, "Odiaeresis": 0xd6, "multiply": 0xd7,
+	"Oslash": 0xd8, "Ooblique": 0xd8, "Ugrave": 0xd9, "Uacute": 0xda,
+	"Ucircumflex": 0xdb, "Udiaeresis": 0xdc, "Yacute": 0xdd, "THORN": 0xde,
+	"Thorn": 0xde, "ssharp": 0xdf,
+	"agrave": 0xe0, "aacute": 0xe1, "acircumflex": 0xe2, "atilde": 0xe3,
+	"adiaeresis": 0xe4, "aring": 0xe5, "ae": 0xe6, "ccedilla": 0xe7,
+	"egrave": 0xe8, "eacute": 0xe9, "ecircumflex": 0xea, "ediaeresis": 0xeb,
+	"igrave": 0xec, "iacute": 0xed, "icircumflex": 0xee, "idiaeresis": 0xef,
+	"eth": 0xf0, "ntilde": 0xf1, "ograve": 0xf2, "oacute": 0xf3,
+	"ocircumflex": 0xf4, "otilde": 0xf5, "odiaeresis": 0xf6, "division": 0xf7,
+	"oslash": 0xf8, "ooblique": 0xf8, "ugrave": 0xf9, "uacute": 0xfa,
+	"ucircumflex": 0xfb, "udiaeresis": 0xfc, "yacute": 0xfd, "thorn": 0xfe,
+	"ydiaeresis": 0xff,
+
+	// Common beyond Latin-1
+	"EuroSign": '€', "oe": 'œ', "OE": 'Œ', "idotless": 'ı', "lstroke": 'ł',
+	"Lstroke": 'Ł', "Ydiaeresis": 'Ÿ', "ellipsis": '…', "emdash": '—',
+	"endash": '–', "leftsinglequotemark": '‘', "rightsinglequotemark": '’',
+	"singlelowquotemark": '‚', "leftdoublequotemark": '“',
+	"rightdoublequotemark": '”', "doublelowquotemark": '„', "dagger": '†',
+	"doubledagger": '‡', "enfilledcircbullet": '•', "permille": '‰',
+	"trademark": '™', "notequal": '≠', "lessthanequal": '≤',
+	"greaterthanequal": '≥', "infinity": '∞', "approxeq": '≈',
+	"oneeighth": '⅛', "threeeighths": '⅜', "fiveeighths": '⅝',
+	"seveneighths": '⅞', "leftarrow": '←', "uparrow": '↑',
+	"rightarrow": '→', "downarrow": '↓', "partialderivative": '∂',
+	"integral": '∫', "radical": '√', "squareroot": '√',
+	"Greek_pi": 'π', "Greek_OMEGA": 'Ω', "Greek_mu": 'μ',
+}
+
+// KeysymRune returns the character a keysym name types. Dead keys,
+// function keys and unknown names report false.
+func KeysymRune(name string) (rune, bool) {
+	if r, ok := keysymRunes[name]; ok {
+		return r, true
+	}
+	if utf8.RuneCountInString(name) == 1 {
+		r, _ := utf8.DecodeRuneInString(name)
+		return r, true
+	}
+	// U20AC, as written in symbol files for Unicode characters
+	if hex, ok := strings.CutPrefix(name, "U"); ok && len(hex) >= 4 {
+		if v, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return rune(v), utf8.ValidRune(rune(v))
+		}
+	}
+	// 0x10020ac, a Unicode keysym by value
+	if hex, ok := strings.CutPrefix(name, "0x"); ok {
+		if v, err := strconv.ParseUint(hex, 16, 32); err == nil && v >= 0x1000100 && v <= 0x110ffff {
+			return rune(v - 0x1000000), true
+		}
+	}
+	return 0, false
+}
+
+// IsDeadKeysym reports whether name is a dead key, such as dead_acute.
+func IsDeadKeysym(name string) bool {
+	return strings.HasPrefix(name, "dead_")
+}
@@ -0,0 +1,190 @@
+// Package xkb reads XKB keyboard layouts from the system's xkeyboard-config
+// symbol files, without linking libxkbcommon.
+package xkb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultRoot is where xkeyboard-config installs its data; XKB_CONFIG_ROOT
+// overrides it as it does for libxkbcommon.
+const defaultRoot = "/usr/share/X11/xkb"
+
+// maxIncludeDepth bounds include chains so a cycle cannot recurse forever.
+const maxIncludeDepth = 16
+
+// Levels holds the keysym names of a key's first group, level 1 (plain) to
+// level 4 (Shift+AltGr). Missing levels are empty.
+type Levels [4]string
+
+var (
+	sectionRe = regexp.MustCompile(`(?m)^\s*((?:\w+\s+)*)xkb_symbols\s+"([^"]+)"\s*\{`)
+	includeRe = regexp.MustCompile(`(?m)^\s*(?:include|augment|override|replace)\s+"([^"]+)"`)
+	keyRe     = regexp.MustCompile(`(?s)\bkey\s+<(\w+)>\s*\{(.*)`)
+	groupRe   = regexp.MustCompile(`symbols\[\s*Group1\s*\]\s*=\s*\[([^\]]*)\]`)
+	listRe    = regexp.MustCompile(`\[([^\]]*)\]`)
+	commentRe = regexp.MustCompile(`(?m)//.*$|(?s)/\*.*?\*/`)
+)
+
+// ParseSpec splits a layout written as "fr" or "fr(oss)" into its name and
+// variant, which is empty for the default variant.
+func ParseSpec(spec string) (layout, variant string) {
+	layout, variant, _ = strings.Cut(strings.TrimSpace(spec), "(")
+	return layout, strings.TrimSuffix(variant, ")")
+}
+
+// Symbols returns the keysyms of every key the layout defines, keyed by
+// XKB key name such as "AE01", following its includes.
+func Symbols(layout, variant string) (map[string]Levels, error) {
+	root := os.Getenv("XKB_CONFIG_ROOT")
+	if root == "" {
+		root = defaultRoot
+	}
+	keys := make(map[string]Levels)
+	if err := load(filepath.Join(root, "symbols"), layout, variant, keys, 0); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("xkb layout %s defines no keys", spec(layout, variant))
+	}
+	return keys, nil
+}
+
+// load merges the keys of one symbols section into keys, includes first
+// so the section's own keys override them.
+func load(dir, file, section string, keys map[string]Levels, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("xkb include chain too deep at %s", spec(file, section))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, filepath.Base(file)))
+	if err != nil {
+		return fmt.Errorf("reading xkb symbols: %w", err)
+	}
+	body, err := findSection(commentRe.ReplaceAllString(string(data), ""), section)
+	if err != nil {
+		return fmt.Errorf("%s: %w", spec(file, section), err)
+	}
+
+	// Includes end at the line, other statements at a semicolon
+	for _, stmt := range strings.Split(body, ";") {
+		for _, m := range includeRe.FindAllStringSubmatch(stmt, -1) {
+			for _, inc := range strings.FieldsFunc(m[1], func(r rune) bool { return r == '+' || r == '|' }) {
+				incFile, incSection := ParseSpec(inc)
+				if err := load(dir, incFile, incSection, keys, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		if m := keyRe.FindStringSubmatch(stmt); m != nil {
+			if levels, ok := parseLevels(m[2]); ok {
+				// Like XKB's override merge, levels left out keep the
+				// included ones
+				merged := keys[m[1]]
+				for i, sym := range levels {
+					if sym != "" {
+						merged[i] = sym
+					}
+				}
+				keys[m[1]] = merged
+			}
+		}
+	}
+	return nil
+}
+
+// findSection returns the body of the named xkb_symbols section, or of the
+// one marked default (else the first) when name is empty.
+func findSection(data, name string) (string, error) {
+	matches := sectionRe.FindAllStringSubmatchIndex(data, -1)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no xkb_symbols sections")
+	}
+
+	pick := -1
+	for i, m := range matches {
+		flags, sectionName := data[m[2]:m[3]], data[m[4]:m[5]]
+		if (name != "" && sectionName == name) || (name == "" && strings.Contains(flags, "default")) {
+			pick = i
+			break
+		}
+	}
+	if pick < 0 && name == "" {
+		pick = 0
+	}
+	if pick < 0 {
+		return "", fmt.Errorf("variant %q not found", name)
+	}
+
+	// The body runs to the brace closing the section
+	start := matches[pick][1]
+	depth := 1
+	for i := start; i < len(data); i++ {
+		switch data[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return data[start:i], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unterminated xkb_symbols section")
+}
+
+// parseLevels reads the first group's keysym list from a key body such as
+// `{ [ a, A, ae, AE ] }` or `{ type= "FOUR_LEVEL", symbols[Group1]= [...] }`.
+func parseLevels(body string) (Levels, bool) {
+	var list string
+	if m := groupRe.FindStringSubmatch(body); m != nil {
+		list = m[1]
+	} else {
+		for _, m := range listRe.FindAllStringSubmatch(body, -1) {
+			// Skip the group index of type[Group1] and similar
+			if !strings.HasPrefix(strings.TrimSpace(m[1]), "Group") {
+				list = m[1]
+				break
+			}
+		}
+	}
+	if list == "" {
+		return Levels{}, false
+	}
+
+	var levels Levels
+	for i, sym := range strings.Split(list, ",") {
+		if i == len(levels) {
+			break
+		}
+		levels[i] = strings.TrimSpace(sym)
+	}
+	return levels, true
+}
+
+func spec(layout, variant string) string {
+	if variant == "" {
+		return layout
+	}
+	return layout + "(" + variant + ")"
+}
+
+// KeyNames maps XKB key names to asahi-map key names, which are physical US
+// positions, for the keys an Option layer covers.
+var KeyNames = map[string]string{
+	"TLDE": "grave",
+	"AE01": "1", "AE02": "2", "AE03": "3", "AE04": "4", "AE05": "5",
+	"AE06": "6", "AE07": "7", "AE08": "8", "AE09": "9", "AE10": "0",
+	"AE11": "minus", "AE12": "equal",
+	"AD01": "q", "AD02": "w", "AD03": "e", "AD04": "r", "AD05": "t",
+	"AD06": "y", "AD07": "u", "AD08": "i", "AD09": "o", "AD10": "p",
+	"AD11": "leftbrace", "AD12": "rightbrace",
+	"AC01": "a", "AC02": "s", "AC03": "d", "AC04": "f", "AC05": "g",
+	"AC06": "h", "AC07": "j", "AC08": "k", "AC09": "l",
+	"AC10": "semicolon", "AC11": "apostrophe", "BKSL": "backslash",
+	"AB01": "z", "AB02": "x", "AB03": "c", "AB04": "v", "AB05": "b",
+	"AB06": "n", "AB07": "m", "AB08": "comma", "AB09": "dot", "AB10": "slash",
+	"LSGT": "102nd", "SPCE": "space",
+}
@@ -0,0 +1,289 @@
+// Package xtest types Unicode characters on X11 through the XTEST
+// extension, by mapping each character's keysym to a spare keycode and
+// faking presses of it, the technique xdotool uses. It speaks just enough
+// of the X11 protocol for that, so no X libraries are needed.
+package xtest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialTimeout bounds connecting to the X server.
+const dialTimeout = 2 * time.Second
+
+// conn is a connection to an X server. Requests are little-endian and
+// numbered in the order they are sent.
+type conn struct {
+	c   net.Conn
+	r   *bufio.Reader
+	seq uint16
+
+	root       uint32
+	minKeycode byte
+	maxKeycode byte
+}
+
+// displayAddr splits DISPLAY, e.g. ":0", ":1.0" or "host:10.0", into the
+// network address of its server and its display number.
+func displayAddr(display string) (network, addr, number string, err error) {
+	host, rest, ok := strings.Cut(display, ":")
+	if !ok {
+		return "", "", "", fmt.Errorf("invalid DISPLAY %q", display)
+	}
+	number, _, _ = strings.Cut(rest, ".")
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		return "", "", "", fmt.Errorf("invalid DISPLAY %q", display)
+	}
+	if host == "" || host == "unix" {
+		return "unix", "/tmp/.X11-unix/X" + number, number, nil
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(6000+n)), number, nil
+}
+
+// dial connects to the X server named by display and reads the setup.
+func dial(display string) (*conn, error) {
+	network, addr, number, err := displayAddr(display)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.DialTimeout(network, addr, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to X display %s: %w", display, err)
+	}
+	x := &conn{c: c, r: bufio.NewReader(c)}
+	if err := x.setup(cookie(number)); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("connecting to X display %s: %w", display, err)
+	}
+	return x, nil
+}
+
+// cookie returns the MIT-MAGIC-COOKIE-1 for the local display number from
+// the Xauthority file, nil when there is none.
+func cookie(number string) []byte {
+	path := os.Getenv("XAUTHORITY")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, ".Xauthority")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+
+	// Entries are a family then address, number, name and data, each
+	// prefixed with a big-endian length
+	const familyLocal, familyWild = 256, 65535
+	for len(data) >= 2 {
+		family := binary.BigEndian.Uint16(data)
+		data = data[2:]
+		var fields [4][]byte
+		for i := range fields {
+			if len(data) < 2 {
+				return nil
+			}
+			n := int(binary.BigEndian.Uint16(data))
+			if len(data) < 2+n {
+				return nil
+			}
+			fields[i], data = data[2:2+n], data[2+n:]
+		}
+		address, num, name, value := string(fields[0]), string(fields[1]), string(fields[2]), fields[3]
+		if name != "MIT-MAGIC-COOKIE-1" || (num != "" && num != number) {
+			continue
+		}
+		if family == familyWild || family == familyLocal && address == hostname {
+			return value
+		}
+	}
+	return nil
+}
+
+// pad4 returns how many bytes pad n to a multiple of four.
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// setup sends the connection setup and keeps what later requests need.
+func (x *conn) setup(auth []byte) error {
+	name := ""
+	if auth != nil {
+		name = "MIT-MAGIC-COOKIE-1"
+	}
+	req := make([]byte, 12, 12+len(name)+pad4(len(name))+len(auth)+pad4(len(auth)))
+	req[0] = 'l'
+	binary.LittleEndian.PutUint16(req[2:], 11)
+	binary.LittleEndian.PutUint16(req[6:], uint16(len(name)))
+	binary.LittleEndian.PutUint16(req[8:], uint16(len(auth)))
+	req = append(req, name...)
+	req = append(req, make([]byte, pad4(len(name)))...)
+	req = append(req, auth...)
+	req = append(req, make([]byte, pad4(len(auth)))...)
+	x.c.SetDeadline(time.Now().Add(dialTimeout))
+	defer x.c.SetDeadline(time.Time{})
+	if _, err := x.c.Write(req); err != nil {
+		return err
+	}
+
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(x.r, head); err != nil {
+		return err
+	}
+	data := make([]byte, 4*int(binary.LittleEndian.Uint16(head[6:])))
+	if _, err := io.ReadFull(x.r, data); err != nil {
+		return err
+	}
+	if head[0] != 1 {
+		reason := data
+		if head[0] == 0 && int(head[1]) <= len(data) {
+			reason = data[:head[1]]
+		}
+		return fmt.Errorf("X server refused the connection: %s", strings.TrimSpace(string(reason)))
+	}
+
+	if len(data) < 32 {
+		return errors.New("short X setup reply")
+	}
+	vendorLen := int(binary.LittleEndian.Uint16(data[16:]))
+	formats := int(data[21])
+	x.minKeycode, x.maxKeycode = data[26], data[27]
+	screen := 32 + vendorLen + pad4(vendorLen) + 8*formats
+	if len(data) < screen+4 {
+		return errors.New("short X setup reply")
+	}
+	x.root = binary.LittleEndian.Uint32(data[screen:])
+	return nil
+}
+
+// send writes a request. length, in four-byte units, is filled in.
+func (x *conn) send(req []byte) error {
+	binary.LittleEndian.PutUint16(req[2:], uint16(len(req)/4))
+	x.seq++
+	_, err := x.c.Write(req)
+	return err
+}
+
+// reply reads until the reply to the latest request, skipping events such
+// as the MappingNotify every client receives. It returns the reply's extra
+// data after the first 32 bytes along with those bytes.
+func (x *conn) reply() ([]byte, error) {
+	x.c.SetReadDeadline(time.Now().Add(dialTimeout))
+	defer x.c.SetReadDeadline(time.Time{})
+	for {
+		packet := make([]byte, 32)
+		if _, err := io.ReadFull(x.r, packet); err != nil {
+			return nil, err
+		}
+		switch packet[0] {
+		case 0:
+			return nil, fmt.Errorf("X error %d on request %d.%d", packet[1], packet[10], binary.LittleEndian.Uint16(packet[8:]))
+		case 1:
+			extra := make([]byte, 4*int(binary.LittleEndian.Uint32(packet[4:])))
+			if _, err := io.ReadFull(x.r, extra); err != nil {
+				return nil, err
+			}
+			if binary.LittleEndian.Uint16(packet[2:]) != x.seq {
+				continue
+			}
+			return append(packet, extra...), nil
+		}
+	}
+}
+
+// sync waits until the server has handled every request sent so far,
+// reporting the first error among them.
+func (x *conn) sync() error {
+	// GetInputFocus, the cheapest request with a reply
+	if err := x.send([]byte{43, 0, 0, 0}); err != nil {
+		return err
+	}
+	_, err := x.reply()
+	return err
+}
+
+// queryExtension returns the major opcode of an extension.
+func (x *conn) queryExtension(name string) (byte, error) {
+	req := make([]byte, 8, 8+len(name)+pad4(len(name)))
+	req[0] = 98
+	binary.LittleEndian.PutUint16(req[4:], uint16(len(name)))
+	req = append(req, name...)
+	req = append(req, make([]byte, pad4(len(name)))...)
+	if err := x.send(req); err != nil {
+		return 0, err
+	}
+	rep, err := x.reply()
+	if err != nil {
+		return 0, err
+	}
+	if rep[8] == 0 {
+		return 0, fmt.Errorf("X server has no %s extension", name)
+	}
+	return rep[9], nil
+}
+
+// keyboardMapping returns the keysyms of every keycode from minKeycode,
+// keysymsPerKeycode at a time.
+func (x *conn) keyboardMapping() (keysyms []uint32, perKeycode int, err error) {
+	count := int(x.maxKeycode) - int(x.minKeycode) + 1
+	req := []byte{101, 0, 0, 0, x.minKeycode, byte(count), 0, 0}
+	if err := x.send(req); err != nil {
+		return nil, 0, err
+	}
+	rep, err := x.reply()
+	if err != nil {
+		return nil, 0, err
+	}
+	perKeycode = int(rep[1])
+	data := rep[32:]
+	keysyms = make([]uint32, len(data)/4)
+	for i := range keysyms {
+		keysyms[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return keysyms, perKeycode, nil
+}
+
+// changeKeyboardMapping sets the keysyms of one keycode.
+func (x *conn) changeKeyboardMapping(keycode byte, keysyms []uint32) error {
+	req := make([]byte, 8+4*len(keysyms))
+	req[0] = 100
+	req[1] = 1
+	req[4] = keycode
+	req[5] = byte(len(keysyms))
+	for i, sym := range keysyms {
+		binary.LittleEndian.PutUint32(req[8+4*i:], sym)
+	}
+	return x.send(req)
+}
+
+// fakeKey sends an XTEST key press or release.
+func (x *conn) fakeKey(opcode byte, keycode byte, press bool) error {
+	req := make([]byte, 36)
+	req[0] = opcode
+	req[1] = 2 // FakeInput
+	req[4] = 3 // KeyRelease
+	if press {
+		req[4] = 2 // KeyPress
+	}
+	req[5] = keycode
+	binary.LittleEndian.PutUint32(req[12:], x.root)
+	return x.send(req)
+}
+
+func (x *conn) close() error {
+	return x.c.Close()
+}
@@ -0,0 +1,146 @@
+package xtest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// remapDelay gives clients time to fetch a changed keyboard mapping before
+// the key that uses it arrives; without it some apps read the keycode with
+// their old mapping.
+const remapDelay = 15 * time.Millisecond
+
+// Typer types characters through XTEST. It borrows keycodes no key uses,
+// each mapped to one character, reusing them across characters in turn.
+type Typer struct {
+	mu     sync.Mutex
+	x      *conn
+	opcode byte
+
+	perKeycode int
+	spare      []byte
+	mapped     map[rune]byte
+	next       int
+}
+
+// Available reports why XTEST typing cannot work in this session, or nil.
+// XTEST under XWayland only reaches X11 apps, so Wayland sessions are
+// refused.
+func Available() error {
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		return errors.New("XTEST needs an X11 session, this is Wayland")
+	}
+	if os.Getenv("DISPLAY") == "" {
+		return errors.New("XTEST needs an X11 session, DISPLAY is not set")
+	}
+	return nil
+}
+
+// Open connects to the X server in DISPLAY and finds spare keycodes.
+func Open() (*Typer, error) {
+	if err := Available(); err != nil {
+		return nil, err
+	}
+	x, err := dial(os.Getenv("DISPLAY"))
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTyper(x)
+	if err != nil {
+		x.close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func newTyper(x *conn) (*Typer, error) {
+	opcode, err := x.queryExtension("XTEST")
+	if err != nil {
+		return nil, err
+	}
+	keysyms, perKeycode, err := x.keyboardMapping()
+	if err != nil {
+		return nil, fmt.Errorf("reading keyboard mapping: %w", err)
+	}
+
+	t := &Typer{x: x, opcode: opcode, perKeycode: perKeycode, mapped: make(map[rune]byte)}
+	for i := 0; i+perKeycode <= len(keysyms); i += perKeycode {
+		unused := true
+		for _, sym := range keysyms[i : i+perKeycode] {
+			if sym != 0 {
+				unused = false
+				break
+			}
+		}
+		if unused {
+			t.spare = append(t.spare, x.minKeycode+byte(i/perKeycode))
+		}
+	}
+	if len(t.spare) == 0 || perKeycode < 2 {
+		return nil, errors.New("no spare keycode to type through")
+	}
+	return t, nil
+}
+
+// keysym returns the keysym typing r: Latin-1 characters are their own
+// keysym, others use the Unicode keysym range.
+func keysym(r rune) uint32 {
+	if r >= 0x20 && r <= 0x7e || r >= 0xa0 && r <= 0xff {
+		return uint32(r)
+	}
+	return 0x01000000 | uint32(r)
+}
+
+// TypeRune types r with a press and release of a spare keycode mapped to
+// it.
+func (t *Typer) TypeRune(r rune) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keycode, ok := t.mapped[r]
+	if !ok {
+		keycode = t.spare[t.next]
+		t.next = (t.next + 1) % len(t.spare)
+		for old, code := range t.mapped {
+			if code == keycode {
+				delete(t.mapped, old)
+			}
+		}
+
+		// The same keysym with and without Shift, so a held Shift does
+		// not change it
+		syms := make([]uint32, t.perKeycode)
+		syms[0], syms[1] = keysym(r), keysym(r)
+		if err := t.x.changeKeyboardMapping(keycode, syms); err != nil {
+			return err
+		}
+		if err := t.x.sync(); err != nil {
+			return fmt.Errorf("mapping keycode %d: %w", keycode, err)
+		}
+		t.mapped[r] = keycode
+		time.Sleep(remapDelay)
+	}
+
+	if err := t.x.fakeKey(t.opcode, keycode, true); err != nil {
+		return err
+	}
+	if err := t.x.fakeKey(t.opcode, keycode, false); err != nil {
+		return err
+	}
+	return t.x.sync()
+}
+
+// Close gives the borrowed keycodes back and disconnects.
+func (t *Typer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, keycode := range t.mapped {
+		t.x.changeKeyboardMapping(keycode, make([]uint32, t.perKeycode))
+	}
+	t.x.sync()
+	return t.x.close()
+}
@@ -0,0 +1,261 @@
+package xtest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Setup values of the fake server.
+const (
+	fakeRoot         = 0x123
+	fakeMinKeycode   = 8
+	fakeMaxKeycode   = 12
+	fakeXTestOpcode  = 132
+	fakeMappingEvent = 34 // MappingNotify
+)
+
+// fakeServer answers the requests a Typer sends, as an X server with
+// keycodes 8 to 12 of which 10 to 12 are unused, and records the keyboard
+// changes and faked keys as strings such as "map 10 e9 e9" or "press 10".
+type fakeServer struct {
+	c    net.Conn
+	seq  uint16
+	log  []string
+	done chan error
+}
+
+// newFakeServer returns a client connection to a fake server, already set
+// up.
+func newFakeServer(t *testing.T) (*conn, *fakeServer) {
+	t.Helper()
+	client, server := net.Pipe()
+	s := &fakeServer{c: server, done: make(chan error, 1)}
+	go func() {
+		s.done <- s.serve()
+	}()
+
+	x := &conn{c: client, r: bufio.NewReader(client)}
+	if err := x.setup(nil); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	return x, s
+}
+
+// wait returns the server's log once the client has closed the connection.
+func (s *fakeServer) wait(t *testing.T) []string {
+	t.Helper()
+	if err := <-s.done; err != nil {
+		t.Fatalf("fake server: %v", err)
+	}
+	return s.log
+}
+
+func (s *fakeServer) serve() error {
+	defer s.c.Close()
+	r := bufio.NewReader(s.c)
+
+	// Setup request: byte order, version, auth name and data lengths
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return err
+	}
+	if head[0] != 'l' {
+		return fmt.Errorf("byte order %q, want 'l'", head[0])
+	}
+	nameLen := int(binary.LittleEndian.Uint16(head[6:]))
+	authLen := int(binary.LittleEndian.Uint16(head[8:]))
+	if _, err := io.CopyN(io.Discard, r, int64(nameLen+pad4(nameLen)+authLen+pad4(authLen))); err != nil {
+		return err
+	}
+
+	// Setup reply without vendor or formats, then the root window
+	data := make([]byte, 40)
+	data[26], data[27] = fakeMinKeycode, fakeMaxKeycode
+	binary.LittleEndian.PutUint32(data[32:], fakeRoot)
+	reply := make([]byte, 8)
+	reply[0] = 1
+	binary.LittleEndian.PutUint16(reply[2:], 11)
+	binary.LittleEndian.PutUint16(reply[6:], uint16(len(data)/4))
+	if _, err := s.c.Write(append(reply, data...)); err != nil {
+		return err
+	}
+
+	for {
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(r, req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		body := make([]byte, 4*int(binary.LittleEndian.Uint16(req[2:]))-4)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		req = append(req, body...)
+		s.seq++
+
+		var err error
+		switch req[0] {
+		case 98: // QueryExtension
+			name := string(req[8 : 8+binary.LittleEndian.Uint16(req[4:])])
+			err = s.reply(func(rep []byte) {
+				if name == "XTEST" {
+					rep[8], rep[9] = 1, fakeXTestOpcode
+				}
+			}, nil)
+		case 101: // GetKeyboardMapping, two keysyms per keycode
+			var syms []byte
+			for code := req[4]; code < req[4]+req[5]; code++ {
+				sym := make([]byte, 8)
+				if code < 10 {
+					binary.LittleEndian.PutUint32(sym, 0x61+uint32(code))
+				}
+				syms = append(syms, sym...)
+			}
+			err = s.reply(func(rep []byte) { rep[1] = 2 }, syms)
+		case 100: // ChangeKeyboardMapping
+			entry := fmt.Sprintf("map %d", req[4])
+			for i := range int(req[5]) {
+				entry += fmt.Sprintf(" %x", binary.LittleEndian.Uint32(req[8+4*i:]))
+			}
+			s.log = append(s.log, entry)
+		case fakeXTestOpcode:
+			if req[1] != 2 || binary.LittleEndian.Uint32(req[12:]) != fakeRoot {
+				return fmt.Errorf("unexpected XTEST request % x", req)
+			}
+			op := map[byte]string{2: "press", 3: "release"}[req[4]]
+			s.log = append(s.log, fmt.Sprintf("%s %d", op, req[5]))
+		case 43: // GetInputFocus, after a MappingNotify the client skips
+			event := make([]byte, 32)
+			event[0] = fakeMappingEvent
+			if _, err := s.c.Write(event); err != nil {
+				return err
+			}
+			err = s.reply(nil, nil)
+		default:
+			return fmt.Errorf("unexpected request %d", req[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// reply sends a reply to the latest request, with fill setting fields of
+// its first 32 bytes and extra after them.
+func (s *fakeServer) reply(fill func(rep []byte), extra []byte) error {
+	rep := make([]byte, 32)
+	rep[0] = 1
+	binary.LittleEndian.PutUint16(rep[2:], s.seq)
+	binary.LittleEndian.PutUint32(rep[4:], uint32(len(extra)/4))
+	if fill != nil {
+		fill(rep)
+	}
+	_, err := s.c.Write(append(rep, extra...))
+	return err
+}
+
+func TestTyper(t *testing.T) {
+	x, server := newFakeServer(t)
+	typer, err := newTyper(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{10, 11, 12}; !slices.Equal(typer.spare, want) {
+		t.Fatalf("spare keycodes %v, want %v", typer.spare, want)
+	}
+
+	// é is Latin-1, € a Unicode keysym. Typing é again reuses its keycode,
+	// and a fourth character takes the keycode of the oldest
+	for _, r := range "é€éxy" {
+		if err := typer.TypeRune(r); err != nil {
+			t.Fatalf("typing %q: %v", r, err)
+		}
+	}
+	if err := typer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := server.wait(t)
+	want := []string{
+		"map 10 e9 e9", "press 10", "release 10",
+		"map 11 10020ac 10020ac", "press 11", "release 11",
+		"press 10", "release 10",
+		"map 12 78 78", "press 12", "release 12",
+		"map 10 79 79", "press 10", "release 10",
+	}
+	if !slices.Equal(got[:len(want)], want) {
+		t.Fatalf("requests:\n got %q\nwant %q", got[:len(want)], want)
+	}
+	// Close gives every borrowed keycode back, in any order
+	restored := slices.Sorted(slices.Values(got[len(want):]))
+	if want := []string{"map 10 0 0", "map 11 0 0", "map 12 0 0"}; !slices.Equal(restored, want) {
+		t.Errorf("on close:\n got %q\nwant %q", restored, want)
+	}
+}
+
+func TestDisplayAddr(t *testing.T) {
+	tests := []struct {
+		display, network, addr, number string
+	}{
+		{":0", "unix", "/tmp/.X11-unix/X0", "0"},
+		{":1.0", "unix", "/tmp/.X11-unix/X1", "1"},
+		{"unix:2", "unix", "/tmp/.X11-unix/X2", "2"},
+		{"host:10.0", "tcp", "host:6010", "10"},
+	}
+	for _, tt := range tests {
+		network, addr, number, err := displayAddr(tt.display)
+		if err != nil {
+			t.Errorf("%q: %v", tt.display, err)
+			continue
+		}
+		if network != tt.network || addr != tt.addr || number != tt.number {
+			t.Errorf("%q: got %s %s %s, want %s %s %s", tt.display, network, addr, number, tt.network, tt.addr, tt.number)
+		}
+	}
+	for _, display := range []string{"", "host", ":x", ":-1"} {
+		if _, _, _, err := displayAddr(display); err == nil {
+			t.Errorf("%q: no error", display)
+		}
+	}
+}
+
+func TestCookie(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	entry := func(family uint16, fields ...string) []byte {
+		b := binary.BigEndian.AppendUint16(nil, family)
+		for _, f := range fields {
+			b = binary.BigEndian.AppendUint16(b, uint16(len(f)))
+			b = append(b, f...)
+		}
+		return b
+	}
+	var data []byte
+	data = append(data, entry(256, "otherhost", "0", "MIT-MAGIC-COOKIE-1", "other")...)
+	data = append(data, entry(256, hostname, "1", "MIT-MAGIC-COOKIE-1", "display1")...)
+	data = append(data, entry(256, hostname, "0", "XDM-AUTHORIZATION-1", "xdm")...)
+	data = append(data, entry(256, hostname, "0", "MIT-MAGIC-COOKIE-1", "local")...)
+	data = append(data, entry(65535, "", "", "MIT-MAGIC-COOKIE-1", "wild")...)
+
+	path := filepath.Join(t.TempDir(), "Xauthority")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XAUTHORITY", path)
+
+	for number, want := range map[string]string{"0": "local", "1": "display1", "2": "wild"} {
+		if got := string(cookie(number)); got != want {
+			t.Errorf("display %s: cookie %q, want %q", number, got, want)
+		}
+	}
+}